@@ -0,0 +1,601 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/pex"
+)
+
+// DownloadPiece downloads and verifies piece index, trying the peers in
+// turn until one delivers it. onError, if not nil, is told about every peer
+// that failed.
+func (t *Torrent) DownloadPiece(ctx context.Context, peers []Peer, index int, onError func(Peer, error)) ([]byte, error) {
+	layout, err := NewLayout(t.Info)
+	if err != nil {
+		return nil, err
+	}
+	if index < 0 || index >= layout.NumPieces() {
+		return nil, fmt.Errorf("piece index %d out of range: the torrent has %d pieces", index, layout.NumPieces())
+	}
+	if len(peers) == 0 {
+		return nil, fmt.Errorf("no peers to download piece %d from", index)
+	}
+
+	var errs []error
+	for _, peer := range peers {
+		data, err := t.downloadPieceFrom(ctx, peer, index, layout.PieceLength(index))
+		if err == nil {
+			return data, nil
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		if onError != nil {
+			onError(peer, err)
+		}
+		errs = append(errs, fmt.Errorf("%s: %w", peer, err))
+	}
+	return nil, fmt.Errorf("failed to download piece %d from %d peers: %w", index, len(peers), errors.Join(errs...))
+}
+
+func (t *Torrent) downloadPieceFrom(ctx context.Context, peer Peer, index, length int) ([]byte, error) {
+	conn, err := t.Connect(ctx, peer.String())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	data, err := conn.DownloadPiece(index, length)
+	if err != nil {
+		return nil, err
+	}
+	if err := t.VerifyPiece(index, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// defaultMaxPeers is how many peers a download connects to at once.
+const defaultMaxPeers = 8
+
+// Progress is the state of a download after a piece was verified.
+type Progress struct {
+	Piece int
+	Peer  Peer
+	// Done and Total count pieces.
+	Done  int
+	Total int
+}
+
+// Download fetches the pieces of a torrent from a pool of peer connections
+// and writes them to its storage. Every connection asks Picker for the next
+// piece its peer has and keeps its PipelineDepth block requests in flight;
+// pieces that fail go back to the picker for the others, keeping the blocks
+// that arrived.
+//
+// Peers found while the download runs, by sources that keep looking, are
+// passed to AddPeers. With PEX set, the connected peers that support ut_pex
+// are also told about the others, and the peers they tell about are added.
+//
+// Once Picker has no piece left to hand out to any connection, the download
+// is in endgame mode: connections also request the missing blocks of the
+// pieces others are downloading, so that a slow peer can't hold up the end.
+// Duplicate requests are cancelled as soon as a block arrives.
+type Download struct {
+	Torrent *Torrent
+	Storage io.WriterAt
+	// Picker chooses the pieces, its priorities may be set before Run.
+	Picker *PiecePicker
+	// Counters, if not nil, are told about the verified and redundant data.
+	Counters *TransferCounters
+	// MaxPeers bounds the connections open at once.
+	MaxPeers int
+	// OnProgress, if not nil, is called after every verified piece.
+	OnProgress func(Progress)
+	// OnPeerError, if not nil, is told why a peer was dropped.
+	OnPeerError func(Peer, error)
+	// PEX, if not nil, collects the peers learned through peer exchange
+	// (BEP 11). It is left unused for private torrents.
+	PEX *PEXSource
+
+	layout *Layout
+	// fail stops the download with an error no peer can fix, or with nil
+	// once it is complete.
+	fail context.CancelCauseFunc
+
+	// mu guards Picker and the fields below.
+	mu   sync.Mutex
+	cond *sync.Cond
+	// active holds the pieces being downloaded.
+	active map[int]*pieceBuffer
+	// partial holds the blocks of the pieces given up halfway.
+	partial map[int]*pieceBuffer
+	workers map[*worker]bool
+	done    int
+	// queue holds the peers to connect to, seen every peer ever queued,
+	// and running counts the connections open or opening.
+	queue   []Peer
+	seen    map[string]bool
+	running int
+}
+
+// worker is the part of a Download's state that belongs to a connection.
+// It is guarded by the Download's mu.
+type worker struct {
+	conn *PeerConn
+	peer Peer
+	// pieces are the active pieces the connection requests blocks of, more
+	// than one connection may share them in endgame mode.
+	pieces []int
+	// requested holds the blocks asked for and not received yet.
+	requested map[blockKey]bool
+}
+
+// blockKey identifies a block of a piece.
+type blockKey struct {
+	index int
+	block int
+}
+
+func NewDownload(t *Torrent, storage io.WriterAt) (*Download, error) {
+	layout, err := NewLayout(t.Info)
+	if err != nil {
+		return nil, err
+	}
+	d := &Download{
+		Torrent:  t,
+		Storage:  storage,
+		Picker:   NewPiecePicker(layout.NumPieces()),
+		MaxPeers: defaultMaxPeers,
+		layout:   layout,
+		active:   make(map[int]*pieceBuffer),
+		partial:  make(map[int]*pieceBuffer),
+		workers:  make(map[*worker]bool),
+		seen:     make(map[string]bool),
+	}
+	d.cond = sync.NewCond(&d.mu)
+	return d, nil
+}
+
+// AddPeers queues peers to download from. Peers queued before are left
+// out, so sources may repeat themselves. It may be called before and while
+// Run runs.
+func (d *Download) AddPeers(peers []Peer) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, peer := range peers {
+		key := peer.Addr.String()
+		if d.seen[key] {
+			continue
+		}
+		d.seen[key] = true
+		d.queue = append(d.queue, peer)
+	}
+	d.cond.Broadcast()
+}
+
+// Run downloads from peers, and the peers added while it runs, until every
+// wanted piece is verified and stored. It fails when the peers run out
+// first: none is queued and no connection is left.
+func (d *Download) Run(ctx context.Context, peers []Peer) error {
+	ctx, d.fail = context.WithCancelCause(ctx)
+	defer d.fail(nil)
+	// waiting connections give up when ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		d.mu.Lock()
+		d.cond.Broadcast()
+		d.mu.Unlock()
+	})
+	defer stop()
+
+	d.AddPeers(peers)
+	slots := make(chan struct{}, max(d.MaxPeers, 1))
+	var wg sync.WaitGroup
+	for {
+		select {
+		case slots <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if ctx.Err() != nil {
+			break
+		}
+		peer, ok := d.nextPeer(ctx)
+		if !ok {
+			break
+		}
+		wg.Add(1)
+		go func(peer Peer) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err := d.downloadFrom(ctx, peer)
+			if err != nil && ctx.Err() == nil && d.OnPeerError != nil {
+				d.OnPeerError(peer, err)
+			}
+			d.mu.Lock()
+			d.running--
+			d.cond.Broadcast()
+			d.mu.Unlock()
+		}(peer)
+	}
+	wg.Wait()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	missing := d.Picker.Remaining()
+	if missing == 0 {
+		return nil
+	}
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	return fmt.Errorf("%d of %d pieces missing: no peer left to download them from", missing, d.done+missing)
+}
+
+// nextPeer takes the next queued peer, waiting for one while connections
+// are open. It returns false once the peers ran out or nothing is left to
+// download.
+func (d *Download) nextPeer(ctx context.Context) (Peer, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.queue) == 0 && d.running > 0 && d.Picker.Remaining() > 0 && ctx.Err() == nil {
+		d.cond.Wait()
+	}
+	if len(d.queue) == 0 || d.Picker.Remaining() == 0 || ctx.Err() != nil {
+		return Peer{}, false
+	}
+	peer := d.queue[0]
+	d.queue = d.queue[1:]
+	d.running++
+	return peer, true
+}
+
+func (d *Download) complete() bool {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.Picker.Remaining() == 0
+}
+
+// downloadFrom downloads blocks from a single peer until there is nothing
+// left it can help with.
+func (d *Download) downloadFrom(ctx context.Context, peer Peer) error {
+	conn, err := d.Torrent.Connect(ctx, peer.String())
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	// the peer may send ut_pex messages before it unchokes us
+	exchange := d.PEX != nil && d.Torrent.PEXEnabled()
+	if exchange {
+		receiver := pex.NewReceiver()
+		conn.OnPEX = func(payload []byte) {
+			// peer exchange is a hint, a malformed message is ignored
+			if msg, err := receiver.Receive(payload); err == nil && msg != nil {
+				d.addPEX(ctx, peer, msg)
+			}
+		}
+	}
+	if err := conn.Unchoke(); err != nil {
+		return err
+	}
+	// later haves set bits of the counted bitfield, so removing it on the
+	// way out also forgets them
+	counted := conn.Bitfield
+	d.mu.Lock()
+	d.Picker.AddBitfield(counted)
+	d.mu.Unlock()
+	defer func() {
+		d.mu.Lock()
+		d.Picker.RemoveBitfield(counted)
+		d.mu.Unlock()
+	}()
+	conn.OnHave = func(index int) {
+		d.mu.Lock()
+		d.Picker.AddHave(index)
+		d.mu.Unlock()
+	}
+
+	w := &worker{conn: conn, peer: peer, requested: make(map[blockKey]bool)}
+	d.mu.Lock()
+	d.workers[w] = true
+	d.mu.Unlock()
+	defer d.release(w)
+	if exchange && conn.PEXID != 0 {
+		ctx, stop := context.WithCancel(ctx)
+		defer stop()
+		go d.sendPeers(ctx, w)
+	}
+
+	for {
+		if !conn.Choked {
+			requests, ok := d.next(ctx, w)
+			if !ok {
+				return nil
+			}
+			for _, request := range requests {
+				if err := conn.WriteMessage(request); err != nil {
+					return err
+				}
+			}
+			if err := conn.Flush(); err != nil {
+				return err
+			}
+		}
+
+		m, err := conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+		switch m := m.(type) {
+		case peerwire.Choke:
+			// a choked peer drops our requests, they are sent again once it
+			// unchokes us
+			d.mu.Lock()
+			clear(w.requested)
+			d.mu.Unlock()
+		case peerwire.Piece:
+			if err := d.receive(w, m, peer); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// addPEX records a ut_pex message from peer and queues the peers learned
+// so far.
+func (d *Download) addPEX(ctx context.Context, peer Peer, msg *pex.Message) {
+	d.PEX.Add(peer.Addr, msg)
+	infoHash, err := d.Torrent.InfoHash()
+	if err != nil {
+		return
+	}
+	if peers, err := d.PEX.FindPeers(ctx, infoHash); err == nil {
+		d.AddPeers(peers)
+	}
+}
+
+// sendPeers tells w's peer about the other peers we are connected to, as
+// often as ut_pex allows, until ctx is done.
+func (d *Download) sendPeers(ctx context.Context, w *worker) {
+	sender := pex.NewSender()
+	ticker := time.NewTicker(pex.Interval)
+	defer ticker.Stop()
+	for {
+		if msg := sender.Next(d.connected(w)); msg != nil {
+			if payload, err := msg.Marshal(); err == nil {
+				// a failure is for the connection's worker to notice
+				w.conn.Send(peerwire.Extended{ExtendedID: w.conn.PEXID, Payload: payload})
+			}
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// connected returns the peers of the connections other than w's. We
+// connected to them, so they accept connections.
+func (d *Download) connected(w *worker) []pex.Peer {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	var peers []pex.Peer
+	for other := range d.workers {
+		if other != w && other.peer.Addr != w.peer.Addr {
+			peers = append(peers, pex.Peer{Addr: other.peer.Addr, Flags: pex.FlagReachable})
+		}
+	}
+	return peers
+}
+
+// next returns the requests that fill the pipeline of w. It waits while
+// there is nothing to request and nothing in flight but others may give
+// pieces back, and returns false once there is nothing left for the peer.
+func (d *Download) next(ctx context.Context, w *worker) ([]peerwire.Request, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for ctx.Err() == nil && d.Picker.Remaining() > 0 {
+		requests := d.requests(w)
+		if len(requests) > 0 || len(w.requested) > 0 {
+			return requests, true
+		}
+		if d.Picker.Pending() == 0 {
+			// nothing is in flight, so nothing will be given back
+			return nil, false
+		}
+		d.cond.Wait()
+	}
+	return nil, false
+}
+
+// requests chooses the blocks to request from w's peer: the missing blocks
+// of its pieces, then of new pieces from Picker, then in endgame mode of
+// the pieces others are downloading. d.mu must be held.
+func (d *Download) requests(w *worker) []peerwire.Request {
+	var requests []peerwire.Request
+	want := w.conn.PipelineDepth() - len(w.requested)
+	add := func(piece *pieceBuffer) {
+		for block := range piece.received {
+			key := blockKey{index: piece.index, block: block}
+			if len(requests) >= want {
+				return
+			}
+			if piece.received[block] || w.requested[key] {
+				continue
+			}
+			w.requested[key] = true
+			requests = append(requests, peerwire.Request{
+				Index:  uint32(piece.index),
+				Begin:  uint32(block * peerwire.BlockLength),
+				Length: uint32(piece.blockLength(block)),
+			})
+		}
+	}
+
+	for _, index := range w.pieces {
+		add(d.active[index])
+	}
+	endgame := d.endgame()
+	for len(requests) < want {
+		index, ok := d.Picker.Pick(w.conn.Bitfield)
+		if !ok {
+			break
+		}
+		piece := d.partial[index]
+		if piece == nil {
+			piece = newPieceBuffer(index, d.layout.PieceLength(index))
+		}
+		delete(d.partial, index)
+		d.active[index] = piece
+		w.pieces = append(w.pieces, index)
+		add(piece)
+	}
+	if !d.endgame() {
+		// a peer with only pieces others are downloading waits its turn
+		return requests
+	}
+	if !endgame {
+		// the connections waiting for pieces may help now
+		d.cond.Broadcast()
+	}
+	for index, piece := range d.active {
+		if len(requests) >= want {
+			break
+		}
+		if !w.conn.Bitfield.Has(index) || slices.Contains(w.pieces, index) {
+			continue
+		}
+		w.pieces = append(w.pieces, index)
+		add(piece)
+	}
+	return requests
+}
+
+// endgame reports whether every piece left is being downloaded, so that
+// the connections with nothing else to do request the missing blocks of
+// the others. d.mu must be held.
+func (d *Download) endgame() bool {
+	return d.Picker.Remaining() == d.Picker.Pending()
+}
+
+// receive stores a block from w's peer and cancels the requests other
+// peers have for it. The piece it completes is verified and stored.
+func (d *Download) receive(w *worker, m peerwire.Piece, peer Peer) error {
+	key := blockKey{index: int(m.Index), block: int(m.Begin) / peerwire.BlockLength}
+	d.mu.Lock()
+	delete(w.requested, key)
+	piece := d.active[key.index]
+	if piece == nil || !piece.add(m) {
+		// it arrived from another peer first, or wasn't asked for
+		d.mu.Unlock()
+		if d.Counters != nil {
+			d.Counters.AddRedundant(int64(len(m.Block)))
+		}
+		return nil
+	}
+	var others []*PeerConn
+	for other := range d.workers {
+		if other.requested[key] {
+			delete(other.requested, key)
+			others = append(others, other.conn)
+		}
+	}
+	complete := piece.complete()
+	if complete {
+		delete(d.active, piece.index)
+		for other := range d.workers {
+			other.pieces = slices.DeleteFunc(other.pieces, func(index int) bool { return index == piece.index })
+		}
+	}
+	d.mu.Unlock()
+
+	cancel := peerwire.Cancel{Index: m.Index, Begin: m.Begin, Length: uint32(len(m.Block))}
+	for _, conn := range others {
+		// a failure is for the connection's own worker to notice
+		conn.Send(cancel)
+	}
+	if !complete {
+		return nil
+	}
+
+	if err := d.Torrent.VerifyPiece(piece.index, piece.data); err != nil {
+		// some block is corrupt and we can't tell which, start over
+		d.abort(piece.index)
+		return err
+	}
+	if _, err := d.Storage.WriteAt(piece.data, int64(d.layout.PieceOffset(piece.index))); err != nil {
+		// no other peer would do better
+		d.abort(piece.index)
+		d.fail(fmt.Errorf("failed to write piece %d: %w", piece.index, err))
+		return nil
+	}
+	d.finish(piece.index)
+	if d.Counters != nil {
+		d.Counters.AddDownloaded(int64(len(piece.data)))
+	}
+	d.report(piece.index, peer)
+	return nil
+}
+
+// release gives back the pieces only w was downloading, keeping the blocks
+// that arrived.
+func (d *Download) release(w *worker) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	delete(d.workers, w)
+	for _, index := range w.pieces {
+		shared := false
+		for other := range d.workers {
+			shared = shared || slices.Contains(other.pieces, index)
+		}
+		if shared {
+			continue
+		}
+		piece := d.active[index]
+		delete(d.active, index)
+		partial := piece.count > 0
+		if partial {
+			d.partial[index] = piece
+		}
+		d.Picker.Abort(index, partial)
+	}
+	d.cond.Broadcast()
+}
+
+// abort gives back a piece whose blocks were dropped.
+func (d *Download) abort(index int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Picker.Abort(index, false)
+	d.cond.Broadcast()
+}
+
+// finish records a verified and stored piece.
+func (d *Download) finish(index int) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.Picker.Done(index)
+	d.done++
+	if d.Picker.Remaining() == 0 {
+		// the connections still open have nothing left to do
+		d.fail(nil)
+	}
+	d.cond.Broadcast()
+}
+
+func (d *Download) report(index int, peer Peer) {
+	if d.OnProgress == nil {
+		return
+	}
+	d.mu.Lock()
+	progress := Progress{Piece: index, Peer: peer, Done: d.done, Total: d.done + d.Picker.Remaining()}
+	d.mu.Unlock()
+	d.OnProgress(progress)
+}
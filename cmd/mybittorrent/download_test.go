@@ -0,0 +1,629 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha1"
+	"io"
+	"math/rand"
+	"net"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/pex"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testContent returns a torrent file for length random bytes in pieces of
+// pieceLength, and the bytes.
+func testContent(t testing.TB, length, pieceLength int, announce string) (string, []byte) {
+	t.Helper()
+	content := make([]byte, length)
+	rand.New(rand.NewSource(int64(length))).Read(content)
+	var pieces []byte
+	for offset := 0; offset < length; offset += pieceLength {
+		hash := sha1.Sum(content[offset:min(offset+pieceLength, length)])
+		pieces = append(pieces, hash[:]...)
+	}
+	fileName := writeTorrent(t, map[string]interface{}{
+		"announce": announce,
+		"info": map[string]interface{}{
+			"name":         "content.bin",
+			"length":       length,
+			"piece length": pieceLength,
+			"pieces":       string(pieces),
+		},
+	})
+	return fileName, content
+}
+
+// testPEXID is the id test seeders take ut_pex messages with, not ours so
+// that mixing them up shows.
+const testPEXID = 2
+
+// testSeeder is a peer serving content, with ways to misbehave.
+type testSeeder struct {
+	torrent *Torrent
+	content []byte
+	// pieces is what the seeder has, nil for everything.
+	pieces peerwire.Bitfield
+	// corrupt flips a byte of every block served.
+	corrupt bool
+	// hangUp closes the connection at the first request.
+	hangUp bool
+	// chokeOnce drops the first request with a choke and unchokes again.
+	chokeOnce bool
+	// hangUpAfter, if not zero, closes the connection after serving that
+	// many blocks.
+	hangUpAfter int
+	// delay holds back every block, unless the request is cancelled
+	// meanwhile.
+	delay time.Duration
+	// unchokeDelay holds back the unchoke.
+	unchokeDelay time.Duration
+	// duplicate sends every block twice.
+	duplicate bool
+	// reqq, if not zero, is sent in an extension handshake.
+	reqq int
+	// pex, if not nil, offers ut_pex in an extension handshake and is sent
+	// after it. exchanged, if not nil, gets the ut_pex messages read.
+	pex       *pex.Message
+	exchanged chan *pex.Message
+	// served counts the blocks served, cancels the cancel messages read.
+	served  atomic.Int64
+	cancels atomic.Int64
+	// maxQueued is the most requests held back by delay at once.
+	maxQueued atomic.Int64
+}
+
+// start serves the seeder on loopback until the test ends.
+func (s *testSeeder) start(t *testing.T) Peer {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(conn)
+		}
+	}()
+	return Peer{Addr: netip.MustParseAddrPort(listener.Addr().String())}
+}
+
+func (s *testSeeder) serve(conn net.Conn) {
+	defer conn.Close()
+	infoHash, _ := s.torrent.InfoHash()
+	if _, err := peerwire.ReadHandshake(conn); err != nil {
+		return
+	}
+	response := &peerwire.Handshake{InfoHash: infoHash}
+	copy(response.PeerID[:], "-TS0001-seeder000000")
+	extensions := s.reqq > 0 || s.pex != nil
+	if extensions {
+		response.Reserved[5] |= peerwire.ReservedExtensions
+	}
+	conn.Write(response.Marshal())
+
+	layout, _ := NewLayout(s.torrent.Info)
+	pieces := s.pieces
+	if pieces == nil {
+		pieces = peerwire.NewBitfield(layout.NumPieces())
+		for i := 0; i < layout.NumPieces(); i++ {
+			pieces.Set(i)
+		}
+	}
+	wire := peerwire.NewConn(conn)
+	wire.Send(pieces)
+	if extensions {
+		handshake := map[string]interface{}{"m": map[string]interface{}{}}
+		if s.reqq > 0 {
+			handshake["reqq"] = s.reqq
+		}
+		if s.pex != nil {
+			handshake["m"] = map[string]interface{}{pex.ExtensionName: testPEXID}
+		}
+		payload, _ := bencode.Marshal(handshake)
+		wire.Send(peerwire.Extended{Payload: []byte(payload)})
+	}
+	if s.pex != nil {
+		payload, _ := s.pex.Marshal()
+		wire.Send(peerwire.Extended{ExtendedID: extensionPEX, Payload: payload})
+	}
+
+	choked := false
+	var mu sync.Mutex
+	cancelled := make(map[peerwire.Request]bool)
+	queued := int64(0)
+	for {
+		m, err := wire.ReadMessage()
+		if err != nil {
+			return
+		}
+		switch m := m.(type) {
+		case peerwire.Interested:
+			time.Sleep(s.unchokeDelay)
+			wire.Send(peerwire.Unchoke{})
+		case peerwire.Extended:
+			if m.ExtendedID == testPEXID && s.exchanged != nil {
+				if msg, err := pex.Parse(m.Payload); err == nil {
+					s.exchanged <- msg
+				}
+			}
+		case peerwire.Cancel:
+			s.cancels.Add(1)
+			mu.Lock()
+			cancelled[peerwire.Request(m)] = true
+			mu.Unlock()
+		case peerwire.Request:
+			if s.hangUp || (s.hangUpAfter > 0 && s.served.Load() == int64(s.hangUpAfter)) {
+				return
+			}
+			if s.chokeOnce && !choked {
+				choked = true
+				wire.Send(peerwire.Choke{})
+				wire.Send(peerwire.Unchoke{})
+				continue
+			}
+			offset := layout.PieceOffset(int(m.Index)) + int(m.Begin)
+			if offset+int(m.Length) > len(s.content) {
+				return
+			}
+			block := bytes.Clone(s.content[offset : offset+int(m.Length)])
+			if s.corrupt {
+				block[0] ^= 0xff
+			}
+			piece := peerwire.Piece{Index: m.Index, Begin: m.Begin, Block: block}
+			if s.delay > 0 {
+				mu.Lock()
+				queued++
+				if queued > s.maxQueued.Load() {
+					s.maxQueued.Store(queued)
+				}
+				mu.Unlock()
+				time.AfterFunc(s.delay, func() {
+					mu.Lock()
+					defer mu.Unlock()
+					queued--
+					if !cancelled[m] {
+						wire.Send(piece)
+						s.served.Add(1)
+					}
+				})
+				continue
+			}
+			wire.Send(piece)
+			if s.duplicate {
+				wire.Send(piece)
+			}
+			s.served.Add(1)
+		}
+	}
+}
+
+func TestDownloadPiece(t *testing.T) {
+	fileName, content := testContent(t, 180_000, 3*peerwire.BlockLength+1000, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+
+	missing := peerwire.NewBitfield(torrent.Info.NumPieces())
+	missing.Set(0)
+	peers := []Peer{
+		(&testSeeder{torrent: torrent, content: content, hangUp: true}).start(t),
+		(&testSeeder{torrent: torrent, content: content, corrupt: true}).start(t),
+		(&testSeeder{torrent: torrent, content: content, pieces: missing}).start(t),
+		(&testSeeder{torrent: torrent, content: content, chokeOnce: true}).start(t),
+	}
+
+	var failed []Peer
+	data, err := torrent.DownloadPiece(context.Background(), peers, 1, func(peer Peer, err error) {
+		failed = append(failed, peer)
+	})
+	require.NoError(t, err)
+	pieceLength := torrent.Info.PieceLength
+	assert.Equal(t, content[pieceLength:2*pieceLength], data)
+	assert.Equal(t, peers[:3], failed)
+
+	// the short last piece
+	data, err = torrent.DownloadPiece(context.Background(), peers[3:], 3, nil)
+	require.NoError(t, err)
+	assert.Equal(t, content[3*pieceLength:], data)
+
+	_, err = torrent.DownloadPiece(context.Background(), peers[:3], 1, nil)
+	assert.ErrorContains(t, err, "failed to download piece 1 from 3 peers")
+	assert.ErrorContains(t, err, "hash mismatch")
+	assert.ErrorIs(t, err, errPieceMissing)
+
+	_, err = torrent.DownloadPiece(context.Background(), peers, 4, nil)
+	assert.ErrorContains(t, err, "out of range")
+}
+
+func TestRunDownloadPiece(t *testing.T) {
+	server := tracker.NewServer()
+	announceURL, _ := startEmbeddedTracker(t, server)
+	fileName, content := testContent(t, 50_000, 2*peerwire.BlockLength, announceURL)
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	infoHash, err := torrent.InfoHash()
+	require.NoError(t, err)
+
+	seeder := (&testSeeder{torrent: torrent, content: content}).start(t)
+	_, err = server.Announce(&tracker.Request{InfoHash: infoHash, PeerID: [20]byte{1}, Addr: seeder.Addr, NumWant: -1})
+	require.NoError(t, err)
+
+	output := filepath.Join(t.TempDir(), "piece")
+	buffer := &bytes.Buffer{}
+	err = NewClient(buffer).Run([]string{"--lsd=false", "download_piece", "-o", output, fileName, "1"})
+	require.NoError(t, err)
+	assert.Equal(t, "Piece 1 downloaded to "+output+".\n", buffer.String())
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, content[2*peerwire.BlockLength:], data)
+}
+
+func TestRunDownloadPieceInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{"no output", []string{"download_piece", "../../sample.torrent", "0"}, "usage: download_piece"},
+		{"no index", []string{"download_piece", "-o", "out", "../../sample.torrent"}, "usage: download_piece"},
+		{"bad index", []string{"download_piece", "-o", "out", "../../sample.torrent", "x"}, "invalid piece index"},
+		{"index out of range", []string{"download_piece", "-o", "out", "../../sample.torrent", "3"}, "the torrent has 3 pieces"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := NewClient(&bytes.Buffer{}).Run(tt.args)
+			assert.ErrorContains(t, err, tt.want)
+		})
+	}
+}
+
+func TestDownload(t *testing.T) {
+	// three files, one of them empty, in pieces that span file boundaries
+	content := make([]byte, 100_000)
+	rand.New(rand.NewSource(1)).Read(content)
+	pieceLength := 2 * peerwire.BlockLength
+	var pieces []byte
+	for offset := 0; offset < len(content); offset += pieceLength {
+		hash := sha1.Sum(content[offset:min(offset+pieceLength, len(content))])
+		pieces = append(pieces, hash[:]...)
+	}
+	fileName := writeTorrent(t, map[string]interface{}{
+		"announce": "http://tracker.invalid/announce",
+		"info": map[string]interface{}{
+			"name":         "dir",
+			"piece length": pieceLength,
+			"pieces":       string(pieces),
+			"files": []interface{}{
+				map[string]interface{}{"length": 30_000, "path": []interface{}{"a"}},
+				map[string]interface{}{"length": 0, "path": []interface{}{"sub", "empty"}},
+				map[string]interface{}{"length": 70_000, "path": []interface{}{"sub", "b"}},
+			},
+		},
+	})
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+
+	even := peerwire.NewBitfield(torrent.Info.NumPieces())
+	for i := 0; i < torrent.Info.NumPieces(); i += 2 {
+		even.Set(i)
+	}
+	peers := []Peer{
+		(&testSeeder{torrent: torrent, content: content, corrupt: true}).start(t),
+		(&testSeeder{torrent: torrent, content: content, pieces: even}).start(t),
+		(&testSeeder{torrent: torrent, content: content, hangUp: true}).start(t),
+		(&testSeeder{torrent: torrent, content: content, chokeOnce: true}).start(t),
+	}
+
+	layout, err := NewLayout(torrent.Info)
+	require.NoError(t, err)
+	resolver, err := storage.NewResolver(t.TempDir())
+	require.NoError(t, err)
+	store, err := OpenStorage(layout, resolver)
+	require.NoError(t, err)
+	defer store.Close()
+
+	download, err := NewDownload(torrent, store)
+	require.NoError(t, err)
+	download.MaxPeers = 2
+	download.Counters = NewTransferCounters(int64(len(content)))
+	var mu sync.Mutex
+	var progress []Progress
+	var failed []Peer
+	download.OnProgress = func(p Progress) {
+		mu.Lock()
+		progress = append(progress, p)
+		mu.Unlock()
+	}
+	download.OnPeerError = func(peer Peer, err error) {
+		mu.Lock()
+		failed = append(failed, peer)
+		mu.Unlock()
+	}
+	require.NoError(t, download.Run(context.Background(), peers))
+
+	assert.Len(t, progress, torrent.Info.NumPieces())
+	assert.Equal(t, torrent.Info.NumPieces(), progress[len(progress)-1].Done)
+	assert.ElementsMatch(t, []Peer{peers[0], peers[2]}, failed)
+	assert.Equal(t, int64(len(content)), download.Counters.Downloaded())
+	assert.Zero(t, download.Counters.Left())
+
+	for name, want := range map[string][]byte{
+		"dir/a":         content[:30_000],
+		"dir/sub/empty": {},
+		"dir/sub/b":     content[30_000:],
+	} {
+		data, err := os.ReadFile(filepath.Join(resolver.Root(), name))
+		require.NoError(t, err)
+		assert.Equal(t, want, data, name)
+	}
+}
+
+func TestDownloadRunsOutOfPeers(t *testing.T) {
+	fileName, content := testContent(t, 50_000, peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	some := peerwire.NewBitfield(torrent.Info.NumPieces())
+	some.Set(1)
+	peers := []Peer{
+		(&testSeeder{torrent: torrent, content: content, pieces: some}).start(t),
+		(&testSeeder{torrent: torrent, content: content, corrupt: true}).start(t),
+	}
+
+	download, err := NewDownload(torrent, &discardWriter{})
+	require.NoError(t, err)
+	err = download.Run(context.Background(), peers)
+	assert.ErrorContains(t, err, "3 of 4 pieces missing")
+}
+
+func TestDownloadAddPeers(t *testing.T) {
+	fileName, content := testContent(t, 50_000, peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	some := peerwire.NewBitfield(torrent.Info.NumPieces())
+	some.Set(1)
+	first := (&testSeeder{torrent: torrent, content: content, pieces: some}).start(t)
+	later := (&testSeeder{torrent: torrent, content: content}).start(t)
+
+	// a peer found while the first one is still connected finishes the
+	// download, and one queued again isn't connected to twice
+	download, err := NewDownload(torrent, &discardWriter{})
+	require.NoError(t, err)
+	var once sync.Once
+	download.OnProgress = func(Progress) {
+		once.Do(func() { download.AddPeers([]Peer{first, later, later}) })
+	}
+	var failed []Peer
+	download.OnPeerError = func(peer Peer, err error) { failed = append(failed, peer) }
+	require.NoError(t, download.Run(context.Background(), []Peer{first}))
+	assert.Empty(t, failed)
+	assert.Empty(t, download.queue)
+}
+
+func TestDownloadPEX(t *testing.T) {
+	fileName, content := testContent(t, 50_000, peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+
+	// the first seeder tells about the second, which the download isn't
+	// given, and is told about it in turn once both are connected
+	second := (&testSeeder{torrent: torrent, content: content, delay: time.Second}).start(t)
+	first := &testSeeder{
+		torrent:      torrent,
+		content:      content,
+		unchokeDelay: 200 * time.Millisecond,
+		pex:          &pex.Message{Added: []pex.Peer{{Addr: second.Addr}}},
+		exchanged:    make(chan *pex.Message, 1),
+	}
+	firstPeer := first.start(t)
+
+	download, err := NewDownload(torrent, &discardWriter{})
+	require.NoError(t, err)
+	download.PEX = NewPEXSource(torrent)
+	require.NoError(t, download.Run(context.Background(), []Peer{firstPeer}))
+	assert.Contains(t, download.seen, second.Addr.String())
+
+	select {
+	case msg := <-first.exchanged:
+		assert.Equal(t, []pex.Peer{{Addr: second.Addr, Flags: pex.FlagReachable}}, msg.Added)
+	case <-time.After(time.Second):
+		t.Fatal("no ut_pex message sent")
+	}
+}
+
+func TestDownloadKeepsPartialPieces(t *testing.T) {
+	fileName, content := testContent(t, 4*peerwire.BlockLength, 4*peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	quitter := &testSeeder{torrent: torrent, content: content, hangUpAfter: 3}
+	seeder := &testSeeder{torrent: torrent, content: content}
+	peers := []Peer{quitter.start(t), seeder.start(t)}
+
+	download, err := NewDownload(torrent, &discardWriter{})
+	require.NoError(t, err)
+	download.MaxPeers = 1
+	require.NoError(t, download.Run(context.Background(), peers))
+	// the second peer only sent the block the first one didn't
+	assert.Equal(t, int64(3), quitter.served.Load())
+	assert.Equal(t, int64(1), seeder.served.Load())
+}
+
+func TestDownloadSkipsPieces(t *testing.T) {
+	fileName, content := testContent(t, 50_000, peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	some := peerwire.NewBitfield(torrent.Info.NumPieces())
+	some.Set(1)
+	some.Set(2)
+	peers := []Peer{(&testSeeder{torrent: torrent, content: content, pieces: some}).start(t)}
+
+	download, err := NewDownload(torrent, &discardWriter{})
+	require.NoError(t, err)
+	download.Picker.SetPriority(0, PrioritySkip)
+	download.Picker.SetPriority(3, PrioritySkip)
+	var progress []Progress
+	download.OnProgress = func(p Progress) { progress = append(progress, p) }
+	require.NoError(t, download.Run(context.Background(), peers))
+	require.Len(t, progress, 2)
+	assert.Equal(t, Progress{Piece: progress[1].Piece, Peer: peers[0], Done: 2, Total: 2}, progress[1])
+}
+
+func TestDownloadEndgame(t *testing.T) {
+	fileName, content := testContent(t, 4*peerwire.BlockLength, peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	slow := &testSeeder{torrent: torrent, content: content, delay: time.Minute}
+	// the slow peer is asked for every piece before the other unchokes us
+	fast := &testSeeder{torrent: torrent, content: content, unchokeDelay: 200 * time.Millisecond}
+	peers := []Peer{slow.start(t), fast.start(t)}
+
+	download, err := NewDownload(torrent, &discardWriter{})
+	require.NoError(t, err)
+	done := make(chan error)
+	go func() { done <- download.Run(context.Background(), peers) }()
+	select {
+	case err := <-done:
+		require.NoError(t, err)
+	case <-time.After(10 * time.Second):
+		t.Fatal("the slow peer held up the download")
+	}
+	assert.True(t, download.complete())
+	assert.Zero(t, slow.served.Load())
+	assert.Eventually(t, func() bool { return slow.cancels.Load() == 4 }, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestDownloadNoEndgameMidway(t *testing.T) {
+	fileName, content := testContent(t, 12*peerwire.BlockLength, peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	// the slow seeder is asked for piece 0 first, then the other peer, which
+	// only has piece 0, connects while most pieces are still to be picked
+	slow := &testSeeder{torrent: torrent, content: content, delay: 300 * time.Millisecond}
+	late := &testSeeder{torrent: torrent, content: content, pieces: bitfieldOf(12, 0), unchokeDelay: 100 * time.Millisecond}
+	peers := []Peer{slow.start(t), late.start(t)}
+
+	download, err := NewDownload(torrent, &discardWriter{})
+	require.NoError(t, err)
+	download.Picker.SetPriority(0, PriorityHigh)
+	require.NoError(t, download.Run(context.Background(), peers))
+	assert.Zero(t, late.served.Load(), "piece 0 was requested twice before the endgame")
+}
+
+func TestDownloadCountsRedundantData(t *testing.T) {
+	fileName, content := testContent(t, 3*peerwire.BlockLength, peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	peers := []Peer{(&testSeeder{torrent: torrent, content: content, duplicate: true}).start(t)}
+
+	download, err := NewDownload(torrent, &discardWriter{})
+	require.NoError(t, err)
+	download.Counters = NewTransferCounters(int64(len(content)))
+	require.NoError(t, download.Run(context.Background(), peers))
+	assert.Equal(t, int64(len(content)), download.Counters.Downloaded())
+	// the copy of the last block is never read
+	assert.Equal(t, int64(2*peerwire.BlockLength), download.Counters.Redundant())
+}
+
+type discardWriter struct{}
+
+func (discardWriter) WriteAt(p []byte, off int64) (int, error) {
+	return len(p), nil
+}
+
+func TestRunDownload(t *testing.T) {
+	server := tracker.NewServer()
+	announceURL, _ := startEmbeddedTracker(t, server)
+	fileName, content := testContent(t, 200_000, 2*peerwire.BlockLength, announceURL)
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	infoHash, err := torrent.InfoHash()
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		seeder := (&testSeeder{torrent: torrent, content: content}).start(t)
+		_, err = server.Announce(&tracker.Request{InfoHash: infoHash, PeerID: [20]byte{byte(i + 1)}, Addr: seeder.Addr, NumWant: -1})
+		require.NoError(t, err)
+	}
+
+	output := filepath.Join(t.TempDir(), "out", "content.bin")
+	buffer, errOut := &bytes.Buffer{}, &bytes.Buffer{}
+	c := NewClient(buffer)
+	c.errOut = errOut
+	err = c.Run([]string{"--lsd=false", "download", "-o", output, fileName})
+	require.NoError(t, err)
+	assert.Equal(t, "Downloaded "+fileName+" to "+output+".\n", buffer.String())
+	assert.Contains(t, errOut.String(), "(7/7)")
+
+	data, err := os.ReadFile(output)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	// the tracker was told about the completed download
+	stats := server.Scrape(infoHash)
+	require.Len(t, stats, 1)
+	assert.Equal(t, 1, stats[0].Downloaded)
+}
+
+func TestRunDownloadAnnounces(t *testing.T) {
+	server := tracker.NewServer()
+	announceURL, _ := startEmbeddedTracker(t, server)
+	fileName, content := testContent(t, 50_000, peerwire.BlockLength, announceURL)
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	infoHash, err := torrent.InfoHash()
+	require.NoError(t, err)
+	// the seeder holds the download back long enough to look at the tracker
+	seeder := (&testSeeder{torrent: torrent, content: content, unchokeDelay: time.Second}).start(t)
+	_, err = server.Announce(&tracker.Request{InfoHash: infoHash, PeerID: [20]byte{1}, Addr: seeder.Addr, NumWant: -1})
+	require.NoError(t, err)
+
+	done := make(chan error, 1)
+	go func() {
+		c := NewClient(&bytes.Buffer{})
+		c.errOut = io.Discard
+		done <- c.Run([]string{"--lsd=false", "download", "-o", filepath.Join(t.TempDir(), "out"), fileName})
+	}()
+
+	// started put the downloader in the swarm while it downloads
+	assert.Eventually(t, func() bool {
+		return server.Scrape(infoHash)[0].Incomplete == 1
+	}, 900*time.Millisecond, 10*time.Millisecond)
+	select {
+	case err := <-done:
+		t.Fatalf("download ended before the check: %v", err)
+	default:
+	}
+
+	require.NoError(t, <-done)
+	// then completed and stopped
+	stats := server.Scrape(infoHash)[0]
+	assert.Equal(t, 1, stats.Downloaded)
+	assert.Equal(t, 0, stats.Incomplete)
+	assert.Equal(t, 1, stats.Complete)
+}
+
+func TestRunDownloadInvalid(t *testing.T) {
+	err := NewClient(&bytes.Buffer{}).Run([]string{"download", "../../sample.torrent"})
+	assert.ErrorContains(t, err, "usage: download")
+
+	server := tracker.NewServer()
+	announceURL, _ := startEmbeddedTracker(t, server)
+	fileName, _ := testContent(t, 50_000, peerwire.BlockLength, announceURL)
+	err = NewClient(&bytes.Buffer{}).Run([]string{"--lsd=false", "download", "-o", filepath.Join(t.TempDir(), "out"), fileName})
+	assert.ErrorContains(t, err, "download failed: 4 of 4 pieces missing")
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// FileSpan is the part of a single file covered by (part of) a piece.
+type FileSpan struct {
+	// FileIndex is the index into Layout.Files.
+	FileIndex int
+	// Offset is where the span starts within the file.
+	Offset int
+	Length int
+}
+
+// LayoutFile is a file in the torrent with its position in the concatenated
+// content of all files.
+type LayoutFile struct {
+	// Path is the torrent path of the file, starting with the torrent name.
+	Path   []string
+	Length int
+	// Offset is where the file starts in the torrent's content.
+	Offset int
+}
+
+// Layout maps pieces to the files they cover and back.
+type Layout struct {
+	Files       []LayoutFile
+	TotalLength int
+	pieceLength int
+	numPieces   int
+}
+
+func NewLayout(info *Info) (*Layout, error) {
+	if info.PieceLength <= 0 {
+		return nil, fmt.Errorf("invalid piece length: %d", info.PieceLength)
+	}
+
+	layout := &Layout{pieceLength: info.PieceLength}
+	if len(info.Files) == 0 {
+		layout.Files = []LayoutFile{{Path: []string{info.Name}, Length: info.Length}}
+	} else {
+		layout.Files = make([]LayoutFile, 0, len(info.Files))
+		for _, file := range info.Files {
+			path := append([]string{info.Name}, file.Path...)
+			layout.Files = append(layout.Files, LayoutFile{Path: path, Length: file.Length})
+		}
+	}
+
+	for i := range layout.Files {
+		layout.Files[i].Offset = layout.TotalLength
+		layout.TotalLength += layout.Files[i].Length
+	}
+
+	layout.numPieces = (layout.TotalLength + info.PieceLength - 1) / info.PieceLength
+	if layout.numPieces != info.NumPieces() {
+		return nil, fmt.Errorf("torrent has %d piece hashes but its length needs %d pieces", info.NumPieces(), layout.numPieces)
+	}
+
+	return layout, nil
+}
+
+func (l *Layout) NumPieces() int {
+	return l.numPieces
+}
+
+// PieceOffset is where piece i starts in the torrent's content.
+func (l *Layout) PieceOffset(i int) int {
+	return i * l.pieceLength
+}
+
+// PieceLength is the length of piece i. Only the last piece may be shorter
+// than the torrent's piece length.
+func (l *Layout) PieceLength(i int) int {
+	if i < 0 || i >= l.numPieces {
+		return 0
+	}
+	if i == l.numPieces-1 {
+		return l.TotalLength - l.PieceOffset(i)
+	}
+	return l.pieceLength
+}
+
+// PieceRange returns the file spans covered by piece i, in order.
+func (l *Layout) PieceRange(i int) []FileSpan {
+	return l.Spans(l.PieceOffset(i), l.PieceLength(i))
+}
+
+// Spans returns the file spans covering length bytes starting at offset in
+// the torrent's content. Zero length files are never part of a span.
+func (l *Layout) Spans(offset, length int) []FileSpan {
+	if length <= 0 {
+		return nil
+	}
+	end := offset + length
+
+	// first file that ends after offset
+	first := sort.Search(len(l.Files), func(j int) bool {
+		return l.Files[j].Offset+l.Files[j].Length > offset
+	})
+
+	var spans []FileSpan
+	for j := first; j < len(l.Files) && l.Files[j].Offset < end; j++ {
+		file := l.Files[j]
+		if file.Length == 0 {
+			continue
+		}
+		start := max(offset, file.Offset)
+		stop := min(end, file.Offset+file.Length)
+		spans = append(spans, FileSpan{FileIndex: j, Offset: start - file.Offset, Length: stop - start})
+	}
+	return spans
+}
+
+// FilePieces returns the first and last piece that cover the file at path
+// (its torrent path joined with "/"). Both are -1 if there is no such file or
+// the file is empty.
+func (l *Layout) FilePieces(path string) (first, last int) {
+	for _, file := range l.Files {
+		if strings.Join(file.Path, "/") != path {
+			continue
+		}
+		if file.Length == 0 {
+			return -1, -1
+		}
+		return file.Offset / l.pieceLength, (file.Offset + file.Length - 1) / l.pieceLength
+	}
+	return -1, -1
+}
+
+// PieceHash returns the expected SHA-1 hash of piece i.
+func (t *Torrent) PieceHash(i int) ([20]byte, error) {
+	var hash [20]byte
+	if i < 0 || i >= t.Info.NumPieces() {
+		return hash, fmt.Errorf("piece index %d out of range", i)
+	}
+	copy(hash[:], t.Info.Pieces[i*20:(i+1)*20])
+	return hash, nil
+}
+
+// VerifyPiece checks data against the hash of piece i.
+func (t *Torrent) VerifyPiece(i int, data []byte) error {
+	expected, err := t.PieceHash(i)
+	if err != nil {
+		return err
+	}
+	layout, err := NewLayout(t.Info)
+	if err != nil {
+		return err
+	}
+	if len(data) != layout.PieceLength(i) {
+		return fmt.Errorf("piece %d has length %d, expected %d", i, len(data), layout.PieceLength(i))
+	}
+	if actual := sha1.Sum(data); !bytes.Equal(actual[:], expected[:]) {
+		return fmt.Errorf("piece %d hash mismatch: got %x, expected %x", i, actual, expected)
+	}
+	return nil
+}
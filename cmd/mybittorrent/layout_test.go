@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/sha1"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// randomInfo builds a multi-file info with random file sizes, including empty
+// files, and the matching number of (fake) piece hashes.
+func randomInfo(r *rand.Rand) *Info {
+	info := &Info{Name: "root", PieceLength: 1 << (4 + r.Intn(6))}
+	numFiles := 1 + r.Intn(6)
+	total := 0
+	for i := 0; i < numFiles; i++ {
+		length := r.Intn(3 * info.PieceLength)
+		if r.Intn(5) == 0 {
+			length = 0
+		}
+		total += length
+		info.Files = append(info.Files, File{Length: length, Path: []string{"dir", string(rune('a' + i))}})
+	}
+	numPieces := (total + info.PieceLength - 1) / info.PieceLength
+	info.Pieces = strings.Repeat("x", 20*numPieces)
+	return info
+}
+
+func TestLayoutProperties(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+
+	for n := 0; n < 500; n++ {
+		info := randomInfo(r)
+		layout, err := NewLayout(info)
+		require.NoError(t, err)
+		require.Equal(t, info.TotalLength(), layout.TotalLength)
+
+		// pieces cover the whole content exactly once, in order
+		fileCovered := make([]int, len(layout.Files))
+		total := 0
+		for i := 0; i < layout.NumPieces(); i++ {
+			pieceLength := layout.PieceLength(i)
+			if i < layout.NumPieces()-1 {
+				assert.Equal(t, info.PieceLength, pieceLength)
+			} else {
+				assert.True(t, pieceLength > 0 && pieceLength <= info.PieceLength)
+			}
+			total += pieceLength
+
+			spanTotal := 0
+			for _, span := range layout.PieceRange(i) {
+				assert.Equal(t, fileCovered[span.FileIndex], span.Offset, "spans must be contiguous within a file")
+				assert.Positive(t, span.Length)
+				fileCovered[span.FileIndex] += span.Length
+				spanTotal += span.Length
+
+				first, last := layout.FilePieces(strings.Join(layout.Files[span.FileIndex].Path, "/"))
+				assert.True(t, first <= i && i <= last)
+			}
+			assert.Equal(t, pieceLength, spanTotal)
+		}
+		assert.Equal(t, info.TotalLength(), total)
+
+		for j, file := range layout.Files {
+			assert.Equal(t, file.Length, fileCovered[j])
+		}
+	}
+}
+
+func TestLayoutSingleFile(t *testing.T) {
+	info := &Info{Name: "sample.txt", Length: 92063, PieceLength: 32768, Pieces: strings.Repeat("x", 60)}
+	layout, err := NewLayout(info)
+	require.NoError(t, err)
+
+	assert.Equal(t, 3, layout.NumPieces())
+	assert.Equal(t, 32768, layout.PieceLength(0))
+	assert.Equal(t, 92063-2*32768, layout.PieceLength(2))
+	assert.Equal(t, 0, layout.PieceLength(3))
+	assert.Equal(t, []FileSpan{{FileIndex: 0, Offset: 65536, Length: 26527}}, layout.PieceRange(2))
+
+	first, last := layout.FilePieces("sample.txt")
+	assert.Equal(t, 0, first)
+	assert.Equal(t, 2, last)
+
+	first, last = layout.FilePieces("missing")
+	assert.Equal(t, -1, first)
+	assert.Equal(t, -1, last)
+}
+
+func TestLayoutSpansFiles(t *testing.T) {
+	info := &Info{
+		Name:        "dir",
+		PieceLength: 10,
+		Pieces:      strings.Repeat("x", 80),
+		Files: []File{
+			{Length: 15, Path: []string{"a"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 20, Path: []string{"b"}},
+		},
+	}
+	layout, err := NewLayout(info)
+	require.NoError(t, err)
+
+	assert.Equal(t, []FileSpan{{0, 10, 5}, {2, 0, 5}}, layout.PieceRange(1))
+
+	first, last := layout.FilePieces("dir/b")
+	assert.Equal(t, 1, first)
+	assert.Equal(t, 3, last)
+
+	first, last = layout.FilePieces("dir/empty")
+	assert.Equal(t, -1, first)
+	assert.Equal(t, -1, last)
+}
+
+func TestLayoutPieceCountMismatch(t *testing.T) {
+	_, err := NewLayout(&Info{Name: "a", Length: 100, PieceLength: 10, Pieces: strings.Repeat("x", 20)})
+	assert.Error(t, err)
+}
+
+func TestVerifyPiece(t *testing.T) {
+	data := []byte(strings.Repeat("hello world ", 10))
+	first := sha1.Sum(data[:64])
+	second := sha1.Sum(data[64:])
+	torrent := &Torrent{Info: &Info{
+		Name:        "hello.txt",
+		Length:      len(data),
+		PieceLength: 64,
+		Pieces:      string(first[:]) + string(second[:]),
+	}}
+
+	assert.NoError(t, torrent.VerifyPiece(0, data[:64]))
+	assert.NoError(t, torrent.VerifyPiece(1, data[64:]))
+	assert.ErrorContains(t, torrent.VerifyPiece(1, data[:64]), "length")
+	assert.ErrorContains(t, torrent.VerifyPiece(0, data[1:65]), "hash mismatch")
+	assert.Error(t, torrent.VerifyPiece(2, nil))
+}
@@ -1,30 +1,128 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
+	"flag"
 	"fmt"
 	"io"
 	"net"
+	"net/http"
 	"os"
+	"os/signal"
+	"path/filepath"
+	"strconv"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/dht"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/lsd"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/metainfo"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerid"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/proxy"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
 )
 
 type Client struct {
 	out io.Writer
+	// errOut receives diagnostics that would break the parsing of out.
+	errOut io.Writer
+	// in is read when a command is given "-" as its torrent file.
+	in io.Reader
+	// format is the output format selected with --format, "text" or "json".
+	format string
+	// network configures connections to peers and trackers.
+	network *Network
+	// peerID and port identify this session to trackers and peers.
+	peerID [20]byte
+	port   int
+	// lsd enables local service discovery for the torrents we download.
+	lsd bool
 }
 
 func NewClient(out io.Writer) *Client {
 	if out == nil {
 		out = os.Stdout
 	}
-	return &Client{out: out}
+	// a fresh peer id for every session, so instances can't be confused
+	id, _ := peerid.Generate(peerid.Prefix)
+	return &Client{out: out, errOut: os.Stderr, in: os.Stdin, format: formatText,
+		network: defaultNetwork(), peerID: id, port: defaultPort, lsd: true}
 }
 
+// peerIDEnv names the environment variable that sets the peer id like
+// --peer-id does, which takes precedence over it.
+const peerIDEnv = "MYBITTORRENT_PEER_ID"
+
+const (
+	formatText = "text"
+	formatJSON = "json"
+)
+
+// Run runs a command until it finishes or the process is interrupted.
 func (c *Client) Run(args []string) error {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	return c.RunContext(ctx, args)
+}
+
+// RunContext runs a command, cancelling its network operations when ctx is
+// done.
+func (c *Client) RunContext(ctx context.Context, args []string) error {
+	if value, ok := os.LookupEnv(peerIDEnv); ok && value != "" {
+		id, err := peerid.Parse(value)
+		if err != nil {
+			return fmt.Errorf("invalid %s: %w", peerIDEnv, err)
+		}
+		c.peerID = id
+	}
+	flags := newFlagSet("mybittorrent")
+	flags.StringVar(&c.format, "format", c.format, "output format: text or json")
+	flags.DurationVar(&c.network.DialTimeout, "dial-timeout", c.network.DialTimeout, "timeout for connecting to peers and trackers")
+	flags.DurationVar(&c.network.ReadTimeout, "read-timeout", c.network.ReadTimeout, "timeout for every read from a peer")
+	flags.DurationVar(&c.network.WriteTimeout, "write-timeout", c.network.WriteTimeout, "timeout for every write to a peer")
+	flags.DurationVar(&c.network.TrackerTimeout, "tracker-timeout", c.network.TrackerTimeout, "timeout for a tracker request")
+	flags.Func("peer-id", "peer id, default $"+peerIDEnv+": 40 hex digits, 20 bytes, or a prefix completed with random bytes", func(value string) error {
+		id, err := peerid.Parse(value)
+		if err == nil {
+			c.peerID = id
+		}
+		return err
+	})
+	flags.IntVar(&c.port, "port", c.port, "port to announce and listen on")
+	flags.BoolVar(&c.lsd, "lsd", c.lsd, "find peers on the local network (BEP 14)")
+	proxyURL := flags.String("proxy", "", "proxy for trackers: socks5://, socks5h:// or http:// URL")
+	proxyPeers := flags.Bool("proxy-peers", false, "also connect to peers through --proxy")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("usage: [--format=text|json] <command> <argument>: %w", err)
+	}
+	if *proxyURL != "" {
+		dialer, err := proxy.Parse(*proxyURL)
+		if err != nil {
+			return err
+		}
+		c.network.TrackerDialer = dialer
+		if *proxyPeers {
+			c.network.PeerDialer = dialer
+		}
+	} else if *proxyPeers {
+		return fmt.Errorf("--proxy-peers requires --proxy")
+	}
+	if c.port <= 0 || c.port > 65535 {
+		return fmt.Errorf("invalid port: %d", c.port)
+	}
+	if c.format != formatText && c.format != formatJSON {
+		return fmt.Errorf("unknown output format: %s", c.format)
+	}
+
+	args = flags.Args()
 	if len(args) < 1 {
-		return fmt.Errorf("usage: <command> <argument>")
+		return fmt.Errorf("usage: [--format=text|json] <command> <argument>")
 	}
 
 	cmd := args[0]
@@ -33,17 +131,134 @@ func (c *Client) Run(args []string) error {
 		return fmt.Errorf("unknown command: %s", cmd)
 	}
 
-	return handler(c, args[1:])
+	return handler(ctx, c, args[1:])
+}
+
+var commandHandlers = map[string]func(context.Context, *Client, []string) error{
+	"decode":         decodeCommand,
+	"info":           infoCommand,
+	"peers":          peersCommand,
+	"handshake":      handshakeCommand,
+	"lint":           lintCommand,
+	"scrape":         scrapeCommand,
+	"tracker":        trackerCommand,
+	"dht_peers":      dhtPeersCommand,
+	"download_piece": downloadPieceCommand,
+	"download":       downloadCommand,
+	"seed":           seedCommand,
 }
 
-var commandHandlers = map[string]func(*Client, []string) error{
-	"decode":    decodeCommand,
-	"info":      infoCommand,
-	"peers":     peersCommand,
-	"handshake": handshakeCommand,
+// newFlagSet returns a flag set for a sub command. Parse errors are returned
+// to the caller instead of being printed.
+func newFlagSet(name string) *flag.FlagSet {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	flags.SetOutput(io.Discard)
+	return flags
+}
+
+// maxTorrentSize limits how much is read from stdin or a URL for a torrent.
+const maxTorrentSize = 32 << 20
+
+// readTorrentFile reads the raw contents of a torrent given on the command line
+// as a file path, "-" for stdin, or an http(s) URL.
+func (c *Client) readTorrentFile(ctx context.Context, source string) ([]byte, error) {
+	switch {
+	case source == "-":
+		rawData, err := io.ReadAll(io.LimitReader(c.in, maxTorrentSize+1))
+		if err != nil {
+			return nil, fmt.Errorf("failed to read stdin: %w", err)
+		}
+		if len(rawData) > maxTorrentSize {
+			return nil, fmt.Errorf("torrent on stdin is larger than %d bytes", maxTorrentSize)
+		}
+		return rawData, nil
+	case strings.HasPrefix(source, "http://") || strings.HasPrefix(source, "https://"):
+		return c.fetchTorrentFile(ctx, source)
+	default:
+		rawData, err := os.ReadFile(source)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read file: %w", err)
+		}
+		return rawData, nil
+	}
 }
 
-func decodeCommand(c *Client, args []string) error {
+func (c *Client) fetchTorrentFile(ctx context.Context, url string) ([]byte, error) {
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch torrent: %w", err)
+	}
+	// torrent URLs go through the same proxy as trackers
+	resp, err := c.network.HTTPClient().Do(request)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch torrent: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("failed to fetch torrent. HTTP status code: %v", resp.StatusCode)
+	}
+
+	rawData, err := io.ReadAll(io.LimitReader(resp.Body, maxTorrentSize+1))
+	if err != nil {
+		return nil, fmt.Errorf("failed to fetch torrent: %w", err)
+	}
+	if len(rawData) > maxTorrentSize {
+		return nil, fmt.Errorf("torrent at %s is larger than %d bytes", url, maxTorrentSize)
+	}
+	return rawData, nil
+}
+
+func (c *Client) writeJSON(value interface{}) error {
+	return json.NewEncoder(c.out).Encode(value)
+}
+
+func (c *Client) openTorrent(ctx context.Context, source string) (*Torrent, error) {
+	rawData, err := c.readTorrentFile(ctx, source)
+	if err != nil {
+		return nil, err
+	}
+	torrent, err := ParseTorrentBytes(rawData)
+	if err != nil {
+		return nil, err
+	}
+	torrent.Network = c.network
+	torrent.PeerID = c.peerID
+	torrent.Port = c.port
+	return torrent, nil
+}
+
+// peerSources returns where the peers of torrent are found: trackers, the
+// source of its trackers' peers, and the local network. The returned
+// function releases the sources. Nothing accepts peers meanwhile, so the
+// torrent isn't announced on the local network, we only hear who has it.
+func (c *Client) peerSources(torrent *Torrent, trackers PeerSource) (MultiSource, func()) {
+	sources := MultiSource{trackers}
+	source, release := c.lsdSource(torrent, c.port, false)
+	if source == nil {
+		return sources, release
+	}
+	return append(sources, source), release
+}
+
+// lsdSource returns the local network as a source of torrent's peers, or
+// nil with --lsd=false, for private torrents, or when no group could be
+// joined. announce tells the local network about the torrent, for the
+// commands that accept peers on port. The returned function releases the
+// source.
+func (c *Client) lsdSource(torrent *Torrent, port int, announce bool) (*LSDSource, func()) {
+	if !c.lsd || torrent.Info.Private {
+		return nil, func() {}
+	}
+	service, err := lsd.Listen(port)
+	if err != nil {
+		fmt.Fprintf(c.errOut, "Warning: local service discovery disabled: %s\n", err)
+		return nil, func() {}
+	}
+	return &LSDSource{Service: service, Announce: announce}, func() { service.Close() }
+}
+
+func decodeCommand(ctx context.Context, c *Client, args []string) error {
 	if len(args) < 1 {
 		return fmt.Errorf("usage: decode <bencoded string>")
 	}
@@ -51,14 +266,66 @@ func decodeCommand(c *Client, args []string) error {
 	if err != nil {
 		return fmt.Errorf("failed to decode: %w", err)
 	}
-	return json.NewEncoder(c.out).Encode(result)
+	return c.writeJSON(result)
+}
+
+type infoOutput struct {
+	TrackerURL  string       `json:"tracker_url"`
+	Name        string       `json:"name"`
+	Length      int          `json:"length"`
+	InfoHash    string       `json:"info_hash"`
+	PieceLength int          `json:"piece_length"`
+	PieceHashes []string     `json:"piece_hashes"`
+	Files       []fileOutput `json:"files"`
+}
+
+type fileOutput struct {
+	Path   []string `json:"path"`
+	Length int      `json:"length"`
 }
 
-func infoCommand(c *Client, args []string) error {
+type peerOutput struct {
+	IP     string `json:"ip"`
+	Port   int    `json:"port"`
+	PeerID string `json:"peer_id,omitempty"`
+}
+
+type trackerOutput struct {
+	URL          string `json:"url"`
+	Tier         int    `json:"tier"`
+	Peers        int    `json:"peers"`
+	LastError    string `json:"last_error,omitempty"`
+	NextAnnounce string `json:"next_announce,omitempty"`
+}
+
+type peersOutput struct {
+	Interval       int             `json:"interval"`
+	MinInterval    int             `json:"min_interval,omitempty"`
+	Seeders        int             `json:"seeders"`
+	Leechers       int             `json:"leechers"`
+	WarningMessage string          `json:"warning_message,omitempty"`
+	Peers          []peerOutput    `json:"peers"`
+	Trackers       []trackerOutput `json:"trackers"`
+}
+
+type handshakeOutput struct {
+	PeerID     string           `json:"peer_id"`
+	Client     peerid.Client    `json:"client"`
+	Reserved   string           `json:"reserved"`
+	Extensions extensionsOutput `json:"extensions"`
+}
+
+type extensionsOutput struct {
+	ExtensionProtocol bool `json:"extension_protocol"`
+	DHT               bool `json:"dht"`
+	Fast              bool `json:"fast"`
+}
+
+func infoCommand(ctx context.Context, c *Client, args []string) error {
 	if len(args) < 1 {
 		return fmt.Errorf("usage: info <torrent file>")
 	}
-	torrent, err := NewTorrent(args[0])
+	torrent, err := c.openTorrent(ctx, args[0])
 	if err != nil {
 		return fmt.Errorf("failed to create torrent: %w", err)
 	}
@@ -73,8 +340,31 @@ func infoCommand(c *Client, args []string) error {
 		return fmt.Errorf("failed to get piece hashes: %w", err)
 	}
 
+	if c.format == formatJSON {
+		layout, err := NewLayout(torrent.Info)
+		if err != nil {
+			return fmt.Errorf("failed to get file layout: %w", err)
+		}
+		output := infoOutput{
+			TrackerURL:  torrent.Announce,
+			Name:        torrent.Info.Name,
+			Length:      torrent.Info.TotalLength(),
+			InfoHash:    hex.EncodeToString(infoHash[:]),
+			PieceLength: torrent.Info.PieceLength,
+			PieceHashes: make([]string, 0, len(pieceHashes)),
+			Files:       make([]fileOutput, 0, len(layout.Files)),
+		}
+		for _, hash := range pieceHashes {
+			output.PieceHashes = append(output.PieceHashes, strings.TrimSpace(hash))
+		}
+		for _, file := range layout.Files {
+			output.Files = append(output.Files, fileOutput{Path: file.Path, Length: file.Length})
+		}
+		return c.writeJSON(output)
+	}
+
 	fmt.Fprintf(c.out, "Tracker URL: %s\n", torrent.Announce)
-	fmt.Fprintf(c.out, "Length: %d\n", torrent.Info.Length)
+	fmt.Fprintf(c.out, "Length: %d\n", torrent.Info.TotalLength())
 	fmt.Fprintf(c.out, "Info Hash: %x\n", infoHash)
 	fmt.Fprintf(c.out, "Piece Length: %d\n", torrent.Info.PieceLength)
 	fmt.Fprintln(c.out, "Piece Hashes:")
@@ -85,30 +375,91 @@ func infoCommand(c *Client, args []string) error {
 	return nil
 }
 
-func peersCommand(c *Client, args []string) error {
-	if len(args) < 1 {
-		return fmt.Errorf("usage: peers <torrent file>")
+func peersCommand(ctx context.Context, c *Client, args []string) error {
+	flags := newFlagSet("peers")
+	allTiers := flags.Bool("all-tiers", false, "announce to every tracker tier and merge the peers")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 {
+		return fmt.Errorf("usage: peers [--all-tiers] <torrent file>")
 	}
-	torrent, err := NewTorrent(args[0])
+	torrent, err := c.openTorrent(ctx, flags.Arg(0))
 	if err != nil {
 		return fmt.Errorf("failed to create torrent: %w", err)
 	}
-	result, err := torrent.DiscoverPeers()
+	trackers, err := NewTrackerTiers(torrent.Trackers(), c.network)
 	if err != nil {
 		return fmt.Errorf("failed to discover peers: %w", err)
 	}
+	trackers.AllTiers = *allTiers
 
-	fmt.Fprintf(c.out, "%s", strings.Join(result.Peers, "\n"))
+	result, err := torrent.DiscoverPeersWith(ctx, trackers)
+	if err != nil {
+		c.printTrackerStatus(trackers.Status())
+		return fmt.Errorf("failed to discover peers: %w", err)
+	}
+
+	if c.format == formatJSON {
+		output := peersOutput{
+			Interval:       result.Interval,
+			MinInterval:    result.MinInterval,
+			Seeders:        result.Complete,
+			Leechers:       result.Incomplete,
+			WarningMessage: result.WarningMessage,
+			Peers:          make([]peerOutput, 0, len(result.Peers)),
+			Trackers:       []trackerOutput{},
+		}
+		for _, peer := range result.Peers {
+			output.Peers = append(output.Peers, peerOutput{
+				IP:     peer.Addr.Addr().String(),
+				Port:   int(peer.Addr.Port()),
+				PeerID: hex.EncodeToString(peer.ID),
+			})
+		}
+		for _, status := range trackers.Status() {
+			tracker := trackerOutput{URL: status.URL, Tier: status.Tier, Peers: status.Peers, LastError: status.LastError}
+			if !status.NextAnnounce.IsZero() {
+				tracker.NextAnnounce = status.NextAnnounce.UTC().Format(time.RFC3339)
+			}
+			output.Trackers = append(output.Trackers, tracker)
+		}
+		return c.writeJSON(output)
+	}
+
+	// the peer list on out stays machine readable, the rest goes to errOut
+	if result.WarningMessage != "" {
+		fmt.Fprintf(c.errOut, "Warning: %s\n", result.WarningMessage)
+	}
+	fmt.Fprintf(c.errOut, "Seeders: %d, Leechers: %d\n", result.Complete, result.Incomplete)
+	c.printTrackerStatus(trackers.Status())
+
+	peers := make([]string, 0, len(result.Peers))
+	for _, peer := range result.Peers {
+		peers = append(peers, peer.String())
+	}
+	fmt.Fprintf(c.out, "%s", strings.Join(peers, "\n"))
 
 	return nil
 }
 
-func handshakeCommand(c *Client, args []string) error {
+// printTrackerStatus prints the status of the trackers that were contacted
+// or can't be used.
+func (c *Client) printTrackerStatus(statuses []TrackerStatus) {
+	for _, status := range statuses {
+		switch {
+		case status.LastError != "":
+			fmt.Fprintf(c.errOut, "Tracker %s (tier %d): error: %s\n", status.URL, status.Tier, status.LastError)
+		case !status.LastAnnounce.IsZero():
+			fmt.Fprintf(c.errOut, "Tracker %s (tier %d): %d peers, next announce in %s\n",
+				status.URL, status.Tier, status.Peers, status.NextAnnounce.Sub(status.LastAnnounce))
+		}
+	}
+}
+
+func handshakeCommand(ctx context.Context, c *Client, args []string) error {
 	if len(args) < 2 {
 		return fmt.Errorf("usage: handshake <torrent file> <peer address>")
 	}
 
-	torrent, err := NewTorrent(args[0])
+	torrent, err := c.openTorrent(ctx, args[0])
 	if err != nil {
 		return fmt.Errorf("failed to create torrent: %w", err)
 	}
@@ -118,15 +469,644 @@ func handshakeCommand(c *Client, args []string) error {
 		return fmt.Errorf("invalid peer address: %w", err)
 	}
 
-	peerID, err := torrent.Handshake(args[1])
+	result, err := torrent.Handshake(ctx, args[1])
 	if err != nil {
 		return fmt.Errorf("handshake failed: %w", err)
 	}
 
-	fmt.Fprintf(c.out, "Peer ID: %x\n", peerID)
+	if c.format == formatJSON {
+		return c.writeJSON(handshakeOutput{
+			PeerID:   hex.EncodeToString(result.PeerID[:]),
+			Client:   peerid.Decode(result.PeerID[:]),
+			Reserved: hex.EncodeToString(result.Reserved[:]),
+			Extensions: extensionsOutput{
+				ExtensionProtocol: result.SupportsExtensions(),
+				DHT:               result.SupportsDHT(),
+				Fast:              result.SupportsFast(),
+			},
+		})
+	}
+
+	fmt.Fprintf(c.out, "Peer ID: %x\n", result.PeerID)
+	fmt.Fprintf(c.errOut, "Client: %s\n", peerid.Decode(result.PeerID[:]))
+	return nil
+}
+
+func lintCommand(ctx context.Context, c *Client, args []string) error {
+	flags := newFlagSet("lint")
+	asJSON := flags.Bool("json", false, "print findings as JSON")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 {
+		return fmt.Errorf("usage: lint [--json] <torrent file>")
+	}
+	fileName := flags.Arg(0)
+
+	rawData, err := c.readTorrentFile(ctx, fileName)
+	if err != nil {
+		return err
+	}
+	data, err := decodeTorrent(rawData)
+	if err != nil {
+		return err
+	}
+
+	findings := metainfo.Validate(data)
+	valid := !metainfo.HasErrors(findings)
+
+	if *asJSON || c.format == formatJSON {
+		err = c.writeJSON(struct {
+			File     string             `json:"file"`
+			Valid    bool               `json:"valid"`
+			Findings []metainfo.Finding `json:"findings"`
+		}{fileName, valid, findings})
+		if err != nil {
+			return err
+		}
+	} else {
+		for _, finding := range findings {
+			fmt.Fprintln(c.out, finding)
+		}
+		if len(findings) == 0 {
+			fmt.Fprintln(c.out, "OK")
+		}
+	}
+
+	if !valid {
+		return fmt.Errorf("%s is not a valid torrent", fileName)
+	}
+	return nil
+}
+
+type scrapeOutput struct {
+	Torrent   string `json:"torrent"`
+	Name      string `json:"name,omitempty"`
+	InfoHash  string `json:"info_hash,omitempty"`
+	Tracker   string `json:"tracker,omitempty"`
+	Seeders   int    `json:"seeders"`
+	Leechers  int    `json:"leechers"`
+	Completed int    `json:"completed"`
+	Error     string `json:"error,omitempty"`
+}
+
+func scrapeCommand(ctx context.Context, c *Client, args []string) error {
+	if len(args) < 1 {
+		return fmt.Errorf("usage: scrape <torrent file>...")
+	}
+
+	rows := make([]scrapeOutput, len(args))
+	infoHashes := make([][20]byte, len(args))
+	// torrents are grouped by their tracker tiers, so each group of
+	// trackers is scraped once
+	byTrackers := map[string][]int{}
+	trackers := [][][]string{}
+
+	for i, source := range args {
+		rows[i].Torrent = source
+		torrent, err := c.openTorrent(ctx, source)
+		if err != nil {
+			rows[i].Error = err.Error()
+			continue
+		}
+		infoHashes[i], err = torrent.InfoHash()
+		if err != nil {
+			rows[i].Error = err.Error()
+			continue
+		}
+		rows[i].Name = torrent.Info.Name
+		rows[i].InfoHash = hex.EncodeToString(infoHashes[i][:])
+
+		tiers := torrent.Trackers()
+		key := fmt.Sprint(tiers)
+		if _, ok := byTrackers[key]; !ok {
+			trackers = append(trackers, tiers)
+		}
+		byTrackers[key] = append(byTrackers[key], i)
+	}
+
+	for _, tiers := range trackers {
+		indexes := byTrackers[fmt.Sprint(tiers)]
+		results, trackerURL, err := c.scrapeTrackers(ctx, tiers, indexes, infoHashes)
+		for _, i := range indexes {
+			rows[i].Tracker = trackerURL
+			if err != nil {
+				rows[i].Error = err.Error()
+			} else if result, ok := results[infoHashes[i]]; ok {
+				rows[i].Seeders = result.Seeders
+				rows[i].Leechers = result.Leechers
+				rows[i].Completed = result.Completed
+			} else {
+				rows[i].Error = "torrent not known to tracker"
+			}
+		}
+	}
+
+	failed := 0
+	for _, row := range rows {
+		if row.Error != "" {
+			failed++
+		}
+	}
+
+	if c.format == formatJSON {
+		if err := c.writeJSON(rows); err != nil {
+			return err
+		}
+	} else {
+		table := tabwriter.NewWriter(c.out, 0, 0, 2, ' ', 0)
+		fmt.Fprintln(table, "NAME\tINFO HASH\tSEEDERS\tLEECHERS\tCOMPLETED")
+		for _, row := range rows {
+			if row.Error != "" {
+				fmt.Fprintf(c.errOut, "%s: %s\n", row.Torrent, row.Error)
+				fmt.Fprintf(table, "%s\t%s\t-\t-\t-\n", row.Name, row.InfoHash)
+				continue
+			}
+			fmt.Fprintf(table, "%s\t%s\t%d\t%d\t%d\n", row.Name, row.InfoHash, row.Seeders, row.Leechers, row.Completed)
+		}
+		if err := table.Flush(); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("failed to scrape %d of %d torrents", failed, len(rows))
+	}
+	return nil
+}
+
+// scrapeTrackers scrapes the info hashes at indexes with the first of the
+// tracker tiers that answers, and returns its URL.
+func (c *Client) scrapeTrackers(ctx context.Context, tiers [][]string, indexes []int, infoHashes [][20]byte) (map[[20]byte]ScrapeResult, string, error) {
+	trackers, err := NewTrackerTiers(tiers, c.network)
+	if err != nil {
+		return nil, "", err
+	}
+
+	hashes := make([][20]byte, 0, len(indexes))
+	for _, i := range indexes {
+		hashes = append(hashes, infoHashes[i])
+	}
+	results, trackerURL, err := trackers.scrape(ctx, hashes...)
+	if err != nil {
+		return nil, "", err
+	}
+
+	byHash := make(map[[20]byte]ScrapeResult, len(results))
+	for _, result := range results {
+		byHash[result.InfoHash] = result
+	}
+	return byHash, trackerURL, nil
+}
+
+// defaultDHTNodesFile is where the DHT node table is kept between runs.
+func defaultDHTNodesFile() string {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return ""
+	}
+	return filepath.Join(dir, "mybittorrent", "dht-nodes")
+}
+
+type dhtPeersOutput struct {
+	InfoHash string       `json:"info_hash"`
+	Nodes    int          `json:"nodes"`
+	Peers    []peerOutput `json:"peers"`
+}
+
+// dhtPeersCommand finds the peers of an info hash through the DHT alone.
+func dhtPeersCommand(ctx context.Context, c *Client, args []string) error {
+	flags := newFlagSet("dht_peers")
+	listen := flags.String("listen", ":0", "UDP address for the DHT node")
+	nodesFile := flags.String("nodes", defaultDHTNodesFile(), "file the node table is loaded from and saved to, empty to disable")
+	bootstrap := flags.String("bootstrap", strings.Join(dht.DefaultBootstrapNodes, ","), "comma separated host:port of nodes to join through")
+	timeout := flags.Duration("timeout", 30*time.Second, "time limit for the lookup")
+	if err := flags.Parse(args); err != nil || flags.NArg() < 1 {
+		return fmt.Errorf("usage: dht_peers [--listen=<addr>] [--nodes=<file>] [--bootstrap=<host:port,...>] [--timeout=<duration>] <info hash>")
+	}
+	decoded, err := hex.DecodeString(flags.Arg(0))
+	if err != nil || len(decoded) != 20 {
+		return fmt.Errorf("invalid info hash %q: want 40 hex digits", flags.Arg(0))
+	}
+	var infoHash [20]byte
+	copy(infoHash[:], decoded)
+
+	id := dht.RandomID()
+	var known []dht.NodeInfo
+	if *nodesFile != "" {
+		if id, known, err = dht.Load(*nodesFile); err != nil {
+			fmt.Fprintf(c.errOut, "Warning: %s\n", err)
+			id = dht.RandomID()
+		}
+	}
+	node, err := dht.Listen(*listen, id)
+	if err != nil {
+		return err
+	}
+	defer node.Close()
+
+	ctx, cancel := context.WithTimeout(ctx, *timeout)
+	defer cancel()
+
+	var addresses []string
+	for _, info := range known {
+		addresses = append(addresses, info.Addr.String())
+	}
+	if *bootstrap != "" {
+		addresses = append(addresses, strings.Split(*bootstrap, ",")...)
+	}
+	if err := node.Bootstrap(ctx, addresses...); err != nil {
+		return fmt.Errorf("failed to join the DHT: %w", err)
+	}
+
+	peers, err := (&DHTSource{Node: node}).FindPeers(ctx, infoHash)
+	if *nodesFile != "" {
+		if err := node.Save(*nodesFile); err != nil {
+			fmt.Fprintf(c.errOut, "Warning: %s\n", err)
+		}
+	}
+	if err != nil {
+		return fmt.Errorf("failed to discover peers: %w", err)
+	}
+
+	if c.format == formatJSON {
+		output := dhtPeersOutput{InfoHash: hex.EncodeToString(infoHash[:]), Nodes: node.Table().Len(), Peers: make([]peerOutput, 0, len(peers))}
+		for _, peer := range peers {
+			output.Peers = append(output.Peers, peerOutput{IP: peer.Addr.Addr().String(), Port: int(peer.Addr.Port())})
+		}
+		return c.writeJSON(output)
+	}
+
+	fmt.Fprintf(c.errOut, "DHT nodes: %d\n", node.Table().Len())
+	lines := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		lines = append(lines, peer.String())
+	}
+	fmt.Fprintf(c.out, "%s", strings.Join(lines, "\n"))
 	return nil
 }
 
+type downloadPieceOutput struct {
+	Piece  int    `json:"piece"`
+	Length int    `json:"length"`
+	Path   string `json:"path"`
+}
+
+// downloadPieceCommand downloads a single piece, verifies it and writes it
+// to a file.
+func downloadPieceCommand(ctx context.Context, c *Client, args []string) error {
+	flags := newFlagSet("download_piece")
+	output := flags.String("o", "", "file to write the piece to")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 || *output == "" {
+		return fmt.Errorf("usage: download_piece -o <output file> <torrent file> <piece index>")
+	}
+	torrent, err := c.openTorrent(ctx, flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to create torrent: %w", err)
+	}
+	index, err := strconv.Atoi(flags.Arg(1))
+	if err != nil || index < 0 || index >= torrent.Info.NumPieces() {
+		return fmt.Errorf("invalid piece index %q: the torrent has %d pieces", flags.Arg(1), torrent.Info.NumPieces())
+	}
+	infoHash, err := torrent.InfoHash()
+	if err != nil {
+		return err
+	}
+
+	sources, release := c.peerSources(torrent, &TrackerSource{Torrent: torrent})
+	defer release()
+	peers, err := sources.FindPeers(ctx, infoHash)
+	if err != nil {
+		return fmt.Errorf("failed to discover peers: %w", err)
+	}
+
+	data, err := torrent.DownloadPiece(ctx, peers, index, func(peer Peer, err error) {
+		fmt.Fprintf(c.errOut, "Peer %s: %s\n", peer, err)
+	})
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(*output, data, 0o644); err != nil {
+		return fmt.Errorf("failed to write piece: %w", err)
+	}
+
+	if c.format == formatJSON {
+		return c.writeJSON(downloadPieceOutput{Piece: index, Length: len(data), Path: *output})
+	}
+	fmt.Fprintf(c.out, "Piece %d downloaded to %s.\n", index, *output)
+	return nil
+}
+
+type downloadOutput struct {
+	Path   string `json:"path"`
+	Length int    `json:"length"`
+	Pieces int    `json:"pieces"`
+	// Redundant counts the bytes received but not needed, mostly duplicates
+	// in endgame mode.
+	Redundant int64 `json:"redundant"`
+}
+
+// downloadCommand downloads a whole torrent. A single file torrent is
+// written to the output path, the files of a multi-file torrent go under
+// it.
+func downloadCommand(ctx context.Context, c *Client, args []string) error {
+	flags := newFlagSet("download")
+	output := flags.String("o", "", "output file, or directory for multi-file torrents")
+	maxPeers := flags.Int("max-peers", defaultMaxPeers, "number of peers to download from at once")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 1 || *output == "" || *maxPeers < 1 {
+		return fmt.Errorf("usage: download -o <output path> [--max-peers=<n>] <torrent file>")
+	}
+	torrent, err := c.openTorrent(ctx, flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to create torrent: %w", err)
+	}
+	infoHash, err := torrent.InfoHash()
+	if err != nil {
+		return err
+	}
+	layout, err := NewLayout(torrent.Info)
+	if err != nil {
+		return err
+	}
+
+	resolver, err := storage.NewResolver(placeLayout(torrent, layout, *output))
+	if err != nil {
+		return err
+	}
+	store, err := OpenStorage(layout, resolver)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+	for _, path := range store.Paths {
+		for _, remap := range path.Remaps {
+			fmt.Fprintf(c.errOut, "Warning: renamed %s\n", remap)
+		}
+	}
+
+	counters := NewTransferCounters(int64(layout.TotalLength))
+	download, err := NewDownload(torrent, store)
+	if err != nil {
+		return err
+	}
+
+	// the announcer runs for the whole session, its started announce finding
+	// the trackers' peers
+	var trackers PeerSource = &TrackerSource{Torrent: torrent}
+	announcer, err := NewAnnouncer(torrent, counters)
+	if err == nil {
+		source := NewAnnouncerSource(announcer)
+		source.OnError = func(err error) {
+			fmt.Fprintf(c.errOut, "Warning: announce failed: %s\n", err)
+		}
+		trackers = source
+	}
+	sources, release := c.peerSources(torrent, trackers)
+	defer release()
+	// the sources that keep looking pass the peers they find later to the
+	// download, until it ends
+	watchCtx, stopWatching := context.WithCancel(ctx)
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		sources.WatchPeers(watchCtx, infoHash, download.AddPeers)
+	}()
+	defer func() {
+		stopWatching()
+		<-watching
+	}()
+	peers, err := sources.FindPeers(ctx, infoHash)
+	if err != nil {
+		return fmt.Errorf("failed to discover peers: %w", err)
+	}
+
+	download.Counters = counters
+	download.MaxPeers = *maxPeers
+	if torrent.PEXEnabled() {
+		download.PEX = NewPEXSource(torrent)
+	}
+	download.OnPeerError = func(peer Peer, err error) {
+		fmt.Fprintf(c.errOut, "Peer %s: %s\n", peer, err)
+	}
+	download.OnProgress = func(progress Progress) {
+		fmt.Fprintf(c.errOut, "Piece %d downloaded from %s (%d/%d)\n", progress.Piece, progress.Peer, progress.Done, progress.Total)
+		if progress.Done == progress.Total && announcer != nil {
+			announcer.NotifyCompleted()
+		}
+	}
+
+	if err := download.Run(ctx, peers); err != nil {
+		return fmt.Errorf("download failed: %w", err)
+	}
+
+	if c.format == formatJSON {
+		return c.writeJSON(downloadOutput{
+			Path:      *output,
+			Length:    layout.TotalLength,
+			Pieces:    layout.NumPieces(),
+			Redundant: counters.Redundant(),
+		})
+	}
+	if redundant := counters.Redundant(); redundant > 0 {
+		fmt.Fprintf(c.errOut, "Redundant data: %d bytes\n", redundant)
+	}
+	fmt.Fprintf(c.out, "Downloaded %s to %s.\n", flags.Arg(0), *output)
+	return nil
+}
+
+// placeLayout makes the files of layout relative to the root it returns,
+// for a torrent stored at path: a single file torrent is the file at path,
+// the files of a multi-file torrent go under it.
+func placeLayout(torrent *Torrent, layout *Layout, path string) string {
+	if len(torrent.Info.Files) == 0 {
+		layout.Files[0].Path = []string{filepath.Base(path)}
+		return filepath.Dir(path)
+	}
+	return path
+}
+
+type seedOutput struct {
+	Path     string `json:"path"`
+	Listen   string `json:"listen"`
+	Pieces   int    `json:"pieces"`
+	Verified int    `json:"verified"`
+}
+
+// seedCommand verifies the data of a torrent stored at a path, as download
+// writes it, then serves the pieces that match to peers and announces them
+// to the trackers until interrupted.
+func seedCommand(ctx context.Context, c *Client, args []string) error {
+	flags := newFlagSet("seed")
+	listen := flags.String("listen", "", "address to accept peers on, --port on every interface by default")
+	if err := flags.Parse(args); err != nil || flags.NArg() != 2 {
+		return fmt.Errorf("usage: seed [--listen=<address>] <torrent file> <path>")
+	}
+	torrent, err := c.openTorrent(ctx, flags.Arg(0))
+	if err != nil {
+		return fmt.Errorf("failed to create torrent: %w", err)
+	}
+	layout, err := NewLayout(torrent.Info)
+	if err != nil {
+		return err
+	}
+	path := flags.Arg(1)
+	resolver, err := storage.NewResolver(placeLayout(torrent, layout, path))
+	if err != nil {
+		return err
+	}
+	store, err := OpenExistingStorage(layout, resolver)
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	have, err := torrent.Verify(store)
+	if err != nil {
+		return err
+	}
+	verified, missing := 0, 0
+	for i := 0; i < layout.NumPieces(); i++ {
+		if have.Has(i) {
+			verified++
+		} else {
+			missing += layout.PieceLength(i)
+		}
+	}
+	if verified == 0 && layout.NumPieces() > 0 {
+		return fmt.Errorf("no verified data for %s at %s", flags.Arg(0), path)
+	}
+	if verified < layout.NumPieces() {
+		fmt.Fprintf(c.errOut, "Warning: %d of %d pieces missing or corrupt, seeding the others\n", layout.NumPieces()-verified, layout.NumPieces())
+	}
+
+	if *listen == "" {
+		*listen = fmt.Sprintf(":%d", c.port)
+	}
+	listener, err := net.Listen("tcp", *listen)
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	defer listener.Close()
+
+	counters := NewTransferCounters(int64(missing))
+	seeder := NewSeeder(c.peerID)
+	seeder.Network = c.network
+	seeder.OnPeerError = func(addr net.Addr, err error) {
+		fmt.Fprintf(c.errOut, "Peer %s: %s\n", addr, err)
+	}
+	if err := seeder.Add(torrent, store, have, counters); err != nil {
+		return err
+	}
+
+	if c.format == formatJSON {
+		err = c.writeJSON(seedOutput{Path: path, Listen: listener.Addr().String(), Pieces: layout.NumPieces(), Verified: verified})
+	} else {
+		_, err = fmt.Fprintf(c.out, "Seeding %d of %d pieces of %s from %s on %s.\n", verified, layout.NumPieces(), flags.Arg(0), path, listener.Addr())
+	}
+	if err != nil {
+		return err
+	}
+
+	// the announces stop with the seeder, peers must reach the port we
+	// listen on
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	port := listener.Addr().(*net.TCPAddr).Port
+	var announcing sync.WaitGroup
+	if announcer, err := NewAnnouncer(torrent, counters); err == nil {
+		announcer.Port = port
+		announcing.Add(1)
+		go func() {
+			defer announcing.Done()
+			announcer.Run(ctx, func(event AnnounceEvent, _ *TrackerResponse, err error) {
+				if err != nil {
+					fmt.Fprintf(c.errOut, "Warning: announce failed: %s\n", err)
+				}
+			})
+		}()
+	}
+	// peers on the local network may find us too, or some other way
+	source, release := c.lsdSource(torrent, port, true)
+	defer release()
+	if source != nil {
+		infoHash, err := torrent.InfoHash()
+		if err != nil {
+			return err
+		}
+		announcing.Add(1)
+		go func() {
+			defer announcing.Done()
+			// the peers are for downloads, a seeder waits for them to connect
+			source.WatchPeers(ctx, infoHash, func([]Peer) {})
+		}()
+	}
+	err = seeder.Serve(ctx, listener)
+	cancel()
+	announcing.Wait()
+	return err
+}
+
+type trackerServerOutput struct {
+	HTTP string `json:"http,omitempty"`
+	UDP  string `json:"udp,omitempty"`
+}
+
+// trackerCommand runs an in-memory tracker for local swarms until
+// interrupted.
+func trackerCommand(ctx context.Context, c *Client, args []string) error {
+	server := tracker.NewServer()
+	flags := newFlagSet("tracker")
+	httpAddr := flags.String("http", ":6969", "address for HTTP announces, empty to disable")
+	udpAddr := flags.String("udp", "", "address for UDP announces, empty to disable")
+	flags.DurationVar(&server.Interval, "interval", server.Interval, "announce interval sent to clients")
+	flags.Float64Var(&server.FailureRate, "failure-rate", 0, "fraction of requests answered with a failure")
+	if err := flags.Parse(args); err != nil {
+		return fmt.Errorf("usage: tracker [--http=<addr>] [--udp=<addr>] [--interval=<duration>] [--failure-rate=<fraction>]: %w", err)
+	}
+	if *httpAddr == "" && *udpAddr == "" {
+		return fmt.Errorf("tracker needs --http or --udp")
+	}
+
+	var output trackerServerOutput
+	errs := make(chan error, 2)
+	if *httpAddr != "" {
+		listener, err := net.Listen("tcp", *httpAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+		httpServer := &http.Server{Handler: server}
+		defer httpServer.Close()
+		go func() { errs <- httpServer.Serve(listener) }()
+		output.HTTP = "http://" + listener.Addr().String() + "/announce"
+	}
+	if *udpAddr != "" {
+		conn, err := net.ListenPacket("udp", *udpAddr)
+		if err != nil {
+			return fmt.Errorf("failed to listen: %w", err)
+		}
+		defer conn.Close()
+		go func() { errs <- server.ServeUDP(conn) }()
+		output.UDP = "udp://" + conn.LocalAddr().String() + "/announce"
+	}
+
+	if c.format == formatJSON {
+		if err := c.writeJSON(output); err != nil {
+			return err
+		}
+	} else {
+		if output.HTTP != "" {
+			fmt.Fprintf(c.out, "HTTP tracker: %s\n", output.HTTP)
+		}
+		if output.UDP != "" {
+			fmt.Fprintf(c.out, "UDP tracker: %s\n", output.UDP)
+		}
+	}
+
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
+
 func main() {
 	client := NewClient(nil)
 	if err := client.Run(os.Args[1:]); err != nil {
@@ -2,8 +2,21 @@ package main
 
 import (
 	"bytes"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
 
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/dht"
+
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -105,3 +118,490 @@ func TestRunUnknownCommand(t *testing.T) {
 	assert.Error(t, err)
 	assert.Contains(t, err.Error(), "unknown command")
 }
+
+func writeTorrent(t testing.TB, data map[string]interface{}) string {
+	t.Helper()
+	encoded, err := bencode.Marshal(data)
+	require.NoError(t, err)
+	fileName := filepath.Join(t.TempDir(), "test.torrent")
+	require.NoError(t, os.WriteFile(fileName, []byte(encoded), 0o644))
+	return fileName
+}
+
+func TestRunLint(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	err := NewClient(buffer).Run([]string{"lint", "../../sample.torrent"})
+
+	require.NoError(t, err)
+	assert.Equal(t, "OK\n", buffer.String())
+}
+
+func TestRunLintInvalid(t *testing.T) {
+	fileName := writeTorrent(t, map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "dir",
+			"piece length": 1000,
+			"pieces":       strings.Repeat("x", 21),
+			"files": []interface{}{
+				map[string]interface{}{"length": 1, "path": []interface{}{"..", "escape"}},
+			},
+		},
+	})
+
+	buffer := &bytes.Buffer{}
+	err := NewClient(buffer).Run([]string{"lint", fileName})
+
+	assert.Error(t, err)
+	assert.Equal(t, `warning: announce: no trackers; peers can only be found through DHT or peer exchange
+warning: info.piece length: 1000 is not a power of two
+error: info.pieces: length 21 is not a multiple of 20
+error: info.files[0].path[0]: path traversal: ".."
+`, buffer.String())
+}
+
+func TestRunLintJSON(t *testing.T) {
+	fileName := writeTorrent(t, map[string]interface{}{
+		"info": map[string]interface{}{
+			"name":         "a.txt",
+			"length":       10,
+			"piece length": 16384,
+			"pieces":       strings.Repeat("x", 20),
+		},
+	})
+
+	buffer := &bytes.Buffer{}
+	err := NewClient(buffer).Run([]string{"lint", "--json", fileName})
+
+	require.NoError(t, err)
+	var report struct {
+		Valid    bool `json:"valid"`
+		Findings []struct {
+			Severity string `json:"severity"`
+			Field    string `json:"field"`
+		} `json:"findings"`
+	}
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &report))
+	assert.True(t, report.Valid)
+	require.Len(t, report.Findings, 1)
+	assert.Equal(t, "warning", report.Findings[0].Severity)
+	assert.Equal(t, "announce", report.Findings[0].Field)
+}
+
+func TestRunInfoMultiFile(t *testing.T) {
+	fileName := writeTorrent(t, map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]interface{}{
+			"name":         "dir",
+			"piece length": 16384,
+			"pieces":       strings.Repeat("x", 40),
+			"private":      1,
+			"source":       "example",
+			"files": []interface{}{
+				map[string]interface{}{"length": 20000, "path": []interface{}{"a.txt"}},
+				map[string]interface{}{"length": 100, "path": []interface{}{"sub", "b.txt"}},
+			},
+		},
+	})
+
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	assert.Equal(t, 20100, torrent.Info.TotalLength())
+	assert.Equal(t, []File{{20000, []string{"a.txt"}}, {100, []string{"sub", "b.txt"}}}, torrent.Info.Files)
+	assert.True(t, torrent.Info.Private)
+
+	// keys that aren't modelled, like source, are part of the info hash
+	infoHash, err := torrent.InfoHash()
+	require.NoError(t, err)
+	torrent.rawInfo = nil
+	withoutSource, err := torrent.InfoHash()
+	require.NoError(t, err)
+	assert.NotEqual(t, infoHash, withoutSource)
+}
+
+const sampleInfoOutput = `Tracker URL: http://bittorrent-test-tracker.codecrafters.io/announce
+Length: 92063
+Info Hash: d69f91e6b2ae4c542468d1073a71d4ea13879a7f
+Piece Length: 32768
+Piece Hashes:
+e876f67a2a8886e8f36b136726c30fa29703022d
+6e2275e604a0766656736e81ff10b55204ad8d35
+f00d937a0213df1982bc8d097227ad9e909acc17
+`
+
+func TestRunInfoFromStdin(t *testing.T) {
+	rawData, err := os.ReadFile("../../sample.torrent")
+	require.NoError(t, err)
+
+	buffer := &bytes.Buffer{}
+	client := NewClient(buffer)
+	client.in = bytes.NewReader(rawData)
+	err = client.Run([]string{"info", "-"})
+
+	require.NoError(t, err)
+	assert.Equal(t, sampleInfoOutput, buffer.String())
+}
+
+func TestRunInfoFromURL(t *testing.T) {
+	server := httptest.NewServer(http.FileServer(http.Dir("../..")))
+	defer server.Close()
+
+	buffer := &bytes.Buffer{}
+	err := NewClient(buffer).Run([]string{"info", server.URL + "/sample.torrent"})
+
+	require.NoError(t, err)
+	assert.Equal(t, sampleInfoOutput, buffer.String())
+
+	err = NewClient(buffer).Run([]string{"info", server.URL + "/missing.torrent"})
+	assert.ErrorContains(t, err, "404")
+}
+
+func TestParseTorrent(t *testing.T) {
+	file, err := os.Open("../../sample.torrent")
+	require.NoError(t, err)
+	defer file.Close()
+
+	torrent, err := ParseTorrent(file)
+	require.NoError(t, err)
+	assert.Equal(t, "sample.txt", torrent.Info.Name)
+
+	_, err = ParseTorrentBytes(nil)
+	assert.Error(t, err)
+	_, err = ParseTorrentBytes([]byte("i42e"))
+	assert.Error(t, err)
+	_, err = ParseTorrentBytes([]byte("d4:infod4:name1:aee"))
+	assert.Error(t, err)
+}
+
+func TestRunInfoJSON(t *testing.T) {
+	buffer := &bytes.Buffer{}
+	err := NewClient(buffer).Run([]string{"--format=json", "info", "../../sample.torrent"})
+
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"tracker_url": "http://bittorrent-test-tracker.codecrafters.io/announce",
+		"name": "sample.txt",
+		"length": 92063,
+		"info_hash": "d69f91e6b2ae4c542468d1073a71d4ea13879a7f",
+		"piece_length": 32768,
+		"piece_hashes": [
+			"e876f67a2a8886e8f36b136726c30fa29703022d",
+			"6e2275e604a0766656736e81ff10b55204ad8d35",
+			"f00d937a0213df1982bc8d097227ad9e909acc17"
+		],
+		"files": [{"path": ["sample.txt"], "length": 92063}]
+	}`, buffer.String())
+}
+
+func TestRunInvalidFormat(t *testing.T) {
+	err := NewClient(&bytes.Buffer{}).Run([]string{"--format=xml", "info", "../../sample.torrent"})
+
+	assert.ErrorContains(t, err, "unknown output format")
+}
+
+// startFakePeer accepts a single connection and answers its handshake with
+// the given reserved bytes and peer id.
+func startFakePeer(t *testing.T, reserved [8]byte, peerID [20]byte) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+
+		request := make([]byte, 68)
+		if _, err := io.ReadFull(conn, request); err != nil {
+			return
+		}
+		response := append([]byte{}, request[:20]...)
+		response = append(response, reserved[:]...)
+		response = append(response, request[28:48]...)
+		response = append(response, peerID[:]...)
+		conn.Write(response)
+	}()
+
+	return listener.Addr().String()
+}
+
+func TestRunHandshakeWithPeer(t *testing.T) {
+	peerID := [20]byte{}
+	copy(peerID[:], "-XX0001-abcdefghijkl")
+	reserved := [8]byte{0, 0, 0, 0, 0, 0x10, 0, 0x05}
+
+	buffer := &bytes.Buffer{}
+	err := NewClient(buffer).Run([]string{"handshake", "../../sample.torrent", startFakePeer(t, reserved, peerID)})
+
+	require.NoError(t, err)
+	assert.Equal(t, "Peer ID: 2d5858303030312d6162636465666768696a6b6c\n", buffer.String())
+
+	buffer.Reset()
+	err = NewClient(buffer).Run([]string{"--format", "json", "handshake", "../../sample.torrent", startFakePeer(t, reserved, peerID)})
+
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"peer_id": "2d5858303030312d6162636465666768696a6b6c",
+		"client": {"name": "unknown (XX)", "version": "0.0.0.1"},
+		"reserved": "0000000000100005",
+		"extensions": {"extension_protocol": true, "dht": true, "fast": true}
+	}`, buffer.String())
+}
+
+// writeSampleTorrent writes a copy of sample.torrent announcing to trackerURL.
+func writeSampleTorrent(t *testing.T, trackerURL string) string {
+	t.Helper()
+	rawData, err := os.ReadFile("../../sample.torrent")
+	require.NoError(t, err)
+	data, err := decodeTorrent(rawData)
+	require.NoError(t, err)
+	data["announce"] = trackerURL
+	return writeTorrent(t, data)
+}
+
+func TestRunPeersWithTracker(t *testing.T) {
+	tracker := newFakeTracker(t, "d8:completei1e10:incompletei2e8:intervali60e"+
+		"5:peers12:\x7f\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe215:warning message4:hey!e")
+	fileName := writeSampleTorrent(t, tracker.server.URL)
+
+	buffer, errBuffer := &bytes.Buffer{}, &bytes.Buffer{}
+	client := NewClient(buffer)
+	client.errOut = errBuffer
+	err := client.Run([]string{"peers", fileName})
+
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:6881\n10.0.0.2:6882", buffer.String())
+	assert.Equal(t, "Warning: hey!\nSeeders: 1, Leechers: 2\n"+
+		"Tracker "+tracker.server.URL+" (tier 0): 2 peers, next announce in 1m0s\n", errBuffer.String())
+
+	buffer.Reset()
+	err = NewClient(buffer).Run([]string{"--format=json", "peers", fileName})
+
+	require.NoError(t, err)
+	var output map[string]interface{}
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &output))
+	trackers := output["trackers"].([]interface{})
+	delete(output, "trackers")
+	require.Len(t, trackers, 1)
+	assert.Equal(t, tracker.server.URL, trackers[0].(map[string]interface{})["url"])
+	assert.Equal(t, 2.0, trackers[0].(map[string]interface{})["peers"])
+	assert.NotEmpty(t, trackers[0].(map[string]interface{})["next_announce"])
+
+	rest, err := json.Marshal(output)
+	require.NoError(t, err)
+	assert.JSONEq(t, `{
+		"interval": 60,
+		"seeders": 1,
+		"leechers": 2,
+		"warning_message": "hey!",
+		"peers": [{"ip": "127.0.0.1", "port": 6881}, {"ip": "10.0.0.2", "port": 6882}]
+	}`, string(rest))
+}
+
+func TestRunPeersTrackerFailure(t *testing.T) {
+	tracker := newFakeTracker(t, "d14:failure reason17:torrent not founde")
+	fileName := writeSampleTorrent(t, tracker.server.URL)
+
+	err := NewClient(&bytes.Buffer{}).Run([]string{"peers", fileName})
+
+	var trackerErr *TrackerError
+	require.ErrorAs(t, err, &trackerErr)
+	assert.Equal(t, "torrent not found", trackerErr.Reason)
+}
+
+func TestRunScrape(t *testing.T) {
+	server := newScrapeTracker(t)
+	first := writeSampleTorrent(t, server.URL+"/announce")
+
+	rawData, err := os.ReadFile(first)
+	require.NoError(t, err)
+	data, err := decodeTorrent(rawData)
+	require.NoError(t, err)
+	data["info"].(map[string]interface{})["name"] = "other.txt"
+	second := writeTorrent(t, data)
+
+	buffer := &bytes.Buffer{}
+	err = NewClient(buffer).Run([]string{"scrape", first, second})
+
+	require.NoError(t, err)
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	require.Len(t, lines, 3)
+	assert.Equal(t, []string{"NAME", "INFO", "HASH", "SEEDERS", "LEECHERS", "COMPLETED"}, strings.Fields(lines[0]))
+	// the first byte of the sample info hash is 0xd6
+	assert.Equal(t, []string{"sample.txt", "d69f91e6b2ae4c542468d1073a71d4ea13879a7f", "214", "215", "2140"}, strings.Fields(lines[1]))
+	assert.Equal(t, "other.txt", strings.Fields(lines[2])[0])
+
+	buffer.Reset()
+	err = NewClient(buffer).Run([]string{"--format=json", "scrape", first})
+
+	require.NoError(t, err)
+	assert.JSONEq(t, `[{
+		"torrent": "`+first+`",
+		"name": "sample.txt",
+		"info_hash": "d69f91e6b2ae4c542468d1073a71d4ea13879a7f",
+		"tracker": "`+server.URL+`/announce",
+		"seeders": 214,
+		"leechers": 215,
+		"completed": 2140
+	}]`, buffer.String())
+}
+
+func TestRunScrapeAnnounceList(t *testing.T) {
+	server := newScrapeTracker(t)
+	rawData, err := os.ReadFile("../../sample.torrent")
+	require.NoError(t, err)
+	data, err := decodeTorrent(rawData)
+	require.NoError(t, err)
+	// the announce URL is ignored when there is an announce-list
+	data["announce"] = server.URL + "/tracker"
+	data["announce-list"] = []interface{}{
+		[]interface{}{server.URL + "/tracker"},
+		[]interface{}{server.URL + "/announce"},
+	}
+	fileName := writeTorrent(t, data)
+
+	buffer := &bytes.Buffer{}
+	err = NewClient(buffer).Run([]string{"--format=json", "scrape", fileName})
+
+	require.NoError(t, err)
+	var rows []scrapeOutput
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &rows))
+	require.Len(t, rows, 1)
+	assert.Equal(t, server.URL+"/announce", rows[0].Tracker)
+	assert.Equal(t, 214, rows[0].Seeders)
+}
+
+func TestRunScrapeErrors(t *testing.T) {
+	server := newScrapeTracker(t)
+	good := writeSampleTorrent(t, server.URL+"/announce")
+	unsupported := writeSampleTorrent(t, server.URL+"/tracker")
+
+	buffer, errBuffer := &bytes.Buffer{}, &bytes.Buffer{}
+	client := NewClient(buffer)
+	client.errOut = errBuffer
+	err := client.Run([]string{"scrape", good, unsupported, "missing.torrent"})
+
+	assert.ErrorContains(t, err, "failed to scrape 2 of 3 torrents")
+	assert.Len(t, strings.Split(strings.TrimSpace(buffer.String()), "\n"), 4)
+	assert.Contains(t, errBuffer.String(), "does not support scrape")
+	assert.Contains(t, errBuffer.String(), "failed to read file")
+}
+
+func TestRunPeerIdentity(t *testing.T) {
+	tracker := newFakeTracker(t, trackerResponseWithID)
+	fileName := writeSampleTorrent(t, tracker.server.URL)
+
+	client := NewClient(&bytes.Buffer{})
+	client.errOut = &bytes.Buffer{}
+	require.NoError(t, client.Run([]string{"peers", fileName}))
+	other := NewClient(&bytes.Buffer{})
+	other.errOut = &bytes.Buffer{}
+	require.NoError(t, other.Run([]string{"--peer-id=-XX0001-", "--port=51413", "peers", fileName}))
+
+	announces := tracker.announces()
+	assert.True(t, strings.HasPrefix(announces[0].Get("peer_id"), "-GO0001-"))
+	assert.Len(t, announces[0].Get("peer_id"), 20)
+	assert.Equal(t, "6881", announces[0].Get("port"))
+	assert.True(t, strings.HasPrefix(announces[1].Get("peer_id"), "-XX0001-"))
+	assert.Equal(t, "51413", announces[1].Get("port"))
+
+	assert.Error(t, NewClient(&bytes.Buffer{}).Run([]string{"--port=70000", "peers", fileName}))
+	assert.Error(t, NewClient(&bytes.Buffer{}).Run([]string{"--peer-id=" + strings.Repeat("x", 21), "peers", fileName}))
+}
+
+func TestRunPeerIDFromEnv(t *testing.T) {
+	tracker := newFakeTracker(t, trackerResponseWithID)
+	fileName := writeSampleTorrent(t, tracker.server.URL)
+
+	t.Setenv(peerIDEnv, "-YY0001-")
+	client := NewClient(&bytes.Buffer{})
+	client.errOut = &bytes.Buffer{}
+	require.NoError(t, client.Run([]string{"peers", fileName}))
+	other := NewClient(&bytes.Buffer{})
+	other.errOut = &bytes.Buffer{}
+	require.NoError(t, other.Run([]string{"--peer-id=-XX0001-", "peers", fileName}))
+
+	announces := tracker.announces()
+	assert.True(t, strings.HasPrefix(announces[0].Get("peer_id"), "-YY0001-"))
+	assert.True(t, strings.HasPrefix(announces[1].Get("peer_id"), "-XX0001-"))
+
+	t.Setenv(peerIDEnv, strings.Repeat("x", 21))
+	assert.ErrorContains(t, NewClient(&bytes.Buffer{}).Run([]string{"peers", fileName}), peerIDEnv)
+}
+
+func TestRunTracker(t *testing.T) {
+	reader, writer := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		done <- NewClient(writer).RunContext(ctx, []string{"--format=json", "tracker", "--http=127.0.0.1:0", "--udp=127.0.0.1:0"})
+	}()
+
+	var urls trackerServerOutput
+	require.NoError(t, json.NewDecoder(reader).Decode(&urls))
+	assert.True(t, strings.HasPrefix(urls.HTTP, "http://127.0.0.1:"), urls.HTTP)
+	assert.True(t, strings.HasPrefix(urls.UDP, "udp://127.0.0.1:"), urls.UDP)
+
+	for _, announceURL := range []string{urls.HTTP, urls.UDP} {
+		torrentPath := writeSampleTorrent(t, announceURL)
+		err := NewClient(&bytes.Buffer{}).Run([]string{"--port=7001", "peers", torrentPath})
+		require.NoError(t, err)
+
+		buffer := &bytes.Buffer{}
+		err = NewClient(buffer).Run([]string{"--port=7002", "peers", torrentPath})
+		require.NoError(t, err)
+		assert.Contains(t, buffer.String(), "127.0.0.1:7001")
+	}
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestRunTrackerInvalid(t *testing.T) {
+	err := NewClient(&bytes.Buffer{}).Run([]string{"tracker", "--http="})
+	assert.ErrorContains(t, err, "needs --http or --udp")
+
+	err = NewClient(&bytes.Buffer{}).Run([]string{"tracker", "--interval=soon"})
+	assert.ErrorContains(t, err, "usage: tracker")
+}
+
+func TestRunDHTPeers(t *testing.T) {
+	nodes := startDHT(t, 6)
+	infoHash := dht.RandomID()
+	_, err := nodes[2].Announce(context.Background(), infoHash, 7003)
+	require.NoError(t, err)
+
+	nodesFile := filepath.Join(t.TempDir(), "dht-nodes")
+	buffer := &bytes.Buffer{}
+	err = NewClient(buffer).Run([]string{"dht_peers", "--listen=127.0.0.1:0", "--nodes=" + nodesFile,
+		"--bootstrap=" + nodes[0].Addr().String(), hex.EncodeToString(infoHash[:])})
+	require.NoError(t, err)
+	assert.Equal(t, "127.0.0.1:7003", buffer.String())
+
+	// the saved table is enough to join again
+	_, known, err := dht.Load(nodesFile)
+	require.NoError(t, err)
+	assert.NotEmpty(t, known)
+
+	buffer.Reset()
+	err = NewClient(buffer).Run([]string{"--format=json", "dht_peers", "--listen=127.0.0.1:0", "--nodes=" + nodesFile,
+		"--bootstrap=", hex.EncodeToString(infoHash[:])})
+	require.NoError(t, err)
+	var output dhtPeersOutput
+	require.NoError(t, json.Unmarshal(buffer.Bytes(), &output))
+	assert.Equal(t, []peerOutput{{IP: "127.0.0.1", Port: 7003}}, output.Peers)
+	assert.Greater(t, output.Nodes, 0)
+}
+
+func TestRunDHTPeersInvalid(t *testing.T) {
+	err := NewClient(&bytes.Buffer{}).Run([]string{"dht_peers"})
+	assert.ErrorContains(t, err, "usage: dht_peers")
+
+	err = NewClient(&bytes.Buffer{}).Run([]string{"dht_peers", "abcd"})
+	assert.ErrorContains(t, err, "invalid info hash")
+
+	err = NewClient(&bytes.Buffer{}).Run([]string{"dht_peers", "--nodes=", "--bootstrap=", "--listen=127.0.0.1:0", strings.Repeat("ab", 20)})
+	assert.ErrorContains(t, err, "failed to join the DHT")
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/proxy"
+)
+
+// Network holds the timeouts and proxies used for every connection to peers
+// and trackers. A zero timeout means no limit.
+type Network struct {
+	DialTimeout time.Duration
+	// ReadTimeout and WriteTimeout bound every single read or write on a
+	// peer connection.
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// TrackerTimeout bounds a whole tracker request.
+	TrackerTimeout time.Duration
+	// TrackerDialer and PeerDialer route tracker and peer connections,
+	// usually through a proxy. nil means connecting directly.
+	TrackerDialer proxy.Dialer
+	PeerDialer    proxy.Dialer
+
+	// transport is shared by the HTTP clients, so they share idle
+	// connections. It is built on first use, the dialers must be set by
+	// then.
+	transportOnce sync.Once
+	transport     *http.Transport
+}
+
+// DefaultNetwork is used when no network is configured.
+var DefaultNetwork = defaultNetwork()
+
+// defaultNetwork returns a network with the default timeouts.
+func defaultNetwork() *Network {
+	return &Network{
+		DialTimeout:    10 * time.Second,
+		ReadTimeout:    2 * time.Minute,
+		WriteTimeout:   30 * time.Second,
+		TrackerTimeout: 30 * time.Second,
+	}
+}
+
+// orDefault lets a nil *Network stand for DefaultNetwork.
+func (n *Network) orDefault() *Network {
+	if n == nil {
+		return DefaultNetwork
+	}
+	return n
+}
+
+// DialContext connects to a peer. The returned connection applies the read
+// and write timeouts to every operation and is closed when ctx is done.
+func (n *Network) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	n = n.orDefault()
+	conn, err := n.dial(ctx, n.PeerDialer, network, address)
+	if err != nil {
+		return nil, err
+	}
+	return n.wrap(ctx, conn), nil
+}
+
+// dial connects through dialer, or directly if it is nil, within the dial
+// timeout.
+func (n *Network) dial(ctx context.Context, dialer proxy.Dialer, network, address string) (net.Conn, error) {
+	if dialer == nil {
+		return (&net.Dialer{Timeout: n.DialTimeout}).DialContext(ctx, network, address)
+	}
+	if n.DialTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, n.DialTimeout)
+		defer cancel()
+	}
+	return dialer.DialContext(ctx, network, address)
+}
+
+// wrap applies the network's deadlines and ctx to an established connection.
+func (n *Network) wrap(ctx context.Context, conn net.Conn) net.Conn {
+	n = n.orDefault()
+	wrapped := &deadlineConn{Conn: conn, ctx: ctx, readTimeout: n.ReadTimeout, writeTimeout: n.WriteTimeout}
+	// closing unblocks pending reads and writes
+	wrapped.stop = context.AfterFunc(ctx, func() { conn.Close() })
+	return wrapped
+}
+
+// HTTPClient returns a client for tracker requests. With a tracker dialer
+// set, the environment's proxy settings are ignored.
+func (n *Network) HTTPClient() *http.Client {
+	n = n.orDefault()
+	n.transportOnce.Do(func() {
+		n.transport = http.DefaultTransport.(*http.Transport).Clone()
+		n.transport.DialContext = func(ctx context.Context, network, address string) (net.Conn, error) {
+			return n.dial(ctx, n.TrackerDialer, network, address)
+		}
+		if n.TrackerDialer != nil {
+			n.transport.Proxy = nil
+		}
+	})
+	return &http.Client{Transport: n.transport, Timeout: n.TrackerTimeout}
+}
+
+// trackerContext bounds a single tracker request by the tracker timeout.
+func (n *Network) trackerContext(ctx context.Context) (context.Context, context.CancelFunc) {
+	n = n.orDefault()
+	if n.TrackerTimeout <= 0 {
+		return context.WithCancel(ctx)
+	}
+	return context.WithTimeout(ctx, n.TrackerTimeout)
+}
+
+// deadlineConn sets a fresh deadline before every read and write, so a peer
+// that stops talking can't hang us forever. Once its context is done it is
+// closed and every operation returns the context's error.
+type deadlineConn struct {
+	net.Conn
+	ctx          context.Context
+	readTimeout  time.Duration
+	writeTimeout time.Duration
+	stop         func() bool
+}
+
+func (c *deadlineConn) Read(b []byte) (int, error) {
+	if c.readTimeout > 0 {
+		if err := c.Conn.SetReadDeadline(time.Now().Add(c.readTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Read(b)
+	return n, c.contextErr(err)
+}
+
+func (c *deadlineConn) Write(b []byte) (int, error) {
+	if c.writeTimeout > 0 {
+		if err := c.Conn.SetWriteDeadline(time.Now().Add(c.writeTimeout)); err != nil {
+			return 0, err
+		}
+	}
+	n, err := c.Conn.Write(b)
+	return n, c.contextErr(err)
+}
+
+func (c *deadlineConn) contextErr(err error) error {
+	if err != nil && c.ctx.Err() != nil {
+		return c.ctx.Err()
+	}
+	return err
+}
+
+func (c *deadlineConn) Close() error {
+	c.stop()
+	return c.Conn.Close()
+}
@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/proxy"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/proxy/proxytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSilentPeer accepts connections but never sends anything.
+func startSilentPeer(t *testing.T) string {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func sampleTorrent(t *testing.T, network *Network) *Torrent {
+	t.Helper()
+	torrent, err := NewTorrent("../../sample.torrent")
+	require.NoError(t, err)
+	torrent.Network = network
+	return torrent
+}
+
+func TestHandshakeReadTimeout(t *testing.T) {
+	torrent := sampleTorrent(t, &Network{ReadTimeout: 50 * time.Millisecond})
+
+	start := time.Now()
+	_, err := torrent.Handshake(context.Background(), startSilentPeer(t))
+
+	var netErr net.Error
+	require.ErrorAs(t, err, &netErr)
+	assert.True(t, netErr.Timeout())
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestHandshakeCancel(t *testing.T) {
+	torrent := sampleTorrent(t, &Network{})
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	_, err := torrent.Handshake(ctx, startSilentPeer(t))
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestDiscoverPeersTimeout(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer server.Close()
+
+	torrent := sampleTorrent(t, &Network{TrackerTimeout: 50 * time.Millisecond})
+	torrent.Announce = server.URL
+
+	start := time.Now()
+	_, err := torrent.DiscoverPeers(context.Background())
+
+	assert.Error(t, err)
+	assert.Less(t, time.Since(start), 5*time.Second)
+}
+
+func TestHTTPClientSharesTransport(t *testing.T) {
+	network := &Network{TrackerTimeout: time.Second}
+	first, second := network.HTTPClient(), network.HTTPClient()
+	assert.Same(t, first.Transport, second.Transport)
+	assert.Equal(t, time.Second, first.Timeout)
+	assert.NotSame(t, first.Transport, (&Network{}).HTTPClient().Transport)
+}
+
+func TestRunContextCancel(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	time.AfterFunc(50*time.Millisecond, cancel)
+
+	err := NewClient(&bytes.Buffer{}).RunContext(ctx, []string{"handshake", "../../sample.torrent", startSilentPeer(t)})
+
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestRunTimeoutFlags(t *testing.T) {
+	client := NewClient(&bytes.Buffer{})
+	err := client.Run([]string{"--read-timeout=50ms", "--dial-timeout", "1s", "handshake", "../../sample.torrent", startSilentPeer(t)})
+
+	assert.ErrorContains(t, err, "timeout")
+	assert.Equal(t, 50*time.Millisecond, client.network.ReadTimeout)
+	assert.Equal(t, time.Second, client.network.DialTimeout)
+	assert.Equal(t, DefaultNetwork.WriteTimeout, client.network.WriteTimeout)
+}
+
+func TestRunThroughProxy(t *testing.T) {
+	for _, tc := range []struct {
+		name   string
+		server func() *proxytest.Server
+		scheme string
+	}{
+		{"socks5", proxytest.NewSOCKS5Server, "socks5"},
+		{"http connect", proxytest.NewHTTPConnectServer, "http"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			server := tc.server()
+			defer server.Close()
+
+			tracker := newFakeTracker(t, "d8:intervali60e5:peers6:\x7f\x00\x00\x01\x1a\xe1e")
+			torrentPath := writeSampleTorrent(t, tracker.server.URL+"/announce")
+
+			buffer := &bytes.Buffer{}
+			err := NewClient(buffer).Run([]string{"--proxy", server.URL(tc.scheme), "peers", torrentPath})
+			require.NoError(t, err)
+			assert.Equal(t, "127.0.0.1:6881", buffer.String())
+
+			// peers are still dialed directly without --proxy-peers
+			peer := startFakePeer(t, [8]byte{}, [20]byte{})
+			err = NewClient(&bytes.Buffer{}).Run([]string{"--proxy", server.URL(tc.scheme), "handshake", torrentPath, peer})
+			require.NoError(t, err)
+			assert.Equal(t, []string{tracker.server.Listener.Addr().String()}, server.Targets())
+
+			peer = startFakePeer(t, [8]byte{}, [20]byte{})
+			err = NewClient(&bytes.Buffer{}).Run([]string{"--proxy", server.URL(tc.scheme), "--proxy-peers", "handshake", torrentPath, peer})
+			require.NoError(t, err)
+			assert.Equal(t, []string{tracker.server.Listener.Addr().String(), peer}, server.Targets())
+		})
+	}
+}
+
+func TestRunProxyFlags(t *testing.T) {
+	err := NewClient(&bytes.Buffer{}).Run([]string{"--proxy", "ftp://proxy", "info", "../../sample.torrent"})
+	assert.ErrorContains(t, err, "unsupported proxy scheme")
+
+	err = NewClient(&bytes.Buffer{}).Run([]string{"--proxy-peers", "info", "../../sample.torrent"})
+	assert.ErrorContains(t, err, "requires --proxy")
+}
+
+func TestUDPTrackerRefusesProxy(t *testing.T) {
+	server := proxytest.NewSOCKS5Server()
+	defer server.Close()
+	dialer, err := proxy.Parse(server.URL("socks5"))
+	require.NoError(t, err)
+
+	tracker, err := NewTrackerClient("udp://127.0.0.1:1/announce", &Network{TrackerDialer: dialer})
+	require.NoError(t, err)
+
+	_, err = tracker.Announce(context.Background(), &AnnounceRequest{})
+	assert.ErrorIs(t, err, ErrUDPProxy)
+	_, err = tracker.Scrape(context.Background(), [20]byte{})
+	assert.ErrorIs(t, err, ErrUDPProxy)
+	assert.Empty(t, server.Targets())
+}
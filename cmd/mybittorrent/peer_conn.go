@@ -0,0 +1,311 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/pex"
+)
+
+// extendedHandshakeID is the extended message id of the extension
+// handshake (BEP 10).
+const extendedHandshakeID = 0
+
+// errPieceMissing is returned when a peer doesn't have the piece asked for.
+var errPieceMissing = errors.New("peer doesn't have the piece")
+
+// PeerConn is a connection to a peer after the handshake. It keeps track of
+// the pieces the peer has and whether it chokes us.
+type PeerConn struct {
+	*peerwire.Conn
+	Addr string
+	// PeerID and Reserved are from the peer's handshake.
+	PeerID   [20]byte
+	Reserved [8]byte
+	// Bitfield holds the pieces the peer has.
+	Bitfield peerwire.Bitfield
+	// Choked is set while the peer chokes us, as it does when the
+	// connection opens.
+	Choked bool
+	// OnHave, if not nil, is called when the peer announces a new piece.
+	OnHave func(index int)
+	// PEXID is the extended message id the peer takes ut_pex messages
+	// with, 0 when it doesn't support peer exchange.
+	PEXID uint8
+	// OnPEX, if not nil, is called with the payload of the ut_pex messages
+	// the peer sends.
+	OnPEX func(payload []byte)
+
+	conn       net.Conn
+	numPieces  int
+	interested bool
+	pipeline   *requestPipeline
+}
+
+// Connect opens a connection to a peer and exchanges handshakes. The peer
+// must answer for the torrent's info hash.
+func (t *Torrent) Connect(ctx context.Context, peerAddress string) (*PeerConn, error) {
+	infoHash, err := t.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+
+	conn, err := t.Network.DialContext(ctx, "tcp", peerAddress)
+	if err != nil {
+		return nil, err
+	}
+
+	request := &peerwire.Handshake{InfoHash: infoHash, PeerID: t.peerID()}
+	request.Reserved[5] |= peerwire.ReservedExtensions
+	if _, err := conn.Write(request.Marshal()); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	response, err := peerwire.ReadHandshake(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if response.InfoHash != infoHash {
+		conn.Close()
+		return nil, fmt.Errorf("peer %s answered for info hash %x", peerAddress, response.InfoHash)
+	}
+
+	p := &PeerConn{
+		Conn:      peerwire.NewConn(conn),
+		Addr:      peerAddress,
+		PeerID:    response.PeerID,
+		Reserved:  response.Reserved,
+		Bitfield:  peerwire.NewBitfield(t.Info.NumPieces()),
+		Choked:    true,
+		conn:      conn,
+		numPieces: t.Info.NumPieces(),
+		pipeline:  newRequestPipeline(),
+	}
+	if response.Reserved[5]&peerwire.ReservedExtensions != 0 {
+		payload, err := bencode.Marshal(t.ExtensionHandshake())
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if err := p.Send(peerwire.Extended{ExtendedID: extendedHandshakeID, Payload: []byte(payload)}); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return p, nil
+}
+
+func (p *PeerConn) Close() error {
+	return p.conn.Close()
+}
+
+// ReadMessage reads the next message from the peer and applies the ones
+// that change its state.
+func (p *PeerConn) ReadMessage() (peerwire.Message, error) {
+	m, err := p.Conn.ReadMessage()
+	if err != nil {
+		return nil, err
+	}
+	switch m := m.(type) {
+	case peerwire.Choke:
+		p.Choked = true
+		p.pipeline.Reset()
+	case peerwire.Unchoke:
+		p.Choked = false
+	case peerwire.Piece:
+		p.pipeline.Received(int(m.Index), int(m.Begin), len(m.Block))
+	case peerwire.Extended:
+		switch {
+		case m.ExtendedID == extendedHandshakeID:
+			p.readExtensionHandshake(m.Payload)
+		case m.ExtendedID == extensionPEX && p.OnPEX != nil:
+			p.OnPEX(m.Payload)
+		}
+	case peerwire.Have:
+		if int(m.Index) >= p.numPieces {
+			return nil, fmt.Errorf("peer has piece %d of %d", m.Index, p.numPieces)
+		}
+		if !p.Bitfield.Has(int(m.Index)) && p.OnHave != nil {
+			p.OnHave(int(m.Index))
+		}
+		p.Bitfield.Set(int(m.Index))
+	case peerwire.Bitfield:
+		if err := m.Validate(p.numPieces); err != nil {
+			return nil, err
+		}
+		p.Bitfield = m
+	}
+	return m, nil
+}
+
+// readExtensionHandshake applies the peer's extension handshake. It is
+// informational, so a malformed one is ignored.
+func (p *PeerConn) readExtensionHandshake(payload []byte) {
+	decoded, err := bencode.Unmarshal(string(payload))
+	if err != nil {
+		return
+	}
+	handshake, _ := decoded.(map[string]interface{})
+	if reqq, ok := handshake["reqq"].(int); ok && reqq > 0 {
+		p.pipeline.setLimit(reqq)
+	}
+	// a later handshake may update or remove an extension, 0 disables it
+	if extensions, ok := handshake["m"].(map[string]interface{}); ok {
+		if id, ok := extensions[pex.ExtensionName].(int); ok && id >= 0 && id <= 255 {
+			p.PEXID = uint8(id)
+		}
+	}
+}
+
+// WriteMessage buffers a message, timing the requests to size the request
+// pipeline. Call Flush to send it.
+func (p *PeerConn) WriteMessage(m peerwire.Message) error {
+	if err := p.Conn.WriteMessage(m); err != nil {
+		return err
+	}
+	p.sent(m)
+	return nil
+}
+
+// Send writes a message and flushes it, like WriteMessage it keeps track of
+// requests and cancels.
+func (p *PeerConn) Send(m peerwire.Message) error {
+	if err := p.Conn.Send(m); err != nil {
+		return err
+	}
+	p.sent(m)
+	return nil
+}
+
+func (p *PeerConn) sent(m peerwire.Message) {
+	switch m := m.(type) {
+	case peerwire.Request:
+		p.pipeline.Requested(int(m.Index), int(m.Begin))
+	case peerwire.Cancel:
+		p.pipeline.Cancelled(int(m.Index), int(m.Begin))
+	}
+}
+
+// PipelineDepth is how many block requests to keep in flight to the peer,
+// from the throughput and round trip time measured so far and the peer's
+// reqq.
+func (p *PeerConn) PipelineDepth() int {
+	return p.pipeline.Depth()
+}
+
+// Unchoke tells the peer that we are interested and waits until it
+// unchokes us.
+func (p *PeerConn) Unchoke() error {
+	if !p.interested {
+		if err := p.Send(peerwire.Interested{}); err != nil {
+			return err
+		}
+		p.interested = true
+	}
+	for p.Choked {
+		if _, err := p.ReadMessage(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// pieceBuffer collects the blocks of a piece, possibly from several
+// connections.
+type pieceBuffer struct {
+	index    int
+	data     []byte
+	received []bool
+	count    int
+}
+
+func newPieceBuffer(index, length int) *pieceBuffer {
+	blocks := (length + peerwire.BlockLength - 1) / peerwire.BlockLength
+	return &pieceBuffer{index: index, data: make([]byte, length), received: make([]bool, blocks)}
+}
+
+func (b *pieceBuffer) complete() bool {
+	return b.count == len(b.received)
+}
+
+func (b *pieceBuffer) blockLength(block int) int {
+	return min(peerwire.BlockLength, len(b.data)-block*peerwire.BlockLength)
+}
+
+// add stores a block and reports whether it was one the piece was missing.
+func (b *pieceBuffer) add(m peerwire.Piece) bool {
+	block := int(m.Begin) / peerwire.BlockLength
+	if int(m.Index) != b.index || int(m.Begin)%peerwire.BlockLength != 0 || block >= len(b.received) ||
+		b.received[block] || len(m.Block) != b.blockLength(block) {
+		return false
+	}
+	copy(b.data[m.Begin:], m.Block)
+	b.received[block] = true
+	b.count++
+	return true
+}
+
+// DownloadPiece downloads piece index, of the given length, keeping
+// PipelineDepth block requests in flight. The data isn't verified.
+func (p *PeerConn) DownloadPiece(index, length int) ([]byte, error) {
+	if err := p.Unchoke(); err != nil {
+		return nil, err
+	}
+	if !p.Bitfield.Has(index) {
+		return nil, errPieceMissing
+	}
+
+	piece := newPieceBuffer(index, length)
+	requested := make([]bool, len(piece.received))
+	pending := 0
+	for !piece.complete() {
+		if !p.Choked {
+			for block := range requested {
+				if pending >= p.PipelineDepth() {
+					break
+				}
+				if requested[block] || piece.received[block] {
+					continue
+				}
+				err := p.WriteMessage(peerwire.Request{
+					Index:  uint32(piece.index),
+					Begin:  uint32(block * peerwire.BlockLength),
+					Length: uint32(piece.blockLength(block)),
+				})
+				if err != nil {
+					return nil, err
+				}
+				requested[block] = true
+				pending++
+			}
+			if err := p.Flush(); err != nil {
+				return nil, err
+			}
+		}
+
+		m, err := p.ReadMessage()
+		if err != nil {
+			return nil, err
+		}
+		switch m := m.(type) {
+		case peerwire.Choke:
+			// a choked peer drops our requests, they are sent again once it
+			// unchokes us
+			for block := range requested {
+				requested[block] = false
+			}
+			pending = 0
+		case peerwire.Piece:
+			block := int(m.Begin) / peerwire.BlockLength
+			if piece.add(m) && requested[block] {
+				pending--
+			}
+		}
+	}
+	return piece.data, nil
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/dht"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/lsd"
+)
+
+// PeerSource finds peers in the swarm of an info hash. Trackers and the DHT
+// are both peer sources.
+type PeerSource interface {
+	FindPeers(ctx context.Context, infoHash [20]byte) ([]Peer, error)
+}
+
+// PeerWatcher is a peer source that keeps finding peers after FindPeers.
+type PeerWatcher interface {
+	PeerSource
+	// WatchPeers passes the peers it finds from now on to onPeers, until
+	// ctx is done.
+	WatchPeers(ctx context.Context, infoHash [20]byte, onPeers func([]Peer))
+}
+
+// TrackerSource finds peers by announcing to the trackers of a torrent.
+type TrackerSource struct {
+	Torrent *Torrent
+}
+
+func (s *TrackerSource) FindPeers(ctx context.Context, infoHash [20]byte) ([]Peer, error) {
+	torrentHash, err := s.Torrent.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+	if torrentHash != infoHash {
+		return nil, fmt.Errorf("trackers of %x can't find peers for %x", torrentHash, infoHash)
+	}
+	response, err := s.Torrent.DiscoverPeers(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return response.Peers, nil
+}
+
+// AnnouncerSource finds peers through an Announcer that runs while the
+// source is watched, so that the trackers hear from a download all along:
+// WatchPeers runs it and passes on the peers of the later announces, and
+// FindPeers waits for the outcome of its started announce.
+type AnnouncerSource struct {
+	Announcer *Announcer
+	// OnError, if not nil, is called with the announces that fail after
+	// the first, whose error FindPeers returns.
+	OnError func(err error)
+
+	once    sync.Once
+	started chan struct{}
+	peers   []Peer
+	err     error
+}
+
+func NewAnnouncerSource(announcer *Announcer) *AnnouncerSource {
+	return &AnnouncerSource{Announcer: announcer, started: make(chan struct{})}
+}
+
+func (s *AnnouncerSource) FindPeers(ctx context.Context, infoHash [20]byte) ([]Peer, error) {
+	if infoHash != s.Announcer.infoHash {
+		return nil, fmt.Errorf("trackers of %x can't find peers for %x", s.Announcer.infoHash, infoHash)
+	}
+	select {
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.started:
+		return s.peers, s.err
+	}
+}
+
+// WatchPeers runs the Announcer until ctx is done, when it announces
+// stopped.
+func (s *AnnouncerSource) WatchPeers(ctx context.Context, infoHash [20]byte, onPeers func([]Peer)) {
+	if infoHash != s.Announcer.infoHash {
+		return
+	}
+	s.Announcer.Run(ctx, func(event AnnounceEvent, response *TrackerResponse, err error) {
+		first := false
+		s.once.Do(func() {
+			first = true
+			if err == nil {
+				s.peers = response.Peers
+			}
+			s.err = err
+			close(s.started)
+		})
+		switch {
+		case first:
+		case err != nil:
+			if s.OnError != nil {
+				s.OnError(err)
+			}
+		case event != EventStopped:
+			onPeers(response.Peers)
+		}
+	})
+}
+
+// DHTSource finds peers through the mainline DHT.
+type DHTSource struct {
+	Node *dht.Node
+}
+
+func (s *DHTSource) FindPeers(ctx context.Context, infoHash [20]byte) ([]Peer, error) {
+	addrs, err := s.Node.GetPeers(ctx, infoHash)
+	if err != nil {
+		return nil, err
+	}
+	peers := make([]Peer, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = Peer{Addr: addr}
+	}
+	return peers, nil
+}
+
+// lsdAnnounceInterval is how often a watched torrent is announced on the
+// local network, BEP 14 asks for every 5 minutes.
+const lsdAnnounceInterval = 5 * time.Minute
+
+// LSDSource finds peers on the local network (BEP 14). Peers announce
+// themselves every few minutes, so FindPeers returns the ones heard from so
+// far, and WatchPeers the ones heard from later.
+type LSDSource struct {
+	Service *lsd.Service
+	// Announce tells the local network about the torrent too. Peers that
+	// hear it connect to the Service's port, so only set it while we accept
+	// peers there.
+	Announce bool
+}
+
+func (s *LSDSource) FindPeers(ctx context.Context, infoHash [20]byte) ([]Peer, error) {
+	if s.Announce {
+		if err := s.Service.Announce(infoHash); err != nil {
+			return nil, err
+		}
+	}
+	addrs := s.Service.Peers(infoHash)
+	peers := make([]Peer, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = Peer{Addr: addr}
+	}
+	return peers, nil
+}
+
+// WatchPeers passes on the peers that announce the torrent, and with
+// Announce set announces it every lsdAnnounceInterval.
+func (s *LSDSource) WatchPeers(ctx context.Context, infoHash [20]byte, onPeers func([]Peer)) {
+	stop := s.Service.Watch(infoHash, func(addr netip.AddrPort) {
+		onPeers([]Peer{{Addr: addr}})
+	})
+	defer stop()
+	if !s.Announce {
+		<-ctx.Done()
+		return
+	}
+	ticker := time.NewTicker(lsdAnnounceInterval)
+	defer ticker.Stop()
+	for {
+		// a failure is only worth trying again next time, and an announce
+		// FindPeers just sent isn't repeated
+		s.Service.Announce(infoHash)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// MultiSource asks every source at once and merges their peers. It only
+// fails when every source does.
+type MultiSource []PeerSource
+
+func (m MultiSource) FindPeers(ctx context.Context, infoHash [20]byte) ([]Peer, error) {
+	results := make([][]Peer, len(m))
+	errs := make([]error, len(m))
+	var wg sync.WaitGroup
+	for i, source := range m {
+		wg.Add(1)
+		go func(i int, source PeerSource) {
+			defer wg.Done()
+			results[i], errs[i] = source.FindPeers(ctx, infoHash)
+		}(i, source)
+	}
+	wg.Wait()
+
+	var peers []Peer
+	seen := map[string]bool{}
+	failed := 0
+	for i := range m {
+		if errs[i] != nil {
+			failed++
+			continue
+		}
+		for _, peer := range results[i] {
+			key := peer.Addr.String()
+			if !seen[key] {
+				seen[key] = true
+				peers = append(peers, peer)
+			}
+		}
+	}
+	if len(m) > 0 && failed == len(m) {
+		return nil, errors.Join(errs...)
+	}
+	return peers, nil
+}
+
+// WatchPeers runs the sources that keep finding peers until ctx is done.
+func (m MultiSource) WatchPeers(ctx context.Context, infoHash [20]byte, onPeers func([]Peer)) {
+	var wg sync.WaitGroup
+	for _, source := range m {
+		if watcher, ok := source.(PeerWatcher); ok {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				watcher.WatchPeers(ctx, infoHash, onPeers)
+			}()
+		}
+	}
+	wg.Wait()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/dht"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/lsd"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubSource struct {
+	peers []Peer
+	err   error
+}
+
+func (s *stubSource) FindPeers(ctx context.Context, infoHash [20]byte) ([]Peer, error) {
+	return s.peers, s.err
+}
+
+func peersAt(addrs ...string) []Peer {
+	peers := make([]Peer, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = Peer{Addr: netip.MustParseAddrPort(addr)}
+	}
+	return peers
+}
+
+func TestMultiSource(t *testing.T) {
+	sources := MultiSource{
+		&stubSource{peers: peersAt("10.0.0.1:1", "10.0.0.2:2")},
+		&stubSource{err: errors.New("tracker down")},
+		&stubSource{peers: peersAt("10.0.0.2:2", "10.0.0.3:3")},
+	}
+	peers, err := sources.FindPeers(context.Background(), [20]byte{})
+	require.NoError(t, err)
+	assert.Equal(t, peersAt("10.0.0.1:1", "10.0.0.2:2", "10.0.0.3:3"), peers)
+
+	_, err = MultiSource{&stubSource{err: errors.New("tracker down")}, &stubSource{err: errors.New("dht down")}}.
+		FindPeers(context.Background(), [20]byte{})
+	assert.ErrorContains(t, err, "tracker down")
+	assert.ErrorContains(t, err, "dht down")
+}
+
+// startDHT runs count DHT nodes on loopback that know each other.
+func startDHT(t *testing.T, count int) []*dht.Node {
+	t.Helper()
+	nodes := make([]*dht.Node, count)
+	for i := range nodes {
+		node, err := dht.Listen("127.0.0.1:0", dht.RandomID())
+		require.NoError(t, err)
+		node.QueryTimeout = 500 * time.Millisecond
+		t.Cleanup(func() { node.Close() })
+		nodes[i] = node
+	}
+	for _, node := range nodes[1:] {
+		require.NoError(t, node.Bootstrap(context.Background(), nodes[0].Addr().String()))
+	}
+	return nodes
+}
+
+func TestPeerSources(t *testing.T) {
+	server := httptest.NewServer(tracker.NewServer())
+	defer server.Close()
+	seeder := sampleTorrent(t, nil)
+	seeder.Announce = server.URL + "/announce"
+	seeder.Port = 7001
+	infoHash, err := seeder.InfoHash()
+	require.NoError(t, err)
+	_, err = seeder.DiscoverPeers(context.Background())
+	require.NoError(t, err)
+
+	nodes := startDHT(t, 8)
+	_, err = nodes[3].Announce(context.Background(), infoHash, 7002)
+	require.NoError(t, err)
+
+	leecher := sampleTorrent(t, nil)
+	leecher.Announce = seeder.Announce
+	leecher.PeerID[0] = 'x'
+	sources := MultiSource{&TrackerSource{Torrent: leecher}, &DHTSource{Node: nodes[6]}}
+
+	peers, err := sources.FindPeers(context.Background(), infoHash)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, peersAt("127.0.0.1:7001", "127.0.0.1:7002"), peers)
+
+	_, err = (&TrackerSource{Torrent: leecher}).FindPeers(context.Background(), [20]byte{1})
+	assert.ErrorContains(t, err, "can't find peers")
+}
+
+func TestLSDSource(t *testing.T) {
+	// two services on loopback, each one's group being the other's socket
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		require.NoError(t, err)
+		return conn
+	}
+	firstConn, secondConn := listen(), listen()
+	first, second := lsd.NewService(7001), lsd.NewService(7002)
+	first.Attach(firstConn, secondConn.LocalAddr().(*net.UDPAddr).AddrPort())
+	second.Attach(secondConn, firstConn.LocalAddr().(*net.UDPAddr).AddrPort())
+	defer first.Close()
+	defer second.Close()
+
+	infoHash := [20]byte{1}
+	_, err := (&LSDSource{Service: first, Announce: true}).FindPeers(context.Background(), infoHash)
+	require.NoError(t, err)
+	source := &LSDSource{Service: second, Announce: true}
+	assert.Eventually(t, func() bool {
+		peers, err := source.FindPeers(context.Background(), infoHash)
+		return err == nil && assert.ObjectsAreEqual(peersAt("127.0.0.1:7001"), peers)
+	}, time.Second, 10*time.Millisecond)
+}
+
+func TestLSDSourceWatchPeers(t *testing.T) {
+	listen := func() net.PacketConn {
+		conn, err := net.ListenPacket("udp4", "127.0.0.1:0")
+		require.NoError(t, err)
+		return conn
+	}
+	firstConn, secondConn := listen(), listen()
+	first, second := lsd.NewService(7001), lsd.NewService(7002)
+	first.Attach(firstConn, secondConn.LocalAddr().(*net.UDPAddr).AddrPort())
+	second.Attach(secondConn, firstConn.LocalAddr().(*net.UDPAddr).AddrPort())
+	defer first.Close()
+	defer second.Close()
+
+	// a peer that announces after the first FindPeers is passed on, to a
+	// source that doesn't announce itself
+	infoHash := [20]byte{1}
+	found := make(chan []Peer, 1)
+	ctx, cancel := context.WithCancel(context.Background())
+	watching := make(chan struct{})
+	go func() {
+		defer close(watching)
+		MultiSource{&stubSource{}, &LSDSource{Service: second}}.WatchPeers(ctx, infoHash, func(peers []Peer) { found <- peers })
+	}()
+	assert.Eventually(t, func() bool {
+		_, err := (&LSDSource{Service: first, Announce: true}).FindPeers(context.Background(), infoHash)
+		require.NoError(t, err)
+		select {
+		case peers := <-found:
+			assert.Equal(t, peersAt("127.0.0.1:7001"), peers)
+			return true
+		default:
+			return false
+		}
+	}, time.Second, 10*time.Millisecond)
+	cancel()
+	<-watching
+	assert.Empty(t, first.Peers(infoHash))
+}
+
+func TestClientPeerSources(t *testing.T) {
+	c := NewClient(io.Discard)
+	torrent := sampleTorrent(t, nil)
+
+	c.lsd = false
+	sources, release := c.peerSources(torrent, &TrackerSource{Torrent: torrent})
+	release()
+	assert.Equal(t, MultiSource{&TrackerSource{Torrent: torrent}}, sources)
+
+	// private torrents only use their trackers
+	c.lsd = true
+	torrent.Info.Private = true
+	sources, release = c.peerSources(torrent, &TrackerSource{Torrent: torrent})
+	release()
+	assert.Len(t, sources, 1)
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/pex"
+)
+
+// extensionPEX is the id we ask peers to send ut_pex messages with.
+const extensionPEX = 1
+
+// ErrPrivateTorrent is returned when peer exchange is used for a private
+// torrent.
+var ErrPrivateTorrent = errors.New("peer exchange is disabled for private torrents")
+
+// PEXEnabled reports whether peer exchange may be used for the torrent.
+func (t *Torrent) PEXEnabled() bool {
+	return !t.Info.Private
+}
+
+// ExtensionHandshake returns the dictionary we send in the extension
+// protocol handshake (BEP 10). ut_pex is only offered when PEX is enabled.
+func (t *Torrent) ExtensionHandshake() map[string]interface{} {
+	extensions := map[string]interface{}{}
+	if t.PEXEnabled() {
+		extensions[pex.ExtensionName] = extensionPEX
+	}
+	return map[string]interface{}{"m": extensions}
+}
+
+// PEXSource collects the peers connected peers tell us about through
+// ut_pex, and hands them out as a peer source.
+type PEXSource struct {
+	Torrent *Torrent
+	// Seeding leaves out peers flagged as seeds: while we seed, peers that
+	// are seeds themselves want nothing from us.
+	Seeding bool
+
+	mu    sync.Mutex
+	peers map[netip.AddrPort]*learnedPeer
+}
+
+type learnedPeer struct {
+	flags pex.Flags
+	// from is the connected peer that told us about this one.
+	from netip.AddrPort
+}
+
+func NewPEXSource(torrent *Torrent) *PEXSource {
+	return &PEXSource{Torrent: torrent, peers: map[netip.AddrPort]*learnedPeer{}}
+}
+
+// Add records a ut_pex message received from the peer at from. Peers it
+// drops are forgotten when from is the one that told us about them.
+func (s *PEXSource) Add(from netip.AddrPort, msg *pex.Message) {
+	if !s.Torrent.PEXEnabled() {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, peer := range msg.Added {
+		if peer.Addr == from || !peer.Addr.IsValid() {
+			continue
+		}
+		s.peers[peer.Addr] = &learnedPeer{flags: peer.Flags, from: from}
+	}
+	for _, addr := range msg.Dropped {
+		if learned, ok := s.peers[addr]; ok && learned.from == from {
+			delete(s.peers, addr)
+		}
+	}
+}
+
+// FindPeers returns the peers learned so far, the ones known to accept
+// connections first.
+func (s *PEXSource) FindPeers(ctx context.Context, infoHash [20]byte) ([]Peer, error) {
+	if !s.Torrent.PEXEnabled() {
+		return nil, ErrPrivateTorrent
+	}
+	torrentHash, err := s.Torrent.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+	if torrentHash != infoHash {
+		return nil, fmt.Errorf("peer exchange of %x can't find peers for %x", torrentHash, infoHash)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	addrs := make([]netip.AddrPort, 0, len(s.peers))
+	for addr, learned := range s.peers {
+		if s.Seeding && learned.flags&pex.FlagSeed != 0 {
+			continue
+		}
+		addrs = append(addrs, addr)
+	}
+	sort.Slice(addrs, func(i, j int) bool {
+		reachableI := s.peers[addrs[i]].flags&pex.FlagReachable != 0
+		reachableJ := s.peers[addrs[j]].flags&pex.FlagReachable != 0
+		if reachableI != reachableJ {
+			return reachableI
+		}
+		return addrs[i].Compare(addrs[j]) < 0
+	})
+
+	peers := make([]Peer, len(addrs))
+	for i, addr := range addrs {
+		peers[i] = Peer{Addr: addr}
+	}
+	return peers, nil
+}
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/pex"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPEXSource(t *testing.T) {
+	torrent := sampleTorrent(t, nil)
+	infoHash, err := torrent.InfoHash()
+	require.NoError(t, err)
+	first := netip.MustParseAddrPort("10.0.0.1:1")
+	second := netip.MustParseAddrPort("10.0.0.2:2")
+
+	source := NewPEXSource(torrent)
+	source.Add(first, &pex.Message{Added: []pex.Peer{
+		{Addr: netip.MustParseAddrPort("10.0.1.1:1")},
+		{Addr: netip.MustParseAddrPort("10.0.1.2:2"), Flags: pex.FlagReachable},
+		{Addr: netip.MustParseAddrPort("10.0.1.3:3"), Flags: pex.FlagSeed},
+		// a peer can't add itself
+		{Addr: first},
+	}})
+	peers, err := source.FindPeers(context.Background(), infoHash)
+	require.NoError(t, err)
+	// reachable peers come first
+	assert.Equal(t, peersAt("10.0.1.2:2", "10.0.1.1:1", "10.0.1.3:3"), peers)
+
+	// only the peer that added a peer can drop it
+	source.Add(second, &pex.Message{Dropped: []netip.AddrPort{netip.MustParseAddrPort("10.0.1.1:1")}})
+	source.Add(first, &pex.Message{Dropped: []netip.AddrPort{netip.MustParseAddrPort("10.0.1.2:2")}})
+	source.Seeding = true
+	peers, err = source.FindPeers(context.Background(), infoHash)
+	require.NoError(t, err)
+	assert.Equal(t, peersAt("10.0.1.1:1"), peers)
+
+	_, err = source.FindPeers(context.Background(), [20]byte{1})
+	assert.ErrorContains(t, err, "can't find peers")
+}
+
+func TestPEXPrivateTorrent(t *testing.T) {
+	torrent := sampleTorrent(t, nil)
+	assert.True(t, torrent.PEXEnabled())
+	assert.Equal(t, map[string]interface{}{"ut_pex": extensionPEX}, torrent.ExtensionHandshake()["m"])
+
+	torrent.Info.Private = true
+	assert.False(t, torrent.PEXEnabled())
+	assert.Empty(t, torrent.ExtensionHandshake()["m"])
+
+	source := NewPEXSource(torrent)
+	source.Add(netip.MustParseAddrPort("10.0.0.1:1"), &pex.Message{Added: []pex.Peer{{Addr: netip.MustParseAddrPort("10.0.1.1:1")}}})
+	infoHash, err := torrent.InfoHash()
+	require.NoError(t, err)
+	_, err = source.FindPeers(context.Background(), infoHash)
+	assert.ErrorIs(t, err, ErrPrivateTorrent)
+	assert.Empty(t, source.peers)
+}
@@ -0,0 +1,301 @@
+package main
+
+import (
+	"fmt"
+	"math/rand"
+	"slices"
+	"sort"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerwire"
+)
+
+// Priority tells how much a piece or file is wanted.
+type Priority int
+
+const (
+	// PrioritySkip pieces are not downloaded at all.
+	PrioritySkip Priority = iota
+	PriorityLow
+	PriorityNormal
+	PriorityHigh
+)
+
+var priorityNames = []string{"skip", "low", "normal", "high"}
+
+func (p Priority) String() string {
+	if p < 0 || int(p) >= len(priorityNames) {
+		return fmt.Sprintf("Priority(%d)", int(p))
+	}
+	return priorityNames[p]
+}
+
+// ParsePriority parses the name of a priority.
+func ParsePriority(s string) (Priority, error) {
+	for i, name := range priorityNames {
+		if strings.EqualFold(s, name) {
+			return Priority(i), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid priority %q: want skip, low, normal or high", s)
+}
+
+// defaultRandomFirst is how many pieces are picked at random before rarest
+// first.
+const defaultRandomFirst = 4
+
+// PiecePicker chooses the piece to download next. It counts how many
+// connected peers have each piece, and prefers, in order: pieces that were
+// partly downloaded, higher priorities, and rarer pieces, breaking ties at
+// random. The first few pieces are picked at random regardless of rarity,
+// rare pieces being slow to get, so that we have something to share soon.
+//
+// Like libtorrent's, the picker keeps the pieces it may pick in buckets of
+// equal preference, ordered best first, and counts the remaining and
+// pending pieces as they change: it runs while a download holds its lock,
+// on every block received, so it mustn't scan every piece.
+//
+// A PiecePicker is not safe for concurrent use.
+type PiecePicker struct {
+	// RandomFirst is how many pieces are picked at random before rarest
+	// first starts.
+	RandomFirst int
+
+	availability []int
+	priority     []Priority
+	state        []pieceState
+	done         int
+	remaining    int
+	pending      int
+	// buckets holds the pieces that may be picked by their pickKey, keys
+	// the keys of the buckets that aren't empty, best first. position is
+	// where a piece is in its bucket, -1 for the others.
+	buckets  map[pickKey][]int
+	keys     []pickKey
+	position []int
+	rand     *rand.Rand
+}
+
+type pieceState uint8
+
+const (
+	pieceWanted pieceState = iota
+	// piecePartial was started and gave up, its blocks are kept.
+	piecePartial
+	piecePending
+	pieceDone
+)
+
+// pickKey is what the picker orders pieces by.
+type pickKey struct {
+	partial      bool
+	priority     Priority
+	availability int
+}
+
+// before tells whether pieces of k are picked before those of other. The
+// availability is only compared when rarest is set.
+func (k pickKey) before(other pickKey, rarest bool) bool {
+	if k.partial != other.partial {
+		return k.partial
+	}
+	if k.priority != other.priority {
+		return k.priority > other.priority
+	}
+	return rarest && k.availability < other.availability
+}
+
+func NewPiecePicker(numPieces int) *PiecePicker {
+	p := &PiecePicker{
+		RandomFirst:  defaultRandomFirst,
+		availability: make([]int, numPieces),
+		priority:     make([]Priority, numPieces),
+		state:        make([]pieceState, numPieces),
+		buckets:      make(map[pickKey][]int),
+		position:     make([]int, numPieces),
+		rand:         rand.New(rand.NewSource(rand.Int63())),
+	}
+	for i := range p.priority {
+		p.priority[i] = PriorityNormal
+		p.position[i] = -1
+		p.count(i, 1)
+		p.index(i)
+	}
+	return p
+}
+
+// update applies change to the state of piece i, keeping the counts and
+// the buckets in step.
+func (p *PiecePicker) update(i int, change func()) {
+	p.unindex(i)
+	p.count(i, -1)
+	change()
+	p.count(i, 1)
+	p.index(i)
+}
+
+func (p *PiecePicker) count(i, delta int) {
+	if p.state[i] != pieceDone && p.priority[i] != PrioritySkip {
+		p.remaining += delta
+	}
+	if p.state[i] == piecePending {
+		p.pending += delta
+	}
+}
+
+func (p *PiecePicker) key(i int) pickKey {
+	return pickKey{partial: p.state[i] == piecePartial, priority: p.priority[i], availability: p.availability[i]}
+}
+
+// index puts piece i in its bucket, if it may be picked.
+func (p *PiecePicker) index(i int) {
+	if p.state[i] == piecePending || p.state[i] == pieceDone || p.priority[i] == PrioritySkip {
+		return
+	}
+	key := p.key(i)
+	bucket, ok := p.buckets[key]
+	if !ok {
+		at := sort.Search(len(p.keys), func(j int) bool { return key.before(p.keys[j], true) })
+		p.keys = slices.Insert(p.keys, at, key)
+	}
+	p.position[i] = len(bucket)
+	p.buckets[key] = append(bucket, i)
+}
+
+// unindex takes piece i out of its bucket. The order within a bucket
+// doesn't matter, picks start at a random place.
+func (p *PiecePicker) unindex(i int) {
+	at := p.position[i]
+	if at < 0 {
+		return
+	}
+	key := p.key(i)
+	bucket := p.buckets[key]
+	last := bucket[len(bucket)-1]
+	bucket[at] = last
+	p.position[last] = at
+	p.position[i] = -1
+	if bucket = bucket[:len(bucket)-1]; len(bucket) > 0 {
+		p.buckets[key] = bucket
+		return
+	}
+	delete(p.buckets, key)
+	p.keys = slices.DeleteFunc(p.keys, func(k pickKey) bool { return k == key })
+}
+
+// AddBitfield counts the pieces of a peer that connected.
+func (p *PiecePicker) AddBitfield(b peerwire.Bitfield) {
+	for i := range p.availability {
+		if b.Has(i) {
+			p.update(i, func() { p.availability[i]++ })
+		}
+	}
+}
+
+// RemoveBitfield forgets the pieces of a peer that disconnected.
+func (p *PiecePicker) RemoveBitfield(b peerwire.Bitfield) {
+	for i := range p.availability {
+		if b.Has(i) && p.availability[i] > 0 {
+			p.update(i, func() { p.availability[i]-- })
+		}
+	}
+}
+
+// AddHave counts a piece a connected peer announced.
+func (p *PiecePicker) AddHave(index int) {
+	if index >= 0 && index < len(p.availability) {
+		p.update(index, func() { p.availability[index]++ })
+	}
+}
+
+// SetPriority sets the priority of a piece.
+func (p *PiecePicker) SetPriority(index int, priority Priority) {
+	p.update(index, func() { p.priority[index] = priority })
+}
+
+// SetFilePriorities sets the priority of every piece from the priorities of
+// the files in layout, in the order of layout.Files. A piece shared by
+// several files gets the highest of their priorities.
+func (p *PiecePicker) SetFilePriorities(layout *Layout, priorities []Priority) {
+	piecePriorities := make([]Priority, len(p.priority))
+	for fileIndex, file := range layout.Files {
+		if file.Length == 0 {
+			continue
+		}
+		first := file.Offset / layout.pieceLength
+		last := (file.Offset + file.Length - 1) / layout.pieceLength
+		for i := first; i <= last; i++ {
+			piecePriorities[i] = max(piecePriorities[i], priorities[fileIndex])
+		}
+	}
+	for i, priority := range piecePriorities {
+		p.SetPriority(i, priority)
+	}
+}
+
+// Pick chooses a piece that has has and marks it pending. It returns false
+// when has no piece we still want.
+func (p *PiecePicker) Pick(has peerwire.Bitfield) (int, bool) {
+	rarest := p.done >= p.RandomFirst
+	// the buckets of the best key that has a piece of has, or before
+	// rarest first all the buckets of equal preference but for rarity,
+	// are searched from a random place
+	for first := 0; first < len(p.keys); {
+		last := first + 1
+		for last < len(p.keys) && !p.keys[first].before(p.keys[last], rarest) {
+			last++
+		}
+		group := make([][]int, 0, last-first)
+		size := 0
+		for _, key := range p.keys[first:last] {
+			group = append(group, p.buckets[key])
+			size += len(p.buckets[key])
+		}
+		start := p.rand.Intn(size)
+		for n := 0; n < size; n++ {
+			at := (start + n) % size
+			bucket := 0
+			for at >= len(group[bucket]) {
+				at -= len(group[bucket])
+				bucket++
+			}
+			if i := group[bucket][at]; has.Has(i) {
+				p.update(i, func() { p.state[i] = piecePending })
+				return i, true
+			}
+		}
+		first = last
+	}
+	return 0, false
+}
+
+// Done marks a pending piece as downloaded and verified.
+func (p *PiecePicker) Done(index int) {
+	if p.state[index] == pieceDone {
+		return
+	}
+	p.done++
+	p.update(index, func() { p.state[index] = pieceDone })
+}
+
+// Abort puts a pending piece back. partial tells that some of its blocks
+// were kept, so it is picked before the others.
+func (p *PiecePicker) Abort(index int, partial bool) {
+	p.update(index, func() {
+		if partial {
+			p.state[index] = piecePartial
+		} else {
+			p.state[index] = pieceWanted
+		}
+	})
+}
+
+// Remaining counts the pieces that are wanted and not done yet.
+func (p *PiecePicker) Remaining() int {
+	return p.remaining
+}
+
+// Pending counts the pieces being downloaded.
+func (p *PiecePicker) Pending() int {
+	return p.pending
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"math/rand"
+	"testing"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func bitfieldOf(numPieces int, pieces ...int) peerwire.Bitfield {
+	b := peerwire.NewBitfield(numPieces)
+	for _, i := range pieces {
+		b.Set(i)
+	}
+	return b
+}
+
+// testPicker returns a picker over availability, which maps every simulated
+// peer to the pieces it has.
+func testPicker(numPieces int, seed int64, availability ...[]int) *PiecePicker {
+	p := NewPiecePicker(numPieces)
+	p.RandomFirst = 0
+	p.rand = rand.New(rand.NewSource(seed))
+	for _, pieces := range availability {
+		p.AddBitfield(bitfieldOf(numPieces, pieces...))
+	}
+	return p
+}
+
+func pickAll(t *testing.T, p *PiecePicker, has peerwire.Bitfield) []int {
+	t.Helper()
+	var picked []int
+	for {
+		index, ok := p.Pick(has)
+		if !ok {
+			return picked
+		}
+		p.Done(index)
+		picked = append(picked, index)
+	}
+}
+
+func TestPiecePickerRarestFirst(t *testing.T) {
+	all := bitfieldOf(5, 0, 1, 2, 3, 4)
+	p := testPicker(5, 1,
+		[]int{0, 1, 2, 3, 4},
+		[]int{0, 1, 2, 4},
+		[]int{0, 2, 4},
+		[]int{0, 2},
+		[]int{2},
+	)
+	assert.Equal(t, []int{3, 1, 4, 0, 2}, pickAll(t, p, all))
+	assert.Zero(t, p.Remaining())
+
+	// a piece the peer doesn't have is never picked
+	p = testPicker(5, 1, []int{0, 1, 2, 3, 4}, []int{0, 2, 4})
+	assert.Equal(t, []int{1, 0}, pickAll(t, p, bitfieldOf(5, 0, 1)))
+
+	// haves count like bitfields, and a peer that leaves takes its pieces
+	p = testPicker(3, 1, []int{0, 1, 2})
+	p.AddHave(0)
+	p.AddHave(2)
+	gone := bitfieldOf(3, 1, 2)
+	p.AddBitfield(gone)
+	p.RemoveBitfield(gone)
+	index, ok := p.Pick(bitfieldOf(3, 0, 1, 2))
+	require.True(t, ok)
+	assert.Equal(t, 1, index)
+}
+
+func TestPiecePickerBreaksTiesAtRandom(t *testing.T) {
+	picked := make(map[int]int)
+	for seed := int64(0); seed < 100; seed++ {
+		// pieces 1, 2 and 3 are equally rare
+		p := testPicker(4, seed, []int{0, 1, 2, 3}, []int{0})
+		index, ok := p.Pick(bitfieldOf(4, 0, 1, 2, 3))
+		require.True(t, ok)
+		picked[index]++
+	}
+	assert.Zero(t, picked[0])
+	for _, index := range []int{1, 2, 3} {
+		assert.Greater(t, picked[index], 15, "piece %d", index)
+	}
+}
+
+func TestPiecePickerRandomFirst(t *testing.T) {
+	all := bitfieldOf(4, 0, 1, 2, 3)
+	first := make(map[int]int)
+	for seed := int64(0); seed < 100; seed++ {
+		// piece 3 is the rarest by far
+		p := testPicker(4, seed, []int{0, 1, 2, 3}, []int{0, 1, 2}, []int{0, 1, 2})
+		p.RandomFirst = 1
+		picked := pickAll(t, p, all)
+		first[picked[0]]++
+		if picked[0] != 3 {
+			// rarest first once a piece is done
+			assert.Equal(t, 3, picked[1])
+		}
+	}
+	for index := range 4 {
+		assert.Greater(t, first[index], 10, "piece %d", index)
+	}
+}
+
+func TestPiecePickerPriorities(t *testing.T) {
+	all := bitfieldOf(5, 0, 1, 2, 3, 4)
+	p := testPicker(5, 1, []int{0, 1, 2, 3, 4}, []int{0, 1, 2, 3})
+	p.SetPriority(0, PriorityHigh)
+	p.SetPriority(3, PriorityLow)
+	p.SetPriority(4, PrioritySkip)
+	// priority wins over rarity, skipped pieces are never picked
+	assert.Equal(t, 4, p.Remaining())
+	picked := pickAll(t, p, all)
+	require.Len(t, picked, 4)
+	assert.Equal(t, 0, picked[0])
+	assert.ElementsMatch(t, []int{1, 2}, picked[1:3])
+	assert.Equal(t, 3, picked[3])
+	assert.Zero(t, p.Remaining())
+}
+
+func TestPiecePickerFilePriorities(t *testing.T) {
+	info := &Info{
+		Name:        "dir",
+		PieceLength: 10,
+		Pieces:      string(make([]byte, 20*6)),
+		Files: []File{
+			{Length: 15, Path: []string{"a"}},
+			{Length: 0, Path: []string{"empty"}},
+			{Length: 10, Path: []string{"b"}},
+			{Length: 35, Path: []string{"c"}},
+		},
+	}
+	layout, err := NewLayout(info)
+	require.NoError(t, err)
+
+	p := testPicker(6, 1)
+	p.SetFilePriorities(layout, []Priority{PriorityLow, PriorityHigh, PrioritySkip, PriorityNormal})
+	// piece 1 is shared by a and b, piece 2 by b and c
+	assert.Equal(t, []Priority{PriorityLow, PriorityLow, PriorityNormal, PriorityNormal, PriorityNormal, PriorityNormal}, p.priority)
+
+	p.SetFilePriorities(layout, []Priority{PrioritySkip, PriorityNormal, PriorityHigh, PrioritySkip})
+	assert.Equal(t, []Priority{PrioritySkip, PriorityHigh, PriorityHigh, PrioritySkip, PrioritySkip, PrioritySkip}, p.priority)
+	assert.Equal(t, 2, p.Remaining())
+}
+
+func TestPiecePickerPartialPieces(t *testing.T) {
+	all := bitfieldOf(4, 0, 1, 2, 3)
+	p := testPicker(4, 1, []int{0, 1, 2, 3}, []int{0, 1, 2}, []int{0, 1})
+
+	index, ok := p.Pick(all)
+	require.True(t, ok)
+	assert.Equal(t, 3, index)
+	// a pending piece isn't picked twice
+	index, ok = p.Pick(all)
+	require.True(t, ok)
+	assert.Equal(t, 2, index)
+	assert.Equal(t, 2, p.Pending())
+
+	// a piece given up halfway comes first, even over higher priorities
+	p.SetPriority(1, PriorityHigh)
+	p.Abort(2, true)
+	p.Abort(3, false)
+	assert.Zero(t, p.Pending())
+	index, ok = p.Pick(all)
+	require.True(t, ok)
+	assert.Equal(t, 2, index)
+	index, ok = p.Pick(all)
+	require.True(t, ok)
+	assert.Equal(t, 1, index)
+	index, ok = p.Pick(all)
+	require.True(t, ok)
+	assert.Equal(t, 3, index)
+
+	// but not from a peer that doesn't have it
+	p.Abort(3, true)
+	index, ok = p.Pick(bitfieldOf(4, 0))
+	require.True(t, ok)
+	assert.Equal(t, 0, index)
+	assert.Equal(t, 4, p.Remaining())
+}
+
+func TestPiecePickerKeepsCounts(t *testing.T) {
+	const numPieces = 50
+	r := rand.New(rand.NewSource(1))
+	p := testPicker(numPieces, 1)
+	p.RandomFirst = 5
+	var peers []peerwire.Bitfield
+	for step := 0; step < 2000; step++ {
+		index := r.Intn(numPieces)
+		switch r.Intn(7) {
+		case 0:
+			peer := peerwire.NewBitfield(numPieces)
+			for i := range numPieces {
+				if r.Intn(2) == 0 {
+					peer.Set(i)
+				}
+			}
+			p.AddBitfield(peer)
+			peers = append(peers, peer)
+		case 1:
+			if len(peers) > 0 {
+				p.RemoveBitfield(peers[0])
+				peers = peers[1:]
+			}
+		case 2:
+			p.AddHave(index)
+		case 3:
+			p.SetPriority(index, Priority(r.Intn(4)))
+		case 4:
+			if picked, ok := p.Pick(bitfieldOf(numPieces, index, (index+7)%numPieces)); ok {
+				assert.Equal(t, piecePending, p.state[picked])
+			}
+		case 5:
+			if p.state[index] == piecePending {
+				p.Abort(index, r.Intn(2) == 0)
+			}
+		case 6:
+			if p.state[index] == piecePending {
+				p.Done(index)
+			}
+		}
+
+		// the counts and buckets match what a scan of every piece finds
+		remaining, pending, pickable := 0, 0, 0
+		for i, state := range p.state {
+			if state != pieceDone && p.priority[i] != PrioritySkip {
+				remaining++
+			}
+			if state == piecePending {
+				pending++
+			}
+			if (state == pieceWanted || state == piecePartial) && p.priority[i] != PrioritySkip {
+				pickable++
+				require.Equal(t, i, p.buckets[p.key(i)][p.position[i]], "step %d", step)
+			} else {
+				require.Equal(t, -1, p.position[i], "step %d", step)
+			}
+		}
+		indexed := 0
+		for j, key := range p.keys {
+			indexed += len(p.buckets[key])
+			if j > 0 {
+				require.True(t, p.keys[j-1].before(key, true), "step %d", step)
+			}
+		}
+		require.Equal(t, remaining, p.Remaining(), "step %d", step)
+		require.Equal(t, pending, p.Pending(), "step %d", step)
+		require.Equal(t, pickable, indexed, "step %d", step)
+		require.Len(t, p.buckets, len(p.keys), "step %d", step)
+	}
+}
+
+func TestParsePriority(t *testing.T) {
+	for _, priority := range []Priority{PrioritySkip, PriorityLow, PriorityNormal, PriorityHigh} {
+		parsed, err := ParsePriority(priority.String())
+		require.NoError(t, err)
+		assert.Equal(t, priority, parsed)
+	}
+	parsed, err := ParsePriority("HIGH")
+	require.NoError(t, err)
+	assert.Equal(t, PriorityHigh, parsed)
+	_, err = ParsePriority("urgent")
+	assert.Error(t, err)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"math"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerwire"
+)
+
+const (
+	// initialPipelineDepth is how many block requests are kept in flight to
+	// a peer before its link is measured.
+	initialPipelineDepth = 5
+	minPipelineDepth     = 2
+	// maxPipelineDepth is libtorrent's max_out_request_queue.
+	maxPipelineDepth = 500
+	// defaultPeerRequestQueue is assumed for peers that don't send reqq in
+	// their extension handshake, it is libtorrent's default.
+	defaultPeerRequestQueue = 250
+	// rateWindow is how long a download rate measure lasts.
+	rateWindow = time.Second
+)
+
+// requestPipeline sizes the queue of block requests kept in flight to a
+// peer. Too few and the peer idles while our next requests travel, too
+// many and they only wait at the peer, to be lost when it chokes us.
+//
+// Like libtorrent it follows the measured download rate, and keeps twice
+// the bandwidth-delay product in flight: the rate times the lowest round
+// trip time seen. While the queue is what limits the rate, that doubles it
+// every round trip; once the link does, it settles.
+//
+// Every block gives a rate sample, the data delivered between its request
+// and its arrival over that time, and the rate is the highest sample of
+// the last rateWindow or so. That is what BBR does for TCP.
+//
+// A requestPipeline is safe for concurrent use: cancels are sent from the
+// goroutines of other connections.
+type requestPipeline struct {
+	mu sync.Mutex
+	// limit is the most requests the peer accepts, from its reqq.
+	limit int
+
+	sent map[blockKey]sentRequest
+	// delivered counts the bytes received.
+	delivered int
+	minRTT    time.Duration
+	// rate is the highest rate sample, in bytes per second, of the window
+	// that started at windowStart; lastRate is the one of the window before.
+	rate        float64
+	lastRate    float64
+	windowStart time.Time
+	now         func() time.Time
+}
+
+type sentRequest struct {
+	at time.Time
+	// delivered is what was delivered when the request was sent.
+	delivered int
+}
+
+func newRequestPipeline() *requestPipeline {
+	return &requestPipeline{
+		limit: defaultPeerRequestQueue,
+		sent:  make(map[blockKey]sentRequest),
+		now:   time.Now,
+	}
+}
+
+// Depth is how many requests to keep in flight.
+func (p *requestPipeline) Depth() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	depth := initialPipelineDepth
+	if rate := max(p.rate, p.lastRate); rate > 0 {
+		bdp := rate * p.minRTT.Seconds() / peerwire.BlockLength
+		depth = max(int(math.Ceil(2*bdp)), minPipelineDepth)
+	}
+	return max(min(depth, maxPipelineDepth, p.limit), 1)
+}
+
+// Requested records a request sent.
+func (p *requestPipeline) Requested(index, begin int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	key := blockKey{index: index, block: begin / peerwire.BlockLength}
+	p.sent[key] = sentRequest{at: p.now(), delivered: p.delivered}
+}
+
+// Received records a block received.
+func (p *requestPipeline) Received(index, begin, length int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	now := p.now()
+	key := blockKey{index: index, block: begin / peerwire.BlockLength}
+	request, ok := p.sent[key]
+	if !ok {
+		return
+	}
+	delete(p.sent, key)
+	p.delivered += length
+
+	rtt := now.Sub(request.at)
+	if rtt <= 0 {
+		return
+	}
+	if p.minRTT == 0 || rtt < p.minRTT {
+		p.minRTT = rtt
+	}
+	if now.Sub(p.windowStart) > rateWindow {
+		p.lastRate, p.rate, p.windowStart = p.rate, 0, now
+	}
+	p.rate = max(p.rate, float64(p.delivered-request.delivered)/rtt.Seconds())
+}
+
+// Cancelled forgets a request we cancelled. Should its block arrive anyway,
+// it doesn't tell the round trip: it may have been sent long before.
+func (p *requestPipeline) Cancelled(index, begin int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	delete(p.sent, blockKey{index: index, block: begin / peerwire.BlockLength})
+}
+
+// Reset forgets the outstanding requests, as a peer does when it chokes us.
+func (p *requestPipeline) Reset() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	clear(p.sent)
+}
+
+// setLimit sets the most requests the peer accepts.
+func (p *requestPipeline) setLimit(limit int) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.limit = limit
+}
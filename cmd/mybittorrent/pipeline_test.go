@@ -0,0 +1,290 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerwire"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// testPipeline returns a pipeline on a fake clock, advanced by the returned
+// function.
+func testPipeline() (*requestPipeline, func(time.Duration)) {
+	now := time.Unix(0, 0)
+	p := newRequestPipeline()
+	p.now = func() time.Time { return now }
+	return p, func(d time.Duration) { now = now.Add(d) }
+}
+
+func TestRequestPipelineGrowsWhileQueueLimited(t *testing.T) {
+	p, advance := testPipeline()
+	assert.Equal(t, initialPipelineDepth, p.Depth())
+
+	// every block takes a round trip of 100ms, however many are in flight
+	depth := p.Depth()
+	for round := 0; round < 6; round++ {
+		for block := 0; block < depth; block++ {
+			p.Requested(round, block*peerwire.BlockLength)
+		}
+		advance(100 * time.Millisecond)
+		for block := 0; block < depth; block++ {
+			p.Received(round, block*peerwire.BlockLength, peerwire.BlockLength)
+		}
+		assert.Greater(t, p.Depth(), depth, "round %d", round)
+		depth = p.Depth()
+	}
+	assert.Greater(t, depth, 50)
+}
+
+func TestRequestPipelineSettlesOnBandwidthDelayProduct(t *testing.T) {
+	p, advance := testPipeline()
+	// a round trip of 100ms and 20 blocks a second: 2 blocks are enough to
+	// keep the link busy
+	for block := 0; block < 100; block++ {
+		p.Requested(0, block*peerwire.BlockLength)
+	}
+	advance(100 * time.Millisecond)
+	for block := 0; block < 100; block++ {
+		advance(50 * time.Millisecond)
+		p.Received(0, block*peerwire.BlockLength, peerwire.BlockLength)
+	}
+	assert.Equal(t, 100*time.Millisecond+50*time.Millisecond, p.minRTT)
+	assert.InDelta(t, 20*peerwire.BlockLength, max(p.rate, p.lastRate), peerwire.BlockLength)
+	// twice 20 blocks/s times 150ms
+	assert.Equal(t, 6, p.Depth())
+}
+
+func TestRequestPipelineLimits(t *testing.T) {
+	p, advance := testPipeline()
+	p.limit = 3
+	assert.Equal(t, 3, p.Depth())
+
+	// a fast link would take more than the peer accepts
+	for block := 0; block < 100; block++ {
+		p.Requested(0, block*peerwire.BlockLength)
+	}
+	advance(100 * time.Millisecond)
+	for block := 0; block < 100; block++ {
+		p.Received(0, block*peerwire.BlockLength, peerwire.BlockLength)
+	}
+	assert.Equal(t, 3, p.Depth())
+	// twice 1000 blocks/s times 100ms
+	p.limit = defaultPeerRequestQueue
+	assert.Equal(t, 200, p.Depth())
+	p.limit = 1000
+	p.minRTT *= 10
+	assert.Equal(t, maxPipelineDepth, p.Depth())
+
+	// a slow one still keeps a few requests in flight
+	p, advance = testPipeline()
+	p.Requested(0, 0)
+	advance(2 * time.Second)
+	p.Received(0, 0, peerwire.BlockLength)
+	assert.Equal(t, minPipelineDepth, p.Depth())
+}
+
+func TestRequestPipelineReset(t *testing.T) {
+	p, advance := testPipeline()
+	p.Requested(0, 0)
+	p.Reset()
+	advance(time.Second)
+	// the block of a request dropped by a choke doesn't tell the round trip
+	p.Received(0, 0, peerwire.BlockLength)
+	assert.Zero(t, p.minRTT)
+	assert.Equal(t, initialPipelineDepth, p.Depth())
+}
+
+func TestRequestPipelineCancelled(t *testing.T) {
+	p, advance := testPipeline()
+	p.Requested(0, 0)
+	p.Requested(0, peerwire.BlockLength)
+	p.Cancelled(0, 0)
+	assert.Len(t, p.sent, 1)
+	advance(time.Second)
+	// a block that arrives after all isn't a round trip sample
+	p.Received(0, 0, peerwire.BlockLength)
+	assert.Zero(t, p.minRTT)
+	p.Received(0, peerwire.BlockLength, peerwire.BlockLength)
+	assert.Equal(t, time.Second, p.minRTT)
+	assert.Empty(t, p.sent)
+}
+
+func TestDownloadPieceRespectsReqq(t *testing.T) {
+	fileName, content := testContent(t, 10*peerwire.BlockLength, 10*peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	seeder := &testSeeder{torrent: torrent, content: content, reqq: 2, delay: 10 * time.Millisecond}
+	peer := seeder.start(t)
+
+	conn, err := torrent.Connect(context.Background(), peer.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	data, err := conn.DownloadPiece(0, len(content))
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+	assert.Equal(t, 2, conn.PipelineDepth())
+	assert.Equal(t, int64(2), seeder.maxQueued.Load())
+}
+
+// linkDialer connects to a seeder over a simulated link.
+type linkDialer struct {
+	seeder *testSeeder
+	// latency is one way, bandwidth in bytes per second.
+	latency   time.Duration
+	bandwidth int
+}
+
+func (d *linkDialer) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	client, server := newLink(d.latency, d.bandwidth)
+	go d.seeder.serve(server)
+	return client, nil
+}
+
+// newLink returns both ends of a simulated link: what is written arrives
+// after the time it takes to send at bandwidth, queued behind the data
+// sent before, plus latency.
+func newLink(latency time.Duration, bandwidth int) (net.Conn, net.Conn) {
+	ab := newLinkDirection(latency, bandwidth)
+	ba := newLinkDirection(latency, bandwidth)
+	return &linkConn{in: ba, out: ab}, &linkConn{in: ab, out: ba}
+}
+
+type linkDirection struct {
+	latency   time.Duration
+	bandwidth int
+
+	// writeMu keeps the chunks in order, and guards the fields below.
+	writeMu sync.Mutex
+	chunks  chan linkChunk
+	// free is when the data written so far has been sent.
+	free      time.Time
+	writeDone bool
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	received []byte
+	closed   bool
+}
+
+type linkChunk struct {
+	data    []byte
+	arrival time.Time
+}
+
+func newLinkDirection(latency time.Duration, bandwidth int) *linkDirection {
+	d := &linkDirection{latency: latency, bandwidth: bandwidth, chunks: make(chan linkChunk, 1024)}
+	d.cond = sync.NewCond(&d.mu)
+	go func() {
+		for chunk := range d.chunks {
+			time.Sleep(time.Until(chunk.arrival))
+			d.mu.Lock()
+			d.received = append(d.received, chunk.data...)
+			d.cond.Broadcast()
+			d.mu.Unlock()
+		}
+	}()
+	return d
+}
+
+func (d *linkDirection) write(b []byte) (int, error) {
+	d.writeMu.Lock()
+	defer d.writeMu.Unlock()
+	if d.writeDone {
+		return 0, net.ErrClosed
+	}
+	if now := time.Now(); d.free.Before(now) {
+		d.free = now
+	}
+	d.free = d.free.Add(time.Duration(len(b)) * time.Second / time.Duration(d.bandwidth))
+	d.chunks <- linkChunk{data: bytes.Clone(b), arrival: d.free.Add(d.latency)}
+	return len(b), nil
+}
+
+func (d *linkDirection) read(b []byte) (int, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.received) == 0 && !d.closed {
+		d.cond.Wait()
+	}
+	if len(d.received) == 0 {
+		return 0, io.EOF
+	}
+	n := copy(b, d.received)
+	d.received = d.received[n:]
+	return n, nil
+}
+
+func (d *linkDirection) close() {
+	d.writeMu.Lock()
+	if !d.writeDone {
+		d.writeDone = true
+		close(d.chunks)
+	}
+	d.writeMu.Unlock()
+
+	d.mu.Lock()
+	d.closed = true
+	d.cond.Broadcast()
+	d.mu.Unlock()
+}
+
+// linkConn is an end of a simulated link. Deadlines are ignored.
+type linkConn struct {
+	in, out *linkDirection
+}
+
+func (c *linkConn) Read(b []byte) (int, error)  { return c.in.read(b) }
+func (c *linkConn) Write(b []byte) (int, error) { return c.out.write(b) }
+
+func (c *linkConn) Close() error {
+	c.in.close()
+	c.out.close()
+	return nil
+}
+
+func (c *linkConn) LocalAddr() net.Addr                { return &net.TCPAddr{} }
+func (c *linkConn) RemoteAddr() net.Addr               { return &net.TCPAddr{} }
+func (c *linkConn) SetDeadline(t time.Time) error      { return nil }
+func (c *linkConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *linkConn) SetWriteDeadline(t time.Time) error { return nil }
+
+// BenchmarkDownloadLatency downloads from a single peer over a link with a
+// 50ms round trip and 40MB/s, which needs about 120 requests in flight. A
+// reqq of 5 stands for a fixed pipeline.
+func BenchmarkDownloadLatency(b *testing.B) {
+	for _, bench := range []struct {
+		name string
+		reqq int
+	}{
+		{"reqq=5", 5},
+		{"adaptive", 0},
+	} {
+		b.Run(bench.name, func(b *testing.B) {
+			length := 4 << 20
+			fileName, content := testContent(b, length, 256<<10, "http://tracker.invalid/announce")
+			torrent, err := NewTorrent(fileName)
+			require.NoError(b, err)
+			torrent.Network = &Network{PeerDialer: &linkDialer{
+				seeder:    &testSeeder{torrent: torrent, content: content, reqq: bench.reqq},
+				latency:   25 * time.Millisecond,
+				bandwidth: 40 << 20,
+			}}
+			peers := peersAt("127.0.0.1:6881")
+
+			b.SetBytes(int64(length))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				download, err := NewDownload(torrent, &discardWriter{})
+				require.NoError(b, err)
+				require.NoError(b, download.Run(context.Background(), peers))
+			}
+		})
+	}
+}
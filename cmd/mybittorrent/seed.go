@@ -0,0 +1,321 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"slices"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerwire"
+)
+
+// maxServedRequests is the reqq we advertise: how many requests a peer may
+// queue with us. Requests beyond it are dropped.
+const maxServedRequests = 250
+
+const (
+	// defaultMaxInboundPeers bounds the connections a Seeder serves at once.
+	defaultMaxInboundPeers = 50
+	// maxAcceptDelay is the longest wait after a failed accept, as in
+	// net/http.
+	maxAcceptDelay = time.Second
+)
+
+// Verify checks the pieces of the torrent in r against their hashes and
+// returns the ones that match. Pieces that can't be read are missing.
+func (t *Torrent) Verify(r io.ReaderAt) (peerwire.Bitfield, error) {
+	layout, err := NewLayout(t.Info)
+	if err != nil {
+		return nil, err
+	}
+	have := peerwire.NewBitfield(layout.NumPieces())
+	for i := 0; i < layout.NumPieces(); i++ {
+		data := make([]byte, layout.PieceLength(i))
+		if _, err := r.ReadAt(data, int64(layout.PieceOffset(i))); err != nil {
+			continue
+		}
+		if t.VerifyPiece(i, data) == nil {
+			have.Set(i)
+		}
+	}
+	return have, nil
+}
+
+// Seeder accepts connections from peers and serves them the verified pieces
+// of the torrents added to it. Every interested peer is unchoked.
+type Seeder struct {
+	// Network's read and write timeouts apply to the accepted connections.
+	Network *Network
+	PeerID  [20]byte
+	// MaxPeers bounds the connections served at once, the ones beyond it
+	// are closed as soon as they are accepted.
+	MaxPeers int
+	// OnPeerError, if not nil, is told why a connection ended.
+	OnPeerError func(addr net.Addr, err error)
+
+	mu       sync.Mutex
+	torrents map[[20]byte]*seededTorrent
+}
+
+type seededTorrent struct {
+	torrent  *Torrent
+	layout   *Layout
+	storage  io.ReaderAt
+	have     peerwire.Bitfield
+	counters *TransferCounters
+}
+
+func NewSeeder(peerID [20]byte) *Seeder {
+	return &Seeder{PeerID: peerID, MaxPeers: defaultMaxInboundPeers, torrents: make(map[[20]byte]*seededTorrent)}
+}
+
+// Add serves torrent from storage to the peers that ask for its info hash.
+// have holds the pieces verified in storage, only they are served.
+// counters, if not nil, are told about the data uploaded.
+func (s *Seeder) Add(t *Torrent, storage io.ReaderAt, have peerwire.Bitfield, counters *TransferCounters) error {
+	infoHash, err := t.InfoHash()
+	if err != nil {
+		return err
+	}
+	layout, err := NewLayout(t.Info)
+	if err != nil {
+		return err
+	}
+	if err := have.Validate(layout.NumPieces()); err != nil {
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.torrents[infoHash] = &seededTorrent{torrent: t, layout: layout, storage: storage, have: have, counters: counters}
+	return nil
+}
+
+// Remove stops serving a torrent to new connections.
+func (s *Seeder) Remove(infoHash [20]byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	delete(s.torrents, infoHash)
+}
+
+// Serve accepts connections on listener until ctx is done, which closes
+// the listener and the connections. Temporary accept errors, such as
+// running out of file descriptors, are retried after a while; on any other
+// the connections are closed and the error returned.
+func (s *Seeder) Serve(ctx context.Context, listener net.Listener) error {
+	stop := context.AfterFunc(ctx, func() { listener.Close() })
+	defer stop()
+
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	// the connections end with ctx
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	slots := make(chan struct{}, max(s.MaxPeers, 1))
+	var delay time.Duration
+	for {
+		conn, err := listener.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			if retryAccept(err) {
+				delay = min(max(2*delay, 5*time.Millisecond), maxAcceptDelay)
+				select {
+				case <-time.After(delay):
+				case <-ctx.Done():
+				}
+				continue
+			}
+			return err
+		}
+		delay = 0
+		select {
+		case slots <- struct{}{}:
+		default:
+			conn.Close()
+			continue
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer func() { <-slots }()
+			err := s.serveConn(ctx, conn)
+			if err != nil && ctx.Err() == nil && s.OnPeerError != nil {
+				s.OnPeerError(conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// retryAccept reports whether a failed accept is worth retrying: the process
+// ran out of file descriptors, or a connection was reset before it was
+// accepted.
+func retryAccept(err error) bool {
+	var errno syscall.Errno
+	if !errors.As(err, &errno) {
+		return false
+	}
+	return errno == syscall.EMFILE || errno == syscall.ENFILE || errno == syscall.ECONNABORTED
+}
+
+func (s *Seeder) serveConn(ctx context.Context, conn net.Conn) error {
+	conn = s.Network.wrap(ctx, conn)
+	defer conn.Close()
+
+	request, err := peerwire.ReadHandshake(conn)
+	if err != nil {
+		return err
+	}
+	s.mu.Lock()
+	seeded := s.torrents[request.InfoHash]
+	s.mu.Unlock()
+	if seeded == nil {
+		return fmt.Errorf("peer asked for unknown info hash %x", request.InfoHash)
+	}
+
+	response := &peerwire.Handshake{InfoHash: request.InfoHash, PeerID: s.PeerID}
+	response.Reserved[5] |= peerwire.ReservedExtensions
+	if _, err := conn.Write(response.Marshal()); err != nil {
+		return err
+	}
+	wire := peerwire.NewConn(conn)
+	if request.Reserved[5]&peerwire.ReservedExtensions != 0 {
+		// the seeder doesn't exchange peers, so it offers no extension
+		handshake := map[string]interface{}{"m": map[string]interface{}{}, "reqq": maxServedRequests}
+		payload, err := bencode.Marshal(handshake)
+		if err != nil {
+			return err
+		}
+		if err := wire.WriteMessage(peerwire.Extended{ExtendedID: extendedHandshakeID, Payload: []byte(payload)}); err != nil {
+			return err
+		}
+	}
+	if err := wire.Send(seeded.have); err != nil {
+		return err
+	}
+
+	u := &upload{seeded: seeded, wire: wire}
+	u.cond = sync.NewCond(&u.mu)
+	sent := make(chan error, 1)
+	go func() {
+		err := u.send()
+		// stops the read below
+		conn.Close()
+		sent <- err
+	}()
+	err = u.receive()
+	u.stop()
+	if sendErr := <-sent; sendErr != nil {
+		return sendErr
+	}
+	return err
+}
+
+// upload serves a peer. One goroutine reads its messages and queues its
+// requests, another answers them in order, so that a cancel can still take
+// back a queued request.
+type upload struct {
+	seeded *seededTorrent
+	wire   *peerwire.Conn
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	queue    []peerwire.Request
+	unchoked bool
+	stopped  bool
+}
+
+// receive reads the messages of the peer until it hangs up or misbehaves.
+func (u *upload) receive() error {
+	for {
+		m, err := u.wire.ReadMessage()
+		if err != nil {
+			if err == io.EOF {
+				return nil
+			}
+			return err
+		}
+		switch m := m.(type) {
+		case peerwire.Interested:
+			u.mu.Lock()
+			unchoke := !u.unchoked
+			u.unchoked = true
+			u.mu.Unlock()
+			if unchoke {
+				if err := u.wire.Send(peerwire.Unchoke{}); err != nil {
+					return err
+				}
+			}
+		case peerwire.Request:
+			if err := u.seeded.checkRequest(m); err != nil {
+				return err
+			}
+			u.mu.Lock()
+			// requests of a choked peer, and beyond our reqq, are dropped
+			if u.unchoked && len(u.queue) < maxServedRequests {
+				u.queue = append(u.queue, m)
+				u.cond.Signal()
+			}
+			u.mu.Unlock()
+		case peerwire.Cancel:
+			u.mu.Lock()
+			u.queue = slices.DeleteFunc(u.queue, func(r peerwire.Request) bool { return r == peerwire.Request(m) })
+			u.mu.Unlock()
+		}
+	}
+}
+
+// send answers the queued requests until stop.
+func (u *upload) send() error {
+	for {
+		u.mu.Lock()
+		for len(u.queue) == 0 && !u.stopped {
+			u.cond.Wait()
+		}
+		if u.stopped {
+			u.mu.Unlock()
+			return nil
+		}
+		request := u.queue[0]
+		u.queue = u.queue[1:]
+		u.mu.Unlock()
+
+		block := make([]byte, request.Length)
+		offset := u.seeded.layout.PieceOffset(int(request.Index)) + int(request.Begin)
+		if _, err := u.seeded.storage.ReadAt(block, int64(offset)); err != nil {
+			return fmt.Errorf("failed to read piece %d: %w", request.Index, err)
+		}
+		if err := u.wire.Send(peerwire.Piece{Index: request.Index, Begin: request.Begin, Block: block}); err != nil {
+			return err
+		}
+		if u.seeded.counters != nil {
+			u.seeded.counters.AddUploaded(int64(len(block)))
+		}
+	}
+}
+
+func (u *upload) stop() {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	u.stopped = true
+	u.cond.Broadcast()
+}
+
+// checkRequest rejects requests for pieces we don't have or outside them.
+func (t *seededTorrent) checkRequest(r peerwire.Request) error {
+	index := int(r.Index)
+	if index >= t.layout.NumPieces() || !t.have.Has(index) {
+		return fmt.Errorf("peer requested piece %d, which we don't have", r.Index)
+	}
+	if r.Length == 0 || r.Length > peerwire.MaxBlockLength || int(r.Begin)+int(r.Length) > t.layout.PieceLength(index) {
+		return fmt.Errorf("peer requested %d bytes at %d of piece %d", r.Length, r.Begin, r.Index)
+	}
+	return nil
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerwire"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startSeeder serves torrent from storage on loopback until the test ends.
+// The returned function tells the errors of the connections so far.
+func startSeeder(t *testing.T, torrent *Torrent, storage io.ReaderAt, have peerwire.Bitfield, counters *TransferCounters) (Peer, func() []error) {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	seeder := NewSeeder([20]byte{1})
+	var mu sync.Mutex
+	var errs []error
+	seeder.OnPeerError = func(addr net.Addr, err error) {
+		mu.Lock()
+		errs = append(errs, err)
+		mu.Unlock()
+	}
+	require.NoError(t, seeder.Add(torrent, storage, have, counters))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- seeder.Serve(ctx, listener) }()
+	t.Cleanup(func() {
+		cancel()
+		assert.NoError(t, <-served)
+	})
+	return Peer{Addr: listener.Addr().(*net.TCPAddr).AddrPort()}, func() []error {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]error(nil), errs...)
+	}
+}
+
+func TestTorrentVerify(t *testing.T) {
+	fileName, content := testContent(t, 100_000, 2*peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+
+	have, err := torrent.Verify(bytes.NewReader(content))
+	require.NoError(t, err)
+	assert.Equal(t, bitfieldOf(4, 0, 1, 2, 3), have)
+
+	corrupt := bytes.Clone(content)
+	corrupt[40_000] ^= 0xff
+	have, err = torrent.Verify(bytes.NewReader(corrupt))
+	require.NoError(t, err)
+	assert.Equal(t, bitfieldOf(4, 0, 2, 3), have)
+
+	// pieces that can't be read are missing
+	have, err = torrent.Verify(bytes.NewReader(content[:70_000]))
+	require.NoError(t, err)
+	assert.Equal(t, bitfieldOf(4, 0, 1), have)
+}
+
+func TestOpenExistingStorage(t *testing.T) {
+	fileName := writeTorrent(t, map[string]interface{}{
+		"announce": "http://tracker.invalid/announce",
+		"info": map[string]interface{}{
+			"name":         "dir",
+			"piece length": 10,
+			"pieces":       string(make([]byte, 3*20)),
+			"files": []interface{}{
+				map[string]interface{}{"length": 15, "path": []interface{}{"a"}},
+				map[string]interface{}{"length": 15, "path": []interface{}{"b"}},
+			},
+		},
+	})
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	layout, err := NewLayout(torrent.Info)
+	require.NoError(t, err)
+	resolver, err := storage.NewResolver(t.TempDir())
+	require.NoError(t, err)
+	require.NoError(t, os.MkdirAll(filepath.Join(resolver.Root(), "dir"), 0o755))
+	require.NoError(t, os.WriteFile(filepath.Join(resolver.Root(), "dir", "a"), []byte("0123456789abcde"), 0o644))
+
+	store, err := OpenExistingStorage(layout, resolver)
+	require.NoError(t, err)
+	defer store.Close()
+	data := make([]byte, 10)
+	_, err = store.ReadAt(data, 5)
+	require.NoError(t, err)
+	assert.Equal(t, "56789abcde", string(data))
+	// the missing file isn't created
+	_, err = store.ReadAt(data, 10)
+	assert.ErrorIs(t, err, os.ErrNotExist)
+	assert.NoFileExists(t, filepath.Join(resolver.Root(), "dir", "b"))
+	_, err = store.WriteAt(data, 0)
+	assert.Error(t, err)
+}
+
+func TestOpenStorageDuplicatePaths(t *testing.T) {
+	fileName := writeTorrent(t, map[string]interface{}{
+		"announce": "http://tracker.invalid/announce",
+		"info": map[string]interface{}{
+			"name":         "dir",
+			"piece length": 10,
+			"pieces":       string(make([]byte, 3*20)),
+			"files": []interface{}{
+				map[string]interface{}{"length": 15, "path": []interface{}{"a:b"}},
+				map[string]interface{}{"length": 15, "path": []interface{}{"a_b"}},
+			},
+		},
+	})
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	layout, err := NewLayout(torrent.Info)
+	require.NoError(t, err)
+	resolver, err := storage.NewResolver(t.TempDir())
+	require.NoError(t, err)
+
+	// both sanitise to a_b, the second file is stored beside the first
+	// instead of truncating it
+	store, err := OpenStorage(layout, resolver)
+	require.NoError(t, err)
+	defer store.Close()
+	_, err = store.WriteAt([]byte("0123456789abcdefghijklmnopqrst"), 0)
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(resolver.Root(), "dir", "a_b"), store.Paths[0].Path)
+	assert.Equal(t, filepath.Join(resolver.Root(), "dir", "a_b~2"), store.Paths[1].Path)
+	require.Len(t, store.Paths[1].Remaps, 1)
+	assert.Equal(t, "duplicate path", store.Paths[1].Remaps[0].Reason)
+
+	first, err := os.ReadFile(store.Paths[0].Path)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789abcde", string(first))
+	second, err := os.ReadFile(store.Paths[1].Path)
+	require.NoError(t, err)
+	assert.Equal(t, "fghijklmnopqrst", string(second))
+}
+
+func TestSeeder(t *testing.T) {
+	fileName, content := testContent(t, 100_000, 2*peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	have, err := torrent.Verify(bytes.NewReader(content))
+	require.NoError(t, err)
+	counters := NewTransferCounters(0)
+	peer, _ := startSeeder(t, torrent, bytes.NewReader(content), have, counters)
+
+	download, err := NewDownload(torrent, &discardWriter{})
+	require.NoError(t, err)
+	download.Counters = NewTransferCounters(int64(len(content)))
+	require.NoError(t, download.Run(context.Background(), []Peer{peer}))
+	assert.Equal(t, int64(len(content)), download.Counters.Downloaded())
+	assert.Equal(t, int64(len(content)), counters.Uploaded())
+}
+
+func TestSeederRejects(t *testing.T) {
+	fileName, content := testContent(t, 100_000, 2*peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	peer, peerErrors := startSeeder(t, torrent, bytes.NewReader(content), bitfieldOf(4, 0), nil)
+
+	// the pieces we have, and our reqq, are sent to peers, but peer
+	// exchange isn't offered
+	conn, err := torrent.Connect(context.Background(), peer.String())
+	require.NoError(t, err)
+	defer conn.Close()
+	data, err := conn.DownloadPiece(0, torrent.Info.PieceLength)
+	require.NoError(t, err)
+	assert.Equal(t, content[:torrent.Info.PieceLength], data)
+	assert.Equal(t, bitfieldOf(4, 0), conn.Bitfield)
+	assert.Equal(t, maxServedRequests, conn.pipeline.limit)
+	assert.Zero(t, conn.PEXID)
+
+	// a peer asking for a piece we don't have is dropped
+	require.NoError(t, conn.Send(peerwire.Request{Index: 1, Length: peerwire.BlockLength}))
+	_, err = conn.ReadMessage()
+	assert.Error(t, err)
+
+	// and so is one that wants another torrent
+	raw, err := net.Dial("tcp", peer.String())
+	require.NoError(t, err)
+	defer raw.Close()
+	_, err = raw.Write((&peerwire.Handshake{InfoHash: [20]byte{1}}).Marshal())
+	require.NoError(t, err)
+	_, err = peerwire.ReadHandshake(raw)
+	assert.Error(t, err)
+
+	assert.Eventually(t, func() bool { return len(peerErrors()) == 2 }, time.Second, 10*time.Millisecond)
+	errs := peerErrors()
+	assert.ErrorContains(t, errs[0], "peer requested piece 1, which we don't have")
+	assert.ErrorContains(t, errs[1], "unknown info hash")
+}
+
+// flakyListener fails the accepts before the next connection with errs.
+type flakyListener struct {
+	net.Listener
+	mu   sync.Mutex
+	errs []error
+}
+
+func (l *flakyListener) Accept() (net.Conn, error) {
+	l.mu.Lock()
+	if len(l.errs) > 0 {
+		err := l.errs[0]
+		l.errs = l.errs[1:]
+		l.mu.Unlock()
+		return nil, err
+	}
+	l.mu.Unlock()
+	return l.Listener.Accept()
+}
+
+func (l *flakyListener) fail(errs ...error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.errs = append(l.errs, errs...)
+}
+
+// acceptError is the error a listener's Accept returns for errno.
+func acceptError(errno syscall.Errno) error {
+	return &net.OpError{Op: "accept", Net: "tcp", Err: os.NewSyscallError("accept", errno)}
+}
+
+func TestSeederServe(t *testing.T) {
+	fileName, content := testContent(t, 100_000, 2*peerwire.BlockLength, "http://tracker.invalid/announce")
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	have, err := torrent.Verify(bytes.NewReader(content))
+	require.NoError(t, err)
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	flaky := &flakyListener{Listener: listener}
+	flaky.fail(acceptError(syscall.EMFILE), acceptError(syscall.ECONNABORTED))
+	seeder := NewSeeder([20]byte{1})
+	seeder.MaxPeers = 1
+	require.NoError(t, seeder.Add(torrent, bytes.NewReader(content), have, nil))
+	served := make(chan error, 1)
+	go func() { served <- seeder.Serve(context.Background(), flaky) }()
+
+	// running out of file descriptors and aborted connections are retried
+	conn, err := torrent.Connect(context.Background(), listener.Addr().String())
+	require.NoError(t, err)
+	defer conn.Close()
+	data, err := conn.DownloadPiece(0, torrent.Info.PieceLength)
+	require.NoError(t, err)
+	assert.Equal(t, content[:torrent.Info.PieceLength], data)
+
+	// connections beyond MaxPeers are closed
+	_, err = torrent.Connect(context.Background(), listener.Addr().String())
+	assert.Error(t, err)
+
+	// any other error closes the connections and ends Serve
+	flaky.fail(errors.New("listener broken"))
+	_, err = torrent.Connect(context.Background(), listener.Addr().String())
+	assert.Error(t, err)
+	select {
+	case err := <-served:
+		assert.ErrorContains(t, err, "listener broken")
+	case <-time.After(5 * time.Second):
+		t.Fatal("Serve didn't return")
+	}
+	_, err = conn.ReadMessage()
+	assert.Error(t, err)
+}
+
+func TestRunSeed(t *testing.T) {
+	server := tracker.NewServer()
+	announceURL, _ := startEmbeddedTracker(t, server)
+	fileName, content := testContent(t, 200_000, 2*peerwire.BlockLength, announceURL)
+	path := filepath.Join(t.TempDir(), "content.bin")
+	require.NoError(t, os.WriteFile(path, content, 0o644))
+
+	reader, writer := io.Pipe()
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error, 1)
+	go func() {
+		c := NewClient(writer)
+		c.errOut = io.Discard
+		done <- c.RunContext(ctx, []string{"--format=json", "--lsd=false", "seed", "--listen=127.0.0.1:0", fileName, path})
+	}()
+	var output seedOutput
+	require.NoError(t, json.NewDecoder(reader).Decode(&output))
+	assert.Equal(t, seedOutput{Path: path, Listen: output.Listen, Pieces: 7, Verified: 7}, output)
+
+	// a download finds the seed through the tracker, once it announced
+	torrent, err := NewTorrent(fileName)
+	require.NoError(t, err)
+	infoHash, err := torrent.InfoHash()
+	require.NoError(t, err)
+	assert.Eventually(t, func() bool {
+		stats := server.Scrape(infoHash)
+		return len(stats) == 1 && stats[0].Complete == 1
+	}, 5*time.Second, 10*time.Millisecond)
+	downloaded := filepath.Join(t.TempDir(), "content.bin")
+	c := NewClient(&bytes.Buffer{})
+	c.errOut = io.Discard
+	require.NoError(t, c.Run([]string{"--lsd=false", "download", "-o", downloaded, fileName}))
+	data, err := os.ReadFile(downloaded)
+	require.NoError(t, err)
+	assert.Equal(t, content, data)
+
+	cancel()
+	assert.NoError(t, <-done)
+}
+
+func TestRunSeedInvalid(t *testing.T) {
+	err := NewClient(&bytes.Buffer{}).Run([]string{"seed", "../../sample.torrent"})
+	assert.ErrorContains(t, err, "usage: seed")
+
+	fileName, _ := testContent(t, 50_000, peerwire.BlockLength, "http://tracker.invalid/announce")
+	err = NewClient(&bytes.Buffer{}).Run([]string{"seed", fileName, filepath.Join(t.TempDir(), "content.bin")})
+	assert.ErrorContains(t, err, "no verified data")
+}
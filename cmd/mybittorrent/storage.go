@@ -0,0 +1,125 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/storage"
+)
+
+// Storage keeps the content of a torrent in its files. Offsets are in the
+// concatenated content of all files, as in Layout.
+type Storage struct {
+	layout *Layout
+	files  []*os.File
+	// Paths are where the files of the layout are stored, in order.
+	Paths []*storage.ResolvedPath
+}
+
+// OpenStorage creates the files of layout under the resolver's root, or
+// opens them if they exist, and sizes them to their length.
+func OpenStorage(layout *Layout, resolver *storage.Resolver) (*Storage, error) {
+	paths, err := resolvePaths(layout, resolver)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store %w", err)
+	}
+	s := &Storage{layout: layout}
+	for i, file := range layout.Files {
+		resolved := paths[i]
+		if err := os.MkdirAll(filepath.Dir(resolved.Path), 0o755); err != nil {
+			s.Close()
+			return nil, err
+		}
+		f, err := os.OpenFile(resolved.Path, os.O_RDWR|os.O_CREATE, 0o644)
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+		s.Paths = append(s.Paths, resolved)
+		if err := f.Truncate(int64(file.Length)); err != nil {
+			s.Close()
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// OpenExistingStorage opens the files of layout under the resolver's root
+// for reading, as they are. Missing files are left out: reading from them
+// fails with fs.ErrNotExist.
+func OpenExistingStorage(layout *Layout, resolver *storage.Resolver) (*Storage, error) {
+	paths, err := resolvePaths(layout, resolver)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find %w", err)
+	}
+	s := &Storage{layout: layout}
+	for _, resolved := range paths {
+		f, err := os.Open(resolved.Path)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			s.Close()
+			return nil, err
+		}
+		s.files = append(s.files, f)
+		s.Paths = append(s.Paths, resolved)
+	}
+	return s, nil
+}
+
+// resolvePaths resolves the paths of the files of layout, in order.
+func resolvePaths(layout *Layout, resolver *storage.Resolver) ([]*storage.ResolvedPath, error) {
+	paths := make([][]string, len(layout.Files))
+	for i, file := range layout.Files {
+		paths[i] = file.Path
+	}
+	return resolver.ResolveAll(paths)
+}
+
+// WriteAt writes p at offset off of the torrent's content, across as many
+// files as it covers.
+func (s *Storage) WriteAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(s.layout.TotalLength) {
+		return 0, fmt.Errorf("write of %d bytes at %d is outside the torrent", len(p), off)
+	}
+	written := 0
+	for _, span := range s.layout.Spans(int(off), len(p)) {
+		n, err := s.files[span.FileIndex].WriteAt(p[written:written+span.Length], int64(span.Offset))
+		written += n
+		if err != nil {
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+// ReadAt reads len(p) bytes at offset off of the torrent's content.
+func (s *Storage) ReadAt(p []byte, off int64) (int, error) {
+	if off < 0 || off+int64(len(p)) > int64(s.layout.TotalLength) {
+		return 0, fmt.Errorf("read of %d bytes at %d is outside the torrent", len(p), off)
+	}
+	read := 0
+	for _, span := range s.layout.Spans(int(off), len(p)) {
+		if s.files[span.FileIndex] == nil {
+			return read, fmt.Errorf("%s: %w", s.Paths[span.FileIndex].Path, fs.ErrNotExist)
+		}
+		n, err := s.files[span.FileIndex].ReadAt(p[read:read+span.Length], int64(span.Offset))
+		read += n
+		if err != nil {
+			return read, err
+		}
+	}
+	return read, nil
+}
+
+func (s *Storage) Close() error {
+	var errs []error
+	for _, f := range s.files {
+		if f != nil {
+			errs = append(errs, f.Close())
+		}
+	}
+	return errors.Join(errs...)
+}
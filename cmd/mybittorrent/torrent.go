@@ -1,222 +1,336 @@
 package main
 
 import (
+	"context"
 	"crypto/sha1"
-	"encoding/binary"
 	"fmt"
 	"io"
-	"net"
-	"net/http"
-	"net/url"
 	"os"
-	"strconv"
+	"sync"
 
 	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerid"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerwire"
 )
 
-const peerId string = "00112233445566778899"
-const peerPort string = "6881"
+// defaultPort is the port we tell trackers and peers we listen on.
+const defaultPort = 6881
+
+// defaultPeerID identifies this process when no peer id is configured.
+var defaultPeerID = sync.OnceValue(func() [20]byte {
+	id, _ := peerid.Generate(peerid.Prefix)
+	return id
+})
 
 type Torrent struct {
 	Announce string `bencode:"announce"`
-	Info     *Info
+	// AnnounceList holds tiers of tracker URLs (BEP 12). When present it
+	// replaces Announce.
+	AnnounceList [][]string `bencode:"announce-list"`
+	Info         *Info
+	// Network configures connections to peers and trackers. Nil means
+	// DefaultNetwork.
+	Network *Network
+	// PeerID and Port identify us to trackers and peers. Zero values mean
+	// the process wide peer id and defaultPort.
+	PeerID [20]byte
+	Port   int
+	// rawInfo is the info dictionary as decoded from the torrent file. The
+	// info hash is computed from it so that keys we don't model still count.
+	rawInfo map[string]interface{}
 }
 
 type Info struct {
-	Name        string `bencode:"name"`
-	Length      int    `bencode:"length"`
-	PieceLength int    `bencode:"piece length"`
+	Name string `bencode:"name"`
+	// Length is only set for single file torrents, see TotalLength.
+	Length      int `bencode:"length"`
+	PieceLength int `bencode:"piece length"`
 	// concatenated SHA-1 hashes of each piece (20 bytes each)
 	Pieces string `bencode:"pieces"`
+	// Files is only set for multi-file torrents.
+	Files []File `bencode:"files"`
+	// Private torrents (BEP 27) only get peers from their trackers, so DHT
+	// and peer exchange must not be used for them.
+	Private bool `bencode:"private"`
 }
 
-func NewTorrent(fileName string) (torrent *Torrent, err error) {
-	rawData, err := os.ReadFile(fileName)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read file: %w", err)
-	}
+type File struct {
+	Length int      `bencode:"length"`
+	Path   []string `bencode:"path"`
+}
 
-	result, err := bencode.Unmarshal(string(rawData))
-	if err != nil {
-		return nil, fmt.Errorf("failed to decode bencode: %v", err)
+// TotalLength is the length of all the content in the torrent.
+func (info *Info) TotalLength() int {
+	if len(info.Files) == 0 {
+		return info.Length
 	}
-
-	data, ok := result.(map[string]interface{})
-	if !ok {
-		return nil, fmt.Errorf("invalid torrent file. Root element is not a dictionary")
+	total := 0
+	for _, file := range info.Files {
+		total += file.Length
 	}
+	return total
+}
 
-	info := data["info"].(map[string]interface{})
+// NumPieces is the number of piece hashes in the torrent.
+func (info *Info) NumPieces() int {
+	return len(info.Pieces) / 20
+}
 
-	torrentInfo := &Info{
-		Name:        info["name"].(string),
-		Length:      info["length"].(int),
-		PieceLength: info["piece length"].(int),
-		Pieces:      info["pieces"].(string),
+// dictionary converts the info back into its bencode dictionary form.
+func (info *Info) dictionary() map[string]interface{} {
+	dict := map[string]interface{}{
+		"name":         info.Name,
+		"piece length": info.PieceLength,
+		"pieces":       info.Pieces,
 	}
-
-	torrent = &Torrent{
-		Announce: data["announce"].(string),
-		Info:     torrentInfo,
+	if info.Private {
+		dict["private"] = 1
+	}
+	if len(info.Files) == 0 {
+		dict["length"] = info.Length
+		return dict
 	}
 
-	return torrent, nil
+	files := make([]interface{}, 0, len(info.Files))
+	for _, file := range info.Files {
+		path := make([]interface{}, 0, len(file.Path))
+		for _, component := range file.Path {
+			path = append(path, component)
+		}
+		files = append(files, map[string]interface{}{"length": file.Length, "path": path})
+	}
+	dict["files"] = files
+	return dict
 }
 
-func (torrent *Torrent) InfoHash() ([20]byte, error) {
-	bencodeData, err := bencode.ToBencodeDictionary(*torrent.Info)
-	empty := [20]byte{}
-	if err != nil {
-		return empty, err
-	}
-	bencodedString, err := bencode.Marshal(bencodeData)
+func NewTorrent(fileName string) (torrent *Torrent, err error) {
+	rawData, err := os.ReadFile(fileName)
 	if err != nil {
-		return empty, fmt.Errorf("failed to bencode info: %v", err)
+		return nil, fmt.Errorf("failed to read file: %w", err)
 	}
-
-	return sha1.Sum([]byte(bencodedString)), nil
-
+	return ParseTorrentBytes(rawData)
 }
 
-func (torrent *Torrent) PieceHashes() ([]string, error) {
-	pieces := torrent.Info.Pieces
-
-	if len(pieces)%20 != 0 {
-		return nil, fmt.Errorf("invalid pieces length")
-	}
-
-	result := make([]string, len(pieces)/20)
-	for i := 0; i < len(pieces); i += 20 {
-		result = append(result, fmt.Sprintf("%x\n", pieces[i:i+20]))
+// ParseTorrent reads a whole torrent file from r.
+func ParseTorrent(r io.Reader) (*Torrent, error) {
+	rawData, err := io.ReadAll(r)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read torrent: %w", err)
 	}
-
-	return result, nil
+	return ParseTorrentBytes(rawData)
 }
 
-func (t *Torrent) Handshake(peerAddress string) (peerId []byte, err error) {
-	infoHash, err := t.InfoHash()
+func ParseTorrentBytes(rawData []byte) (torrent *Torrent, err error) {
+	data, err := decodeTorrent(rawData)
 	if err != nil {
 		return nil, err
 	}
 
-	conn, err := net.Dial("tcp", peerAddress)
-	if err != nil {
-		return nil, err
+	info, ok := data["info"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid torrent file. Missing info dictionary")
 	}
 
-	defer conn.Close()
-
-	// Peer protocol handshake message is 68 bytes.
-	var handshake = make([]byte, 68)
-	handshake[0] = 19
-	copy(handshake[1:20], []byte("BitTorrent protocol"))
-	copy(handshake[28:48], infoHash[:])
-	copy(handshake[48:], []byte(peerId))
-
-	_, err = conn.Write(handshake)
+	announce, _ := data["announce"].(string)
+	name, ok := info["name"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid torrent file. Missing name")
+	}
+	length, hasLength := info["length"].(int)
+	files, err := parseFiles(info["files"])
 	if err != nil {
 		return nil, err
 	}
+	if !hasLength && files == nil {
+		return nil, fmt.Errorf("invalid torrent file. Missing length")
+	}
+	pieceLength, ok := info["piece length"].(int)
+	if !ok || pieceLength <= 0 {
+		return nil, fmt.Errorf("invalid torrent file. Missing or invalid piece length")
+	}
+	pieces, ok := info["pieces"].(string)
+	if !ok {
+		return nil, fmt.Errorf("invalid torrent file. Missing pieces")
+	}
 
-	response := make([]byte, 68)
-	_, err = io.ReadFull(conn, response)
-	if err != nil {
-		return nil, err
+	private, _ := info["private"].(int)
+	torrentInfo := &Info{
+		Name:        name,
+		Length:      length,
+		PieceLength: pieceLength,
+		Pieces:      pieces,
+		Files:       files,
+		Private:     private == 1,
 	}
 
-	return response[48:], nil
-}
+	torrent = &Torrent{
+		Announce:     announce,
+		AnnounceList: parseAnnounceList(data["announce-list"]),
+		Info:         torrentInfo,
+		rawInfo:      info,
+	}
 
-type TrackerResponse struct {
-	Interval int
-	Peers    []string
+	return torrent, nil
 }
 
-func (t *Torrent) DiscoverPeers() (*TrackerResponse, error) {
-	infoHash, err := t.InfoHash()
-	if err != nil {
-		return nil, err
+// parseAnnounceList returns the non-empty tiers of an announce-list. Entries
+// of the wrong type are skipped rather than failing the whole torrent.
+func parseAnnounceList(value interface{}) [][]string {
+	list, _ := value.([]interface{})
+	var tiers [][]string
+	for _, rawTier := range list {
+		rawURLs, _ := rawTier.([]interface{})
+		var tier []string
+		for _, rawURL := range rawURLs {
+			if u, ok := rawURL.(string); ok && u != "" {
+				tier = append(tier, u)
+			}
+		}
+		if len(tier) > 0 {
+			tiers = append(tiers, tier)
+		}
 	}
+	return tiers
+}
 
-	infoHashEscaped := url.QueryEscape(string(infoHash[:]))
-	queryParams := url.Values{
-		"peer_id":    {peerId},
-		"port":       {peerPort},
-		"uploaded":   {"0"},
-		"downloaded": {"0"},
-		"left":       {strconv.Itoa(t.Info.Length)},
-		"compact":    {string("1")},
+// Trackers returns the torrent's tracker tiers, falling back to a single
+// tier with Announce when there is no announce-list.
+func (t *Torrent) Trackers() [][]string {
+	if len(t.AnnounceList) > 0 {
+		return t.AnnounceList
 	}
-
-	// encoding the info hash along with the other query params breaks the url
-	resp, err := http.Get(t.Announce + "?" + queryParams.Encode() + "&info_hash=" + infoHashEscaped)
-
-	if err != nil {
-		return nil, err
+	if t.Announce != "" {
+		return [][]string{{t.Announce}}
 	}
+	return nil
+}
 
-	defer func() {
-		err = resp.Body.Close()
-	}()
+func (t *Torrent) peerID() [20]byte {
+	if t.PeerID == [20]byte{} {
+		return defaultPeerID()
+	}
+	return t.PeerID
+}
 
-	if resp.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("failed to fetch peers. HTTP status code: %v", resp.StatusCode)
+func (t *Torrent) port() int {
+	if t.Port == 0 {
+		return defaultPort
 	}
+	return t.Port
+}
 
-	body, err := io.ReadAll(resp.Body)
-	if err != nil {
-		return nil, fmt.Errorf("failed to read response body. err:%v", err)
+// decodeTorrent decodes raw torrent data into its root dictionary.
+func decodeTorrent(rawData []byte) (map[string]interface{}, error) {
+	if len(rawData) == 0 {
+		return nil, fmt.Errorf("invalid torrent file. No data")
 	}
 
-	rawBody := string(body)
-	value, err := bencode.Unmarshal(rawBody)
+	result, err := bencode.Unmarshal(string(rawData))
 	if err != nil {
-		return nil, fmt.Errorf("failed to decode response. response: %v err:%v", rawBody, err)
+		return nil, fmt.Errorf("failed to decode bencode: %v", err)
 	}
 
-	data, ok := value.(map[string]interface{})
+	data, ok := result.(map[string]interface{})
 	if !ok {
-		return nil, fmt.Errorf("invalid response. root value is not a map. response: %v", rawBody)
+		return nil, fmt.Errorf("invalid torrent file. Root element is not a dictionary")
 	}
+	return data, nil
+}
 
-	interval, ok := data["interval"].(int)
-	if !ok {
-		return nil, fmt.Errorf("invalid response. Could not find interval. response: %v", rawBody)
+func parseFiles(value interface{}) ([]File, error) {
+	if value == nil {
+		return nil, nil
+	}
+	list, ok := value.([]interface{})
+	if !ok || len(list) == 0 {
+		return nil, fmt.Errorf("invalid torrent file. Invalid files list")
 	}
 
-	peers, ok := data["peers"].(string)
-	if !ok {
-		return nil, fmt.Errorf("invalid response.  Could not find peers. response: %v", rawBody)
+	files := make([]File, 0, len(list))
+	for i, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, fmt.Errorf("invalid torrent file. File %d is not a dictionary", i)
+		}
+		length, ok := entry["length"].(int)
+		if !ok || length < 0 {
+			return nil, fmt.Errorf("invalid torrent file. File %d has an invalid length", i)
+		}
+		rawPath, ok := entry["path"].([]interface{})
+		if !ok || len(rawPath) == 0 {
+			return nil, fmt.Errorf("invalid torrent file. File %d has an invalid path", i)
+		}
+		path := make([]string, 0, len(rawPath))
+		for _, component := range rawPath {
+			s, ok := component.(string)
+			if !ok {
+				return nil, fmt.Errorf("invalid torrent file. File %d has an invalid path", i)
+			}
+			path = append(path, s)
+		}
+		files = append(files, File{Length: length, Path: path})
 	}
+	return files, nil
+}
 
-	peersList, err := parsePeersResponse(peers)
+func (torrent *Torrent) InfoHash() ([20]byte, error) {
+	empty := [20]byte{}
+	bencodeData := torrent.rawInfo
+	if bencodeData == nil {
+		bencodeData = torrent.Info.dictionary()
+	}
+	bencodedString, err := bencode.Marshal(bencodeData)
 	if err != nil {
-		return nil, err
+		return empty, fmt.Errorf("failed to bencode info: %v", err)
 	}
 
-	return &TrackerResponse{
-		Interval: interval,
-		Peers:    peersList,
-	}, nil
+	return sha1.Sum([]byte(bencodedString)), nil
+
 }
 
-func parsePeersResponse(byteString string) ([]string, error) {
-	data := []byte(byteString)
+func (torrent *Torrent) PieceHashes() ([]string, error) {
+	pieces := torrent.Info.Pieces
 
-	if len(data) == 0 {
-		return nil, fmt.Errorf("invalid response: empty peers field")
+	if len(pieces)%20 != 0 {
+		return nil, fmt.Errorf("invalid pieces length")
 	}
 
-	if len(data)%6 != 0 {
-		return nil, fmt.Errorf("invalid response: peers field length (%d) is not a multiple of 6", len(data))
+	result := make([]string, 0, len(pieces)/20)
+	for i := 0; i < len(pieces); i += 20 {
+		result = append(result, fmt.Sprintf("%x\n", pieces[i:i+20]))
 	}
 
-	peers := make([]string, 0, len(data)/6)
-	for i := 0; i < len(data); i += 6 {
-		ip := net.IP(data[i : i+4])
-		port := binary.BigEndian.Uint16(data[i+4 : i+6])
-		peers = append(peers, fmt.Sprintf("%s:%d", ip.String(), port))
-	}
+	return result, nil
+}
+
+// HandshakeResult is what a peer told us about itself in its handshake.
+type HandshakeResult struct {
+	PeerID   [20]byte
+	Reserved [8]byte
+}
+
+// SupportsExtensions reports whether the peer supports the extension
+// protocol (BEP 10).
+func (h *HandshakeResult) SupportsExtensions() bool {
+	return h.Reserved[5]&peerwire.ReservedExtensions != 0
+}
+
+// SupportsDHT reports whether the peer runs a DHT node (BEP 5).
+func (h *HandshakeResult) SupportsDHT() bool {
+	return h.Reserved[7]&peerwire.ReservedDHT != 0
+}
+
+// SupportsFast reports whether the peer supports the fast extension (BEP 6).
+func (h *HandshakeResult) SupportsFast() bool {
+	return h.Reserved[7]&peerwire.ReservedFast != 0
+}
 
-	return peers, nil
+// Handshake connects to a peer only to exchange handshakes.
+func (t *Torrent) Handshake(ctx context.Context, peerAddress string) (*HandshakeResult, error) {
+	conn, err := t.Connect(ctx, peerAddress)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return &HandshakeResult{PeerID: conn.PeerID, Reserved: conn.Reserved}, nil
 }
@@ -0,0 +1,769 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// Peer is a peer address as returned by a peer source such as a tracker.
+type Peer struct {
+	Addr netip.AddrPort
+	// ID is the peer's id when the source knows it, nil otherwise.
+	ID []byte
+}
+
+func (p Peer) String() string {
+	return p.Addr.String()
+}
+
+type TrackerResponse struct {
+	Interval int
+	// MinInterval is how often we may re-announce at most, zero if not given.
+	MinInterval int
+	Peers       []Peer
+	// TrackerID must be sent back on later announces to the same tracker.
+	TrackerID string
+	// Complete and Incomplete are the number of seeders and leechers.
+	Complete   int
+	Incomplete int
+	// WarningMessage is set when the announce succeeded but the tracker has
+	// something to tell.
+	WarningMessage string
+}
+
+// TrackerError is returned when a tracker answers with a failure reason.
+type TrackerError struct {
+	Reason string
+	// RetryIn is how many minutes the tracker wants us to wait before trying
+	// again (BEP 31), zero if not given.
+	RetryIn int
+	// Never is set when the tracker asks to never retry.
+	Never bool
+}
+
+func (e *TrackerError) Error() string {
+	return "tracker failure: " + e.Reason
+}
+
+type AnnounceEvent string
+
+const (
+	EventNone      AnnounceEvent = ""
+	EventStarted   AnnounceEvent = "started"
+	EventCompleted AnnounceEvent = "completed"
+	EventStopped   AnnounceEvent = "stopped"
+)
+
+// AnnounceRequest holds the parameters of a single tracker announce.
+type AnnounceRequest struct {
+	InfoHash   [20]byte
+	PeerID     string
+	Port       int
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      AnnounceEvent
+	// NumWant is the number of peers we'd like. Zero leaves it to the tracker.
+	NumWant int
+	// Key identifies this client to the tracker across IP address changes.
+	Key string
+	// IP is our address, if it differs from the one we connect from.
+	IP string
+	// TrackerID overrides the id the tracker client remembers from earlier
+	// responses.
+	TrackerID string
+}
+
+func (req *AnnounceRequest) query() string {
+	queryParams := url.Values{
+		"peer_id":    {req.PeerID},
+		"port":       {strconv.Itoa(req.Port)},
+		"uploaded":   {strconv.FormatInt(req.Uploaded, 10)},
+		"downloaded": {strconv.FormatInt(req.Downloaded, 10)},
+		"left":       {strconv.FormatInt(req.Left, 10)},
+		"compact":    {string("1")},
+	}
+	if req.Event != EventNone {
+		queryParams.Set("event", string(req.Event))
+	}
+	if req.NumWant > 0 {
+		queryParams.Set("numwant", strconv.Itoa(req.NumWant))
+	}
+	if req.Key != "" {
+		queryParams.Set("key", req.Key)
+	}
+	if req.IP != "" {
+		queryParams.Set("ip", req.IP)
+	}
+	if req.TrackerID != "" {
+		queryParams.Set("trackerid", req.TrackerID)
+	}
+
+	// encoding the info hash along with the other query params breaks the url
+	return queryParams.Encode() + "&info_hash=" + url.QueryEscape(string(req.InfoHash[:]))
+}
+
+// ScrapeResult is a tracker's view of a single swarm.
+type ScrapeResult struct {
+	InfoHash  [20]byte
+	Seeders   int
+	Completed int
+	Leechers  int
+}
+
+// ErrScrapeUnsupported is returned by trackers that have no scrape endpoint.
+var ErrScrapeUnsupported = errors.New("tracker does not support scrape")
+
+// TrackerClient talks to a single tracker.
+type TrackerClient interface {
+	Announce(ctx context.Context, req *AnnounceRequest) (*TrackerResponse, error)
+	// Scrape returns the swarm statistics for the given info hashes. Hashes
+	// the tracker doesn't know are left out of the result.
+	Scrape(ctx context.Context, infoHashes ...[20]byte) ([]ScrapeResult, error)
+}
+
+// NewTrackerClient returns a client for the tracker at announceURL, picked by
+// the URL's scheme. A nil network means DefaultNetwork.
+func NewTrackerClient(announceURL string, network *Network) (TrackerClient, error) {
+	u, err := url.Parse(announceURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid tracker URL: %w", err)
+	}
+	switch u.Scheme {
+	case "http", "https":
+		return &HTTPTracker{URL: announceURL, Client: network.HTTPClient()}, nil
+	case "udp":
+		tracker, err := NewUDPTracker(u.Host)
+		if err != nil {
+			return nil, err
+		}
+		tracker.Network = network
+		return tracker, nil
+	default:
+		return nil, fmt.Errorf("unsupported tracker URL scheme: %q", u.Scheme)
+	}
+}
+
+// HTTPTracker is a client for HTTP(S) trackers.
+type HTTPTracker struct {
+	URL    string
+	Client *http.Client
+
+	mu        sync.Mutex
+	trackerID string
+}
+
+// Announce sends an announce, echoing the tracker id from earlier responses.
+func (t *HTTPTracker) Announce(ctx context.Context, req *AnnounceRequest) (*TrackerResponse, error) {
+	t.mu.Lock()
+	if req.TrackerID == "" && t.trackerID != "" {
+		withID := *req
+		withID.TrackerID = t.trackerID
+		req = &withID
+	}
+	t.mu.Unlock()
+
+	response, err := announceHTTP(ctx, t.Client, t.URL, req)
+	if err != nil {
+		return nil, err
+	}
+
+	if response.TrackerID != "" {
+		t.mu.Lock()
+		t.trackerID = response.TrackerID
+		t.mu.Unlock()
+	}
+	return response, nil
+}
+
+// ScrapeURL derives the scrape URL from the announce URL by convention: the
+// last path component must start with "announce", which is replaced by
+// "scrape".
+func (t *HTTPTracker) ScrapeURL() (string, error) {
+	u, err := url.Parse(t.URL)
+	if err != nil {
+		return "", err
+	}
+	slash := strings.LastIndex(u.Path, "/")
+	if !strings.HasPrefix(u.Path[slash+1:], "announce") {
+		return "", ErrScrapeUnsupported
+	}
+	u.Path = u.Path[:slash+1] + "scrape" + strings.TrimPrefix(u.Path[slash+1:], "announce")
+	u.RawPath = ""
+	return u.String(), nil
+}
+
+// httpMaxScrapeHashes keeps scrape URLs to a length trackers accept.
+const httpMaxScrapeHashes = 64
+
+func (t *HTTPTracker) Scrape(ctx context.Context, infoHashes ...[20]byte) ([]ScrapeResult, error) {
+	scrapeURL, err := t.ScrapeURL()
+	if err != nil {
+		return nil, err
+	}
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += httpMaxScrapeHashes {
+		batch := infoHashes[start:min(start+httpMaxScrapeHashes, len(infoHashes))]
+		batchResults, err := t.scrape(ctx, scrapeURL, batch)
+		if err != nil {
+			return nil, err
+		}
+		results = append(results, batchResults...)
+	}
+	return results, nil
+}
+
+func (t *HTTPTracker) scrape(ctx context.Context, scrapeURL string, infoHashes [][20]byte) (results []ScrapeResult, err error) {
+	query := make([]string, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		query = append(query, "info_hash="+url.QueryEscape(string(infoHash[:])))
+	}
+	separator := "?"
+	if strings.Contains(scrapeURL, "?") {
+		separator = "&"
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, scrapeURL+separator+strings.Join(query, "&"), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := t.Client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		if closeErr := resp.Body.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body. err:%v", err)
+	}
+	rawBody := string(body)
+
+	if resp.StatusCode != http.StatusOK {
+		if trackerErr := parseFailureReason(rawBody); trackerErr != nil {
+			return nil, trackerErr
+		}
+		return nil, fmt.Errorf("failed to scrape. HTTP status code: %v", resp.StatusCode)
+	}
+
+	return parseScrapeResponse(rawBody, infoHashes)
+}
+
+func parseScrapeResponse(rawBody string, infoHashes [][20]byte) ([]ScrapeResult, error) {
+	if rawBody == "" {
+		return nil, fmt.Errorf("invalid scrape response. empty body")
+	}
+	value, err := bencode.Unmarshal(rawBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode scrape response. response: %v err:%v", rawBody, err)
+	}
+	data, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid scrape response. root value is not a map. response: %v", rawBody)
+	}
+	if trackerErr := failureReason(data); trackerErr != nil {
+		return nil, trackerErr
+	}
+	files, ok := data["files"].(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid scrape response. Could not find files. response: %v", rawBody)
+	}
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		file, ok := files[string(infoHash[:])].(map[string]interface{})
+		if !ok {
+			continue
+		}
+		result := ScrapeResult{InfoHash: infoHash}
+		result.Seeders, _ = file["complete"].(int)
+		result.Completed, _ = file["downloaded"].(int)
+		result.Leechers, _ = file["incomplete"].(int)
+		results = append(results, result)
+	}
+	return results, nil
+}
+
+// DiscoverPeers announces to the torrent's trackers, trying tiers in order.
+func (t *Torrent) DiscoverPeers(ctx context.Context) (*TrackerResponse, error) {
+	tiers, err := NewTrackerTiers(t.Trackers(), t.Network)
+	if err != nil {
+		return nil, err
+	}
+	return t.DiscoverPeersWith(ctx, tiers)
+}
+
+// DiscoverPeersWith announces to the given tracker as a fresh leecher.
+func (t *Torrent) DiscoverPeersWith(ctx context.Context, tracker TrackerClient) (*TrackerResponse, error) {
+	infoHash, err := t.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+
+	peerID := t.peerID()
+	return tracker.Announce(ctx, &AnnounceRequest{
+		InfoHash: infoHash,
+		PeerID:   string(peerID[:]),
+		Port:     t.port(),
+		Left:     int64(t.Info.TotalLength()),
+	})
+}
+
+func announceHTTP(ctx context.Context, client *http.Client, announceURL string, req *AnnounceRequest) (response *TrackerResponse, err error) {
+	separator := "?"
+	if u, err := url.Parse(announceURL); err == nil && u.RawQuery != "" {
+		separator = "&"
+	}
+
+	httpRequest, err := http.NewRequestWithContext(ctx, http.MethodGet, announceURL+separator+req.query(), nil)
+	if err != nil {
+		return nil, err
+	}
+
+	resp, err := client.Do(httpRequest)
+	if err != nil {
+		return nil, err
+	}
+
+	defer func() {
+		if closeErr := resp.Body.Close(); err == nil {
+			err = closeErr
+		}
+	}()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response body. err:%v", err)
+	}
+
+	if resp.StatusCode != http.StatusOK {
+		// some trackers send their failure reason with an error status
+		if trackerErr := parseFailureReason(string(body)); trackerErr != nil {
+			return nil, trackerErr
+		}
+		return nil, fmt.Errorf("failed to fetch peers. HTTP status code: %v", resp.StatusCode)
+	}
+
+	return parseTrackerResponse(string(body))
+}
+
+// parseFailureReason returns the tracker's failure, if rawBody is a bencoded
+// dictionary with a failure reason.
+func parseFailureReason(rawBody string) *TrackerError {
+	if rawBody == "" {
+		return nil
+	}
+	value, err := bencode.Unmarshal(rawBody)
+	if err != nil {
+		return nil
+	}
+	data, ok := value.(map[string]interface{})
+	if !ok {
+		return nil
+	}
+	return failureReason(data)
+}
+
+func failureReason(data map[string]interface{}) *TrackerError {
+	reason, ok := data["failure reason"].(string)
+	if !ok {
+		return nil
+	}
+	trackerErr := &TrackerError{Reason: reason}
+	switch retry := data["retry in"].(type) {
+	case int:
+		trackerErr.RetryIn = retry
+	case string:
+		trackerErr.Never = retry == "never"
+	}
+	return trackerErr
+}
+
+func parseTrackerResponse(rawBody string) (*TrackerResponse, error) {
+	if rawBody == "" {
+		return nil, fmt.Errorf("invalid response. empty body")
+	}
+
+	value, err := bencode.Unmarshal(rawBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decode response. response: %v err:%v", rawBody, err)
+	}
+
+	data, ok := value.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid response. root value is not a map. response: %v", rawBody)
+	}
+
+	if trackerErr := failureReason(data); trackerErr != nil {
+		return nil, trackerErr
+	}
+
+	interval, ok := data["interval"].(int)
+	if !ok {
+		return nil, fmt.Errorf("invalid response. Could not find interval. response: %v", rawBody)
+	}
+
+	peersList, err := parsePeers(data)
+	if err != nil {
+		return nil, err
+	}
+
+	response := &TrackerResponse{
+		Interval: interval,
+		Peers:    peersList,
+	}
+	response.MinInterval, _ = data["min interval"].(int)
+	response.TrackerID, _ = data["tracker id"].(string)
+	response.Complete, _ = data["complete"].(int)
+	response.Incomplete, _ = data["incomplete"].(int)
+	response.WarningMessage, _ = data["warning message"].(string)
+
+	return response, nil
+}
+
+// parsePeers collects the peers of a tracker response from the compact or
+// dictionary form of "peers" (BEP 3, BEP 23) and the compact "peers6" (BEP 7).
+// A response without peers is valid.
+func parsePeers(data map[string]interface{}) ([]Peer, error) {
+	peers := []Peer{}
+
+	switch value := data["peers"].(type) {
+	case nil:
+	case string:
+		compact, err := parseCompactPeers(value, 4)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, compact...)
+	case []interface{}:
+		peers = append(peers, parsePeerDictionaries(value)...)
+	default:
+		return nil, fmt.Errorf("invalid response: peers field is neither a string nor a list")
+	}
+
+	switch value := data["peers6"].(type) {
+	case nil:
+	case string:
+		compact, err := parseCompactPeers(value, 16)
+		if err != nil {
+			return nil, err
+		}
+		peers = append(peers, compact...)
+	default:
+		return nil, fmt.Errorf("invalid response: peers6 field is not a string")
+	}
+
+	return peers, nil
+}
+
+// parseCompactPeers parses peers encoded as an ip address of ipLength bytes
+// followed by a 2 byte port, all in network byte order.
+func parseCompactPeers(byteString string, ipLength int) ([]Peer, error) {
+	data := []byte(byteString)
+	size := ipLength + 2
+
+	if len(data)%size != 0 {
+		return nil, fmt.Errorf("invalid response: peers field length (%d) is not a multiple of %d", len(data), size)
+	}
+
+	peers := make([]Peer, 0, len(data)/size)
+	for i := 0; i < len(data); i += size {
+		ip, _ := netip.AddrFromSlice(data[i : i+ipLength])
+		port := binary.BigEndian.Uint16(data[i+ipLength : i+size])
+		peers = append(peers, Peer{Addr: netip.AddrPortFrom(ip.Unmap(), port)})
+	}
+
+	return peers, nil
+}
+
+// parsePeerDictionaries parses the original peer list form, a list of
+// dictionaries with "peer id", "ip" and "port" keys. Entries that aren't an
+// ip address literal, such as host names, are skipped.
+func parsePeerDictionaries(list []interface{}) []Peer {
+	peers := make([]Peer, 0, len(list))
+	for _, item := range list {
+		entry, ok := item.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ipString, _ := entry["ip"].(string)
+		ip, err := netip.ParseAddr(ipString)
+		if err != nil {
+			continue
+		}
+		port, ok := entry["port"].(int)
+		if !ok || port <= 0 || port > 65535 {
+			continue
+		}
+
+		peer := Peer{Addr: netip.AddrPortFrom(ip.Unmap(), uint16(port))}
+		if id, ok := entry["peer id"].(string); ok && len(id) == 20 {
+			peer.ID = []byte(id)
+		}
+		peers = append(peers, peer)
+	}
+	return peers
+}
+
+// TransferCounters are the transfer statistics of a download session, as
+// reported to trackers. They are safe for concurrent use.
+type TransferCounters struct {
+	uploaded   atomic.Int64
+	downloaded atomic.Int64
+	left       atomic.Int64
+	redundant  atomic.Int64
+}
+
+func NewTransferCounters(left int64) *TransferCounters {
+	counters := &TransferCounters{}
+	counters.left.Store(left)
+	return counters
+}
+
+func (c *TransferCounters) AddUploaded(n int64) {
+	c.uploaded.Add(n)
+}
+
+// AddDownloaded records n bytes of verified data as downloaded.
+func (c *TransferCounters) AddDownloaded(n int64) {
+	c.downloaded.Add(n)
+	c.left.Add(-n)
+}
+
+// AddRedundant records n bytes received that weren't needed, such as blocks
+// that arrived from another peer first in endgame mode. Trackers aren't told
+// about them.
+func (c *TransferCounters) AddRedundant(n int64) {
+	c.redundant.Add(n)
+}
+
+func (c *TransferCounters) Uploaded() int64 {
+	return c.uploaded.Load()
+}
+
+func (c *TransferCounters) Downloaded() int64 {
+	return c.downloaded.Load()
+}
+
+func (c *TransferCounters) Left() int64 {
+	return c.left.Load()
+}
+
+func (c *TransferCounters) Redundant() int64 {
+	return c.redundant.Load()
+}
+
+// defaultAnnounceInterval is used until a tracker tells us its interval.
+const defaultAnnounceInterval = 30 * time.Minute
+
+// stoppedAnnounceTimeout bounds the final "stopped" announce, which is sent
+// after the session's context is already cancelled.
+const stoppedAnnounceTimeout = 5 * time.Second
+
+// Announcer keeps a tracker informed about a download session: it sends the
+// started, periodic, completed and stopped announces with the session's
+// current transfer statistics.
+type Announcer struct {
+	tracker  TrackerClient
+	infoHash [20]byte
+	counters *TransferCounters
+
+	PeerID  string
+	Port    int
+	NumWant int
+	IP      string
+	// Interval overrides the interval requested by the tracker when set.
+	Interval time.Duration
+
+	key       string
+	completed chan struct{}
+
+	mu           sync.Mutex
+	nextInterval time.Duration
+	minInterval  time.Duration
+	sentComplete bool
+}
+
+func NewAnnouncer(t *Torrent, counters *TransferCounters) (*Announcer, error) {
+	infoHash, err := t.InfoHash()
+	if err != nil {
+		return nil, err
+	}
+
+	tracker, err := NewTrackerTiers(t.Trackers(), t.Network)
+	if err != nil {
+		return nil, err
+	}
+
+	var key [4]byte
+	if _, err := rand.Read(key[:]); err != nil {
+		return nil, err
+	}
+
+	peerID := t.peerID()
+	return &Announcer{
+		tracker:      tracker,
+		infoHash:     infoHash,
+		counters:     counters,
+		PeerID:       string(peerID[:]),
+		Port:         t.port(),
+		NumWant:      50,
+		key:          fmt.Sprintf("%x", key),
+		completed:    make(chan struct{}, 1),
+		nextInterval: defaultAnnounceInterval,
+	}, nil
+}
+
+// Announce sends a single announce with the given event and the current
+// transfer statistics.
+func (a *Announcer) Announce(ctx context.Context, event AnnounceEvent) (*TrackerResponse, error) {
+	a.mu.Lock()
+	req := &AnnounceRequest{
+		InfoHash:   a.infoHash,
+		PeerID:     a.PeerID,
+		Port:       a.Port,
+		Uploaded:   a.counters.Uploaded(),
+		Downloaded: a.counters.Downloaded(),
+		Left:       max(a.counters.Left(), 0),
+		Event:      event,
+		NumWant:    a.NumWant,
+		Key:        a.key,
+		IP:         a.IP,
+	}
+	if event == EventStopped {
+		req.NumWant = 0
+	}
+	a.mu.Unlock()
+
+	response, err := a.tracker.Announce(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if response.Interval > 0 {
+		a.nextInterval = time.Duration(response.Interval) * time.Second
+	}
+	a.minInterval = time.Duration(response.MinInterval) * time.Second
+	if event == EventCompleted {
+		a.sentComplete = true
+	}
+	return response, nil
+}
+
+// NotifyCompleted tells a running announcer that the download finished, so it
+// sends the completed event right away instead of at the next interval.
+func (a *Announcer) NotifyCompleted() {
+	select {
+	case a.completed <- struct{}{}:
+	default:
+	}
+}
+
+// interval is the time until the next periodic announce, never shorter
+// than the tracker's min interval.
+func (a *Announcer) interval() time.Duration {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	interval := a.nextInterval
+	if a.Interval > 0 {
+		interval = a.Interval
+	}
+	return max(interval, a.minInterval)
+}
+
+// retryDelay is the time until a failed announce is tried again, after the
+// given number of consecutive failures.
+func (a *Announcer) retryDelay(failures int) time.Duration {
+	return min(a.interval(), trackerRetryDelay(failures))
+}
+
+// Run announces started, then keeps announcing every interval until ctx is
+// cancelled, when it announces completed if that is still due, and stopped.
+// A failed announce is retried sooner, see retryDelay.
+// onResponse, if not nil, is called with the outcome of every announce.
+func (a *Announcer) Run(ctx context.Context, onResponse func(AnnounceEvent, *TrackerResponse, error)) {
+	report := func(event AnnounceEvent, response *TrackerResponse, err error) {
+		if onResponse != nil {
+			onResponse(event, response, err)
+		}
+	}
+
+	event := EventStarted
+	if a.counters.Left() <= 0 {
+		// seeding from the start, there is nothing to complete
+		a.mu.Lock()
+		a.sentComplete = true
+		a.mu.Unlock()
+	}
+
+	failures := 0
+	for {
+		response, err := a.Announce(ctx, event)
+		if ctx.Err() != nil {
+			break
+		}
+		report(event, response, err)
+		if err == nil || event != EventStarted {
+			event = EventNone
+		}
+
+		wait := a.interval()
+		if err != nil {
+			failures++
+			wait = a.retryDelay(failures)
+		} else {
+			failures = 0
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+		case <-timer.C:
+		case <-a.completed:
+		}
+		timer.Stop()
+		if ctx.Err() != nil {
+			break
+		}
+
+		a.mu.Lock()
+		if event == EventNone && !a.sentComplete && a.counters.Left() <= 0 {
+			event = EventCompleted
+		}
+		a.mu.Unlock()
+	}
+
+	stopCtx, cancel := context.WithTimeout(context.Background(), stoppedAnnounceTimeout)
+	defer cancel()
+	// a download that completed as it stopped, or whose completed announce
+	// was cut short, still reports it
+	a.mu.Lock()
+	completed := !a.sentComplete && a.counters.Left() <= 0
+	a.mu.Unlock()
+	if completed {
+		response, err := a.Announce(stopCtx, EventCompleted)
+		report(EventCompleted, response, err)
+	}
+	response, err := a.Announce(stopCtx, EventStopped)
+	report(EventStopped, response, err)
+}
@@ -0,0 +1,448 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/peerid"
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/tracker"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// fakeTracker records the query of every announce it receives and answers
+// with a fixed response.
+type fakeTracker struct {
+	mu       sync.Mutex
+	queries  []url.Values
+	response string
+	server   *httptest.Server
+}
+
+func newFakeTracker(t *testing.T, response string) *fakeTracker {
+	tracker := &fakeTracker{response: response}
+	tracker.server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tracker.mu.Lock()
+		tracker.queries = append(tracker.queries, r.URL.Query())
+		tracker.mu.Unlock()
+		w.Write([]byte(tracker.response))
+	}))
+	t.Cleanup(tracker.server.Close)
+	return tracker
+}
+
+func (f *fakeTracker) announces() []url.Values {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return append([]url.Values{}, f.queries...)
+}
+
+func (f *fakeTracker) torrent(t *testing.T) *Torrent {
+	torrent, err := NewTorrent("../../sample.torrent")
+	require.NoError(t, err)
+	torrent.Announce = f.server.URL + "/announce"
+	return torrent
+}
+
+const trackerResponseWithID = "d8:intervali1800e10:tracker id3:abc5:peers6:\x7f\x00\x00\x01\x1a\xe1e"
+
+func TestDiscoverPeers(t *testing.T) {
+	tracker := newFakeTracker(t, trackerResponseWithID)
+
+	result, err := tracker.torrent(t).DiscoverPeers(context.Background())
+
+	require.NoError(t, err)
+	assert.Equal(t, 1800, result.Interval)
+	assert.Equal(t, []Peer{{Addr: netip.MustParseAddrPort("127.0.0.1:6881")}}, result.Peers)
+
+	query := tracker.announces()[0]
+	assert.Equal(t, "\xd6\x9f\x91\xe6\xb2\xaeLT$h\xd1\x07:q\xd4\xea\x13\x87\x9a\x7f", query.Get("info_hash"))
+	assert.Equal(t, "92063", query.Get("left"))
+	assert.Equal(t, "1", query.Get("compact"))
+	assert.False(t, query.Has("event"))
+}
+
+// startEmbeddedTracker serves a tracker over HTTP and UDP and returns both
+// announce URLs.
+func startEmbeddedTracker(t *testing.T, server *tracker.Server) (httpURL, udpURL string) {
+	t.Helper()
+	httpServer := httptest.NewServer(server)
+	t.Cleanup(httpServer.Close)
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	go server.ServeUDP(conn)
+
+	return httpServer.URL + "/announce", "udp://" + conn.LocalAddr().String()
+}
+
+func TestDiscoverPeersEmbeddedTracker(t *testing.T) {
+	for _, protocol := range []string{"http", "udp"} {
+		t.Run(protocol, func(t *testing.T) {
+			server := tracker.NewServer()
+			announceURL, udpURL := startEmbeddedTracker(t, server)
+			if protocol == "udp" {
+				announceURL = udpURL
+			}
+
+			first := sampleTorrent(t, &Network{TrackerTimeout: 5 * time.Second})
+			first.Announce = announceURL
+			first.PeerID, _ = peerid.Generate(peerid.Prefix)
+			first.Port = 7001
+			second := sampleTorrent(t, first.Network)
+			second.Announce = announceURL
+			second.PeerID, _ = peerid.Generate(peerid.Prefix)
+			second.Port = 7002
+
+			_, err := first.DiscoverPeers(context.Background())
+			require.NoError(t, err)
+			result, err := second.DiscoverPeers(context.Background())
+			require.NoError(t, err)
+
+			require.Len(t, result.Peers, 1)
+			assert.Equal(t, netip.MustParseAddrPort("127.0.0.1:7001"), result.Peers[0].Addr)
+			assert.Equal(t, 2, result.Incomplete)
+
+			infoHash, err := second.InfoHash()
+			require.NoError(t, err)
+			assert.Len(t, server.Peers(infoHash), 2)
+		})
+	}
+}
+
+func TestAnnouncerEmbeddedTrackerFailover(t *testing.T) {
+	broken := tracker.NewServer()
+	broken.InjectFault(tracker.Fault{FailureReason: "overloaded", RetryIn: 5})
+	brokenServer := httptest.NewServer(broken)
+	defer brokenServer.Close()
+	working := httptest.NewServer(tracker.NewServer())
+	defer working.Close()
+
+	torrent := sampleTorrent(t, nil)
+	torrent.AnnounceList = [][]string{{brokenServer.URL + "/announce"}, {working.URL + "/announce"}}
+
+	result, err := torrent.DiscoverPeers(context.Background())
+	require.NoError(t, err)
+	assert.Equal(t, 1, result.Incomplete)
+}
+
+func TestAnnouncerSendsStatistics(t *testing.T) {
+	tracker := newFakeTracker(t, trackerResponseWithID)
+	counters := NewTransferCounters(92063)
+	announcer, err := NewAnnouncer(tracker.torrent(t), counters)
+	require.NoError(t, err)
+	announcer.IP = "10.0.0.1"
+
+	_, err = announcer.Announce(context.Background(), EventStarted)
+	require.NoError(t, err)
+	counters.AddDownloaded(32768)
+	counters.AddUploaded(100)
+	_, err = announcer.Announce(context.Background(), EventNone)
+	require.NoError(t, err)
+
+	announces := tracker.announces()
+	require.Len(t, announces, 2)
+
+	assert.Equal(t, "started", announces[0].Get("event"))
+	assert.Equal(t, "0", announces[0].Get("downloaded"))
+	assert.Equal(t, "92063", announces[0].Get("left"))
+	assert.Equal(t, "50", announces[0].Get("numwant"))
+	assert.Equal(t, "10.0.0.1", announces[0].Get("ip"))
+	assert.Len(t, announces[0].Get("key"), 8)
+	assert.False(t, announces[0].Has("trackerid"))
+
+	assert.False(t, announces[1].Has("event"))
+	assert.Equal(t, "32768", announces[1].Get("downloaded"))
+	assert.Equal(t, "100", announces[1].Get("uploaded"))
+	assert.Equal(t, "59295", announces[1].Get("left"))
+	assert.Equal(t, "abc", announces[1].Get("trackerid"))
+	assert.Equal(t, announces[0].Get("key"), announces[1].Get("key"))
+}
+
+func TestAnnouncerIntervals(t *testing.T) {
+	tracker := newFakeTracker(t, "d8:intervali1800e12:min intervali60e5:peers0:e")
+	announcer, err := NewAnnouncer(tracker.torrent(t), NewTransferCounters(100))
+	require.NoError(t, err)
+
+	// failures are retried well before the next periodic announce
+	assert.Equal(t, defaultAnnounceInterval, announcer.interval())
+	assert.Equal(t, trackerRetryInterval, announcer.retryDelay(1))
+	assert.Equal(t, 4*trackerRetryInterval, announcer.retryDelay(3))
+
+	// and announces never come faster than the tracker's min interval
+	announcer.Interval = 10 * time.Second
+	_, err = announcer.Announce(context.Background(), EventStarted)
+	require.NoError(t, err)
+	assert.Equal(t, time.Minute, announcer.interval())
+	assert.Equal(t, time.Minute, announcer.retryDelay(5))
+}
+
+func TestAnnouncerLifecycle(t *testing.T) {
+	tracker := newFakeTracker(t, trackerResponseWithID)
+	counters := NewTransferCounters(100)
+	announcer, err := NewAnnouncer(tracker.torrent(t), counters)
+	require.NoError(t, err)
+	announcer.Interval = 10 * time.Millisecond
+
+	ctx, cancel := context.WithCancel(context.Background())
+	events := make(chan AnnounceEvent, 100)
+	done := make(chan struct{})
+	go func() {
+		announcer.Run(ctx, func(event AnnounceEvent, _ *TrackerResponse, err error) {
+			assert.NoError(t, err)
+			events <- event
+		})
+		close(done)
+	}()
+
+	require.Equal(t, EventStarted, <-events)
+	require.Equal(t, EventNone, <-events)
+
+	counters.AddDownloaded(100)
+	announcer.NotifyCompleted()
+	for event := range events {
+		if event == EventCompleted {
+			break
+		}
+		require.Equal(t, EventNone, event)
+	}
+
+	cancel()
+	<-done
+
+	announces := tracker.announces()
+	last := announces[len(announces)-1]
+	assert.Equal(t, "stopped", last.Get("event"))
+	assert.Equal(t, "100", last.Get("downloaded"))
+	assert.Equal(t, "0", last.Get("left"))
+
+	completed := 0
+	for _, query := range announces {
+		if query.Get("event") == "completed" {
+			completed++
+		}
+	}
+	assert.Equal(t, 1, completed)
+}
+
+func TestAnnounceURLWithQuery(t *testing.T) {
+	tracker := newFakeTracker(t, trackerResponseWithID)
+	torrent := tracker.torrent(t)
+	torrent.Announce += "?passkey=secret"
+
+	_, err := torrent.DiscoverPeers(context.Background())
+
+	require.NoError(t, err)
+	query := tracker.announces()[0]
+	assert.Equal(t, "secret", query.Get("passkey"))
+	assert.True(t, strings.HasPrefix(query.Get("peer_id"), peerid.Prefix))
+}
+
+func TestTrackerResponseFields(t *testing.T) {
+	tracker := newFakeTracker(t, "d8:completei5e10:incompletei7e8:intervali1800e12:min intervali60e"+
+		"5:peers6:\x7f\x00\x00\x01\x1a\xe110:tracker id3:abc15:warning message9:slow downe")
+
+	result, err := tracker.torrent(t).DiscoverPeers(context.Background())
+
+	require.NoError(t, err)
+	assert.Equal(t, &TrackerResponse{
+		Interval:       1800,
+		MinInterval:    60,
+		Peers:          []Peer{{Addr: netip.MustParseAddrPort("127.0.0.1:6881")}},
+		TrackerID:      "abc",
+		Complete:       5,
+		Incomplete:     7,
+		WarningMessage: "slow down",
+	}, result)
+}
+
+func TestTrackerFailureReason(t *testing.T) {
+	testCases := []struct {
+		name     string
+		status   int
+		body     string
+		expected *TrackerError
+	}{
+		{"failure", http.StatusOK, "d14:failure reason12:unregisterede", &TrackerError{Reason: "unregistered"}},
+		{"retry in", http.StatusOK, "d14:failure reason4:busy8:retry ini10ee", &TrackerError{Reason: "busy", RetryIn: 10}},
+		{"retry never", http.StatusOK, "d14:failure reason6:banned8:retry in5:nevere", &TrackerError{Reason: "banned", Never: true}},
+		{"error status", http.StatusForbidden, "d14:failure reason11:bad passkeye", &TrackerError{Reason: "bad passkey"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tc.status)
+				w.Write([]byte(tc.body))
+			}))
+			defer server.Close()
+
+			_, err := announceHTTP(context.Background(), http.DefaultClient, server.URL, &AnnounceRequest{})
+
+			var trackerErr *TrackerError
+			require.ErrorAs(t, err, &trackerErr)
+			assert.Equal(t, tc.expected, trackerErr)
+		})
+	}
+}
+
+func TestTrackerErrorStatus(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer server.Close()
+
+	_, err := announceHTTP(context.Background(), http.DefaultClient, server.URL, &AnnounceRequest{})
+
+	assert.ErrorContains(t, err, "HTTP status code: 502")
+}
+
+func TestParsePeers(t *testing.T) {
+	peerID := "-XX0001-abcdefghijkl"
+	testCases := []struct {
+		name     string
+		data     map[string]interface{}
+		expected []string
+	}{
+		{"compact", map[string]interface{}{"peers": "\x7f\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x1a\xe2"}, []string{"127.0.0.1:6881", "10.0.0.2:6882"}},
+		{"empty compact", map[string]interface{}{"peers": ""}, []string{}},
+		{"no peers", map[string]interface{}{}, []string{}},
+		{"compact ipv6", map[string]interface{}{"peers6": "\x20\x01\x0d\xb8" + strings.Repeat("\x00", 11) + "\x01\x1a\xe1"}, []string{"[2001:db8::1]:6881"}},
+		{"both", map[string]interface{}{
+			"peers":  "\x7f\x00\x00\x01\x1a\xe1",
+			"peers6": strings.Repeat("\x00", 15) + "\x01\x1a\xe1",
+		}, []string{"127.0.0.1:6881", "[::1]:6881"}},
+		{"dictionaries", map[string]interface{}{"peers": []interface{}{
+			map[string]interface{}{"peer id": peerID, "ip": "10.0.0.1", "port": 6881},
+			map[string]interface{}{"ip": "2001:db8::2", "port": 51413},
+			map[string]interface{}{"ip": "::ffff:192.168.1.1", "port": 1},
+			map[string]interface{}{"ip": "tracker.example", "port": 6881},
+			map[string]interface{}{"ip": "10.0.0.3", "port": 70000},
+			"garbage",
+		}}, []string{"10.0.0.1:6881", "[2001:db8::2]:51413", "192.168.1.1:1"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			peers, err := parsePeers(tc.data)
+
+			require.NoError(t, err)
+			addresses := []string{}
+			for _, peer := range peers {
+				addresses = append(addresses, peer.String())
+			}
+			assert.Equal(t, tc.expected, addresses)
+		})
+	}
+
+	peers, err := parsePeers(testCases[5].data)
+	require.NoError(t, err)
+	assert.Equal(t, []byte(peerID), peers[0].ID)
+	assert.Nil(t, peers[1].ID)
+}
+
+func TestParsePeersInvalid(t *testing.T) {
+	testCases := []struct {
+		name string
+		data map[string]interface{}
+	}{
+		{"truncated compact", map[string]interface{}{"peers": "\x7f\x00\x00\x01\x1a"}},
+		{"truncated ipv6", map[string]interface{}{"peers6": "\x7f\x00\x00\x01\x1a\xe1"}},
+		{"wrong type", map[string]interface{}{"peers": 5}},
+		{"wrong ipv6 type", map[string]interface{}{"peers6": []interface{}{}}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			_, err := parsePeers(tc.data)
+			assert.Error(t, err)
+		})
+	}
+}
+
+func TestScrapeURL(t *testing.T) {
+	testCases := []struct {
+		announce string
+		expected string
+	}{
+		{"http://example.com/announce", "http://example.com/scrape"},
+		{"http://example.com/x/announce", "http://example.com/x/scrape"},
+		{"http://example.com/announce.php", "http://example.com/scrape.php"},
+		{"http://example.com/announce?x2%0644", "http://example.com/scrape?x2%0644"},
+		{"http://example.com/x%064announce", ""},
+		{"http://example.com/a", ""},
+		{"http://example.com/announce/x", ""},
+		{"http://example.com/x/announce?passkey=abc", "http://example.com/x/scrape?passkey=abc"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.announce, func(t *testing.T) {
+			scrapeURL, err := (&HTTPTracker{URL: tc.announce}).ScrapeURL()
+			if tc.expected == "" {
+				assert.ErrorIs(t, err, ErrScrapeUnsupported)
+			} else {
+				require.NoError(t, err)
+				assert.Equal(t, tc.expected, scrapeURL)
+			}
+		})
+	}
+}
+
+// newScrapeTracker answers scrapes for every requested info hash whose first
+// byte isn't zero, with seeders, completed and leechers derived from it.
+func newScrapeTracker(t *testing.T) *httptest.Server {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/scrape" {
+			http.NotFound(w, r)
+			return
+		}
+		files := map[string]interface{}{}
+		for _, infoHash := range r.URL.Query()["info_hash"] {
+			if infoHash[0] == 0 {
+				continue
+			}
+			n := int(infoHash[0])
+			files[infoHash] = map[string]interface{}{"complete": n, "downloaded": n * 10, "incomplete": n + 1}
+		}
+		body, _ := bencode.Marshal(map[string]interface{}{"files": files})
+		w.Write([]byte(body))
+	}))
+	t.Cleanup(server.Close)
+	return server
+}
+
+func TestHTTPTrackerScrape(t *testing.T) {
+	server := newScrapeTracker(t)
+	tracker := &HTTPTracker{URL: server.URL + "/announce", Client: http.DefaultClient}
+
+	hashes := make([][20]byte, 0, 100)
+	for i := 0; i < 100; i++ {
+		hashes = append(hashes, [20]byte{byte(i), 1})
+	}
+	results, err := tracker.Scrape(context.Background(), hashes...)
+
+	require.NoError(t, err)
+	require.Len(t, results, 99)
+	assert.Equal(t, ScrapeResult{InfoHash: [20]byte{99, 1}, Seeders: 99, Completed: 990, Leechers: 100}, results[98])
+}
+
+func TestHTTPTrackerScrapeFailure(t *testing.T) {
+	tracker := newFakeTracker(t, "d14:failure reason8:disablede")
+	client := &HTTPTracker{URL: tracker.server.URL + "/announce", Client: http.DefaultClient}
+
+	_, err := client.Scrape(context.Background(), [20]byte{1})
+
+	var trackerErr *TrackerError
+	require.ErrorAs(t, err, &trackerErr)
+	assert.Equal(t, "disabled", trackerErr.Reason)
+}
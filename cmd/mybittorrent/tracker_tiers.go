@@ -0,0 +1,310 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// trackerRetryInterval is the first delay before retrying a failed tracker.
+// It doubles with every consecutive failure up to maxTrackerRetryInterval.
+const (
+	trackerRetryInterval    = time.Minute
+	maxTrackerRetryInterval = time.Hour
+)
+
+// TrackerStatus is what we know about one tracker of a torrent.
+type TrackerStatus struct {
+	URL  string
+	Tier int
+	// LastAnnounce is the time of the last announce, zero if never tried.
+	LastAnnounce time.Time
+	// NextAnnounce is when the tracker may be announced to again. Until
+	// then a tracker that failed is skipped.
+	NextAnnounce time.Time
+	LastError    string
+	Failures     int
+	// Never is set when the tracker asked never to be retried (BEP 31).
+	Never bool
+	// Peers is the number of peers returned by the last successful announce.
+	Peers int
+}
+
+type tieredTracker struct {
+	client TrackerClient
+	status TrackerStatus
+}
+
+// TrackerTiers implements the multi-tracker extension (BEP 12). Each tier is
+// shuffled once; trackers are tried in order and the one that answers is
+// moved to the front of its tier. Tiers are only tried when every tracker of
+// the tiers before them failed, unless AllTiers is set. A tracker that
+// failed is skipped until its NextAnnounce, and for good once it told us
+// never to retry.
+type TrackerTiers struct {
+	// AllTiers makes Announce contact the first working tracker of every
+	// tier and merge their peers, instead of stopping at the first success.
+	AllTiers bool
+
+	mu    sync.Mutex
+	tiers [][]*tieredTracker
+	now   func() time.Time
+}
+
+func NewTrackerTiers(urls [][]string, network *Network) (*TrackerTiers, error) {
+	newClient := func(announceURL string) (TrackerClient, error) {
+		return NewTrackerClient(announceURL, network)
+	}
+	return newTrackerTiers(urls, newClient, rand.Shuffle)
+}
+
+func newTrackerTiers(urls [][]string, newClient func(string) (TrackerClient, error), shuffle func(int, func(int, int))) (*TrackerTiers, error) {
+	if len(urls) == 0 {
+		return nil, fmt.Errorf("torrent has no trackers")
+	}
+
+	m := &TrackerTiers{now: time.Now}
+	for i, tierURLs := range urls {
+		tier := make([]*tieredTracker, 0, len(tierURLs))
+		for _, u := range tierURLs {
+			entry := &tieredTracker{status: TrackerStatus{URL: u, Tier: i}}
+			client, err := newClient(u)
+			if err != nil {
+				// keep it visible in the status, it's never announced to
+				entry.status.LastError = err.Error()
+			}
+			entry.client = client
+			tier = append(tier, entry)
+		}
+		shuffle(len(tier), func(a, b int) { tier[a], tier[b] = tier[b], tier[a] })
+		m.tiers = append(m.tiers, tier)
+	}
+	return m, nil
+}
+
+// Announce announces to the trackers in tier order and returns the response
+// of the tracker that answered, or with AllTiers, the merged responses.
+func (m *TrackerTiers) Announce(ctx context.Context, req *AnnounceRequest) (*TrackerResponse, error) {
+	var responses []*TrackerResponse
+	var errs []error
+
+	for tierIndex := range m.tiers {
+		response, err := m.announceTier(ctx, tierIndex, req)
+		if err != nil {
+			errs = append(errs, err)
+			if ctx.Err() != nil {
+				break
+			}
+			continue
+		}
+		responses = append(responses, response)
+		if !m.AllTiers {
+			break
+		}
+	}
+
+	if len(responses) == 0 {
+		if len(errs) == 1 {
+			return nil, errs[0]
+		}
+		return nil, fmt.Errorf("all trackers failed: %w", errors.Join(errs...))
+	}
+	return mergeTrackerResponses(responses), nil
+}
+
+// announceTier tries the trackers of one tier in order, promoting the first
+// one that answers to the front of the tier.
+func (m *TrackerTiers) announceTier(ctx context.Context, tierIndex int, req *AnnounceRequest) (*TrackerResponse, error) {
+	m.mu.Lock()
+	tier := append([]*tieredTracker{}, m.tiers[tierIndex]...)
+	m.mu.Unlock()
+
+	var lastErr error
+	for _, entry := range tier {
+		if entry.client == nil {
+			continue
+		}
+		if err := m.backingOff(entry); err != nil {
+			lastErr = err
+			continue
+		}
+
+		response, err := entry.client.Announce(ctx, req)
+		if err != nil && ctx.Err() != nil {
+			// cut short by us, the tracker isn't to blame
+			return nil, fmt.Errorf("%s: %w", entry.status.URL, err)
+		}
+		m.record(entry, response, err)
+		if err != nil {
+			lastErr = fmt.Errorf("%s: %w", entry.status.URL, err)
+			continue
+		}
+
+		m.promote(tierIndex, entry)
+		return response, nil
+	}
+
+	if lastErr == nil {
+		lastErr = fmt.Errorf("tier %d has no usable trackers", tierIndex)
+	}
+	return nil, lastErr
+}
+
+// trackerRetryDelay is how long to wait before retrying after the given
+// number of consecutive failures.
+func trackerRetryDelay(failures int) time.Duration {
+	return min(trackerRetryInterval<<min(failures-1, 10), maxTrackerRetryInterval)
+}
+
+// backingOff returns why a tracker that failed mustn't be announced to yet,
+// or nil.
+func (m *TrackerTiers) backingOff(entry *tieredTracker) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	status := entry.status
+	switch {
+	case status.Never:
+		return fmt.Errorf("%s: %s, not retried", status.URL, status.LastError)
+	case status.Failures > 0 && m.now().Before(status.NextAnnounce):
+		return fmt.Errorf("%s: %s, not retried before %s", status.URL, status.LastError, status.NextAnnounce.Format(time.TimeOnly))
+	}
+	return nil
+}
+
+func (m *TrackerTiers) record(entry *tieredTracker, response *TrackerResponse, err error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	now := m.now()
+	status := &entry.status
+	status.LastAnnounce = now
+
+	if err != nil {
+		status.LastError = err.Error()
+		status.Failures++
+		retry := trackerRetryDelay(status.Failures)
+		var trackerErr *TrackerError
+		if errors.As(err, &trackerErr) {
+			if trackerErr.RetryIn > 0 {
+				retry = time.Duration(trackerErr.RetryIn) * time.Minute
+			}
+			status.Never = trackerErr.Never
+		}
+		status.NextAnnounce = now.Add(retry)
+		return
+	}
+
+	status.LastError = ""
+	status.Failures = 0
+	status.Peers = len(response.Peers)
+	interval := time.Duration(max(response.Interval, response.MinInterval)) * time.Second
+	if interval <= 0 {
+		interval = defaultAnnounceInterval
+	}
+	status.NextAnnounce = now.Add(interval)
+}
+
+func (m *TrackerTiers) promote(tierIndex int, entry *tieredTracker) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	tier := m.tiers[tierIndex]
+	for i, candidate := range tier {
+		if candidate == entry {
+			copy(tier[1:i+1], tier[:i])
+			tier[0] = entry
+			return
+		}
+	}
+}
+
+// Scrape scrapes the first tracker, in tier order, that supports it.
+func (m *TrackerTiers) Scrape(ctx context.Context, infoHashes ...[20]byte) ([]ScrapeResult, error) {
+	results, _, err := m.scrape(ctx, infoHashes...)
+	return results, err
+}
+
+// scrape is Scrape, also returning the URL of the tracker that answered.
+func (m *TrackerTiers) scrape(ctx context.Context, infoHashes ...[20]byte) ([]ScrapeResult, string, error) {
+	lastErr := ErrScrapeUnsupported
+	for _, status := range m.Status() {
+		client := m.client(status.URL)
+		if client == nil {
+			continue
+		}
+		results, err := client.Scrape(ctx, infoHashes...)
+		if err == nil {
+			return results, status.URL, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, "", lastErr
+}
+
+func (m *TrackerTiers) client(url string) TrackerClient {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for _, tier := range m.tiers {
+		for _, entry := range tier {
+			if entry.status.URL == url {
+				return entry.client
+			}
+		}
+	}
+	return nil
+}
+
+// Status returns the status of every tracker, in the order they are tried.
+func (m *TrackerTiers) Status() []TrackerStatus {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	var statuses []TrackerStatus
+	for _, tier := range m.tiers {
+		for _, entry := range tier {
+			statuses = append(statuses, entry.status)
+		}
+	}
+	return statuses
+}
+
+// mergeTrackerResponses combines responses from several trackers. Peers are
+// deduplicated by address; the interval is the shortest one.
+func mergeTrackerResponses(responses []*TrackerResponse) *TrackerResponse {
+	if len(responses) == 1 {
+		return responses[0]
+	}
+
+	merged := &TrackerResponse{Peers: []Peer{}}
+	seen := map[string]int{}
+	for _, response := range responses {
+		if merged.Interval == 0 || (response.Interval > 0 && response.Interval < merged.Interval) {
+			merged.Interval = response.Interval
+		}
+		merged.MinInterval = max(merged.MinInterval, response.MinInterval)
+		merged.Complete = max(merged.Complete, response.Complete)
+		merged.Incomplete = max(merged.Incomplete, response.Incomplete)
+		if merged.WarningMessage == "" {
+			merged.WarningMessage = response.WarningMessage
+		}
+
+		for _, peer := range response.Peers {
+			key := peer.Addr.String()
+			if i, ok := seen[key]; ok {
+				if merged.Peers[i].ID == nil {
+					merged.Peers[i].ID = peer.ID
+				}
+				continue
+			}
+			seen[key] = len(merged.Peers)
+			merged.Peers = append(merged.Peers, peer)
+		}
+	}
+	return merged
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type stubTracker struct {
+	response *TrackerResponse
+	err      error
+	calls    int
+}
+
+func (s *stubTracker) Announce(ctx context.Context, req *AnnounceRequest) (*TrackerResponse, error) {
+	s.calls++
+	return s.response, s.err
+}
+
+func (s *stubTracker) Scrape(ctx context.Context, infoHashes ...[20]byte) ([]ScrapeResult, error) {
+	s.calls++
+	if s.err != nil {
+		return nil, s.err
+	}
+	return []ScrapeResult{{InfoHash: infoHashes[0], Seeders: len(s.response.Peers)}}, nil
+}
+
+func peersResponse(addresses ...string) *TrackerResponse {
+	response := &TrackerResponse{Interval: 60}
+	for _, address := range addresses {
+		response.Peers = append(response.Peers, Peer{Addr: netip.MustParseAddrPort(address)})
+	}
+	return response
+}
+
+func newStubTiers(t *testing.T, urls [][]string, stubs map[string]*stubTracker) *TrackerTiers {
+	newClient := func(u string) (TrackerClient, error) {
+		stub, ok := stubs[u]
+		if !ok {
+			return nil, errors.New("unsupported")
+		}
+		return stub, nil
+	}
+	noShuffle := func(int, func(int, int)) {}
+	tiers, err := newTrackerTiers(urls, newClient, noShuffle)
+	require.NoError(t, err)
+	return tiers
+}
+
+func statusURLs(tiers *TrackerTiers) []string {
+	urls := []string{}
+	for _, status := range tiers.Status() {
+		urls = append(urls, status.URL)
+	}
+	return urls
+}
+
+func TestTrackerTiersFallThrough(t *testing.T) {
+	stubs := map[string]*stubTracker{
+		"a": {err: errors.New("timeout")},
+		"b": {err: &TrackerError{Reason: "down", RetryIn: 5}},
+		"c": {response: peersResponse("10.0.0.1:1")},
+		"d": {response: peersResponse("10.0.0.2:1")},
+	}
+	tiers := newStubTiers(t, [][]string{{"a", "b"}, {"c"}, {"d"}}, stubs)
+
+	response, err := tiers.Announce(context.Background(), &AnnounceRequest{})
+
+	require.NoError(t, err)
+	assert.Equal(t, peersResponse("10.0.0.1:1"), response)
+	assert.Equal(t, 0, stubs["d"].calls, "tiers after a success are not tried")
+
+	statuses := tiers.Status()
+	assert.Equal(t, "timeout", statuses[0].LastError)
+	assert.Equal(t, 1, statuses[0].Failures)
+	assert.Equal(t, "tracker failure: down", statuses[1].LastError)
+	assert.Equal(t, 300.0, statuses[1].NextAnnounce.Sub(statuses[1].LastAnnounce).Seconds())
+	assert.Equal(t, 1, statuses[2].Peers)
+	assert.Empty(t, statuses[2].LastError)
+	assert.True(t, statuses[3].LastAnnounce.IsZero())
+}
+
+func TestTrackerTiersPromotesWorkingTracker(t *testing.T) {
+	stubs := map[string]*stubTracker{
+		"a": {err: errors.New("timeout")},
+		"b": {err: errors.New("timeout")},
+		"c": {response: peersResponse("10.0.0.1:1")},
+	}
+	tiers := newStubTiers(t, [][]string{{"a", "b", "c"}}, stubs)
+
+	_, err := tiers.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c", "a", "b"}, statusURLs(tiers))
+
+	_, err = tiers.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, stubs["a"].calls, "the promoted tracker is tried first")
+}
+
+func TestTrackerTiersBackOff(t *testing.T) {
+	stubs := map[string]*stubTracker{
+		"a": {err: errors.New("timeout")},
+		"b": {err: &TrackerError{Reason: "banned", Never: true}},
+		"c": {response: peersResponse("10.0.0.1:1")},
+	}
+	tiers := newStubTiers(t, [][]string{{"a", "b"}, {"c"}}, stubs)
+	now := time.Unix(0, 0)
+	tiers.now = func() time.Time { return now }
+
+	_, err := tiers.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, stubs["a"].calls)
+	assert.Equal(t, 1, stubs["b"].calls)
+
+	// failed trackers are skipped until their retry time, and a tracker
+	// that said never for good
+	now = now.Add(trackerRetryInterval / 2)
+	_, err = tiers.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 1, stubs["a"].calls)
+	assert.Equal(t, 1, stubs["b"].calls)
+	assert.Equal(t, 2, stubs["c"].calls)
+
+	now = now.Add(trackerRetryInterval)
+	_, err = tiers.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 2, stubs["a"].calls)
+	assert.Equal(t, 1, stubs["b"].calls)
+	assert.True(t, tiers.Status()[1].Never)
+
+	// working trackers aren't held back by their interval, events can't
+	// wait for it
+	_, err = tiers.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 4, stubs["c"].calls)
+
+	stubs["c"].err = errors.New("down")
+	_, err = tiers.Announce(context.Background(), &AnnounceRequest{})
+	assert.ErrorContains(t, err, "b: tracker failure: banned, not retried")
+	assert.ErrorContains(t, err, "c: down")
+	_, err = tiers.Announce(context.Background(), &AnnounceRequest{})
+	assert.ErrorContains(t, err, "c: down, not retried before")
+	assert.Equal(t, 5, stubs["c"].calls)
+
+	// nor is one whose announce we cancelled
+	now = now.Add(maxTrackerRetryInterval)
+	stubs["a"].err = context.Canceled
+	stubs["c"].err = nil
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = tiers.Announce(ctx, &AnnounceRequest{})
+	assert.ErrorIs(t, err, context.Canceled)
+	assert.Equal(t, 3, stubs["a"].calls)
+	stubs["a"].response, stubs["a"].err = peersResponse("10.0.0.2:1"), nil
+	_, err = tiers.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+	assert.Equal(t, 4, stubs["a"].calls)
+}
+
+func TestTrackerTiersAllFail(t *testing.T) {
+	stubs := map[string]*stubTracker{
+		"a": {err: errors.New("first")},
+		"b": {err: errors.New("second")},
+	}
+	tiers := newStubTiers(t, [][]string{{"a"}, {"b", "wss://unsupported"}}, stubs)
+
+	_, err := tiers.Announce(context.Background(), &AnnounceRequest{})
+
+	assert.ErrorContains(t, err, "first")
+	assert.ErrorContains(t, err, "second")
+	assert.Equal(t, "unsupported", tiers.Status()[2].LastError)
+}
+
+func TestTrackerTiersAllTiersMergesPeers(t *testing.T) {
+	withID := peersResponse("10.0.0.2:1")
+	withID.Peers[0].ID = []byte("-XX0001-abcdefghijkl")
+	withID.Interval = 30
+	stubs := map[string]*stubTracker{
+		"a": {response: peersResponse("10.0.0.1:1", "10.0.0.2:1")},
+		"b": {response: withID},
+		"c": {err: errors.New("down")},
+		"d": {response: peersResponse("10.0.0.3:1", "10.0.0.1:1")},
+	}
+	tiers := newStubTiers(t, [][]string{{"a"}, {"b"}, {"c", "d"}}, stubs)
+	tiers.AllTiers = true
+
+	response, err := tiers.Announce(context.Background(), &AnnounceRequest{})
+
+	require.NoError(t, err)
+	assert.Equal(t, 30, response.Interval)
+	addresses := []string{}
+	for _, peer := range response.Peers {
+		addresses = append(addresses, peer.String())
+	}
+	assert.Equal(t, []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"}, addresses)
+	assert.Equal(t, []byte("-XX0001-abcdefghijkl"), response.Peers[1].ID)
+}
+
+func TestTrackerTiersShufflesEachTier(t *testing.T) {
+	var sizes []int
+	shuffle := func(n int, swap func(int, int)) {
+		sizes = append(sizes, n)
+		if n > 1 {
+			swap(0, n-1)
+		}
+	}
+	newClient := func(string) (TrackerClient, error) { return &stubTracker{}, nil }
+
+	tiers, err := newTrackerTiers([][]string{{"a", "b", "c"}, {"d"}}, newClient, shuffle)
+
+	require.NoError(t, err)
+	assert.Equal(t, []int{3, 1}, sizes)
+	assert.Equal(t, []string{"c", "b", "a", "d"}, statusURLs(tiers))
+}
+
+func TestTrackerTiersScrape(t *testing.T) {
+	stubs := map[string]*stubTracker{
+		"a": {err: ErrScrapeUnsupported},
+		"b": {response: peersResponse("10.0.0.1:1")},
+	}
+	tiers := newStubTiers(t, [][]string{{"a"}, {"b"}}, stubs)
+
+	results, err := tiers.Scrape(context.Background(), [20]byte{1})
+
+	require.NoError(t, err)
+	assert.Equal(t, []ScrapeResult{{InfoHash: [20]byte{1}, Seeders: 1}}, results)
+}
+
+func TestTorrentTrackers(t *testing.T) {
+	torrent, err := NewTorrent(writeTorrent(t, map[string]interface{}{
+		"announce": "http://ignored/announce",
+		"announce-list": []interface{}{
+			[]interface{}{"http://a/announce", "udp://b:80"},
+			[]interface{}{},
+			[]interface{}{"http://c/announce", 5},
+		},
+		"info": map[string]interface{}{"name": "a", "length": 1, "piece length": 16384, "pieces": "01234567890123456789"},
+	}))
+
+	require.NoError(t, err)
+	assert.Equal(t, [][]string{{"http://a/announce", "udp://b:80"}, {"http://c/announce"}}, torrent.Trackers())
+
+	torrent.AnnounceList = nil
+	assert.Equal(t, [][]string{{"http://ignored/announce"}}, torrent.Trackers())
+}
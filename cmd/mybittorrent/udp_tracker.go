@@ -0,0 +1,306 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15) constants.
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// udpConnectionIDLifetime is how long a client may use a connection id.
+	udpConnectionIDLifetime = time.Minute
+	// udpMaxRetransmissions is the largest n in the 15 * 2^n back-off.
+	udpMaxRetransmissions = 8
+	// udpMaxScrapeHashes is the most info hashes one scrape request may carry.
+	udpMaxScrapeHashes = 74
+)
+
+var udpEvents = map[AnnounceEvent]uint32{
+	EventNone:      0,
+	EventCompleted: 1,
+	EventStarted:   2,
+	EventStopped:   3,
+}
+
+// UDPTracker is a client for UDP trackers (BEP 15).
+type UDPTracker struct {
+	Address string
+	// BaseTimeout is the initial response timeout, doubled on every
+	// retransmission. BEP 15 uses 15 seconds.
+	BaseTimeout time.Duration
+	// MaxRetransmissions bounds how often a request is resent.
+	MaxRetransmissions int
+	// Network bounds the whole request by its tracker timeout.
+	Network *Network
+
+	mu           sync.Mutex
+	connectionID uint64
+	connectedAt  time.Time
+}
+
+func NewUDPTracker(address string) (*UDPTracker, error) {
+	if _, _, err := net.SplitHostPort(address); err != nil {
+		return nil, fmt.Errorf("invalid UDP tracker address: %w", err)
+	}
+	return &UDPTracker{
+		Address:            address,
+		BaseTimeout:        15 * time.Second,
+		MaxRetransmissions: udpMaxRetransmissions,
+	}, nil
+}
+
+func (t *UDPTracker) Announce(ctx context.Context, req *AnnounceRequest) (*TrackerResponse, error) {
+	ctx, cancel := t.Network.trackerContext(ctx)
+	defer cancel()
+
+	conn, err := t.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var ip [4]byte
+	if req.IP != "" {
+		if parsed := net.ParseIP(req.IP).To4(); parsed != nil {
+			copy(ip[:], parsed)
+		}
+	}
+	key, _ := strconv.ParseUint(req.Key, 16, 32)
+	numWant := int32(-1)
+	if req.NumWant > 0 {
+		numWant = int32(req.NumWant)
+	}
+
+	var peerID [20]byte
+	copy(peerID[:], req.PeerID)
+
+	body := make([]byte, 0, 82)
+	body = append(body, req.InfoHash[:]...)
+	body = append(body, peerID[:]...)
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Downloaded))
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Left))
+	body = binary.BigEndian.AppendUint64(body, uint64(req.Uploaded))
+	body = binary.BigEndian.AppendUint32(body, udpEvents[req.Event])
+	body = append(body, ip[:]...)
+	body = binary.BigEndian.AppendUint32(body, uint32(key))
+	body = binary.BigEndian.AppendUint32(body, uint32(numWant))
+	body = binary.BigEndian.AppendUint16(body, uint16(req.Port))
+
+	response, err := t.connectedRequest(ctx, conn, udpActionAnnounce, body)
+	if err != nil {
+		return nil, err
+	}
+	if len(response) < 12 {
+		return nil, fmt.Errorf("invalid UDP announce response: %d bytes", len(response))
+	}
+
+	// peers are IPv6 when we talk to the tracker over IPv6
+	ipLength := 4
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok && addr.IP.To4() == nil {
+		ipLength = 16
+	}
+	peers, err := parseCompactPeers(string(response[12:]), ipLength)
+	if err != nil {
+		return nil, err
+	}
+
+	return &TrackerResponse{
+		Interval:   int(binary.BigEndian.Uint32(response[0:4])),
+		Incomplete: int(binary.BigEndian.Uint32(response[4:8])),
+		Complete:   int(binary.BigEndian.Uint32(response[8:12])),
+		Peers:      peers,
+	}, nil
+}
+
+// Scrape asks the tracker about the swarms of the given info hashes.
+func (t *UDPTracker) Scrape(ctx context.Context, infoHashes ...[20]byte) ([]ScrapeResult, error) {
+	ctx, cancel := t.Network.trackerContext(ctx)
+	defer cancel()
+
+	conn, err := t.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	results := make([]ScrapeResult, 0, len(infoHashes))
+	for start := 0; start < len(infoHashes); start += udpMaxScrapeHashes {
+		batch := infoHashes[start:min(start+udpMaxScrapeHashes, len(infoHashes))]
+
+		body := make([]byte, 0, 20*len(batch))
+		for _, infoHash := range batch {
+			body = append(body, infoHash[:]...)
+		}
+
+		response, err := t.connectedRequest(ctx, conn, udpActionScrape, body)
+		if err != nil {
+			return nil, err
+		}
+		if len(response) < 12*len(batch) {
+			return nil, fmt.Errorf("invalid UDP scrape response: %d bytes for %d info hashes", len(response), len(batch))
+		}
+
+		for i, infoHash := range batch {
+			entry := response[12*i:]
+			results = append(results, ScrapeResult{
+				InfoHash:  infoHash,
+				Seeders:   int(binary.BigEndian.Uint32(entry[0:4])),
+				Completed: int(binary.BigEndian.Uint32(entry[4:8])),
+				Leechers:  int(binary.BigEndian.Uint32(entry[8:12])),
+			})
+		}
+	}
+	return results, nil
+}
+
+func (t *UDPTracker) dial(ctx context.Context) (net.Conn, error) {
+	// neither proxy kind carries UDP, and going around it would leak traffic
+	if t.Network != nil && t.Network.TrackerDialer != nil {
+		return nil, ErrUDPProxy
+	}
+	var dialer net.Dialer
+	conn, err := dialer.DialContext(ctx, "udp", t.Address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to reach UDP tracker: %w", err)
+	}
+	return conn, nil
+}
+
+// connectedRequest sends a request that needs a connection id, connecting
+// first if we don't have a valid one.
+func (t *UDPTracker) connectedRequest(ctx context.Context, conn net.Conn, action uint32, body []byte) ([]byte, error) {
+	connectionID, err := t.connect(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := t.roundTrip(ctx, conn, connectionID, action, body)
+	if errors.Is(err, errUDPTimeout) {
+		// the connection id may have expired on the tracker's side
+		t.forgetConnection(connectionID)
+	}
+	return response, err
+}
+
+func (t *UDPTracker) connect(ctx context.Context, conn net.Conn) (uint64, error) {
+	t.mu.Lock()
+	if t.connectionID != 0 && time.Since(t.connectedAt) < udpConnectionIDLifetime {
+		connectionID := t.connectionID
+		t.mu.Unlock()
+		return connectionID, nil
+	}
+	t.mu.Unlock()
+
+	response, err := t.roundTrip(ctx, conn, udpProtocolID, udpActionConnect, nil)
+	if err != nil {
+		return 0, err
+	}
+	if len(response) < 8 {
+		return 0, fmt.Errorf("invalid UDP connect response: %d bytes", len(response))
+	}
+	connectionID := binary.BigEndian.Uint64(response)
+
+	t.mu.Lock()
+	t.connectionID = connectionID
+	t.connectedAt = time.Now()
+	t.mu.Unlock()
+
+	return connectionID, nil
+}
+
+func (t *UDPTracker) forgetConnection(connectionID uint64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if t.connectionID == connectionID {
+		t.connectionID = 0
+	}
+}
+
+var errUDPTimeout = errors.New("UDP tracker did not respond")
+
+// ErrUDPProxy is returned by UDP trackers when trackers must be reached
+// through a proxy.
+var ErrUDPProxy = errors.New("UDP trackers can't be reached through a proxy")
+
+// roundTrip sends a request and waits for the response with a matching
+// transaction id, retransmitting with exponential back-off. It returns the
+// response payload after the action and transaction id.
+func (t *UDPTracker) roundTrip(ctx context.Context, conn net.Conn, connectionID uint64, action uint32, body []byte) ([]byte, error) {
+	var transactionID [4]byte
+	if _, err := rand.Read(transactionID[:]); err != nil {
+		return nil, err
+	}
+
+	request := make([]byte, 0, 16+len(body))
+	request = binary.BigEndian.AppendUint64(request, connectionID)
+	request = binary.BigEndian.AppendUint32(request, action)
+	request = append(request, transactionID[:]...)
+	request = append(request, body...)
+
+	// unblock reads as soon as ctx is done
+	stop := context.AfterFunc(ctx, func() {
+		conn.SetReadDeadline(time.Now())
+	})
+	defer stop()
+
+	buffer := make([]byte, 64*1024)
+	for n := 0; n <= t.MaxRetransmissions; n++ {
+		if _, err := conn.Write(request); err != nil {
+			return nil, fmt.Errorf("failed to send UDP tracker request: %w", err)
+		}
+
+		deadline := time.Now().Add(t.BaseTimeout << n)
+		if err := conn.SetReadDeadline(deadline); err != nil {
+			return nil, err
+		}
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+
+		for {
+			size, err := conn.Read(buffer)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			var netErr net.Error
+			if errors.As(err, &netErr) && netErr.Timeout() {
+				break
+			}
+			if err != nil {
+				return nil, fmt.Errorf("failed to read UDP tracker response: %w", err)
+			}
+
+			response := buffer[:size]
+			if size < 8 || string(response[4:8]) != string(transactionID[:]) {
+				// stale response to an earlier request, keep waiting
+				continue
+			}
+
+			responseAction := binary.BigEndian.Uint32(response[0:4])
+			switch responseAction {
+			case action:
+				return append([]byte{}, response[8:]...), nil
+			case udpActionError:
+				return nil, &TrackerError{Reason: string(response[8:])}
+			default:
+				return nil, fmt.Errorf("unexpected UDP tracker action %d, expected %d", responseAction, action)
+			}
+		}
+	}
+
+	return nil, errUDPTimeout
+}
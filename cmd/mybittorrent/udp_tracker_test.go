@@ -0,0 +1,276 @@
+package main
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type udpAnnounce struct {
+	infoHash   [20]byte
+	downloaded uint64
+	left       uint64
+	uploaded   uint64
+	event      uint32
+	key        uint32
+	numWant    int32
+	port       uint16
+}
+
+// fakeUDPTracker is a minimal in-process BEP 15 tracker.
+type fakeUDPTracker struct {
+	conn net.PacketConn
+
+	mu        sync.Mutex
+	drop      int
+	connects  int
+	announces []udpAnnounce
+	failure   string
+	issued    map[uint64]bool
+}
+
+func newFakeUDPTracker(t *testing.T) *fakeUDPTracker {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	tracker := &fakeUDPTracker{conn: conn, issued: map[uint64]bool{}}
+	t.Cleanup(func() { conn.Close() })
+	go tracker.serve()
+	return tracker
+}
+
+func (f *fakeUDPTracker) address() string {
+	return f.conn.LocalAddr().String()
+}
+
+func (f *fakeUDPTracker) serve() {
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := f.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		if response := f.handle(buffer[:n]); response != nil {
+			f.conn.WriteTo(response, addr)
+		}
+	}
+}
+
+func (f *fakeUDPTracker) handle(request []byte) []byte {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.drop > 0 {
+		f.drop--
+		return nil
+	}
+	if len(request) < 16 {
+		return nil
+	}
+
+	connectionID := binary.BigEndian.Uint64(request[0:8])
+	action := binary.BigEndian.Uint32(request[8:12])
+	response := binary.BigEndian.AppendUint32(nil, action)
+	response = append(response, request[12:16]...)
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		f.connects++
+		id := uint64(0x1234 + f.connects)
+		f.issued[id] = true
+		return binary.BigEndian.AppendUint64(response, id)
+	}
+
+	if !f.issued[connectionID] {
+		return nil
+	}
+	if f.failure != "" {
+		binary.BigEndian.PutUint32(response[0:4], udpActionError)
+		return append(response, f.failure...)
+	}
+
+	body := request[16:]
+	switch action {
+	case udpActionAnnounce:
+		var announce udpAnnounce
+		copy(announce.infoHash[:], body[0:20])
+		announce.downloaded = binary.BigEndian.Uint64(body[40:48])
+		announce.left = binary.BigEndian.Uint64(body[48:56])
+		announce.uploaded = binary.BigEndian.Uint64(body[56:64])
+		announce.event = binary.BigEndian.Uint32(body[64:68])
+		announce.key = binary.BigEndian.Uint32(body[72:76])
+		announce.numWant = int32(binary.BigEndian.Uint32(body[76:80]))
+		announce.port = binary.BigEndian.Uint16(body[80:82])
+		f.announces = append(f.announces, announce)
+
+		response = binary.BigEndian.AppendUint32(response, 1800)
+		response = binary.BigEndian.AppendUint32(response, 3)
+		response = binary.BigEndian.AppendUint32(response, 2)
+		return append(response, 127, 0, 0, 1, 0x1a, 0xe1, 10, 0, 0, 2, 0x1a, 0xe2)
+	case udpActionScrape:
+		for i := 0; i+20 <= len(body); i += 20 {
+			response = binary.BigEndian.AppendUint32(response, uint32(body[i]))
+			response = binary.BigEndian.AppendUint32(response, 100)
+			response = binary.BigEndian.AppendUint32(response, uint32(body[i+1]))
+		}
+		return response
+	}
+	return nil
+}
+
+func (f *fakeUDPTracker) dropNext(n int) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.drop = n
+}
+
+func (f *fakeUDPTracker) stats() (connects int, announces []udpAnnounce) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.connects, append([]udpAnnounce{}, f.announces...)
+}
+
+func newTestUDPTracker(t *testing.T, fake *fakeUDPTracker) *UDPTracker {
+	tracker, err := NewUDPTracker(fake.address())
+	require.NoError(t, err)
+	tracker.BaseTimeout = 20 * time.Millisecond
+	tracker.MaxRetransmissions = 3
+	return tracker
+}
+
+func TestUDPTrackerAnnounce(t *testing.T) {
+	fake := newFakeUDPTracker(t)
+	tracker := newTestUDPTracker(t, fake)
+
+	req := &AnnounceRequest{
+		InfoHash:   [20]byte{1, 2, 3},
+		PeerID:     "-XX0001-abcdefghijkl",
+		Port:       6881,
+		Downloaded: 10,
+		Left:       20,
+		Uploaded:   30,
+		Event:      EventStarted,
+		Key:        "deadbeef",
+	}
+	response, err := tracker.Announce(context.Background(), req)
+
+	require.NoError(t, err)
+	assert.Equal(t, &TrackerResponse{
+		Interval:   1800,
+		Incomplete: 3,
+		Complete:   2,
+		Peers: []Peer{
+			{Addr: netip.MustParseAddrPort("127.0.0.1:6881")},
+			{Addr: netip.MustParseAddrPort("10.0.0.2:6882")},
+		},
+	}, response)
+
+	_, err = tracker.Announce(context.Background(), &AnnounceRequest{Event: EventStopped, NumWant: 5})
+	require.NoError(t, err)
+
+	connects, announces := fake.stats()
+	assert.Equal(t, 1, connects, "the connection id is reused")
+	assert.Equal(t, udpAnnounce{
+		infoHash:   [20]byte{1, 2, 3},
+		downloaded: 10,
+		left:       20,
+		uploaded:   30,
+		event:      2,
+		key:        0xdeadbeef,
+		numWant:    -1,
+		port:       6881,
+	}, announces[0])
+	assert.Equal(t, uint32(3), announces[1].event)
+	assert.Equal(t, int32(5), announces[1].numWant)
+}
+
+func TestUDPTrackerRetransmits(t *testing.T) {
+	fake := newFakeUDPTracker(t)
+	fake.dropNext(2)
+	tracker := newTestUDPTracker(t, fake)
+
+	_, err := tracker.Announce(context.Background(), &AnnounceRequest{})
+
+	require.NoError(t, err)
+	connects, announces := fake.stats()
+	assert.Equal(t, 1, connects)
+	assert.Len(t, announces, 1)
+}
+
+func TestUDPTrackerTimeout(t *testing.T) {
+	fake := newFakeUDPTracker(t)
+	fake.dropNext(1000)
+	tracker := newTestUDPTracker(t, fake)
+	tracker.MaxRetransmissions = 1
+
+	start := time.Now()
+	_, err := tracker.Announce(context.Background(), &AnnounceRequest{})
+
+	assert.ErrorIs(t, err, errUDPTimeout)
+	// 20ms, then 40ms after the retransmission
+	assert.GreaterOrEqual(t, time.Since(start), 60*time.Millisecond)
+}
+
+func TestUDPTrackerContextCancel(t *testing.T) {
+	fake := newFakeUDPTracker(t)
+	fake.dropNext(1000)
+	tracker := newTestUDPTracker(t, fake)
+	tracker.BaseTimeout = time.Hour
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := tracker.Announce(ctx, &AnnounceRequest{})
+
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
+
+func TestUDPTrackerError(t *testing.T) {
+	fake := newFakeUDPTracker(t)
+	tracker := newTestUDPTracker(t, fake)
+	_, err := tracker.Announce(context.Background(), &AnnounceRequest{})
+	require.NoError(t, err)
+
+	fake.mu.Lock()
+	fake.failure = "info hash not found"
+	fake.mu.Unlock()
+	_, err = tracker.Announce(context.Background(), &AnnounceRequest{})
+
+	var trackerErr *TrackerError
+	require.ErrorAs(t, err, &trackerErr)
+	assert.Equal(t, "info hash not found", trackerErr.Reason)
+}
+
+func TestUDPTrackerScrape(t *testing.T) {
+	fake := newFakeUDPTracker(t)
+	tracker := newTestUDPTracker(t, fake)
+
+	results, err := tracker.Scrape(context.Background(), [20]byte{5, 1}, [20]byte{7, 9})
+
+	require.NoError(t, err)
+	assert.Equal(t, []ScrapeResult{
+		{InfoHash: [20]byte{5, 1}, Seeders: 5, Completed: 100, Leechers: 1},
+		{InfoHash: [20]byte{7, 9}, Seeders: 7, Completed: 100, Leechers: 9},
+	}, results)
+}
+
+func TestDiscoverPeersUDP(t *testing.T) {
+	fake := newFakeUDPTracker(t)
+	torrent, err := NewTorrent("../../sample.torrent")
+	require.NoError(t, err)
+	torrent.Announce = "udp://" + fake.address() + "/announce"
+
+	result, err := torrent.DiscoverPeers(context.Background())
+
+	require.NoError(t, err)
+	assert.Len(t, result.Peers, 2)
+	_, announces := fake.stats()
+	assert.Equal(t, uint64(92063), announces[0].left)
+}
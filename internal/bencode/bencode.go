@@ -61,12 +61,16 @@ func decodeString(bencodedString string) (value string, remaining string, err er
 	if err != nil {
 		return "", "", err
 	}
+	if length < 0 {
+		return "", "", fmt.Errorf("invalid bencode string. Negative length")
+	}
 
 	start := colonIndex + 1
-	end := start + length
-	if end > len(bencodedString)+1 {
+	// compared before adding, a huge length would overflow end
+	if length > len(bencodedString)-start {
 		return "", "", fmt.Errorf("invalid bencode string. Length is greater than actual string length")
 	}
+	end := start + length
 
 	return bencodedString[start:end], bencodedString[end:], nil
 }
@@ -150,6 +154,9 @@ func Unmarshal(bencodedString string) (value interface{}, err error) {
 }
 
 func decode(bencodedString string) (value interface{}, remain string, err error) {
+	if bencodedString == "" {
+		return "", "", fmt.Errorf("invalid bencode input. Unexpected end of input")
+	}
 	firstChar := bencodedString[0]
 	switch {
 	case unicode.IsDigit(rune(firstChar)):
@@ -1,6 +1,7 @@
 package bencode
 
 import (
+	"reflect"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -40,6 +41,9 @@ func TestDecodeString(t *testing.T) {
 		{"invalid length", "4:sp", "", "", true},
 		{"missing content", "10:", "", "", true},
 		{"invalid format", "1x:ha", "", "", true},
+		{"one byte short", "3:sp", "", "", true},
+		{"negative length", "-1:a", "", "", true},
+		{"overflowing length", "9223372036854775807:a", "", "", true},
 	}
 
 	for _, tc := range testCases {
@@ -157,6 +161,12 @@ func TestUnmarshal(t *testing.T) {
 		{"list", "l5:helloi52ee", []interface{}{"hello", 52}, false},
 		{"dictionary", "d3:foo3:bar5:helloi52ee", map[string]interface{}{"foo": "bar", "hello": 52}, false},
 		{"invalid input", "x", nil, true},
+		{"empty input", "", nil, true},
+		{"truncated string", "5:hell", nil, true},
+		{"truncated list", "l", nil, true},
+		{"truncated dictionary", "d3:foo", nil, true},
+		{"truncated nested dictionary", "d1:ad1:b", nil, true},
+		{"overflowing length in dictionary", "d9223372036854775807:ae", nil, true},
 	}
 
 	for _, tc := range testCases {
@@ -172,6 +182,34 @@ func TestUnmarshal(t *testing.T) {
 	}
 }
 
+func FuzzUnmarshal(f *testing.F) {
+	f.Add("5:hello")
+	f.Add("i-52e")
+	f.Add("l5:helloi52ee")
+	f.Add("d3:foo3:bar5:helloi52ee")
+	f.Add("d1:ad1:bl1:cee")
+	f.Add("d9223372036854775807:ae")
+
+	f.Fuzz(func(t *testing.T, data string) {
+		value, err := Unmarshal(data)
+		if err != nil {
+			return
+		}
+		// whatever was decoded encodes back to something that decodes the same
+		encoded, err := Marshal(value)
+		if err != nil {
+			t.Fatalf("encoding %#v: %v", value, err)
+		}
+		decoded, err := Unmarshal(encoded)
+		if err != nil {
+			t.Fatalf("re-decoding %q: %v", encoded, err)
+		}
+		if !reflect.DeepEqual(decoded, value) {
+			t.Fatalf("%#v decodes as %#v after a round trip", value, decoded)
+		}
+	})
+}
+
 func TestToBencodeDictionary(t *testing.T) {
 	type TestStruct struct {
 		Foo  string `bencode:"foo"`
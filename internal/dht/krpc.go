@@ -0,0 +1,165 @@
+package dht
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// KRPC error codes.
+const (
+	ErrorGeneric  = 201
+	ErrorServer   = 202
+	ErrorProtocol = 203
+	ErrorMethod   = 204
+)
+
+// Error is a KRPC error returned by a remote node.
+type Error struct {
+	Code    int
+	Message string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("dht error %d: %s", e.Code, e.Message)
+}
+
+// message is a decoded KRPC message. Exactly one of the query, response and
+// error parts is set, according to Type.
+type message struct {
+	TransactionID string
+	// Type is "q", "r" or "e".
+	Type   string
+	Method string
+	Args   map[string]interface{}
+	Reply  map[string]interface{}
+	Err    *Error
+}
+
+func (m *message) encode() ([]byte, error) {
+	dict := map[string]interface{}{"t": m.TransactionID, "y": m.Type}
+	switch m.Type {
+	case "q":
+		dict["q"] = m.Method
+		dict["a"] = m.Args
+	case "r":
+		dict["r"] = m.Reply
+	case "e":
+		dict["e"] = []interface{}{m.Err.Code, m.Err.Message}
+	}
+	encoded, err := bencode.Marshal(dict)
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encoded), nil
+}
+
+// decodeDict decodes a bencoded dictionary.
+func decodeDict(data []byte) (map[string]interface{}, error) {
+	decoded, err := bencode.Unmarshal(string(data))
+	if err != nil {
+		return nil, err
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("not a bencoded dictionary")
+	}
+	return dict, nil
+}
+
+// decodeMessage parses a KRPC message from an untrusted packet.
+func decodeMessage(packet []byte) (*message, error) {
+	dict, err := decodeDict(packet)
+	if err != nil {
+		return nil, fmt.Errorf("invalid KRPC message: %w", err)
+	}
+
+	msg := &message{}
+	msg.TransactionID, _ = dict["t"].(string)
+	msg.Type, _ = dict["y"].(string)
+	switch msg.Type {
+	case "q":
+		msg.Method, _ = dict["q"].(string)
+		msg.Args, _ = dict["a"].(map[string]interface{})
+		if msg.Method == "" || msg.Args == nil {
+			return nil, fmt.Errorf("invalid KRPC query")
+		}
+	case "r":
+		msg.Reply, _ = dict["r"].(map[string]interface{})
+		if msg.Reply == nil {
+			return nil, fmt.Errorf("invalid KRPC response")
+		}
+	case "e":
+		list, _ := dict["e"].([]interface{})
+		if len(list) != 2 {
+			return nil, fmt.Errorf("invalid KRPC error")
+		}
+		code, _ := list[0].(int)
+		text, _ := list[1].(string)
+		msg.Err = &Error{Code: code, Message: text}
+	default:
+		return nil, fmt.Errorf("invalid KRPC message type: %q", msg.Type)
+	}
+	return msg, nil
+}
+
+// nodeID reads a 20 byte node id or info hash from a dictionary.
+func nodeID(dict map[string]interface{}, key string) ([20]byte, bool) {
+	var id [20]byte
+	value, ok := dict[key].(string)
+	if !ok || len(value) != 20 {
+		return id, false
+	}
+	copy(id[:], value)
+	return id, true
+}
+
+// Compact encodings (BEP 5). Only IPv4 is supported.
+const (
+	compactPeerLength = 6
+	compactNodeLength = 26
+)
+
+func compactPeer(addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap().As4()
+	return binary.BigEndian.AppendUint16(ip[:], addr.Port())
+}
+
+func parseCompactPeer(data string) (netip.AddrPort, bool) {
+	if len(data) != compactPeerLength {
+		return netip.AddrPort{}, false
+	}
+	ip := netip.AddrFrom4([4]byte([]byte(data[:4])))
+	return netip.AddrPortFrom(ip, binary.BigEndian.Uint16([]byte(data[4:]))), true
+}
+
+func compactNodes(nodes []NodeInfo) string {
+	data := make([]byte, 0, len(nodes)*compactNodeLength)
+	for _, node := range nodes {
+		if !node.Addr.Addr().Unmap().Is4() {
+			continue
+		}
+		data = append(data, node.ID[:]...)
+		data = append(data, compactPeer(node.Addr)...)
+	}
+	return string(data)
+}
+
+func parseCompactNodes(data string) ([]NodeInfo, error) {
+	if len(data)%compactNodeLength != 0 {
+		return nil, fmt.Errorf("invalid compact node info: %d bytes", len(data))
+	}
+	nodes := make([]NodeInfo, 0, len(data)/compactNodeLength)
+	for i := 0; i < len(data); i += compactNodeLength {
+		var node NodeInfo
+		copy(node.ID[:], data[i:i+20])
+		node.Addr, _ = parseCompactPeer(data[i+20 : i+compactNodeLength])
+		if node.Addr.Port() == 0 {
+			continue
+		}
+		nodes = append(nodes, node)
+	}
+	return nodes, nil
+}
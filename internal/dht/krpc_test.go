@@ -0,0 +1,82 @@
+package dht
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMessageRoundTrip(t *testing.T) {
+	testCases := []struct {
+		name    string
+		message *message
+		encoded string
+	}{
+		{
+			"query",
+			&message{TransactionID: "aa", Type: "q", Method: "ping", Args: map[string]interface{}{"id": "abcdefghij0123456789"}},
+			"d1:ad2:id20:abcdefghij0123456789e1:q4:ping1:t2:aa1:y1:qe",
+		},
+		{
+			"response",
+			&message{TransactionID: "aa", Type: "r", Reply: map[string]interface{}{"id": "mnopqrstuvwxyz123456"}},
+			"d1:rd2:id20:mnopqrstuvwxyz123456e1:t2:aa1:y1:re",
+		},
+		{
+			"error",
+			&message{TransactionID: "aa", Type: "e", Err: &Error{Code: ErrorGeneric, Message: "A Generic Error Ocurred"}},
+			"d1:eli201e23:A Generic Error Ocurrede1:t2:aa1:y1:ee",
+		},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			encoded, err := tc.message.encode()
+			require.NoError(t, err)
+			assert.Equal(t, tc.encoded, string(encoded))
+
+			decoded, err := decodeMessage(encoded)
+			require.NoError(t, err)
+			assert.Equal(t, tc.message, decoded)
+		})
+	}
+}
+
+func TestDecodeMessageInvalid(t *testing.T) {
+	for _, packet := range []string{
+		"",
+		"i42e",
+		"d1:y1:xe",
+		"d1:y1:qe",
+		"d1:y1:re",
+		"d1:eli201ee1:y1:ee",
+		"d1:t2:aa1:y1:q1:q4:ping1:a",
+		"d1:t99:aa",
+		"d1:tl",
+		"d9223372036854775807:ae",
+		"d",
+	} {
+		_, err := decodeMessage([]byte(packet))
+		assert.Error(t, err, packet)
+	}
+}
+
+func TestCompactNodes(t *testing.T) {
+	nodes := []NodeInfo{
+		{ID: [20]byte{1}, Addr: netip.MustParseAddrPort("10.0.0.1:6881")},
+		{ID: [20]byte{2}, Addr: netip.MustParseAddrPort("[::1]:6881")},
+		{ID: [20]byte{3}, Addr: netip.MustParseAddrPort("192.168.1.1:1")},
+	}
+
+	compact := compactNodes(nodes)
+	assert.Len(t, compact, 2*compactNodeLength)
+
+	parsed, err := parseCompactNodes(compact)
+	require.NoError(t, err)
+	assert.Equal(t, []NodeInfo{nodes[0], nodes[2]}, parsed)
+
+	_, err = parseCompactNodes(compact[1:])
+	assert.Error(t, err)
+}
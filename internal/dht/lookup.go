@@ -0,0 +1,238 @@
+package dht
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sort"
+	"sync"
+)
+
+// alpha is the number of queries a lookup keeps in flight.
+const alpha = 3
+
+// DefaultBootstrapNodes are well-known routers used to join the DHT.
+var DefaultBootstrapNodes = []string{
+	"router.bittorrent.com:6881",
+	"dht.transmissionbt.com:6881",
+	"router.utorrent.com:6881",
+}
+
+// ErrNoNodes is returned when a lookup has no node to start from.
+var ErrNoNodes = errors.New("no DHT nodes known, bootstrap first")
+
+// Bootstrap joins the DHT through the nodes at the given host:port
+// addresses, then looks up our own id to fill the routing table.
+func (n *Node) Bootstrap(ctx context.Context, addresses ...string) error {
+	var wg sync.WaitGroup
+	for _, address := range addresses {
+		wg.Add(1)
+		go func(address string) {
+			defer wg.Done()
+			addrs, err := resolve(ctx, address)
+			if err != nil {
+				return
+			}
+			for _, addr := range addrs {
+				// answering nodes are added to the table
+				n.Ping(ctx, addr)
+			}
+		}(address)
+	}
+	wg.Wait()
+
+	if n.table.Len() == 0 {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return fmt.Errorf("failed to bootstrap: none of %d nodes answered", len(addresses))
+	}
+	n.lookup(ctx, n.id, false)
+	return ctx.Err()
+}
+
+func resolve(ctx context.Context, address string) ([]netip.AddrPort, error) {
+	if addr, err := netip.ParseAddrPort(address); err == nil {
+		return []netip.AddrPort{netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())}, nil
+	}
+	host, port, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	portNumber, err := net.DefaultResolver.LookupPort(ctx, "udp", port)
+	if err != nil {
+		return nil, err
+	}
+	ips, err := net.DefaultResolver.LookupNetIP(ctx, "ip4", host)
+	if err != nil {
+		return nil, err
+	}
+	addrs := make([]netip.AddrPort, len(ips))
+	for i, ip := range ips {
+		addrs[i] = netip.AddrPortFrom(ip.Unmap(), uint16(portNumber))
+	}
+	return addrs, nil
+}
+
+// GetPeers looks up the peers of a torrent.
+func (n *Node) GetPeers(ctx context.Context, infoHash [20]byte) ([]netip.AddrPort, error) {
+	if n.table.Len() == 0 {
+		return nil, ErrNoNodes
+	}
+	result := n.lookup(ctx, infoHash, true)
+	if len(result.peers) == 0 && ctx.Err() != nil {
+		return nil, ctx.Err()
+	}
+	return result.peers, nil
+}
+
+// Announce tells the nodes closest to infoHash that we accept connections
+// for it on port, so that their get_peers answers include us. A port of 0
+// announces our DHT port. It returns the number of nodes that accepted.
+func (n *Node) Announce(ctx context.Context, infoHash [20]byte, port int) (int, error) {
+	if n.table.Len() == 0 {
+		return 0, ErrNoNodes
+	}
+	result := n.lookup(ctx, infoHash, true)
+
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	accepted := 0
+	for _, candidate := range result.closest {
+		if candidate.token == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(candidate *lookupCandidate) {
+			defer wg.Done()
+			if n.announcePeer(ctx, candidate.Addr, infoHash, port, candidate.token) == nil {
+				mu.Lock()
+				accepted++
+				mu.Unlock()
+			}
+		}(candidate)
+	}
+	wg.Wait()
+
+	if accepted == 0 {
+		if ctx.Err() != nil {
+			return 0, ctx.Err()
+		}
+		return 0, fmt.Errorf("no DHT node accepted the announce")
+	}
+	return accepted, nil
+}
+
+type lookupCandidate struct {
+	NodeInfo
+	queried   bool
+	responded bool
+	failed    bool
+	token     string
+}
+
+type lookupResult struct {
+	// closest are the K closest nodes that answered.
+	closest []*lookupCandidate
+	peers   []netip.AddrPort
+}
+
+// lookup runs an iterative search towards target (find_node, or get_peers
+// when getPeers is set). It keeps alpha queries in flight to the closest
+// nodes not asked yet, and stops once the K closest nodes it knows have all
+// answered.
+func (n *Node) lookup(ctx context.Context, target [20]byte, getPeers bool) *lookupResult {
+	var candidates []*lookupCandidate
+	seen := map[netip.AddrPort]bool{}
+	addCandidates := func(nodes []NodeInfo) {
+		for _, node := range nodes {
+			if seen[node.Addr] || node.ID == n.id {
+				continue
+			}
+			seen[node.Addr] = true
+			candidates = append(candidates, &lookupCandidate{NodeInfo: node})
+		}
+		sort.Slice(candidates, func(i, j int) bool {
+			return closer(target, candidates[i].ID, candidates[j].ID)
+		})
+	}
+	addCandidates(n.table.Closest(target, K))
+
+	type answer struct {
+		candidate *lookupCandidate
+		nodes     []NodeInfo
+		peers     []netip.AddrPort
+		token     string
+		err       error
+	}
+	answers := make(chan answer)
+	inFlight := 0
+	peerSeen := map[netip.AddrPort]bool{}
+	result := &lookupResult{}
+
+	for {
+		// query the closest nodes that haven't been asked, as long as they
+		// are among the K closest live candidates
+		live := 0
+		for _, candidate := range candidates {
+			if live >= K || inFlight >= alpha || ctx.Err() != nil {
+				break
+			}
+			if candidate.failed {
+				continue
+			}
+			live++
+			if candidate.queried {
+				continue
+			}
+			candidate.queried = true
+			inFlight++
+			go func(candidate *lookupCandidate) {
+				var a answer
+				a.candidate = candidate
+				if getPeers {
+					var reply *getPeersReply
+					reply, a.err = n.getPeers(ctx, candidate.Addr, target)
+					if a.err == nil {
+						a.nodes, a.peers, a.token = reply.Nodes, reply.Peers, reply.Token
+					}
+				} else {
+					a.nodes, a.err = n.FindNode(ctx, candidate.Addr, target)
+				}
+				answers <- a
+			}(candidate)
+		}
+		if inFlight == 0 {
+			break
+		}
+
+		a := <-answers
+		inFlight--
+		if a.err != nil {
+			// a failed node no longer counts towards the K closest
+			a.candidate.failed = true
+			continue
+		}
+		a.candidate.responded = true
+		a.candidate.token = a.token
+		for _, peer := range a.peers {
+			if !peerSeen[peer] {
+				peerSeen[peer] = true
+				result.peers = append(result.peers, peer)
+			}
+		}
+		addCandidates(a.nodes)
+	}
+
+	for _, candidate := range candidates {
+		if len(result.closest) == K {
+			break
+		}
+		if candidate.responded {
+			result.closest = append(result.closest, candidate)
+		}
+	}
+	return result
+}
@@ -0,0 +1,326 @@
+package dht
+
+import (
+	"context"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const defaultQueryTimeout = 2 * time.Second
+
+// ErrTimeout is returned when a node doesn't answer a query.
+var ErrTimeout = errors.New("dht node did not respond")
+
+// Node is a mainline DHT node (BEP 5). It answers queries from other nodes
+// and runs its own queries and lookups over the same socket.
+type Node struct {
+	// QueryTimeout bounds a single query to another node.
+	QueryTimeout time.Duration
+
+	id     [20]byte
+	conn   net.PacketConn
+	table  *Table
+	peers  *peerStore
+	tokens *tokens
+
+	mu      sync.Mutex
+	pending map[string]*pendingQuery
+	closed  chan struct{}
+}
+
+type pendingQuery struct {
+	addr     netip.AddrPort
+	response chan *message
+}
+
+// NewNode runs a node with the given id on conn until Close is called.
+func NewNode(conn net.PacketConn, id [20]byte) *Node {
+	n := &Node{
+		QueryTimeout: defaultQueryTimeout,
+		id:           id,
+		conn:         conn,
+		table:        NewTable(id),
+		peers:        newPeerStore(time.Now),
+		tokens:       newTokens(time.Now),
+		pending:      map[string]*pendingQuery{},
+		closed:       make(chan struct{}),
+	}
+	go n.serve()
+	return n
+}
+
+// Listen runs a node on a UDP address.
+func Listen(address string, id [20]byte) (*Node, error) {
+	conn, err := net.ListenPacket("udp4", address)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	return NewNode(conn, id), nil
+}
+
+func (n *Node) ID() [20]byte {
+	return n.id
+}
+
+func (n *Node) Addr() netip.AddrPort {
+	if addr, ok := n.conn.LocalAddr().(*net.UDPAddr); ok {
+		return addr.AddrPort()
+	}
+	return netip.AddrPort{}
+}
+
+func (n *Node) Table() *Table {
+	return n.table
+}
+
+func (n *Node) Close() error {
+	err := n.conn.Close()
+	<-n.closed
+	return err
+}
+
+func (n *Node) serve() {
+	defer close(n.closed)
+	buffer := make([]byte, 64*1024)
+	for {
+		size, addr, err := n.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		msg, err := decodeMessage(buffer[:size])
+		if err != nil {
+			continue
+		}
+		from := netip.AddrPortFrom(udpAddr.AddrPort().Addr().Unmap(), udpAddr.AddrPort().Port())
+
+		if msg.Type == "q" {
+			n.handleQuery(msg, from)
+			continue
+		}
+		n.mu.Lock()
+		pending := n.pending[msg.TransactionID]
+		// responses must come from the node we asked
+		if pending != nil && pending.addr == from {
+			delete(n.pending, msg.TransactionID)
+			pending.response <- msg
+		}
+		n.mu.Unlock()
+	}
+}
+
+func (n *Node) send(msg *message, to netip.AddrPort) error {
+	packet, err := msg.encode()
+	if err != nil {
+		return err
+	}
+	_, err = n.conn.WriteTo(packet, net.UDPAddrFromAddrPort(to))
+	return err
+}
+
+func (n *Node) handleQuery(msg *message, from netip.AddrPort) {
+	reply, err := n.answer(msg, from)
+	if err != nil {
+		var krpcErr *Error
+		if !errors.As(err, &krpcErr) {
+			krpcErr = &Error{Code: ErrorServer, Message: err.Error()}
+		}
+		n.send(&message{TransactionID: msg.TransactionID, Type: "e", Err: krpcErr}, from)
+		return
+	}
+	reply["id"] = string(n.id[:])
+	n.send(&message{TransactionID: msg.TransactionID, Type: "r", Reply: reply}, from)
+}
+
+// answer returns the reply to a query, without our id.
+func (n *Node) answer(msg *message, from netip.AddrPort) (map[string]interface{}, error) {
+	id, ok := nodeID(msg.Args, "id")
+	if !ok {
+		return nil, &Error{Code: ErrorProtocol, Message: "missing id"}
+	}
+	// nodes that query us are alive
+	n.table.Add(NodeInfo{ID: id, Addr: from})
+
+	switch msg.Method {
+	case "ping":
+		return map[string]interface{}{}, nil
+
+	case "find_node":
+		target, ok := nodeID(msg.Args, "target")
+		if !ok {
+			return nil, &Error{Code: ErrorProtocol, Message: "missing target"}
+		}
+		return map[string]interface{}{"nodes": compactNodes(n.table.Closest(target, K))}, nil
+
+	case "get_peers":
+		infoHash, ok := nodeID(msg.Args, "info_hash")
+		if !ok {
+			return nil, &Error{Code: ErrorProtocol, Message: "missing info_hash"}
+		}
+		reply := map[string]interface{}{"token": n.tokens.issue(from.Addr())}
+		if peers := n.peers.get(infoHash); len(peers) > 0 {
+			values := make([]interface{}, 0, len(peers))
+			for _, peer := range peers {
+				if peer.Addr().Is4() {
+					values = append(values, string(compactPeer(peer)))
+				}
+			}
+			reply["values"] = values
+		} else {
+			reply["nodes"] = compactNodes(n.table.Closest(infoHash, K))
+		}
+		return reply, nil
+
+	case "announce_peer":
+		infoHash, ok := nodeID(msg.Args, "info_hash")
+		if !ok {
+			return nil, &Error{Code: ErrorProtocol, Message: "missing info_hash"}
+		}
+		token, _ := msg.Args["token"].(string)
+		if !n.tokens.valid(token, from.Addr()) {
+			return nil, &Error{Code: ErrorProtocol, Message: "bad token"}
+		}
+		port, _ := msg.Args["port"].(int)
+		if implied, _ := msg.Args["implied_port"].(int); implied == 1 {
+			port = int(from.Port())
+		}
+		if port <= 0 || port > 65535 {
+			return nil, &Error{Code: ErrorProtocol, Message: "invalid port"}
+		}
+		n.peers.add(infoHash, netip.AddrPortFrom(from.Addr(), uint16(port)))
+		return map[string]interface{}{}, nil
+
+	default:
+		return nil, &Error{Code: ErrorMethod, Message: "method unknown"}
+	}
+}
+
+// newTransactionID returns a random transaction id that no pending query
+// uses. Random ids keep other nodes from guessing the id of a query to spoof
+// its response. n.mu must be held.
+func (n *Node) newTransactionID() string {
+	for {
+		var id [2]byte
+		rand.Read(id[:])
+		if _, ok := n.pending[string(id[:])]; !ok {
+			return string(id[:])
+		}
+	}
+}
+
+// query sends a query and waits for its response. Nodes that answer are
+// added to the routing table.
+func (n *Node) query(ctx context.Context, addr netip.AddrPort, method string, args map[string]interface{}) (map[string]interface{}, error) {
+	args["id"] = string(n.id[:])
+	pending := &pendingQuery{addr: addr, response: make(chan *message, 1)}
+
+	n.mu.Lock()
+	transactionID := n.newTransactionID()
+	n.pending[transactionID] = pending
+	n.mu.Unlock()
+	defer func() {
+		n.mu.Lock()
+		delete(n.pending, transactionID)
+		n.mu.Unlock()
+	}()
+
+	err := n.send(&message{TransactionID: transactionID, Type: "q", Method: method, Args: args}, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	timer := time.NewTimer(n.QueryTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-pending.response:
+		if msg.Err != nil {
+			return nil, msg.Err
+		}
+		id, ok := nodeID(msg.Reply, "id")
+		if !ok {
+			return nil, fmt.Errorf("invalid response from %s: missing id", addr)
+		}
+		n.table.Add(NodeInfo{ID: id, Addr: addr})
+		return msg.Reply, nil
+	case <-timer.C:
+		n.table.Failed(addr)
+		return nil, ErrTimeout
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// Ping checks that the node at addr is alive and returns its id.
+func (n *Node) Ping(ctx context.Context, addr netip.AddrPort) ([20]byte, error) {
+	reply, err := n.query(ctx, addr, "ping", map[string]interface{}{})
+	if err != nil {
+		return [20]byte{}, err
+	}
+	id, _ := nodeID(reply, "id")
+	return id, nil
+}
+
+// FindNode asks the node at addr for the nodes it knows closest to target.
+func (n *Node) FindNode(ctx context.Context, addr netip.AddrPort, target [20]byte) ([]NodeInfo, error) {
+	reply, err := n.query(ctx, addr, "find_node", map[string]interface{}{"target": string(target[:])})
+	if err != nil {
+		return nil, err
+	}
+	nodes, _ := reply["nodes"].(string)
+	return parseCompactNodes(nodes)
+}
+
+// getPeersReply is the answer to get_peers: either peers or closer nodes,
+// and a token for announcing.
+type getPeersReply struct {
+	Peers []netip.AddrPort
+	Nodes []NodeInfo
+	Token string
+}
+
+func (n *Node) getPeers(ctx context.Context, addr netip.AddrPort, infoHash [20]byte) (*getPeersReply, error) {
+	reply, err := n.query(ctx, addr, "get_peers", map[string]interface{}{"info_hash": string(infoHash[:])})
+	if err != nil {
+		return nil, err
+	}
+
+	result := &getPeersReply{}
+	result.Token, _ = reply["token"].(string)
+	values, _ := reply["values"].([]interface{})
+	for _, value := range values {
+		data, _ := value.(string)
+		if peer, ok := parseCompactPeer(data); ok && peer.Port() != 0 {
+			result.Peers = append(result.Peers, peer)
+		}
+	}
+	if nodes, ok := reply["nodes"].(string); ok {
+		result.Nodes, err = parseCompactNodes(nodes)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return result, nil
+}
+
+// announcePeer tells the node at addr that we download infoHash and accept
+// connections on port. A port of 0 asks it to use our UDP source port.
+func (n *Node) announcePeer(ctx context.Context, addr netip.AddrPort, infoHash [20]byte, port int, token string) error {
+	args := map[string]interface{}{
+		"info_hash": string(infoHash[:]),
+		"port":      port,
+		"token":     token,
+	}
+	if port == 0 {
+		args["implied_port"] = 1
+	}
+	_, err := n.query(ctx, addr, "announce_peer", args)
+	return err
+}
@@ -0,0 +1,180 @@
+package dht
+
+import (
+	"context"
+	"net"
+	"net/netip"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startNode runs a node on a loopback port.
+func startNode(t *testing.T) *Node {
+	t.Helper()
+	node, err := Listen("127.0.0.1:0", RandomID())
+	require.NoError(t, err)
+	node.QueryTimeout = 500 * time.Millisecond
+	t.Cleanup(func() { node.Close() })
+	return node
+}
+
+// startNetwork runs count nodes that all bootstrapped from the first.
+func startNetwork(t *testing.T, count int) []*Node {
+	t.Helper()
+	nodes := make([]*Node, count)
+	for i := range nodes {
+		nodes[i] = startNode(t)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	for _, node := range nodes[1:] {
+		require.NoError(t, node.Bootstrap(ctx, nodes[0].Addr().String()))
+	}
+	return nodes
+}
+
+func TestPingAndFindNode(t *testing.T) {
+	a, b := startNode(t), startNode(t)
+	ctx := context.Background()
+
+	id, err := a.Ping(ctx, b.Addr())
+	require.NoError(t, err)
+	assert.Equal(t, b.ID(), id)
+	// both sides learned about each other
+	assert.Equal(t, []NodeInfo{{ID: b.ID(), Addr: b.Addr()}}, a.Table().Nodes())
+	assert.Equal(t, []NodeInfo{{ID: a.ID(), Addr: a.Addr()}}, b.Table().Nodes())
+
+	nodes, err := b.FindNode(ctx, a.Addr(), RandomID())
+	require.NoError(t, err)
+	assert.Equal(t, []NodeInfo{{ID: b.ID(), Addr: b.Addr()}}, nodes)
+}
+
+func TestQueryTimeout(t *testing.T) {
+	silent, err := net.ListenPacket("udp4", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer silent.Close()
+
+	node := startNode(t)
+	node.QueryTimeout = 50 * time.Millisecond
+	_, err = node.Ping(context.Background(), silent.LocalAddr().(*net.UDPAddr).AddrPort())
+	assert.ErrorIs(t, err, ErrTimeout)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = node.Ping(ctx, silent.LocalAddr().(*net.UDPAddr).AddrPort())
+	assert.ErrorIs(t, err, context.Canceled)
+}
+
+func TestTransactionIDs(t *testing.T) {
+	node := startNode(t)
+	node.mu.Lock()
+	defer node.mu.Unlock()
+
+	// every id but one is taken, so a new id can only be that one
+	for i := 1; i < 1<<16; i++ {
+		node.pending[string([]byte{byte(i >> 8), byte(i)})] = &pendingQuery{}
+	}
+	assert.Equal(t, string([]byte{0, 0}), node.newTransactionID())
+	clear(node.pending)
+}
+
+func TestQueryErrors(t *testing.T) {
+	a, b := startNode(t), startNode(t)
+	ctx := context.Background()
+
+	_, err := a.query(ctx, b.Addr(), "vote", map[string]interface{}{})
+	var krpcErr *Error
+	require.ErrorAs(t, err, &krpcErr)
+	assert.Equal(t, ErrorMethod, krpcErr.Code)
+
+	err = a.announcePeer(ctx, b.Addr(), [20]byte{1}, 6881, "forged")
+	require.ErrorAs(t, err, &krpcErr)
+	assert.Equal(t, ErrorProtocol, krpcErr.Code)
+	assert.Equal(t, "bad token", krpcErr.Message)
+}
+
+func TestAnnounceAndGetPeers(t *testing.T) {
+	nodes := startNetwork(t, 24)
+	for _, node := range nodes {
+		assert.Greater(t, node.Table().Len(), 1)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	infoHash := RandomID()
+	accepted, err := nodes[5].Announce(ctx, infoHash, 7005)
+	require.NoError(t, err)
+	assert.Greater(t, accepted, 0)
+	_, err = nodes[9].Announce(ctx, infoHash, 0)
+	require.NoError(t, err)
+
+	peers, err := nodes[17].GetPeers(ctx, infoHash)
+	require.NoError(t, err)
+	assert.ElementsMatch(t, []netip.AddrPort{
+		netip.AddrPortFrom(netip.MustParseAddr("127.0.0.1"), 7005),
+		nodes[9].Addr(),
+	}, peers)
+
+	peers, err = nodes[17].GetPeers(ctx, RandomID())
+	require.NoError(t, err)
+	assert.Empty(t, peers)
+}
+
+func TestLookupWithoutNodes(t *testing.T) {
+	node := startNode(t)
+	_, err := node.GetPeers(context.Background(), RandomID())
+	assert.ErrorIs(t, err, ErrNoNodes)
+	_, err = node.Announce(context.Background(), RandomID(), 1)
+	assert.ErrorIs(t, err, ErrNoNodes)
+
+	err = node.Bootstrap(context.Background(), "127.0.0.1:1")
+	assert.ErrorContains(t, err, "failed to bootstrap")
+}
+
+func TestTokens(t *testing.T) {
+	now := time.Now()
+	tokens := newTokens(func() time.Time { return now })
+	addr := netip.MustParseAddr("10.0.0.1")
+
+	token := tokens.issue(addr)
+	assert.True(t, tokens.valid(token, addr))
+	assert.False(t, tokens.valid(token, netip.MustParseAddr("10.0.0.2")))
+
+	now = now.Add(tokenRotation)
+	assert.True(t, tokens.valid(token, addr), "previous secret")
+	now = now.Add(tokenRotation)
+	assert.False(t, tokens.valid(token, addr), "expired")
+}
+
+func TestPeerStoreExpires(t *testing.T) {
+	now := time.Now()
+	store := newPeerStore(func() time.Time { return now })
+	store.add([20]byte{1}, netip.MustParseAddrPort("10.0.0.1:1"))
+	assert.Len(t, store.get([20]byte{1}), 1)
+
+	now = now.Add(peerTTL + time.Second)
+	assert.Empty(t, store.get([20]byte{1}))
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "state", "dht-nodes")
+
+	id, nodes, err := Load(path)
+	require.NoError(t, err)
+	assert.NotEqual(t, [20]byte{}, id)
+	assert.Empty(t, nodes)
+
+	a, b := startNode(t), startNode(t)
+	_, err = a.Ping(context.Background(), b.Addr())
+	require.NoError(t, err)
+	require.NoError(t, a.Save(path))
+
+	id, nodes, err = Load(path)
+	require.NoError(t, err)
+	assert.Equal(t, a.ID(), id)
+	assert.Equal(t, []NodeInfo{{ID: b.ID(), Addr: b.Addr()}}, nodes)
+}
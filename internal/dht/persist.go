@@ -0,0 +1,63 @@
+package dht
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// Save writes our id and the good nodes of the routing table to path, so
+// the next run keeps its id and can bootstrap without the routers.
+func (n *Node) Save(path string) error {
+	encoded, err := bencode.Marshal(map[string]interface{}{
+		"id":    string(n.id[:]),
+		"nodes": compactNodes(n.table.Nodes()),
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return fmt.Errorf("failed to save DHT nodes: %w", err)
+	}
+	// write to a temporary file first so a crash can't leave half a table
+	temp := path + ".tmp"
+	if err := os.WriteFile(temp, []byte(encoded), 0o644); err != nil {
+		return fmt.Errorf("failed to save DHT nodes: %w", err)
+	}
+	if err := os.Rename(temp, path); err != nil {
+		return fmt.Errorf("failed to save DHT nodes: %w", err)
+	}
+	return nil
+}
+
+// Load reads a node table written by Save. A missing file gives a random
+// id and no nodes.
+func Load(path string) (id [20]byte, nodes []NodeInfo, err error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return RandomID(), nil, nil
+	}
+	if err != nil {
+		return id, nil, fmt.Errorf("failed to load DHT nodes: %w", err)
+	}
+
+	dict, err := decodeDict(data)
+	if err != nil {
+		return id, nil, fmt.Errorf("failed to load DHT nodes from %s: %w", path, err)
+	}
+
+	id, ok := nodeID(dict, "id")
+	if !ok {
+		return id, nil, fmt.Errorf("failed to load DHT nodes: invalid id in %s", path)
+	}
+	compact, _ := dict["nodes"].(string)
+	nodes, err = parseCompactNodes(compact)
+	if err != nil {
+		return id, nil, fmt.Errorf("failed to load DHT nodes: %w", err)
+	}
+	return id, nodes, nil
+}
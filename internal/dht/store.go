@@ -0,0 +1,118 @@
+package dht
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	mathrand "math/rand"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+const (
+	// tokenRotation is how often the token secret changes. Tokens made with
+	// the previous secret are still accepted, so a token lives up to twice
+	// as long.
+	tokenRotation = 5 * time.Minute
+	// peerTTL is how long an announced peer is kept.
+	peerTTL = 30 * time.Minute
+	// maxValues bounds the peers in a get_peers response, so it fits in a
+	// single UDP packet.
+	maxValues = 50
+)
+
+// tokens hands out and checks the write tokens of get_peers and
+// announce_peer. A token is bound to the IP address it was given to.
+type tokens struct {
+	now func() time.Time
+
+	mu       sync.Mutex
+	secret   [8]byte
+	previous [8]byte
+	rotated  time.Time
+}
+
+func newTokens(now func() time.Time) *tokens {
+	t := &tokens{now: now, rotated: now()}
+	rand.Read(t.secret[:])
+	t.previous = t.secret
+	return t
+}
+
+func (t *tokens) rotate() {
+	now := t.now()
+	for now.Sub(t.rotated) >= tokenRotation {
+		t.previous = t.secret
+		rand.Read(t.secret[:])
+		t.rotated = t.rotated.Add(tokenRotation)
+	}
+}
+
+func tokenFor(secret [8]byte, addr netip.Addr) string {
+	ip := addr.Unmap().AsSlice()
+	sum := sha1.Sum(append(ip, secret[:]...))
+	return string(sum[:8])
+}
+
+func (t *tokens) issue(addr netip.Addr) string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return tokenFor(t.secret, addr)
+}
+
+func (t *tokens) valid(token string, addr netip.Addr) bool {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.rotate()
+	return token == tokenFor(t.secret, addr) || token == tokenFor(t.previous, addr)
+}
+
+// peerStore keeps the peers announced to us.
+type peerStore struct {
+	now func() time.Time
+
+	mu    sync.Mutex
+	peers map[[20]byte]map[netip.AddrPort]time.Time
+}
+
+func newPeerStore(now func() time.Time) *peerStore {
+	return &peerStore{now: now, peers: map[[20]byte]map[netip.AddrPort]time.Time{}}
+}
+
+func (s *peerStore) add(infoHash [20]byte, addr netip.AddrPort) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	swarm := s.peers[infoHash]
+	if swarm == nil {
+		swarm = map[netip.AddrPort]time.Time{}
+		s.peers[infoHash] = swarm
+	}
+	swarm[addr] = s.now()
+}
+
+// get returns up to maxValues random peers of a swarm.
+func (s *peerStore) get(infoHash [20]byte) []netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	var peers []netip.AddrPort
+	for addr, announced := range s.peers[infoHash] {
+		if now.Sub(announced) > peerTTL {
+			delete(s.peers[infoHash], addr)
+			continue
+		}
+		peers = append(peers, addr)
+	}
+	if len(s.peers[infoHash]) == 0 {
+		delete(s.peers, infoHash)
+	}
+	mathrand.Shuffle(len(peers), func(i, j int) {
+		peers[i], peers[j] = peers[j], peers[i]
+	})
+	if len(peers) > maxValues {
+		peers = peers[:maxValues]
+	}
+	return peers
+}
@@ -0,0 +1,159 @@
+package dht
+
+import (
+	"bytes"
+	"crypto/rand"
+	"math/bits"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+// K is the size of a bucket and the number of closest nodes a lookup
+// returns.
+const K = 8
+
+// maxFailures is the number of unanswered queries after which a node is
+// bad: it is no longer returned and may be replaced.
+const maxFailures = 2
+
+// NodeInfo identifies a DHT node.
+type NodeInfo struct {
+	ID   [20]byte
+	Addr netip.AddrPort
+}
+
+// RandomID returns a random node id.
+func RandomID() [20]byte {
+	var id [20]byte
+	rand.Read(id[:])
+	return id
+}
+
+// distance returns the XOR metric between two ids.
+func distance(a, b [20]byte) [20]byte {
+	var d [20]byte
+	for i := range d {
+		d[i] = a[i] ^ b[i]
+	}
+	return d
+}
+
+// closer reports whether a is closer to target than b.
+func closer(target, a, b [20]byte) bool {
+	da, db := distance(target, a), distance(target, b)
+	return bytes.Compare(da[:], db[:]) < 0
+}
+
+// commonPrefixLength returns the number of leading bits a and b share.
+func commonPrefixLength(a, b [20]byte) int {
+	for i := range a {
+		if x := a[i] ^ b[i]; x != 0 {
+			return i*8 + bits.LeadingZeros8(x)
+		}
+	}
+	return 160
+}
+
+// Table is a routing table of K-buckets. Bucket i holds the nodes whose id
+// shares exactly i leading bits with ours, so buckets close to us cover
+// ever smaller parts of the id space.
+type Table struct {
+	self [20]byte
+	now  func() time.Time
+
+	mu      sync.Mutex
+	buckets [160][]*tableEntry
+}
+
+type tableEntry struct {
+	NodeInfo
+	lastSeen time.Time
+	failures int
+}
+
+func NewTable(self [20]byte) *Table {
+	return &Table{self: self, now: time.Now}
+}
+
+// Add records that node answered us or queried us. It returns false if the
+// node's bucket is full of good nodes.
+func (t *Table) Add(node NodeInfo) bool {
+	if node.ID == t.self || !node.Addr.IsValid() {
+		return false
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	index := commonPrefixLength(t.self, node.ID)
+	bucket := t.buckets[index]
+	for i, entry := range bucket {
+		if entry.ID == node.ID {
+			entry.Addr = node.Addr
+			entry.lastSeen = t.now()
+			entry.failures = 0
+			// the most recently seen node goes to the back
+			t.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), entry)
+			return true
+		}
+	}
+
+	entry := &tableEntry{NodeInfo: node, lastSeen: t.now()}
+	if len(bucket) < K {
+		t.buckets[index] = append(bucket, entry)
+		return true
+	}
+	for i, old := range bucket {
+		if old.failures >= maxFailures {
+			t.buckets[index] = append(append(bucket[:i:i], bucket[i+1:]...), entry)
+			return true
+		}
+	}
+	return false
+}
+
+// Failed records that the node at addr didn't answer a query.
+func (t *Table) Failed(addr netip.AddrPort) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, bucket := range t.buckets {
+		for _, entry := range bucket {
+			if entry.Addr == addr {
+				entry.failures++
+			}
+		}
+	}
+}
+
+// Closest returns up to count good nodes closest to target.
+func (t *Table) Closest(target [20]byte, count int) []NodeInfo {
+	nodes := t.Nodes()
+	sort.Slice(nodes, func(i, j int) bool {
+		return closer(target, nodes[i].ID, nodes[j].ID)
+	})
+	if len(nodes) > count {
+		nodes = nodes[:count]
+	}
+	return nodes
+}
+
+// Nodes returns every good node in the table.
+func (t *Table) Nodes() []NodeInfo {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	var nodes []NodeInfo
+	for _, bucket := range t.buckets {
+		for _, entry := range bucket {
+			if entry.failures < maxFailures {
+				nodes = append(nodes, entry.NodeInfo)
+			}
+		}
+	}
+	return nodes
+}
+
+// Len returns the number of good nodes in the table.
+func (t *Table) Len() int {
+	return len(t.Nodes())
+}
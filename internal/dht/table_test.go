@@ -0,0 +1,70 @@
+package dht
+
+import (
+	"net/netip"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func idWithPrefix(prefix ...byte) [20]byte {
+	var id [20]byte
+	copy(id[:], prefix)
+	return id
+}
+
+func TestCommonPrefixLength(t *testing.T) {
+	assert.Equal(t, 160, commonPrefixLength([20]byte{}, [20]byte{}))
+	assert.Equal(t, 0, commonPrefixLength([20]byte{}, idWithPrefix(0x80)))
+	assert.Equal(t, 7, commonPrefixLength([20]byte{}, idWithPrefix(0x01)))
+	assert.Equal(t, 12, commonPrefixLength(idWithPrefix(0xff, 0xf0), idWithPrefix(0xff, 0xf8)))
+}
+
+func TestTableBuckets(t *testing.T) {
+	table := NewTable([20]byte{})
+	addr := func(i int) netip.AddrPort {
+		return netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 6881)
+	}
+
+	// every id starting with a one bit goes to bucket 0
+	for i := 0; i < K+2; i++ {
+		added := table.Add(NodeInfo{ID: idWithPrefix(0x80, byte(i)), Addr: addr(i)})
+		assert.Equal(t, i < K, added, i)
+	}
+	assert.Equal(t, K, table.Len())
+	assert.False(t, table.Add(NodeInfo{ID: [20]byte{}, Addr: addr(99)}), "our own id")
+
+	// a bad node makes room
+	table.Failed(addr(3))
+	assert.False(t, table.Add(NodeInfo{ID: idWithPrefix(0x80, 50), Addr: addr(50)}))
+	table.Failed(addr(3))
+	assert.Equal(t, K-1, table.Len())
+	assert.True(t, table.Add(NodeInfo{ID: idWithPrefix(0x80, 50), Addr: addr(50)}))
+	assert.Equal(t, K, table.Len())
+
+	// nodes closer to us have their own buckets
+	assert.True(t, table.Add(NodeInfo{ID: idWithPrefix(0x01), Addr: addr(60)}))
+	assert.Equal(t, K+1, table.Len())
+
+	// a known node answering again is good again
+	table.Failed(addr(4))
+	table.Failed(addr(4))
+	assert.Equal(t, K, table.Len())
+	table.Add(NodeInfo{ID: idWithPrefix(0x80, 4), Addr: addr(4)})
+	assert.Equal(t, K+1, table.Len())
+}
+
+func TestTableClosest(t *testing.T) {
+	table := NewTable([20]byte{})
+	for i := 1; i <= 20; i++ {
+		table.Add(NodeInfo{ID: idWithPrefix(byte(i)), Addr: netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, 0, byte(i)}), 1)})
+	}
+
+	closest := table.Closest(idWithPrefix(6), 3)
+	assert.Equal(t, []NodeInfo{
+		{ID: idWithPrefix(6), Addr: netip.MustParseAddrPort("10.0.0.6:1")},
+		{ID: idWithPrefix(7), Addr: netip.MustParseAddrPort("10.0.0.7:1")},
+		{ID: idWithPrefix(4), Addr: netip.MustParseAddrPort("10.0.0.4:1")},
+	}, closest)
+	assert.Len(t, table.Closest([20]byte{}, 100), 20)
+}
@@ -0,0 +1,287 @@
+package lsd
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"slices"
+	"sync"
+	"time"
+)
+
+// The multicast groups of local service discovery (BEP 14).
+var (
+	IPv4Group = netip.MustParseAddrPort("239.192.152.143:6771")
+	IPv6Group = netip.MustParseAddrPort("[ff15::efc0:988f]:6771")
+)
+
+const (
+	// MinInterval is the shortest time between two announces of the same
+	// torrent.
+	MinInterval = time.Minute
+	// peerTTL is how long a peer is kept after its last announce. Clients
+	// re-announce every few minutes.
+	peerTTL = 15 * time.Minute
+	// maxPeers bounds the peers kept per torrent, a noisy LAN can't make
+	// us use unlimited memory.
+	maxPeers = 200
+	// maxTorrents bounds the torrents whose peers are kept, but for the ones
+	// we announce or watch.
+	maxTorrents = 100
+)
+
+// ErrNoGroup is returned when no multicast group could be joined.
+var ErrNoGroup = errors.New("failed to join a local service discovery group")
+
+// Service announces torrents on the local network and collects the peers
+// other clients announce.
+type Service struct {
+	port   int
+	cookie string
+	now    func() time.Time
+
+	mu        sync.Mutex
+	groups    []*group
+	announced map[[20]byte]time.Time
+	peers     map[[20]byte]map[netip.AddrPort]time.Time
+	watches   map[[20]byte][]*watch
+	wg        sync.WaitGroup
+}
+
+type watch struct {
+	onPeer func(netip.AddrPort)
+}
+
+type group struct {
+	conn net.PacketConn
+	addr netip.AddrPort
+}
+
+// NewService returns a service announcing that we accept connections on
+// port. It has no group until Attach or Listen is called.
+func NewService(port int) *Service {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	return &Service{
+		port:      port,
+		cookie:    hex.EncodeToString(cookie),
+		now:       time.Now,
+		announced: map[[20]byte]time.Time{},
+		peers:     map[[20]byte]map[netip.AddrPort]time.Time{},
+		watches:   map[[20]byte][]*watch{},
+	}
+}
+
+// Listen returns a service that joined the IPv4 and the IPv6 groups. It
+// only fails when neither could be joined.
+func Listen(port int) (*Service, error) {
+	s := NewService(port)
+	var errs []error
+	for _, addr := range []netip.AddrPort{IPv4Group, IPv6Group} {
+		network := "udp4"
+		if addr.Addr().Is6() {
+			network = "udp6"
+		}
+		conn, err := net.ListenMulticastUDP(network, nil, net.UDPAddrFromAddrPort(addr))
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+		s.Attach(conn, addr)
+	}
+	if len(s.groups) == 0 {
+		return nil, fmt.Errorf("%w: %w", ErrNoGroup, errors.Join(errs...))
+	}
+	return s, nil
+}
+
+// Attach announces to addr through conn and reads the announces conn
+// receives until Close is called.
+func (s *Service) Attach(conn net.PacketConn, addr netip.AddrPort) {
+	g := &group{conn: conn, addr: addr}
+	s.mu.Lock()
+	s.groups = append(s.groups, g)
+	s.mu.Unlock()
+	s.wg.Add(1)
+	go s.serve(g)
+}
+
+func (s *Service) Close() error {
+	s.mu.Lock()
+	groups := s.groups
+	s.groups = nil
+	s.mu.Unlock()
+	var errs []error
+	for _, g := range groups {
+		errs = append(errs, g.conn.Close())
+	}
+	s.wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (s *Service) serve(g *group) {
+	defer s.wg.Done()
+	buffer := make([]byte, 1500)
+	for {
+		size, addr, err := g.conn.ReadFrom(buffer)
+		if err != nil {
+			return
+		}
+		udpAddr, ok := addr.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		announcement, err := Parse(buffer[:size])
+		if err != nil || announcement.Cookie == s.cookie {
+			continue
+		}
+		ip := udpAddr.AddrPort().Addr().Unmap()
+		s.add(netip.AddrPortFrom(ip, uint16(announcement.Port)), announcement.InfoHashes)
+	}
+}
+
+func (s *Service) add(peer netip.AddrPort, infoHashes [][20]byte) {
+	s.mu.Lock()
+	now := s.now()
+	var notify []func(netip.AddrPort)
+	for _, infoHash := range infoHashes {
+		peers := s.peers[infoHash]
+		if peers == nil {
+			if len(s.peers) >= maxTorrents && !s.wanted(infoHash) {
+				s.expireTorrents(now)
+				if len(s.peers) >= maxTorrents {
+					continue
+				}
+			}
+			peers = map[netip.AddrPort]time.Time{}
+			s.peers[infoHash] = peers
+		}
+		_, known := peers[peer]
+		if !known && len(peers) >= maxPeers {
+			s.expire(peers, now)
+			if len(peers) >= maxPeers {
+				continue
+			}
+		}
+		peers[peer] = now
+		if !known {
+			for _, w := range s.watches[infoHash] {
+				notify = append(notify, w.onPeer)
+			}
+		}
+	}
+	s.mu.Unlock()
+	for _, onPeer := range notify {
+		onPeer(peer)
+	}
+}
+
+// wanted tells whether the peers of infoHash are kept even when there are
+// too many torrents: we announced it, or someone watches it.
+func (s *Service) wanted(infoHash [20]byte) bool {
+	_, announced := s.announced[infoHash]
+	return announced || len(s.watches[infoHash]) > 0
+}
+
+// expireTorrents forgets the expired peers of every torrent, and the
+// torrents left without peers.
+func (s *Service) expireTorrents(now time.Time) {
+	for infoHash, peers := range s.peers {
+		s.expire(peers, now)
+		if len(peers) == 0 {
+			delete(s.peers, infoHash)
+		}
+	}
+}
+
+func (s *Service) expire(peers map[netip.AddrPort]time.Time, now time.Time) {
+	for peer, seen := range peers {
+		if now.Sub(seen) > peerTTL {
+			delete(peers, peer)
+		}
+	}
+}
+
+// Announce tells the local network that we have the torrents of
+// infoHashes. Torrents announced less than MinInterval ago are left out.
+// It fails when the announce couldn't be sent to any group.
+func (s *Service) Announce(infoHashes ...[20]byte) error {
+	s.mu.Lock()
+	now := s.now()
+	var due [][20]byte
+	for _, infoHash := range infoHashes {
+		if last, ok := s.announced[infoHash]; ok && now.Sub(last) < MinInterval {
+			continue
+		}
+		s.announced[infoHash] = now
+		due = append(due, infoHash)
+	}
+	groups := s.groups
+	s.mu.Unlock()
+	if len(due) == 0 {
+		return nil
+	}
+	if len(groups) == 0 {
+		return ErrNoGroup
+	}
+
+	var errs []error
+	sent := 0
+	for start := 0; start < len(due); start += maxInfoHashes {
+		end := min(start+maxInfoHashes, len(due))
+		for _, g := range groups {
+			announcement := &Announcement{
+				Host:       g.addr.String(),
+				Port:       s.port,
+				InfoHashes: due[start:end],
+				Cookie:     s.cookie,
+			}
+			_, err := g.conn.WriteTo(announcement.Marshal(), net.UDPAddrFromAddrPort(g.addr))
+			if err != nil {
+				errs = append(errs, err)
+				continue
+			}
+			sent++
+		}
+	}
+	if sent == 0 {
+		return fmt.Errorf("failed to announce: %w", errors.Join(errs...))
+	}
+	return nil
+}
+
+// Watch calls onPeer with every new peer that announces infoHash, until the
+// returned function is called. onPeer runs on the goroutine reading the
+// announces, it mustn't block.
+func (s *Service) Watch(infoHash [20]byte, onPeer func(netip.AddrPort)) (stop func()) {
+	w := &watch{onPeer: onPeer}
+	s.mu.Lock()
+	s.watches[infoHash] = append(s.watches[infoHash], w)
+	s.mu.Unlock()
+	return func() {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		watches := slices.DeleteFunc(s.watches[infoHash], func(other *watch) bool { return other == w })
+		if len(watches) == 0 {
+			delete(s.watches, infoHash)
+		} else {
+			s.watches[infoHash] = watches
+		}
+	}
+}
+
+// Peers returns the peers that announced infoHash recently.
+func (s *Service) Peers(infoHash [20]byte) []netip.AddrPort {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peers := s.peers[infoHash]
+	s.expire(peers, s.now())
+	result := make([]netip.AddrPort, 0, len(peers))
+	for peer := range peers {
+		result = append(result, peer)
+	}
+	return result
+}
@@ -0,0 +1,262 @@
+package lsd
+
+import (
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAnnouncementRoundTrip(t *testing.T) {
+	a := &Announcement{
+		Host:       IPv4Group.String(),
+		Port:       6881,
+		InfoHashes: [][20]byte{{1}, {2}},
+		Cookie:     "abc",
+	}
+	assert.Equal(t, "BT-SEARCH * HTTP/1.1\r\n"+
+		"Host: 239.192.152.143:6771\r\n"+
+		"Port: 6881\r\n"+
+		"Infohash: 0100000000000000000000000000000000000000\r\n"+
+		"Infohash: 0200000000000000000000000000000000000000\r\n"+
+		"cookie: abc\r\n"+
+		"\r\n\r\n", string(a.Marshal()))
+
+	parsed, err := Parse(a.Marshal())
+	require.NoError(t, err)
+	assert.Equal(t, a, parsed)
+}
+
+func TestParse(t *testing.T) {
+	infoHash := strings.Repeat("ab", 20)
+	tests := []struct {
+		name    string
+		packet  string
+		wantErr bool
+	}{
+		{"minimal", "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: " + infoHash + "\r\n", false},
+		{"lower case headers", "BT-SEARCH * HTTP/1.1\r\nport: 1\r\ninfohash: " + infoHash + "\r\n\r\n", false},
+		{"other message", "M-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: " + infoHash + "\r\n\r\n", true},
+		{"missing port", "BT-SEARCH * HTTP/1.1\r\nInfohash: " + infoHash + "\r\n\r\n", true},
+		{"invalid port", "BT-SEARCH * HTTP/1.1\r\nPort: 70000\r\nInfohash: " + infoHash + "\r\n\r\n", true},
+		{"invalid info hash", "BT-SEARCH * HTTP/1.1\r\nPort: 1\r\nInfohash: abcd\r\n\r\n", true},
+		{"empty", "", true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.packet))
+			if tt.wantErr {
+				assert.Error(t, err)
+			} else {
+				assert.NoError(t, err)
+			}
+		})
+	}
+}
+
+// hub is an in-memory multicast group: every packet written to it is
+// received by all its connections, the sender included.
+type hub struct {
+	mu    sync.Mutex
+	conns []*hubConn
+}
+
+type hubPacket struct {
+	data []byte
+	from net.Addr
+}
+
+type hubConn struct {
+	hub     *hub
+	addr    *net.UDPAddr
+	packets chan hubPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (h *hub) join(addr string) *hubConn {
+	conn := &hubConn{
+		hub:     h,
+		addr:    net.UDPAddrFromAddrPort(netip.MustParseAddrPort(addr)),
+		packets: make(chan hubPacket, 16),
+		closed:  make(chan struct{}),
+	}
+	h.mu.Lock()
+	h.conns = append(h.conns, conn)
+	h.mu.Unlock()
+	return conn
+}
+
+func (c *hubConn) ReadFrom(p []byte) (int, net.Addr, error) {
+	select {
+	case packet := <-c.packets:
+		return copy(p, packet.data), packet.from, nil
+	case <-c.closed:
+		return 0, nil, net.ErrClosed
+	}
+}
+
+func (c *hubConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.hub.mu.Lock()
+	defer c.hub.mu.Unlock()
+	for _, conn := range c.hub.conns {
+		select {
+		case conn.packets <- hubPacket{data: append([]byte(nil), p...), from: c.addr}:
+		default:
+		}
+	}
+	return len(p), nil
+}
+
+func (c *hubConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *hubConn) LocalAddr() net.Addr                { return c.addr }
+func (c *hubConn) SetDeadline(t time.Time) error      { return nil }
+func (c *hubConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *hubConn) SetWriteDeadline(t time.Time) error { return nil }
+
+func TestServiceDiscovery(t *testing.T) {
+	h := &hub{}
+	first := NewService(6881)
+	first.Attach(h.join("192.168.1.1:6771"), IPv4Group)
+	defer first.Close()
+	second := NewService(7000)
+	second.Attach(h.join("192.168.1.2:6771"), IPv4Group)
+	defer second.Close()
+
+	require.NoError(t, first.Announce([20]byte{1}, [20]byte{2}))
+	require.NoError(t, second.Announce([20]byte{1}))
+
+	want := []netip.AddrPort{netip.MustParseAddrPort("192.168.1.1:6881")}
+	assert.Eventually(t, func() bool { return len(second.Peers([20]byte{2})) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, want, second.Peers([20]byte{1}))
+	assert.Eventually(t, func() bool { return len(first.Peers([20]byte{1})) == 1 }, time.Second, 10*time.Millisecond)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("192.168.1.2:7000")}, first.Peers([20]byte{1}))
+	// our own announces are filtered out by their cookie
+	assert.Empty(t, first.Peers([20]byte{2}))
+}
+
+// countingConn counts the packets written to it.
+type countingConn struct {
+	*hubConn
+	mu      sync.Mutex
+	packets []string
+	err     error
+}
+
+func (c *countingConn) WriteTo(p []byte, addr net.Addr) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.err != nil {
+		return 0, c.err
+	}
+	c.packets = append(c.packets, string(p))
+	return len(p), nil
+}
+
+func TestServiceRateLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewService(6881)
+	s.now = func() time.Time { return now }
+	conn := &countingConn{hubConn: (&hub{}).join("192.168.1.1:6771")}
+	s.Attach(conn, IPv4Group)
+	defer s.Close()
+
+	require.NoError(t, s.Announce([20]byte{1}))
+	now = now.Add(10 * time.Second)
+	// only the new torrent is announced again
+	require.NoError(t, s.Announce([20]byte{1}, [20]byte{2}))
+	require.NoError(t, s.Announce([20]byte{1}, [20]byte{2}))
+	require.Len(t, conn.packets, 2)
+	assert.NotContains(t, conn.packets[1], "Infohash: 01")
+	assert.Contains(t, conn.packets[1], "Infohash: 02")
+
+	now = now.Add(MinInterval)
+	require.NoError(t, s.Announce([20]byte{1}, [20]byte{2}))
+	require.Len(t, conn.packets, 3)
+
+	// many torrents are split over several packets
+	var many [][20]byte
+	for i := 0; i < maxInfoHashes+1; i++ {
+		many = append(many, [20]byte{10, byte(i)})
+	}
+	require.NoError(t, s.Announce(many...))
+	assert.Len(t, conn.packets, 5)
+
+	conn.err = errors.New("network is unreachable")
+	assert.Error(t, s.Announce([20]byte{3}))
+}
+
+func TestServicePeerExpiry(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewService(6881)
+	s.now = func() time.Time { return now }
+
+	s.add(netip.MustParseAddrPort("192.168.1.2:1"), [][20]byte{{1}})
+	now = now.Add(peerTTL / 2)
+	s.add(netip.MustParseAddrPort("192.168.1.3:1"), [][20]byte{{1}})
+	now = now.Add(peerTTL/2 + time.Second)
+	assert.Equal(t, []netip.AddrPort{netip.MustParseAddrPort("192.168.1.3:1")}, s.Peers([20]byte{1}))
+
+	for i := 0; i < maxPeers+10; i++ {
+		s.add(netip.AddrPortFrom(netip.AddrFrom4([4]byte{10, 0, byte(i >> 8), byte(i)}), 1), [][20]byte{{2}})
+	}
+	assert.Len(t, s.Peers([20]byte{2}), maxPeers)
+
+	assert.ErrorIs(t, s.Announce([20]byte{1}), ErrNoGroup)
+}
+
+func TestServiceMaxTorrents(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := NewService(6881)
+	s.now = func() time.Time { return now }
+	peer := netip.MustParseAddrPort("192.168.1.2:1")
+
+	for i := 0; i < maxTorrents+10; i++ {
+		s.add(peer, [][20]byte{{1, byte(i)}})
+	}
+	assert.Len(t, s.peers, maxTorrents)
+	assert.Empty(t, s.Peers([20]byte{1, maxTorrents}))
+
+	// the torrents we announce are kept regardless
+	s.announced[[20]byte{2}] = now
+	s.add(peer, [][20]byte{{2}})
+	assert.Equal(t, []netip.AddrPort{peer}, s.Peers([20]byte{2}))
+
+	// and expired ones make room for others
+	now = now.Add(peerTTL + time.Second)
+	s.add(peer, [][20]byte{{3}})
+	assert.Equal(t, []netip.AddrPort{peer}, s.Peers([20]byte{3}))
+	assert.Len(t, s.peers, 1)
+}
+
+func TestServiceWatch(t *testing.T) {
+	s := NewService(6881)
+	var mu sync.Mutex
+	var watched []netip.AddrPort
+	stop := s.Watch([20]byte{1}, func(peer netip.AddrPort) {
+		mu.Lock()
+		watched = append(watched, peer)
+		mu.Unlock()
+	})
+
+	first := netip.MustParseAddrPort("192.168.1.2:1")
+	second := netip.MustParseAddrPort("192.168.1.3:1")
+	s.add(first, [][20]byte{{1}, {2}})
+	// a peer announcing again isn't new
+	s.add(first, [][20]byte{{1}})
+	s.add(second, [][20]byte{{2}})
+	stop()
+	s.add(second, [][20]byte{{1}})
+	assert.Equal(t, []netip.AddrPort{first}, watched)
+	assert.Empty(t, s.watches)
+}
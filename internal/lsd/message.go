@@ -0,0 +1,79 @@
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"fmt"
+	"net/textproto"
+	"strconv"
+	"strings"
+)
+
+// searchLine starts every announce.
+const searchLine = "BT-SEARCH * HTTP/1.1"
+
+// maxInfoHashes bounds the info hashes in one announce, so it fits in a
+// single packet.
+const maxInfoHashes = 20
+
+// Announcement is a BT-SEARCH message: the sender accepts connections on
+// Port for the torrents of InfoHashes.
+type Announcement struct {
+	Host       string
+	Port       int
+	InfoHashes [][20]byte
+	// Cookie lets a client recognise and ignore its own announces.
+	Cookie string
+}
+
+// Marshal encodes the announcement as a BT-SEARCH message.
+func (a *Announcement) Marshal() []byte {
+	var b bytes.Buffer
+	b.WriteString(searchLine + "\r\n")
+	fmt.Fprintf(&b, "Host: %s\r\n", a.Host)
+	fmt.Fprintf(&b, "Port: %d\r\n", a.Port)
+	for _, infoHash := range a.InfoHashes {
+		fmt.Fprintf(&b, "Infohash: %x\r\n", infoHash)
+	}
+	if a.Cookie != "" {
+		fmt.Fprintf(&b, "cookie: %s\r\n", a.Cookie)
+	}
+	b.WriteString("\r\n\r\n")
+	return b.Bytes()
+}
+
+// Parse decodes a BT-SEARCH message. Invalid info hashes are skipped, but
+// an announcement without any valid one is an error.
+func Parse(packet []byte) (*Announcement, error) {
+	reader := textproto.NewReader(bufio.NewReader(bytes.NewReader(packet)))
+	line, err := reader.ReadLine()
+	if err != nil || line != searchLine {
+		return nil, fmt.Errorf("not a BT-SEARCH message")
+	}
+	header, err := reader.ReadMIMEHeader()
+	// the message may end right after the headers, without a blank line
+	if err != nil && len(header) == 0 {
+		return nil, fmt.Errorf("invalid BT-SEARCH message: %w", err)
+	}
+
+	a := &Announcement{Host: header.Get("Host"), Cookie: header.Get("Cookie")}
+	a.Port, err = strconv.Atoi(header.Get("Port"))
+	if err != nil || a.Port <= 0 || a.Port > 65535 {
+		return nil, fmt.Errorf("invalid BT-SEARCH port: %q", header.Get("Port"))
+	}
+	for _, value := range header.Values("Infohash") {
+		decoded, err := hex.DecodeString(strings.TrimSpace(value))
+		if err != nil || len(decoded) != 20 {
+			continue
+		}
+		a.InfoHashes = append(a.InfoHashes, [20]byte(decoded))
+		if len(a.InfoHashes) == maxInfoHashes {
+			break
+		}
+	}
+	if len(a.InfoHashes) == 0 {
+		return nil, fmt.Errorf("BT-SEARCH message without an info hash")
+	}
+	return a, nil
+}
@@ -0,0 +1,343 @@
+package metainfo
+
+import (
+	"fmt"
+	"strings"
+	"unicode/utf8"
+)
+
+// Severity tells how serious a Finding is. Errors make the torrent unusable,
+// warnings point at things most clients tolerate but that are likely mistakes.
+type Severity int
+
+const (
+	SeverityWarning Severity = iota
+	SeverityError
+)
+
+func (s Severity) String() string {
+	switch s {
+	case SeverityWarning:
+		return "warning"
+	case SeverityError:
+		return "error"
+	default:
+		return fmt.Sprintf("severity(%d)", int(s))
+	}
+}
+
+func (s Severity) MarshalText() ([]byte, error) {
+	return []byte(s.String()), nil
+}
+
+// Finding is a single problem found in a torrent's metainfo.
+type Finding struct {
+	Severity Severity `json:"severity"`
+	// Field is the dotted path of the offending key, e.g. "info.files[2].path".
+	Field   string `json:"field"`
+	Message string `json:"message"`
+}
+
+func (f Finding) String() string {
+	return fmt.Sprintf("%s: %s: %s", f.Severity, f.Field, f.Message)
+}
+
+// HasErrors reports whether any of the findings has error severity.
+func HasErrors(findings []Finding) bool {
+	for _, f := range findings {
+		if f.Severity == SeverityError {
+			return true
+		}
+	}
+	return false
+}
+
+type validator struct {
+	findings []Finding
+}
+
+func (v *validator) errorf(field, format string, args ...interface{}) {
+	v.findings = append(v.findings, Finding{SeverityError, field, fmt.Sprintf(format, args...)})
+}
+
+func (v *validator) warnf(field, format string, args ...interface{}) {
+	v.findings = append(v.findings, Finding{SeverityWarning, field, fmt.Sprintf(format, args...)})
+}
+
+// Validate inspects a decoded torrent (the root dictionary returned by
+// bencode.Unmarshal) and returns every problem it finds rather than stopping
+// at the first one. It never panics on malformed input.
+func Validate(data map[string]interface{}) []Finding {
+	v := &validator{findings: []Finding{}}
+
+	v.validateTrackers(data)
+
+	rawInfo, ok := data["info"]
+	if !ok {
+		v.errorf("info", "missing info dictionary")
+		return v.findings
+	}
+	info, ok := rawInfo.(map[string]interface{})
+	if !ok {
+		v.errorf("info", "expected a dictionary, got %s", typeName(rawInfo))
+		return v.findings
+	}
+
+	v.validateName(info)
+	pieceLength, pieceLengthOK := v.validatePieceLength(info)
+	pieceCount, piecesOK := v.validatePieces(info)
+	totalLength, lengthOK := v.validateLength(info)
+
+	if pieceLengthOK && piecesOK && lengthOK {
+		expected := (totalLength + pieceLength - 1) / pieceLength
+		if expected != pieceCount {
+			v.errorf("info.pieces", "has %d piece hashes but a total length of %d with piece length %d needs %d", pieceCount, totalLength, pieceLength, expected)
+		}
+	}
+
+	return v.findings
+}
+
+func (v *validator) validateTrackers(data map[string]interface{}) {
+	hasTracker := false
+
+	if raw, ok := data["announce"]; ok {
+		announce, ok := raw.(string)
+		switch {
+		case !ok:
+			v.errorf("announce", "expected a string, got %s", typeName(raw))
+		case announce == "":
+			v.warnf("announce", "empty tracker URL")
+		default:
+			hasTracker = true
+		}
+	}
+
+	if raw, ok := data["announce-list"]; ok {
+		tiers, ok := raw.([]interface{})
+		if !ok {
+			v.errorf("announce-list", "expected a list of tiers, got %s", typeName(raw))
+		}
+		for i, rawTier := range tiers {
+			tier, ok := rawTier.([]interface{})
+			if !ok {
+				v.errorf(fmt.Sprintf("announce-list[%d]", i), "expected a list of tracker URLs, got %s", typeName(rawTier))
+				continue
+			}
+			for j, rawURL := range tier {
+				if u, ok := rawURL.(string); !ok {
+					v.errorf(fmt.Sprintf("announce-list[%d][%d]", i, j), "expected a string, got %s", typeName(rawURL))
+				} else if u != "" {
+					hasTracker = true
+				}
+			}
+		}
+	}
+
+	if !hasTracker {
+		v.warnf("announce", "no trackers; peers can only be found through DHT or peer exchange")
+	}
+}
+
+func (v *validator) validateName(info map[string]interface{}) {
+	raw, ok := info["name"]
+	if !ok {
+		v.errorf("info.name", "missing")
+		return
+	}
+	name, ok := raw.(string)
+	if !ok {
+		v.errorf("info.name", "expected a string, got %s", typeName(raw))
+		return
+	}
+	v.validatePathComponent("info.name", name)
+}
+
+func (v *validator) validatePieceLength(info map[string]interface{}) (int, bool) {
+	raw, ok := info["piece length"]
+	if !ok {
+		v.errorf("info.piece length", "missing")
+		return 0, false
+	}
+	pieceLength, ok := raw.(int)
+	if !ok {
+		v.errorf("info.piece length", "expected an integer, got %s", typeName(raw))
+		return 0, false
+	}
+	if pieceLength <= 0 {
+		v.errorf("info.piece length", "must be positive, got %d", pieceLength)
+		return 0, false
+	}
+	if pieceLength&(pieceLength-1) != 0 {
+		v.warnf("info.piece length", "%d is not a power of two", pieceLength)
+	}
+	return pieceLength, true
+}
+
+func (v *validator) validatePieces(info map[string]interface{}) (int, bool) {
+	raw, ok := info["pieces"]
+	if !ok {
+		v.errorf("info.pieces", "missing")
+		return 0, false
+	}
+	pieces, ok := raw.(string)
+	if !ok {
+		v.errorf("info.pieces", "expected a byte string, got %s", typeName(raw))
+		return 0, false
+	}
+	if len(pieces)%20 != 0 {
+		v.errorf("info.pieces", "length %d is not a multiple of 20", len(pieces))
+		return 0, false
+	}
+	return len(pieces) / 20, true
+}
+
+// validateLength checks the single-file "length" or multi-file "files" keys
+// and returns the total content length.
+func (v *validator) validateLength(info map[string]interface{}) (int, bool) {
+	rawLength, hasLength := info["length"]
+	rawFiles, hasFiles := info["files"]
+
+	switch {
+	case hasLength && hasFiles:
+		v.errorf("info", "has both length and files keys")
+		return 0, false
+	case !hasLength && !hasFiles:
+		v.errorf("info", "has neither length nor files key")
+		return 0, false
+	case hasLength:
+		length, ok := rawLength.(int)
+		if !ok {
+			v.errorf("info.length", "expected an integer, got %s", typeName(rawLength))
+			return 0, false
+		}
+		if length < 0 {
+			v.errorf("info.length", "must not be negative, got %d", length)
+			return 0, false
+		}
+		return length, true
+	}
+
+	files, ok := rawFiles.([]interface{})
+	if !ok {
+		v.errorf("info.files", "expected a list, got %s", typeName(rawFiles))
+		return 0, false
+	}
+	if len(files) == 0 {
+		v.errorf("info.files", "empty file list")
+		return 0, false
+	}
+
+	total, valid := 0, true
+	seen := map[string]int{}
+	for i, rawFile := range files {
+		field := fmt.Sprintf("info.files[%d]", i)
+		file, ok := rawFile.(map[string]interface{})
+		if !ok {
+			v.errorf(field, "expected a dictionary, got %s", typeName(rawFile))
+			valid = false
+			continue
+		}
+
+		length, ok := file["length"].(int)
+		if !ok {
+			v.errorf(field+".length", "missing or not an integer")
+			valid = false
+		} else if length < 0 {
+			v.errorf(field+".length", "must not be negative, got %d", length)
+			valid = false
+		} else {
+			total += length
+		}
+
+		path, ok := v.validateFilePath(field+".path", file["path"])
+		if !ok {
+			continue
+		}
+		key := strings.Join(path, "/")
+		if first, dup := seen[key]; dup {
+			v.errorf(field+".path", "duplicate path %q, already used by info.files[%d]", key, first)
+		} else {
+			seen[key] = i
+		}
+	}
+
+	return total, valid
+}
+
+func (v *validator) validateFilePath(field string, raw interface{}) ([]string, bool) {
+	list, ok := raw.([]interface{})
+	if !ok {
+		v.errorf(field, "missing or not a list")
+		return nil, false
+	}
+	if len(list) == 0 {
+		v.errorf(field, "empty path")
+		return nil, false
+	}
+
+	path := make([]string, 0, len(list))
+	valid := true
+	for j, rawComponent := range list {
+		componentField := fmt.Sprintf("%s[%d]", field, j)
+		component, ok := rawComponent.(string)
+		if !ok {
+			v.errorf(componentField, "expected a string, got %s", typeName(rawComponent))
+			valid = false
+			continue
+		}
+		if !v.validatePathComponent(componentField, component) {
+			valid = false
+		}
+		path = append(path, component)
+	}
+	return path, valid
+}
+
+// validatePathComponent checks a single name that will become a file or
+// directory name on disk.
+func (v *validator) validatePathComponent(field, component string) bool {
+	switch {
+	case component == "":
+		v.errorf(field, "empty name")
+		return false
+	case component == "." || component == "..":
+		v.errorf(field, "path traversal: %q", component)
+		return false
+	case strings.HasPrefix(component, "/") || strings.HasPrefix(component, `\`) || hasDriveLetter(component):
+		v.errorf(field, "absolute path: %q", component)
+		return false
+	case strings.ContainsAny(component, `/\`):
+		v.errorf(field, "name contains a path separator: %q", component)
+		return false
+	}
+	if !utf8.ValidString(component) {
+		v.warnf(field, "name is not valid UTF-8: %q", component)
+	}
+	return true
+}
+
+func hasDriveLetter(s string) bool {
+	if len(s) < 2 || s[1] != ':' {
+		return false
+	}
+	c := s[0] | 0x20
+	return c >= 'a' && c <= 'z'
+}
+
+func typeName(value interface{}) string {
+	switch value.(type) {
+	case string:
+		return "string"
+	case int:
+		return "integer"
+	case []interface{}:
+		return "list"
+	case map[string]interface{}:
+		return "dictionary"
+	case nil:
+		return "nothing"
+	default:
+		return fmt.Sprintf("%T", value)
+	}
+}
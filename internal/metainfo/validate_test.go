@@ -0,0 +1,128 @@
+package metainfo
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func validTorrent() map[string]interface{} {
+	return map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]interface{}{
+			"name":         "sample.txt",
+			"length":       40000,
+			"piece length": 32768,
+			"pieces":       strings.Repeat("a", 40),
+		},
+	}
+}
+
+func multiFileTorrent(paths ...[]interface{}) map[string]interface{} {
+	files := []interface{}{}
+	for _, path := range paths {
+		files = append(files, map[string]interface{}{"length": 10, "path": path})
+	}
+	return map[string]interface{}{
+		"announce": "http://tracker.example/announce",
+		"info": map[string]interface{}{
+			"name":         "dir",
+			"files":        files,
+			"piece length": 16384,
+			"pieces":       strings.Repeat("a", 20),
+		},
+	}
+}
+
+func fields(findings []Finding) map[string]Severity {
+	result := map[string]Severity{}
+	for _, f := range findings {
+		result[f.Field] = f.Severity
+	}
+	return result
+}
+
+func TestValidateValid(t *testing.T) {
+	findings := Validate(validTorrent())
+	assert.Empty(t, findings)
+	assert.False(t, HasErrors(findings))
+}
+
+func TestValidateCollectsEveryProblem(t *testing.T) {
+	data := validTorrent()
+	delete(data, "announce")
+	info := data["info"].(map[string]interface{})
+	info["name"] = ""
+	info["piece length"] = 30000
+	info["pieces"] = strings.Repeat("a", 41)
+
+	findings := Validate(data)
+
+	assert.True(t, HasErrors(findings))
+	assert.Equal(t, map[string]Severity{
+		"announce":          SeverityWarning,
+		"info.name":         SeverityError,
+		"info.piece length": SeverityWarning,
+		"info.pieces":       SeverityError,
+	}, fields(findings))
+}
+
+func TestValidatePieceCount(t *testing.T) {
+	data := validTorrent()
+	data["info"].(map[string]interface{})["length"] = 100000
+
+	findings := Validate(data)
+
+	assert.Equal(t, map[string]Severity{"info.pieces": SeverityError}, fields(findings))
+}
+
+func TestValidateFilePaths(t *testing.T) {
+	testCases := []struct {
+		name     string
+		paths    [][]interface{}
+		field    string
+		severity Severity
+	}{
+		{"parent directory", [][]interface{}{{"..", "etc", "passwd"}}, "info.files[0].path[0]", SeverityError},
+		{"absolute path", [][]interface{}{{"/etc/passwd"}}, "info.files[0].path[0]", SeverityError},
+		{"windows drive", [][]interface{}{{`C:\evil`}}, "info.files[0].path[0]", SeverityError},
+		{"embedded separator", [][]interface{}{{"a/../b"}}, "info.files[0].path[0]", SeverityError},
+		{"empty component", [][]interface{}{{"a", ""}}, "info.files[0].path[1]", SeverityError},
+		{"empty path", [][]interface{}{{}}, "info.files[0].path", SeverityError},
+		{"duplicate", [][]interface{}{{"a", "b"}, {"a", "b"}}, "info.files[1].path", SeverityError},
+		{"non utf-8", [][]interface{}{{"caf\xe9"}}, "info.files[0].path[0]", SeverityWarning},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			findings := Validate(multiFileTorrent(tc.paths...))
+
+			severity, ok := fields(findings)[tc.field]
+			assert.True(t, ok, "expected a finding for %s, got %v", tc.field, findings)
+			assert.Equal(t, tc.severity, severity)
+		})
+	}
+}
+
+func TestValidateMalformed(t *testing.T) {
+	testCases := []struct {
+		name  string
+		data  map[string]interface{}
+		field string
+	}{
+		{"missing info", map[string]interface{}{"announce": "x"}, "info"},
+		{"info not a dictionary", map[string]interface{}{"info": 5}, "info"},
+		{"announce not a string", map[string]interface{}{"announce": 5, "info": map[string]interface{}{}}, "announce"},
+		{"no length", map[string]interface{}{"info": map[string]interface{}{"name": "a", "piece length": 1, "pieces": ""}}, "info"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			findings := Validate(tc.data)
+
+			assert.True(t, HasErrors(findings))
+			assert.Contains(t, fields(findings), tc.field)
+		})
+	}
+}
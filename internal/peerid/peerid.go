@@ -0,0 +1,154 @@
+package peerid
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+// Prefix identifies this client in Azureus-style peer ids: "GO" followed by
+// a four digit version.
+const Prefix = "-GO0001-"
+
+// Generate returns a peer id starting with prefix and filled up with random
+// bytes.
+func Generate(prefix string) ([20]byte, error) {
+	var id [20]byte
+	if len(prefix) > len(id) {
+		return id, fmt.Errorf("peer id prefix %q is longer than 20 bytes", prefix)
+	}
+	n := copy(id[:], prefix)
+	if _, err := rand.Read(id[n:]); err != nil {
+		return id, err
+	}
+	return id, nil
+}
+
+// Parse reads a peer id given by the user: 40 hex digits, exactly 20 bytes,
+// or a shorter prefix that is completed with random bytes.
+func Parse(s string) ([20]byte, error) {
+	var id [20]byte
+	if len(s) == 40 {
+		if decoded, err := hex.DecodeString(s); err == nil {
+			copy(id[:], decoded)
+			return id, nil
+		}
+	}
+	if len(s) == 20 {
+		copy(id[:], s)
+		return id, nil
+	}
+	if len(s) == 0 || len(s) > 20 {
+		return id, fmt.Errorf("invalid peer id %q: expected 40 hex digits or at most 20 bytes", s)
+	}
+	return Generate(s)
+}
+
+// Client is the software a peer id belongs to.
+type Client struct {
+	Name    string `json:"name"`
+	Version string `json:"version,omitempty"`
+}
+
+func (c Client) String() string {
+	if c.Version == "" {
+		return c.Name
+	}
+	return c.Name + " " + c.Version
+}
+
+// azureusClients maps the two letter codes of Azureus-style ids,
+// "-XX1234-", to client names.
+var azureusClients = map[string]string{
+	"AG": "Ares",
+	"A~": "Ares",
+	"AZ": "Vuze",
+	"BB": "BitBuddy",
+	"BC": "BitComet",
+	"BI": "BiglyBT",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"FD": "Free Download Manager",
+	"GO": "mybittorrent",
+	"KT": "KTorrent",
+	"LT": "libtorrent (Rakshasa)",
+	"lt": "libtorrent (Rasterbar)",
+	"qB": "qBittorrent",
+	"RT": "rTorrent",
+	"SD": "Thunder",
+	"TR": "Transmission",
+	"UM": "µTorrent Mac",
+	"UT": "µTorrent",
+	"WD": "WebTorrent Desktop",
+	"WW": "WebTorrent",
+	"XL": "Xunlei",
+}
+
+// shadowClients maps the first letter of Shadow-style ids, "S58B-----", to
+// client names.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow's client",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// Decode identifies the client that generated a peer id. Unknown ids decode
+// to a Client named "unknown".
+func Decode(id []byte) Client {
+	s := string(id)
+	switch {
+	case len(s) >= 8 && s[0] == '-' && s[7] == '-':
+		if name, ok := azureusClients[s[1:3]]; ok {
+			return Client{Name: name, Version: azureusVersion(s[3:7])}
+		}
+		return Client{Name: fmt.Sprintf("unknown (%s)", s[1:3]), Version: azureusVersion(s[3:7])}
+	case len(s) >= 8 && s[0] == 'M' && strings.Contains(s[1:8], "--"):
+		// Mainline: M followed by a version like "7-2-0--"
+		return Client{Name: "BitTorrent", Version: strings.ReplaceAll(strings.Trim(s[1:8], "-"), "-", ".")}
+	case len(s) >= 6 && shadowClients[s[0]] != "" && strings.HasPrefix(s[4:], "--"):
+		return Client{Name: shadowClients[s[0]], Version: shadowVersion(s[1:4])}
+	default:
+		return Client{Name: "unknown"}
+	}
+}
+
+// azureusVersion turns the four version characters into a dotted version,
+// dropping trailing zeros after the minor version: "4630" is "4.6.3".
+func azureusVersion(v string) string {
+	parts := make([]string, 0, len(v))
+	for _, c := range v {
+		parts = append(parts, versionDigit(c))
+	}
+	for len(parts) > 2 && parts[len(parts)-1] == "0" {
+		parts = parts[:len(parts)-1]
+	}
+	return strings.Join(parts, ".")
+}
+
+func shadowVersion(v string) string {
+	parts := make([]string, 0, len(v))
+	for _, c := range v {
+		parts = append(parts, versionDigit(c))
+	}
+	return strings.Join(parts, ".")
+}
+
+// versionDigit decodes one version character: 0-9, then A-Z for 10-35 and
+// a-z for 36-61.
+func versionDigit(c rune) string {
+	switch {
+	case c >= '0' && c <= '9':
+		return string(c)
+	case c >= 'A' && c <= 'Z':
+		return fmt.Sprint(c - 'A' + 10)
+	case c >= 'a' && c <= 'z':
+		return fmt.Sprint(c - 'a' + 36)
+	default:
+		return string(c)
+	}
+}
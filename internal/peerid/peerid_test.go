@@ -0,0 +1,65 @@
+package peerid
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	first, err := Generate(Prefix)
+	require.NoError(t, err)
+	second, err := Generate(Prefix)
+	require.NoError(t, err)
+
+	assert.Equal(t, Prefix, string(first[:8]))
+	assert.NotEqual(t, first, second)
+
+	_, err = Generate(strings.Repeat("x", 21))
+	assert.Error(t, err)
+}
+
+func TestParse(t *testing.T) {
+	id, err := Parse("2d5452333030302d616263646566676869303132")
+	require.NoError(t, err)
+	assert.Equal(t, "-TR3000-abcdefghi012", string(id[:]))
+
+	id, err = Parse("-XX0001-abcdefghijkl")
+	require.NoError(t, err)
+	assert.Equal(t, "-XX0001-abcdefghijkl", string(id[:]))
+
+	id, err = Parse("-XX0001-")
+	require.NoError(t, err)
+	assert.Equal(t, "-XX0001-", string(id[:8]))
+
+	_, err = Parse("")
+	assert.Error(t, err)
+	_, err = Parse(strings.Repeat("x", 21))
+	assert.Error(t, err)
+}
+
+func TestDecode(t *testing.T) {
+	testCases := []struct {
+		id       string
+		expected Client
+	}{
+		{"-qB4630-abcdefghijkl", Client{"qBittorrent", "4.6.3"}},
+		{"-TR3000-abcdefghijkl", Client{"Transmission", "3.0"}},
+		{"-lt0D70-abcdefghijkl", Client{"libtorrent (Rasterbar)", "0.13.7"}},
+		{"-UT355W-abcdefghijkl", Client{"µTorrent", "3.5.5.32"}},
+		{"-GO0001-abcdefghijkl", Client{"mybittorrent", "0.0.0.1"}},
+		{"-ZZ1200-abcdefghijkl", Client{"unknown (ZZ)", "1.2"}},
+		{"M7-2-0--abcdefghijkl", Client{"BitTorrent", "7.2.0"}},
+		{"T03I--abcdefghijklmn", Client{"BitTornado", "0.3.18"}},
+		{"00112233445566778899", Client{Name: "unknown"}},
+		{"short", Client{Name: "unknown"}},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.id, func(t *testing.T) {
+			assert.Equal(t, tc.expected, Decode([]byte(tc.id)))
+		})
+	}
+}
@@ -0,0 +1,126 @@
+package peerwire
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// protocol is the protocol string of the handshake.
+const protocol = "BitTorrent protocol"
+
+// HandshakeLength is the length of a handshake.
+const HandshakeLength = 68
+
+// Handshake is the first message of a connection, in both directions.
+type Handshake struct {
+	Reserved [8]byte
+	InfoHash [20]byte
+	PeerID   [20]byte
+}
+
+// Reserved bits of the handshake.
+const (
+	// ReservedExtensions is the bit of the extension protocol (BEP 10) in
+	// Reserved[5].
+	ReservedExtensions = 0x10
+	// ReservedDHT is the bit of the DHT (BEP 5) in Reserved[7].
+	ReservedDHT = 0x01
+	// ReservedFast is the bit of the fast extension (BEP 6) in Reserved[7].
+	ReservedFast = 0x04
+)
+
+func (h *Handshake) Marshal() []byte {
+	b := make([]byte, 0, HandshakeLength)
+	b = append(b, byte(len(protocol)))
+	b = append(b, protocol...)
+	b = append(b, h.Reserved[:]...)
+	b = append(b, h.InfoHash[:]...)
+	return append(b, h.PeerID[:]...)
+}
+
+// ReadHandshake reads a handshake from r.
+func ReadHandshake(r io.Reader) (*Handshake, error) {
+	data := make([]byte, HandshakeLength)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	if data[0] != byte(len(protocol)) || string(data[1:20]) != protocol {
+		return nil, fmt.Errorf("not a BitTorrent handshake")
+	}
+	h := &Handshake{}
+	copy(h.Reserved[:], data[20:28])
+	copy(h.InfoHash[:], data[28:48])
+	copy(h.PeerID[:], data[48:])
+	return h, nil
+}
+
+// Conn reads and writes messages on a connection after the handshake.
+// Writes are buffered until Flush, so that pipelined requests leave in few
+// packets. ReadMessage must not be called concurrently, the write methods
+// may be.
+type Conn struct {
+	// MaxMessageSize bounds the length of the messages read.
+	MaxMessageSize int
+
+	reader *bufio.Reader
+
+	mu     sync.Mutex
+	writer *bufio.Writer
+}
+
+// NewConn returns a Conn for rw, with DefaultMaxMessageSize.
+func NewConn(rw io.ReadWriter) *Conn {
+	return &Conn{
+		MaxMessageSize: DefaultMaxMessageSize,
+		reader:         bufio.NewReader(rw),
+		writer:         bufio.NewWriter(rw),
+	}
+}
+
+// ReadMessage reads the next message. Its payload is owned by the caller.
+func (c *Conn) ReadMessage() (Message, error) {
+	var prefix [4]byte
+	if _, err := io.ReadFull(c.reader, prefix[:]); err != nil {
+		return nil, err
+	}
+	length := binary.BigEndian.Uint32(prefix[:])
+	if uint64(length) > uint64(c.MaxMessageSize) {
+		return nil, fmt.Errorf("%w: %d bytes, the limit is %d", ErrMessageTooLarge, length, c.MaxMessageSize)
+	}
+	body := make([]byte, length)
+	if _, err := io.ReadFull(c.reader, body); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, err
+	}
+	return Unmarshal(body)
+}
+
+// WriteMessage buffers a message. Call Flush to send it.
+func (c *Conn) WriteMessage(m Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, err := c.writer.Write(m.appendTo(nil))
+	return err
+}
+
+// Flush sends the buffered messages.
+func (c *Conn) Flush() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.writer.Flush()
+}
+
+// Send writes a message and flushes it with the ones buffered before.
+func (c *Conn) Send(m Message) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, err := c.writer.Write(m.appendTo(nil)); err != nil {
+		return err
+	}
+	return c.writer.Flush()
+}
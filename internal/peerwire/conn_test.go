@@ -0,0 +1,121 @@
+package peerwire
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHandshake(t *testing.T) {
+	h := &Handshake{InfoHash: [20]byte{1}, PeerID: [20]byte{2}}
+	h.Reserved[5] |= ReservedExtensions
+	data := h.Marshal()
+	require.Len(t, data, HandshakeLength)
+	assert.Equal(t, "\x13BitTorrent protocol", string(data[:20]))
+
+	read, err := ReadHandshake(bytes.NewReader(data))
+	require.NoError(t, err)
+	assert.Equal(t, h, read)
+
+	_, err = ReadHandshake(bytes.NewReader(data[:40]))
+	assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	data[1] = 'b'
+	_, err = ReadHandshake(bytes.NewReader(data))
+	assert.ErrorContains(t, err, "not a BitTorrent handshake")
+}
+
+func TestConn(t *testing.T) {
+	client, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	sender, receiver := NewConn(client), NewConn(server)
+
+	messages := []Message{
+		Interested{},
+		Request{Index: 0, Begin: 0, Length: BlockLength},
+		Request{Index: 0, Begin: BlockLength, Length: BlockLength},
+		KeepAlive{},
+		Piece{Index: 0, Begin: 0, Block: bytes.Repeat([]byte{1}, BlockLength)},
+	}
+	done := make(chan error, 1)
+	go func() {
+		for _, m := range messages[:len(messages)-1] {
+			if err := sender.WriteMessage(m); err != nil {
+				done <- err
+				return
+			}
+		}
+		// the buffered messages leave with the last one
+		done <- sender.Send(messages[len(messages)-1])
+	}()
+
+	for _, want := range messages {
+		m, err := receiver.ReadMessage()
+		require.NoError(t, err)
+		assert.Equal(t, want, m)
+	}
+	require.NoError(t, <-done)
+}
+
+func TestConnReadErrors(t *testing.T) {
+	t.Run("too large", func(t *testing.T) {
+		c := NewConn(bytes.NewBuffer([]byte{0, 0, 0, 101, 7}))
+		c.MaxMessageSize = 100
+		_, err := c.ReadMessage()
+		assert.ErrorIs(t, err, ErrMessageTooLarge)
+	})
+	t.Run("huge length", func(t *testing.T) {
+		_, err := NewConn(bytes.NewBuffer([]byte{0xff, 0xff, 0xff, 0xff})).ReadMessage()
+		assert.ErrorIs(t, err, ErrMessageTooLarge)
+	})
+	t.Run("truncated", func(t *testing.T) {
+		_, err := NewConn(bytes.NewBuffer([]byte{0, 0, 0, 5, 4, 0})).ReadMessage()
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+	t.Run("truncated prefix", func(t *testing.T) {
+		_, err := NewConn(bytes.NewBuffer([]byte{0, 0})).ReadMessage()
+		assert.ErrorIs(t, err, io.ErrUnexpectedEOF)
+	})
+	t.Run("closed", func(t *testing.T) {
+		_, err := NewConn(&bytes.Buffer{}).ReadMessage()
+		assert.ErrorIs(t, err, io.EOF)
+	})
+	t.Run("invalid", func(t *testing.T) {
+		_, err := NewConn(bytes.NewBuffer([]byte{0, 0, 0, 2, 1, 0})).ReadMessage()
+		assert.ErrorIs(t, err, ErrInvalidMessage)
+	})
+}
+
+func FuzzReadMessage(f *testing.F) {
+	f.Add([]byte{0, 0, 0, 0})
+	f.Add(Marshal(Have{Index: 3}))
+	f.Add(Marshal(Request{Index: 1, Begin: 2, Length: 3}))
+	f.Add(Marshal(Piece{Index: 1, Begin: 2, Block: []byte("block")}))
+	f.Add(Marshal(Extended{ExtendedID: 0, Payload: []byte("d1:md6:ut_pexi1eee")}))
+	f.Add(Marshal(Bitfield{0xff, 0x80}))
+	f.Add([]byte{0, 0, 0, 1, 99})
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		c := NewConn(bytes.NewBuffer(data))
+		c.MaxMessageSize = 1 << 16
+		for {
+			m, err := c.ReadMessage()
+			if err != nil {
+				return
+			}
+			// whatever was read encodes back to a message that reads the same
+			encoded := Marshal(m)
+			decoded, err := Unmarshal(encoded[4:])
+			if err != nil {
+				t.Fatalf("re-reading %#v: %v", m, err)
+			}
+			if !bytes.Equal(Marshal(decoded), encoded) {
+				t.Fatalf("%#v encodes differently after a round trip", m)
+			}
+		}
+	})
+}
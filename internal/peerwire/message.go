@@ -0,0 +1,256 @@
+package peerwire
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// ID identifies the type of a message.
+type ID uint8
+
+const (
+	IDChoke         ID = 0
+	IDUnchoke       ID = 1
+	IDInterested    ID = 2
+	IDNotInterested ID = 3
+	IDHave          ID = 4
+	IDBitfield      ID = 5
+	IDRequest       ID = 6
+	IDPiece         ID = 7
+	IDCancel        ID = 8
+	IDPort          ID = 9
+	IDExtended      ID = 20
+)
+
+const (
+	// BlockLength is the length of the blocks pieces are requested in.
+	BlockLength = 16 * 1024
+	// MaxBlockLength is the longest block peers are expected to serve.
+	MaxBlockLength = 128 * 1024
+	// DefaultMaxMessageSize bounds the messages a Conn reads. It fits a
+	// piece message of MaxBlockLength and the bitfield of a torrent with
+	// millions of pieces.
+	DefaultMaxMessageSize = 1 << 20
+)
+
+var (
+	// ErrMessageTooLarge is returned for a message longer than the limit of
+	// the connection.
+	ErrMessageTooLarge = errors.New("peer message too large")
+	// ErrInvalidMessage is returned for a message whose payload doesn't fit
+	// its type.
+	ErrInvalidMessage = errors.New("invalid peer message")
+)
+
+// Message is a message of the peer wire protocol, sent after the handshake.
+type Message interface {
+	// appendTo appends the message with its length prefix to b.
+	appendTo(b []byte) []byte
+}
+
+// KeepAlive is the empty message peers send to keep idle connections open.
+type KeepAlive struct{}
+
+type Choke struct{}
+
+type Unchoke struct{}
+
+type Interested struct{}
+
+type NotInterested struct{}
+
+// Have tells that the sender has verified a piece.
+type Have struct {
+	Index uint32
+}
+
+// Bitfield tells which pieces the sender has, the high bit of the first
+// byte being piece 0. It is only sent right after the handshake.
+type Bitfield []byte
+
+// Request asks for a block of a piece.
+type Request struct {
+	Index, Begin, Length uint32
+}
+
+// Piece carries a requested block.
+type Piece struct {
+	Index, Begin uint32
+	Block        []byte
+}
+
+// Cancel withdraws a request.
+type Cancel struct {
+	Index, Begin, Length uint32
+}
+
+// Port tells the port of the sender's DHT node (BEP 5).
+type Port struct {
+	Port uint16
+}
+
+// Extended is a message of the extension protocol (BEP 10). ExtendedID 0
+// is the extension handshake, the others are the ids peers assigned to
+// their extensions.
+type Extended struct {
+	ExtendedID uint8
+	Payload    []byte
+}
+
+// Unknown is a message with an id this package doesn't know, like the
+// messages of the fast extension. Peers that don't support it ignore it.
+type Unknown struct {
+	ID      ID
+	Payload []byte
+}
+
+// appendHeader appends the length prefix and id of a message with a
+// payload of the given length.
+func appendHeader(b []byte, id ID, payloadLength int) []byte {
+	b = binary.BigEndian.AppendUint32(b, uint32(1+payloadLength))
+	return append(b, byte(id))
+}
+
+func appendBlockRef(b []byte, id ID, index, begin, length uint32) []byte {
+	b = appendHeader(b, id, 12)
+	b = binary.BigEndian.AppendUint32(b, index)
+	b = binary.BigEndian.AppendUint32(b, begin)
+	return binary.BigEndian.AppendUint32(b, length)
+}
+
+func (KeepAlive) appendTo(b []byte) []byte     { return binary.BigEndian.AppendUint32(b, 0) }
+func (Choke) appendTo(b []byte) []byte         { return appendHeader(b, IDChoke, 0) }
+func (Unchoke) appendTo(b []byte) []byte       { return appendHeader(b, IDUnchoke, 0) }
+func (Interested) appendTo(b []byte) []byte    { return appendHeader(b, IDInterested, 0) }
+func (NotInterested) appendTo(b []byte) []byte { return appendHeader(b, IDNotInterested, 0) }
+
+func (m Have) appendTo(b []byte) []byte {
+	return binary.BigEndian.AppendUint32(appendHeader(b, IDHave, 4), m.Index)
+}
+
+func (m Bitfield) appendTo(b []byte) []byte {
+	return append(appendHeader(b, IDBitfield, len(m)), m...)
+}
+
+func (m Request) appendTo(b []byte) []byte {
+	return appendBlockRef(b, IDRequest, m.Index, m.Begin, m.Length)
+}
+
+func (m Piece) appendTo(b []byte) []byte {
+	b = appendHeader(b, IDPiece, 8+len(m.Block))
+	b = binary.BigEndian.AppendUint32(b, m.Index)
+	b = binary.BigEndian.AppendUint32(b, m.Begin)
+	return append(b, m.Block...)
+}
+
+func (m Cancel) appendTo(b []byte) []byte {
+	return appendBlockRef(b, IDCancel, m.Index, m.Begin, m.Length)
+}
+
+func (m Port) appendTo(b []byte) []byte {
+	return binary.BigEndian.AppendUint16(appendHeader(b, IDPort, 2), m.Port)
+}
+
+func (m Extended) appendTo(b []byte) []byte {
+	b = appendHeader(b, IDExtended, 1+len(m.Payload))
+	b = append(b, m.ExtendedID)
+	return append(b, m.Payload...)
+}
+
+func (m Unknown) appendTo(b []byte) []byte {
+	return append(appendHeader(b, m.ID, len(m.Payload)), m.Payload...)
+}
+
+// Marshal encodes a message with its length prefix.
+func Marshal(m Message) []byte {
+	return m.appendTo(nil)
+}
+
+// payloadLengths are the payload lengths of the messages that have a fixed
+// one.
+var payloadLengths = map[ID]int{
+	IDChoke: 0, IDUnchoke: 0, IDInterested: 0, IDNotInterested: 0,
+	IDHave: 4, IDRequest: 12, IDCancel: 12, IDPort: 2,
+}
+
+// Unmarshal decodes the body of a message, that is the id and the payload
+// without the length prefix. An empty body is a keep-alive. Payloads are
+// not copied.
+func Unmarshal(body []byte) (Message, error) {
+	if len(body) == 0 {
+		return KeepAlive{}, nil
+	}
+	id, payload := ID(body[0]), body[1:]
+
+	if want, ok := payloadLengths[id]; ok && len(payload) != want {
+		return nil, fmt.Errorf("%w: message %d has %d bytes of payload, want %d", ErrInvalidMessage, id, len(payload), want)
+	}
+	uint32At := func(offset int) uint32 {
+		return binary.BigEndian.Uint32(payload[offset:])
+	}
+
+	switch id {
+	case IDChoke:
+		return Choke{}, nil
+	case IDUnchoke:
+		return Unchoke{}, nil
+	case IDInterested:
+		return Interested{}, nil
+	case IDNotInterested:
+		return NotInterested{}, nil
+	case IDHave:
+		return Have{Index: uint32At(0)}, nil
+	case IDBitfield:
+		return Bitfield(payload), nil
+	case IDRequest:
+		return Request{Index: uint32At(0), Begin: uint32At(4), Length: uint32At(8)}, nil
+	case IDPiece:
+		if len(payload) < 8 {
+			return nil, fmt.Errorf("%w: piece message has %d bytes of payload", ErrInvalidMessage, len(payload))
+		}
+		return Piece{Index: uint32At(0), Begin: uint32At(4), Block: payload[8:]}, nil
+	case IDCancel:
+		return Cancel{Index: uint32At(0), Begin: uint32At(4), Length: uint32At(8)}, nil
+	case IDPort:
+		return Port{Port: binary.BigEndian.Uint16(payload)}, nil
+	case IDExtended:
+		if len(payload) < 1 {
+			return nil, fmt.Errorf("%w: extended message without an id", ErrInvalidMessage)
+		}
+		return Extended{ExtendedID: payload[0], Payload: payload[1:]}, nil
+	default:
+		return Unknown{ID: id, Payload: payload}, nil
+	}
+}
+
+// NewBitfield returns an empty bitfield for a torrent of the given number of
+// pieces.
+func NewBitfield(pieces int) Bitfield {
+	return make(Bitfield, (pieces+7)/8)
+}
+
+// Has reports whether the bitfield has piece index.
+func (b Bitfield) Has(index int) bool {
+	if index < 0 || index/8 >= len(b) {
+		return false
+	}
+	return b[index/8]&(0x80>>(index%8)) != 0
+}
+
+// Set marks piece index, which must be within the bitfield.
+func (b Bitfield) Set(index int) {
+	b[index/8] |= 0x80 >> (index % 8)
+}
+
+// Validate checks that the bitfield of a peer is for a torrent of the given
+// number of pieces: it has the right length and its spare bits are clear.
+func (b Bitfield) Validate(pieces int) error {
+	if len(b) != (pieces+7)/8 {
+		return fmt.Errorf("%w: bitfield of %d bytes for %d pieces", ErrInvalidMessage, len(b), pieces)
+	}
+	if pieces%8 != 0 && b[len(b)-1]&(0xff>>(pieces%8)) != 0 {
+		return fmt.Errorf("%w: bitfield has spare bits set", ErrInvalidMessage)
+	}
+	return nil
+}
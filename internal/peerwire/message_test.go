@@ -0,0 +1,82 @@
+package peerwire
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMarshal(t *testing.T) {
+	tests := []struct {
+		name    string
+		message Message
+		want    []byte
+	}{
+		{"keep-alive", KeepAlive{}, []byte{0, 0, 0, 0}},
+		{"choke", Choke{}, []byte{0, 0, 0, 1, 0}},
+		{"unchoke", Unchoke{}, []byte{0, 0, 0, 1, 1}},
+		{"interested", Interested{}, []byte{0, 0, 0, 1, 2}},
+		{"not interested", NotInterested{}, []byte{0, 0, 0, 1, 3}},
+		{"have", Have{Index: 0x01020304}, []byte{0, 0, 0, 5, 4, 1, 2, 3, 4}},
+		{"bitfield", Bitfield{0xa0, 0x80}, []byte{0, 0, 0, 3, 5, 0xa0, 0x80}},
+		{"request", Request{Index: 1, Begin: 0x4000, Length: 0x4000},
+			[]byte{0, 0, 0, 13, 6, 0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0x40, 0}},
+		{"piece", Piece{Index: 1, Begin: 2, Block: []byte("abc")},
+			[]byte{0, 0, 0, 12, 7, 0, 0, 0, 1, 0, 0, 0, 2, 'a', 'b', 'c'}},
+		{"cancel", Cancel{Index: 1, Begin: 0x4000, Length: 0x4000},
+			[]byte{0, 0, 0, 13, 8, 0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0x40, 0}},
+		{"port", Port{Port: 6881}, []byte{0, 0, 0, 3, 9, 0x1a, 0xe1}},
+		{"extended", Extended{ExtendedID: 1, Payload: []byte("de")}, []byte{0, 0, 0, 4, 20, 1, 'd', 'e'}},
+		{"unknown", Unknown{ID: 13, Payload: []byte{1, 2}}, []byte{0, 0, 0, 3, 13, 1, 2}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := Marshal(tt.message)
+			assert.Equal(t, tt.want, encoded)
+
+			decoded, err := Unmarshal(encoded[4:])
+			require.NoError(t, err)
+			assert.Equal(t, tt.message, decoded)
+		})
+	}
+}
+
+func TestUnmarshalInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		body []byte
+	}{
+		{"choke with payload", []byte{0, 1}},
+		{"short have", []byte{4, 0, 0, 1}},
+		{"long request", []byte{6, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0x40, 0, 0}},
+		{"short cancel", []byte{8, 0, 0, 0, 1}},
+		{"short piece", []byte{7, 0, 0, 0, 1, 0, 0, 0}},
+		{"short port", []byte{9, 1}},
+		{"extended without id", []byte{20}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Unmarshal(tt.body)
+			assert.ErrorIs(t, err, ErrInvalidMessage)
+		})
+	}
+}
+
+func TestBitfield(t *testing.T) {
+	b := NewBitfield(10)
+	assert.Len(t, b, 2)
+	b.Set(0)
+	b.Set(9)
+	assert.Equal(t, Bitfield{0x80, 0x40}, b)
+	assert.True(t, b.Has(0))
+	assert.False(t, b.Has(1))
+	assert.True(t, b.Has(9))
+	assert.False(t, b.Has(16))
+	assert.False(t, b.Has(-1))
+
+	assert.NoError(t, b.Validate(10))
+	assert.ErrorIs(t, b.Validate(17), ErrInvalidMessage)
+	assert.ErrorIs(t, Bitfield{0x80, 0x20}.Validate(10), ErrInvalidMessage)
+	assert.NoError(t, Bitfield{0xff}.Validate(8))
+}
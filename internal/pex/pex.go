@@ -0,0 +1,279 @@
+package pex
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// ExtensionName is the name peer exchange is registered under in the
+// extension protocol handshake (BEP 10).
+const ExtensionName = "ut_pex"
+
+const (
+	// MaxPeers is the most peers a message may add, and the most it may
+	// drop.
+	MaxPeers = 50
+	// Interval is the shortest time allowed between two messages on a
+	// connection.
+	Interval = time.Minute
+)
+
+// Flags describe an added peer.
+type Flags byte
+
+const (
+	// FlagEncryption means the peer prefers encrypted connections.
+	FlagEncryption Flags = 0x01
+	// FlagSeed means the peer is a seed or only uploads.
+	FlagSeed Flags = 0x02
+	// FlagUTP means the peer supports uTP.
+	FlagUTP Flags = 0x04
+	// FlagHolepunch means the peer supports the holepunch extension.
+	FlagHolepunch Flags = 0x08
+	// FlagReachable means the sender connected to the peer itself, so it
+	// accepts incoming connections.
+	FlagReachable Flags = 0x10
+)
+
+// Peer is a peer added by a message.
+type Peer struct {
+	Addr  netip.AddrPort
+	Flags Flags
+}
+
+// Message is a ut_pex message: the peers the sender connected to and
+// disconnected from since its last message.
+type Message struct {
+	Added   []Peer
+	Dropped []netip.AddrPort
+}
+
+// Parse decodes the payload of a ut_pex message. Peers with port 0 are
+// skipped, and flags are ignored when their count doesn't match the peers.
+func Parse(payload []byte) (*Message, error) {
+	decoded, err := bencode.Unmarshal(string(payload))
+	if err != nil {
+		return nil, fmt.Errorf("invalid pex message: %w", err)
+	}
+	dict, ok := decoded.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("invalid pex message: not a dictionary")
+	}
+
+	msg := &Message{}
+	for _, family := range []struct {
+		suffix string
+		size   int
+	}{{"", 6}, {"6", 18}} {
+		added, err := compactField(dict, "added"+family.suffix, family.size)
+		if err != nil {
+			return nil, err
+		}
+		flags, _ := dict["added"+family.suffix+".f"].(string)
+		if len(flags) != len(added) {
+			flags = ""
+		}
+		for i, addr := range added {
+			if addr.Port() == 0 {
+				continue
+			}
+			peer := Peer{Addr: addr}
+			if flags != "" {
+				peer.Flags = Flags(flags[i])
+			}
+			msg.Added = append(msg.Added, peer)
+		}
+
+		dropped, err := compactField(dict, "dropped"+family.suffix, family.size)
+		if err != nil {
+			return nil, err
+		}
+		for _, addr := range dropped {
+			if addr.Port() != 0 {
+				msg.Dropped = append(msg.Dropped, addr)
+			}
+		}
+	}
+	return msg, nil
+}
+
+// compactField reads a string of compact peers of the given size (6 bytes
+// for IPv4, 18 for IPv6). A missing field is empty. Entries with port 0 are
+// kept, so that the flags of the i-th entry are the i-th byte.
+func compactField(dict map[string]interface{}, key string, size int) ([]netip.AddrPort, error) {
+	value, ok := dict[key]
+	if !ok {
+		return nil, nil
+	}
+	data, ok := value.(string)
+	if !ok || len(data)%size != 0 {
+		return nil, fmt.Errorf("invalid pex message: malformed %s", key)
+	}
+	addrs := make([]netip.AddrPort, 0, len(data)/size)
+	for i := 0; i < len(data); i += size {
+		ip, _ := netip.AddrFromSlice([]byte(data[i : i+size-2]))
+		port := binary.BigEndian.Uint16([]byte(data[i+size-2 : i+size]))
+		addrs = append(addrs, netip.AddrPortFrom(ip, port))
+	}
+	return addrs, nil
+}
+
+// Marshal encodes the message as a ut_pex payload. IPv4-mapped addresses
+// are sent as IPv4.
+func (m *Message) Marshal() ([]byte, error) {
+	var added, addedFlags, added6, added6Flags, dropped, dropped6 []byte
+	for _, peer := range m.Added {
+		if peer.Addr.Addr().Unmap().Is4() {
+			added = appendCompact(added, peer.Addr)
+			addedFlags = append(addedFlags, byte(peer.Flags))
+		} else {
+			added6 = appendCompact(added6, peer.Addr)
+			added6Flags = append(added6Flags, byte(peer.Flags))
+		}
+	}
+	for _, addr := range m.Dropped {
+		if addr.Addr().Unmap().Is4() {
+			dropped = appendCompact(dropped, addr)
+		} else {
+			dropped6 = appendCompact(dropped6, addr)
+		}
+	}
+
+	encoded, err := bencode.Marshal(map[string]interface{}{
+		"added":    string(added),
+		"added.f":  string(addedFlags),
+		"added6":   string(added6),
+		"added6.f": string(added6Flags),
+		"dropped":  string(dropped),
+		"dropped6": string(dropped6),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return []byte(encoded), nil
+}
+
+func appendCompact(data []byte, addr netip.AddrPort) []byte {
+	ip := addr.Addr().Unmap()
+	data = append(data, ip.AsSlice()...)
+	return binary.BigEndian.AppendUint16(data, addr.Port())
+}
+
+// Sender builds the messages sent on one connection. It remembers which
+// peers the remote side was told about, so each message only carries the
+// changes, and it sends at most one message per Interval.
+type Sender struct {
+	mu   sync.Mutex
+	now  func() time.Time
+	last time.Time
+	sent map[netip.AddrPort]Flags
+}
+
+func NewSender() *Sender {
+	return newSender(time.Now)
+}
+
+func newSender(now func() time.Time) *Sender {
+	return &Sender{now: now, sent: map[netip.AddrPort]Flags{}}
+}
+
+// Next returns the message telling the remote side about the change from
+// the last message to connected, the peers we are connected to now,
+// without the remote peer itself. It returns nil when it is too early to
+// send or nothing changed. Changes beyond MaxPeers are kept for later
+// messages.
+func (s *Sender) Next(connected []Peer) *Message {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	if !s.last.IsZero() && now.Sub(s.last) < Interval {
+		return nil
+	}
+
+	current := make(map[netip.AddrPort]Flags, len(connected))
+	for _, peer := range connected {
+		current[peer.Addr] = peer.Flags
+	}
+
+	msg := &Message{}
+	for _, peer := range connected {
+		if len(msg.Added) == MaxPeers {
+			break
+		}
+		if flags, ok := s.sent[peer.Addr]; !ok || flags != peer.Flags {
+			msg.Added = append(msg.Added, peer)
+		}
+	}
+	for addr := range s.sent {
+		if _, ok := current[addr]; !ok {
+			msg.Dropped = append(msg.Dropped, addr)
+		}
+	}
+	// keep the choice of dropped peers stable when there are too many
+	sort.Slice(msg.Dropped, func(i, j int) bool {
+		return msg.Dropped[i].Compare(msg.Dropped[j]) < 0
+	})
+	if len(msg.Dropped) > MaxPeers {
+		msg.Dropped = msg.Dropped[:MaxPeers]
+	}
+	if len(msg.Added) == 0 && len(msg.Dropped) == 0 {
+		return nil
+	}
+
+	for _, peer := range msg.Added {
+		s.sent[peer.Addr] = peer.Flags
+	}
+	for _, addr := range msg.Dropped {
+		delete(s.sent, addr)
+	}
+	s.last = now
+	return msg
+}
+
+// Receiver accepts the messages received on one connection. Messages that
+// come faster than Interval allows are ignored.
+type Receiver struct {
+	mu   sync.Mutex
+	now  func() time.Time
+	last time.Time
+}
+
+func NewReceiver() *Receiver {
+	return &Receiver{now: time.Now}
+}
+
+// Receive parses a message. It returns nil without an error when the
+// message came too soon after the previous one. Only the first MaxPeers
+// added and dropped peers are kept.
+func (r *Receiver) Receive(payload []byte) (*Message, error) {
+	r.mu.Lock()
+	now := r.now()
+	// allow some slack, timers of the remote side aren't exact
+	tooSoon := !r.last.IsZero() && now.Sub(r.last) < Interval-5*time.Second
+	if !tooSoon {
+		r.last = now
+	}
+	r.mu.Unlock()
+	if tooSoon {
+		return nil, nil
+	}
+
+	msg, err := Parse(payload)
+	if err != nil {
+		return nil, err
+	}
+	if len(msg.Added) > MaxPeers {
+		msg.Added = msg.Added[:MaxPeers]
+	}
+	if len(msg.Dropped) > MaxPeers {
+		msg.Dropped = msg.Dropped[:MaxPeers]
+	}
+	return msg, nil
+}
@@ -0,0 +1,178 @@
+package pex
+
+import (
+	"fmt"
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func addrs(values ...string) []netip.AddrPort {
+	result := make([]netip.AddrPort, len(values))
+	for i, value := range values {
+		result[i] = netip.MustParseAddrPort(value)
+	}
+	return result
+}
+
+func TestParse(t *testing.T) {
+	payload := "d" +
+		"5:added12:\x0a\x00\x00\x01\x1a\xe1\x0a\x00\x00\x02\x00\x50" +
+		"7:added.f2:\x12\x01" +
+		"6:added618:\x20\x01\x0d\xb8\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe1" +
+		"7:dropped12:\x0a\x00\x00\x03\x1a\xe1\x0a\x00\x00\x04\x00\x00" +
+		"e"
+	msg, err := Parse([]byte(payload))
+	require.NoError(t, err)
+	assert.Equal(t, []Peer{
+		{Addr: netip.MustParseAddrPort("10.0.0.1:6881"), Flags: FlagReachable | FlagSeed},
+		{Addr: netip.MustParseAddrPort("10.0.0.2:80"), Flags: FlagEncryption},
+		{Addr: netip.MustParseAddrPort("[2001:db8::1]:6881")},
+	}, msg.Added)
+	// port 0 is skipped
+	assert.Equal(t, addrs("10.0.0.3:6881"), msg.Dropped)
+}
+
+func TestParseFlagsOfSkippedPeers(t *testing.T) {
+	// the first peer is skipped, the flags still belong to their entries
+	payload := "d" +
+		"5:added18:\x0a\x00\x00\x01\x00\x00\x0a\x00\x00\x02\x1a\xe1\x0a\x00\x00\x03\x1a\xe1" +
+		"7:added.f3:\x02\x10\x01" +
+		"e"
+	msg, err := Parse([]byte(payload))
+	require.NoError(t, err)
+	assert.Equal(t, []Peer{
+		{Addr: netip.MustParseAddrPort("10.0.0.2:6881"), Flags: FlagReachable},
+		{Addr: netip.MustParseAddrPort("10.0.0.3:6881"), Flags: FlagEncryption},
+	}, msg.Added)
+}
+
+func TestParseInvalid(t *testing.T) {
+	tests := []struct {
+		name    string
+		payload string
+	}{
+		{"not bencode", "d5:added"},
+		{"not a dictionary", "le"},
+		{"partial peer", "d5:added5:abcdee"},
+		{"partial IPv6 peer", "d6:added66:abcdefe"},
+		{"not a string", "d7:droppedi1ee"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse([]byte(tt.payload))
+			assert.Error(t, err)
+		})
+	}
+
+	// flags that don't match the peers are ignored
+	msg, err := Parse([]byte("d5:added6:\x0a\x00\x00\x01\x1a\xe17:added.f2:\x10\x10e"))
+	require.NoError(t, err)
+	assert.Equal(t, []Peer{{Addr: netip.MustParseAddrPort("10.0.0.1:6881")}}, msg.Added)
+}
+
+func TestMarshalRoundTrip(t *testing.T) {
+	msg := &Message{
+		Added: []Peer{
+			{Addr: netip.MustParseAddrPort("10.0.0.1:6881"), Flags: FlagUTP},
+			{Addr: netip.MustParseAddrPort("[2001:db8::1]:6881"), Flags: FlagHolepunch},
+		},
+		Dropped: addrs("[::ffff:10.0.0.2]:1", "[2001:db8::2]:2"),
+	}
+	payload, err := msg.Marshal()
+	require.NoError(t, err)
+
+	parsed, err := Parse(payload)
+	require.NoError(t, err)
+	assert.Equal(t, msg.Added, parsed.Added)
+	// mapped addresses are sent as IPv4
+	assert.Equal(t, addrs("10.0.0.2:1", "[2001:db8::2]:2"), parsed.Dropped)
+}
+
+func TestSender(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newSender(func() time.Time { return now })
+	a := Peer{Addr: netip.MustParseAddrPort("10.0.0.1:1")}
+	b := Peer{Addr: netip.MustParseAddrPort("10.0.0.2:2")}
+
+	assert.Nil(t, s.Next(nil), "nothing to tell")
+	msg := s.Next([]Peer{a, b})
+	require.NotNil(t, msg)
+	assert.Equal(t, []Peer{a, b}, msg.Added)
+	assert.Empty(t, msg.Dropped)
+
+	// rate limited
+	now = now.Add(30 * time.Second)
+	assert.Nil(t, s.Next([]Peer{a}))
+
+	now = now.Add(30 * time.Second)
+	msg = s.Next([]Peer{a})
+	require.NotNil(t, msg)
+	assert.Empty(t, msg.Added)
+	assert.Equal(t, []netip.AddrPort{b.Addr}, msg.Dropped)
+
+	// changed flags are sent again
+	now = now.Add(Interval)
+	a.Flags = FlagSeed
+	msg = s.Next([]Peer{a})
+	require.NotNil(t, msg)
+	assert.Equal(t, []Peer{a}, msg.Added)
+
+	now = now.Add(Interval)
+	assert.Nil(t, s.Next([]Peer{a}), "nothing changed")
+}
+
+func TestSenderLimit(t *testing.T) {
+	now := time.Unix(1000, 0)
+	s := newSender(func() time.Time { return now })
+	var connected []Peer
+	for i := 0; i < MaxPeers+10; i++ {
+		connected = append(connected, Peer{Addr: netip.MustParseAddrPort(fmt.Sprintf("10.0.0.%d:1", i))})
+	}
+
+	msg := s.Next(connected)
+	require.NotNil(t, msg)
+	assert.Len(t, msg.Added, MaxPeers)
+
+	// the rest follows in the next message
+	now = now.Add(Interval)
+	msg = s.Next(connected)
+	require.NotNil(t, msg)
+	assert.Equal(t, connected[MaxPeers:], msg.Added)
+}
+
+func TestReceiver(t *testing.T) {
+	now := time.Unix(1000, 0)
+	r := NewReceiver()
+	r.now = func() time.Time { return now }
+
+	var many []Peer
+	for i := 0; i < MaxPeers+10; i++ {
+		many = append(many, Peer{Addr: netip.MustParseAddrPort(fmt.Sprintf("10.0.0.%d:1", i))})
+	}
+	payload, err := (&Message{Added: many}).Marshal()
+	require.NoError(t, err)
+
+	msg, err := r.Receive(payload)
+	require.NoError(t, err)
+	require.NotNil(t, msg)
+	assert.Len(t, msg.Added, MaxPeers)
+
+	// too soon
+	now = now.Add(10 * time.Second)
+	msg, err = r.Receive(payload)
+	require.NoError(t, err)
+	assert.Nil(t, msg)
+
+	now = now.Add(Interval)
+	msg, err = r.Receive(payload)
+	require.NoError(t, err)
+	assert.NotNil(t, msg)
+
+	now = now.Add(Interval)
+	_, err = r.Receive([]byte("garbage"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,306 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// Dialer makes outgoing connections. *net.Dialer implements it.
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// FromURL returns a dialer for the proxy at u. Supported schemes are socks5,
+// socks5h and http for HTTP CONNECT proxies. socks5 is treated as socks5h:
+// host names are always sent to the proxy to resolve, since resolving them
+// locally would leak the trackers and peers we contact to the local DNS
+// server. Credentials are taken from the URL's user info. forward connects to
+// the proxy itself; nil means a plain net.Dialer.
+func FromURL(u *url.URL, forward Dialer) (Dialer, error) {
+	if forward == nil {
+		forward = &net.Dialer{}
+	}
+	address := u.Host
+	if u.Port() == "" {
+		switch u.Scheme {
+		case "socks5", "socks5h":
+			address = net.JoinHostPort(u.Hostname(), "1080")
+		case "http":
+			address = net.JoinHostPort(u.Hostname(), "80")
+		}
+	}
+
+	username := u.User.Username()
+	password, _ := u.User.Password()
+
+	switch u.Scheme {
+	case "socks5", "socks5h":
+		return &SOCKS5{Address: address, Username: username, Password: password, Forward: forward}, nil
+	case "http":
+		return &HTTPConnect{Address: address, Username: username, Password: password, Forward: forward}, nil
+	default:
+		return nil, fmt.Errorf("unsupported proxy scheme: %q", u.Scheme)
+	}
+}
+
+// Parse is FromURL for a proxy URL string.
+func Parse(rawURL string) (Dialer, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid proxy URL: %w", err)
+	}
+	if u.Host == "" {
+		return nil, fmt.Errorf("invalid proxy URL %q: missing host", rawURL)
+	}
+	return FromURL(u, nil)
+}
+
+// dialProxy connects to the proxy and makes sure the connection is closed
+// if ctx ends during the proxy handshake.
+func dialProxy(ctx context.Context, forward Dialer, address string) (net.Conn, func(), error) {
+	conn, err := forward.DialContext(ctx, "tcp", address)
+	if err != nil {
+		return nil, nil, fmt.Errorf("failed to connect to proxy: %w", err)
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	return conn, func() { stop() }, nil
+}
+
+// SOCKS5 connects through a SOCKS5 proxy (RFC 1928), optionally with
+// username and password authentication (RFC 1929).
+type SOCKS5 struct {
+	Address  string
+	Username string
+	Password string
+	Forward  Dialer
+}
+
+const (
+	socksVersion         = 5
+	socksNoAuth          = 0
+	socksUserPassAuth    = 2
+	socksNoAcceptable    = 0xff
+	socksConnect         = 1
+	socksAddressIPv4     = 1
+	socksAddressDomain   = 3
+	socksAddressIPv6     = 4
+	socksSucceeded       = 0
+	socksUserPassVersion = 1
+)
+
+var socksErrors = map[byte]string{
+	1: "general SOCKS server failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+func (s *SOCKS5) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("SOCKS5 proxy: unsupported network %q", network)
+	}
+	host, portString, err := net.SplitHostPort(address)
+	if err != nil {
+		return nil, err
+	}
+	port, err := strconv.ParseUint(portString, 10, 16)
+	if err != nil {
+		return nil, fmt.Errorf("SOCKS5 proxy: invalid port %q", portString)
+	}
+
+	conn, stop, err := dialProxy(ctx, s.Forward, s.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	if err := s.handshake(conn, host, uint16(port)); err != nil {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("SOCKS5 proxy: %w", err)
+	}
+	return conn, nil
+}
+
+func (s *SOCKS5) handshake(conn net.Conn, host string, port uint16) error {
+	methods := []byte{socksNoAuth}
+	if s.Username != "" {
+		methods = []byte{socksUserPassAuth}
+	}
+	greeting := append([]byte{socksVersion, byte(len(methods))}, methods...)
+	if _, err := conn.Write(greeting); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[0] != socksVersion {
+		return fmt.Errorf("unexpected protocol version %d", reply[0])
+	}
+	switch reply[1] {
+	case socksNoAuth:
+	case socksUserPassAuth:
+		if err := s.authenticate(conn); err != nil {
+			return err
+		}
+	case socksNoAcceptable:
+		return errors.New("no acceptable authentication method")
+	default:
+		return fmt.Errorf("unsupported authentication method %d", reply[1])
+	}
+
+	request := []byte{socksVersion, socksConnect, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return fmt.Errorf("host name too long: %q", host)
+		}
+		request = append(request, socksAddressDomain, byte(len(host)))
+		request = append(request, host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		request = append(request, socksAddressIPv4)
+		request = append(request, ip4...)
+	} else {
+		request = append(request, socksAddressIPv6)
+		request = append(request, ip.To16()...)
+	}
+	request = binary.BigEndian.AppendUint16(request, port)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return err
+	}
+	if header[1] != socksSucceeded {
+		if message, ok := socksErrors[header[1]]; ok {
+			return errors.New(message)
+		}
+		return fmt.Errorf("connect failed with code %d", header[1])
+	}
+
+	// skip the bound address and port
+	var skip int
+	switch header[3] {
+	case socksAddressIPv4:
+		skip = 4
+	case socksAddressIPv6:
+		skip = 16
+	case socksAddressDomain:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return err
+		}
+		skip = int(length[0])
+	default:
+		return fmt.Errorf("unsupported bound address type %d", header[3])
+	}
+	_, err := io.CopyN(io.Discard, conn, int64(skip+2))
+	return err
+}
+
+func (s *SOCKS5) authenticate(conn net.Conn) error {
+	if s.Username == "" || len(s.Username) > 255 || len(s.Password) > 255 {
+		return errors.New("invalid credentials for username/password authentication")
+	}
+	request := []byte{socksUserPassVersion, byte(len(s.Username))}
+	request = append(request, s.Username...)
+	request = append(request, byte(len(s.Password)))
+	request = append(request, s.Password...)
+	if _, err := conn.Write(request); err != nil {
+		return err
+	}
+
+	var reply [2]byte
+	if _, err := io.ReadFull(conn, reply[:]); err != nil {
+		return err
+	}
+	if reply[1] != 0 {
+		return errors.New("authentication failed")
+	}
+	return nil
+}
+
+// HTTPConnect connects through an HTTP proxy with the CONNECT method.
+type HTTPConnect struct {
+	Address  string
+	Username string
+	Password string
+	Forward  Dialer
+}
+
+func (h *HTTPConnect) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	if network != "tcp" && network != "tcp4" && network != "tcp6" {
+		return nil, fmt.Errorf("HTTP proxy: unsupported network %q", network)
+	}
+
+	conn, stop, err := dialProxy(ctx, h.Forward, h.Address)
+	if err != nil {
+		return nil, err
+	}
+	defer stop()
+
+	request := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: address},
+		Host:   address,
+		Header: http.Header{},
+	}
+	if h.Username != "" {
+		credentials := base64.StdEncoding.EncodeToString([]byte(h.Username + ":" + h.Password))
+		request.Header.Set("Proxy-Authorization", "Basic "+credentials)
+	}
+
+	fail := func(err error) (net.Conn, error) {
+		conn.Close()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, fmt.Errorf("HTTP proxy: %w", err)
+	}
+
+	if err := request.Write(conn); err != nil {
+		return fail(err)
+	}
+	reader := bufio.NewReader(conn)
+	response, err := http.ReadResponse(reader, request)
+	if err != nil {
+		return fail(err)
+	}
+	response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fail(fmt.Errorf("CONNECT %s: %s", address, response.Status))
+	}
+
+	if reader.Buffered() > 0 {
+		// the target already sent data, don't lose what we buffered
+		return &bufferedConn{Conn: conn, reader: reader}, nil
+	}
+	return conn, nil
+}
+
+type bufferedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.reader.Read(b)
+}
@@ -0,0 +1,180 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/proxy/proxytest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// startEchoServer echoes back every line it receives.
+func startEchoServer(t *testing.T) string {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				line, err := bufio.NewReader(conn).ReadString('\n')
+				if err == nil {
+					conn.Write([]byte("echo: " + line))
+				}
+			}()
+		}
+	}()
+	return listener.Addr().String()
+}
+
+func roundTrip(t *testing.T, dialer Dialer, address string) string {
+	conn, err := dialer.DialContext(context.Background(), "tcp", address)
+	require.NoError(t, err)
+	defer conn.Close()
+
+	_, err = conn.Write([]byte("hello\n"))
+	require.NoError(t, err)
+	line, err := bufio.NewReader(conn).ReadString('\n')
+	require.NoError(t, err)
+	return line
+}
+
+func TestProxies(t *testing.T) {
+	echo := startEchoServer(t)
+	testCases := []struct {
+		name     string
+		server   func() *proxytest.Server
+		scheme   string
+		username string
+	}{
+		{"socks5", proxytest.NewSOCKS5Server, "socks5", ""},
+		{"socks5 with auth", proxytest.NewSOCKS5Server, "socks5h", "user"},
+		{"http connect", proxytest.NewHTTPConnectServer, "http", ""},
+		{"http connect with auth", proxytest.NewHTTPConnectServer, "http", "user"},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			server := tc.server()
+			defer server.Close()
+			server.Username = tc.username
+			server.Password = "secret"
+
+			dialer, err := Parse(server.URL(tc.scheme))
+			require.NoError(t, err)
+
+			assert.Equal(t, "echo: hello\n", roundTrip(t, dialer, echo))
+			assert.Equal(t, []string{echo}, server.Targets())
+		})
+	}
+}
+
+func TestProxyDomainName(t *testing.T) {
+	echo := startEchoServer(t)
+	_, port, _ := net.SplitHostPort(echo)
+	server := proxytest.NewSOCKS5Server()
+	defer server.Close()
+
+	dialer, err := Parse(server.URL("socks5"))
+	require.NoError(t, err)
+
+	// the name is resolved by the proxy, not by us
+	assert.Equal(t, "echo: hello\n", roundTrip(t, dialer, net.JoinHostPort("localhost", port)))
+	assert.Equal(t, []string{net.JoinHostPort("localhost", port)}, server.Targets())
+}
+
+func TestProxyAuthenticationFailure(t *testing.T) {
+	echo := startEchoServer(t)
+	for _, tc := range []struct {
+		server func() *proxytest.Server
+		scheme string
+	}{
+		{proxytest.NewSOCKS5Server, "socks5"},
+		{proxytest.NewHTTPConnectServer, "http"},
+	} {
+		t.Run(tc.scheme, func(t *testing.T) {
+			server := tc.server()
+			defer server.Close()
+			server.Username = "user"
+			server.Password = "secret"
+
+			dialer, err := FromURL(&url.URL{Scheme: tc.scheme, Host: server.Addr, User: url.UserPassword("user", "wrong")}, nil)
+			require.NoError(t, err)
+
+			_, err = dialer.DialContext(context.Background(), "tcp", echo)
+			assert.Error(t, err)
+			assert.Empty(t, server.Targets())
+		})
+	}
+}
+
+func TestProxyTargetUnreachable(t *testing.T) {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	closed := listener.Addr().String()
+	listener.Close()
+
+	socks := proxytest.NewSOCKS5Server()
+	defer socks.Close()
+	dialer, err := Parse(socks.URL("socks5"))
+	require.NoError(t, err)
+	_, err = dialer.DialContext(context.Background(), "tcp", closed)
+	assert.ErrorContains(t, err, "connection refused")
+
+	httpProxy := proxytest.NewHTTPConnectServer()
+	defer httpProxy.Close()
+	dialer, err = Parse(httpProxy.URL("http"))
+	require.NoError(t, err)
+	_, err = dialer.DialContext(context.Background(), "tcp", closed)
+	assert.ErrorContains(t, err, "502")
+}
+
+func TestProxyContextCancel(t *testing.T) {
+	// a proxy that accepts but never answers
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	defer listener.Close()
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+
+	for _, scheme := range []string{"socks5", "http"} {
+		dialer, err := Parse(scheme + "://" + listener.Addr().String())
+		require.NoError(t, err)
+
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		_, err = dialer.DialContext(ctx, "tcp", "127.0.0.1:1")
+		cancel()
+		assert.ErrorIs(t, err, context.DeadlineExceeded, scheme)
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, rawURL := range []string{"ftp://proxy:21", "socks5://", "://"} {
+		_, err := Parse(rawURL)
+		assert.Error(t, err, rawURL)
+	}
+
+	dialer, err := Parse("socks5://proxy")
+	require.NoError(t, err)
+	assert.Equal(t, "proxy:1080", dialer.(*SOCKS5).Address)
+
+	_, err = dialer.DialContext(context.Background(), "udp", "127.0.0.1:1")
+	assert.ErrorContains(t, err, "unsupported network")
+}
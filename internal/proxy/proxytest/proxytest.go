@@ -0,0 +1,237 @@
+package proxytest
+
+import (
+	"bufio"
+	"encoding/base64"
+	"encoding/binary"
+	"io"
+	"net"
+	"net/http"
+	"strconv"
+	"sync"
+)
+
+// Server is an in-process SOCKS5 or HTTP CONNECT proxy listening on a
+// loopback address, in the spirit of httptest.Server.
+type Server struct {
+	// Addr is the host:port the proxy listens on.
+	Addr string
+	// Username and Password, when set, are required from clients.
+	Username string
+	Password string
+
+	listener net.Listener
+	handle   func(*Server, net.Conn)
+
+	mu      sync.Mutex
+	targets []string
+	wg      sync.WaitGroup
+}
+
+// NewSOCKS5Server starts a SOCKS5 proxy supporting the CONNECT command.
+func NewSOCKS5Server() *Server {
+	return start((*Server).serveSOCKS5)
+}
+
+// NewHTTPConnectServer starts an HTTP proxy supporting the CONNECT method.
+func NewHTTPConnectServer() *Server {
+	return start((*Server).serveHTTPConnect)
+}
+
+func start(handle func(*Server, net.Conn)) *Server {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic("proxytest: failed to listen: " + err.Error())
+	}
+	s := &Server{Addr: listener.Addr().String(), listener: listener, handle: handle}
+	s.wg.Add(1)
+	go s.serve()
+	return s
+}
+
+// URL returns the proxy URL for the given scheme, with credentials if set.
+func (s *Server) URL(scheme string) string {
+	userInfo := ""
+	if s.Username != "" {
+		userInfo = s.Username + ":" + s.Password + "@"
+	}
+	return scheme + "://" + userInfo + s.Addr
+}
+
+// Targets returns the addresses clients asked to connect to, in order.
+func (s *Server) Targets() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]string{}, s.targets...)
+}
+
+func (s *Server) Close() {
+	s.listener.Close()
+	s.wg.Wait()
+}
+
+func (s *Server) serve() {
+	defer s.wg.Done()
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(s, conn)
+	}
+}
+
+func (s *Server) record(target string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.targets = append(s.targets, target)
+}
+
+// relay copies data between client and target until either side is done.
+func relay(client io.ReadWriteCloser, clientReader io.Reader, target net.Conn) {
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(target, clientReader)
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(client, target)
+		done <- struct{}{}
+	}()
+	<-done
+	client.Close()
+	target.Close()
+}
+
+func (s *Server) serveSOCKS5(conn net.Conn) {
+	defer conn.Close()
+
+	var header [2]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil || header[0] != 5 {
+		return
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return
+	}
+
+	wanted := byte(0)
+	if s.Username != "" {
+		wanted = 2
+	}
+	offered := false
+	for _, method := range methods {
+		offered = offered || method == wanted
+	}
+	if !offered {
+		conn.Write([]byte{5, 0xff})
+		return
+	}
+	conn.Write([]byte{5, wanted})
+
+	if wanted == 2 && !s.socksAuthenticate(conn) {
+		return
+	}
+
+	var request [4]byte
+	if _, err := io.ReadFull(conn, request[:]); err != nil {
+		return
+	}
+	var host string
+	switch request[3] {
+	case 1, 4:
+		ip := make([]byte, 4)
+		if request[3] == 4 {
+			ip = make([]byte, 16)
+		}
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return
+		}
+		host = net.IP(ip).String()
+	case 3:
+		var length [1]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return
+		}
+		name := make([]byte, length[0])
+		if _, err := io.ReadFull(conn, name); err != nil {
+			return
+		}
+		host = string(name)
+	default:
+		return
+	}
+	var port [2]byte
+	if _, err := io.ReadFull(conn, port[:]); err != nil {
+		return
+	}
+	target := net.JoinHostPort(host, strconv.Itoa(int(binary.BigEndian.Uint16(port[:]))))
+	s.record(target)
+
+	if request[1] != 1 {
+		conn.Write([]byte{5, 7, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	targetConn, err := net.Dial("tcp", target)
+	if err != nil {
+		conn.Write([]byte{5, 5, 0, 1, 0, 0, 0, 0, 0, 0})
+		return
+	}
+	conn.Write([]byte{5, 0, 0, 1, 127, 0, 0, 1, 0, 0})
+	relay(conn, conn, targetConn)
+}
+
+func (s *Server) socksAuthenticate(conn net.Conn) bool {
+	var version [2]byte
+	if _, err := io.ReadFull(conn, version[:]); err != nil {
+		return false
+	}
+	username := make([]byte, version[1])
+	if _, err := io.ReadFull(conn, username); err != nil {
+		return false
+	}
+	var length [1]byte
+	if _, err := io.ReadFull(conn, length[:]); err != nil {
+		return false
+	}
+	password := make([]byte, length[0])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return false
+	}
+	if string(username) != s.Username || string(password) != s.Password {
+		conn.Write([]byte{1, 1})
+		return false
+	}
+	conn.Write([]byte{1, 0})
+	return true
+}
+
+func (s *Server) serveHTTPConnect(conn net.Conn) {
+	defer conn.Close()
+
+	reader := bufio.NewReader(conn)
+	request, err := http.ReadRequest(reader)
+	if err != nil {
+		return
+	}
+	if request.Method != http.MethodConnect {
+		conn.Write([]byte("HTTP/1.1 405 Method Not Allowed\r\n\r\n"))
+		return
+	}
+	if s.Username != "" {
+		expected := "Basic " + base64.StdEncoding.EncodeToString([]byte(s.Username+":"+s.Password))
+		if request.Header.Get("Proxy-Authorization") != expected {
+			conn.Write([]byte("HTTP/1.1 407 Proxy Authentication Required\r\n\r\n"))
+			return
+		}
+	}
+	s.record(request.Host)
+
+	targetConn, err := net.Dial("tcp", request.Host)
+	if err != nil {
+		conn.Write([]byte("HTTP/1.1 502 Bad Gateway\r\n\r\n"))
+		return
+	}
+	conn.Write([]byte("HTTP/1.1 200 Connection established\r\n\r\n"))
+	relay(conn, reader, targetConn)
+}
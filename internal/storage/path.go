@@ -0,0 +1,304 @@
+package storage
+
+import (
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MaxComponentLength is the longest file or directory name most filesystems
+// accept, in bytes.
+const MaxComponentLength = 255
+
+var (
+	// ErrEmptyPath is returned when nothing usable is left of a torrent path.
+	ErrEmptyPath = errors.New("empty path")
+	// ErrEscapesRoot is returned when a path would resolve outside the root,
+	// for example through a symlink planted in the download directory.
+	ErrEscapesRoot = errors.New("path escapes the storage root")
+	// ErrUnsafePath is returned in strict mode instead of sanitising.
+	ErrUnsafePath = errors.New("unsafe path")
+	// ErrDuplicatePath is returned in strict mode when two torrent paths
+	// resolve to the same file.
+	ErrDuplicatePath = errors.New("duplicate path")
+)
+
+// Remap records a change the resolver made to one component of a torrent path.
+type Remap struct {
+	Index    int    `json:"index"`
+	Original string `json:"original"`
+	// Replacement is empty when the component was dropped.
+	Replacement string `json:"replacement"`
+	Reason      string `json:"reason"`
+}
+
+func (r Remap) String() string {
+	if r.Replacement == "" {
+		return fmt.Sprintf("dropped %q (%s)", r.Original, r.Reason)
+	}
+	return fmt.Sprintf("%q -> %q (%s)", r.Original, r.Replacement, r.Reason)
+}
+
+// ResolvedPath is the filesystem location for a torrent path.
+type ResolvedPath struct {
+	// Path is an absolute path inside the resolver's root.
+	Path   string
+	Remaps []Remap
+}
+
+// Resolver maps file paths from untrusted torrent metainfo to locations under
+// a root directory. Paths are never allowed to leave the root.
+type Resolver struct {
+	root string
+	// Strict makes Resolve fail with ErrUnsafePath instead of sanitising.
+	Strict bool
+	// MaxComponentLength defaults to MaxComponentLength when zero.
+	MaxComponentLength int
+}
+
+func NewResolver(root string) (*Resolver, error) {
+	absRoot, err := filepath.Abs(root)
+	if err != nil {
+		return nil, fmt.Errorf("invalid storage root: %w", err)
+	}
+	// The root itself may legitimately be a symlink, e.g. to a shared volume.
+	if resolved, err := filepath.EvalSymlinks(absRoot); err == nil {
+		absRoot = resolved
+	} else if !errors.Is(err, os.ErrNotExist) {
+		return nil, fmt.Errorf("invalid storage root: %w", err)
+	}
+	return &Resolver{root: absRoot}, nil
+}
+
+func (r *Resolver) Root() string {
+	return r.root
+}
+
+// Resolve maps the components of a torrent path (the name for single file
+// torrents, or name followed by a files[].path entry) to a path under the root.
+func (r *Resolver) Resolve(components []string) (*ResolvedPath, error) {
+	result := &ResolvedPath{}
+	clean := make([]string, 0, len(components))
+
+	for i, component := range components {
+		sanitised, reason := r.sanitise(component)
+		if reason != "" {
+			if r.Strict {
+				return nil, fmt.Errorf("%w: component %d %q: %s", ErrUnsafePath, i, component, reason)
+			}
+			result.Remaps = append(result.Remaps, Remap{i, component, sanitised, reason})
+		}
+		if sanitised != "" {
+			clean = append(clean, sanitised)
+		}
+	}
+
+	if len(clean) == 0 {
+		return nil, ErrEmptyPath
+	}
+
+	path := filepath.Join(append([]string{r.root}, clean...)...)
+	if !r.contains(path) {
+		return nil, fmt.Errorf("%w: %s", ErrEscapesRoot, path)
+	}
+	if err := r.checkSymlinks(clean); err != nil {
+		return nil, err
+	}
+
+	result.Path = path
+	return result, nil
+}
+
+// ResolveAll resolves the paths of all the files of a torrent. Paths that
+// land on the file of an earlier one, because they are repeated or were
+// sanitised to the same name, get a numbered suffix, recorded as a remap of
+// their last component: two torrent files must never share one on disk.
+func (r *Resolver) ResolveAll(paths [][]string) ([]*ResolvedPath, error) {
+	results := make([]*ResolvedPath, len(paths))
+	wanted := make(map[string]bool, len(paths))
+	for i, components := range paths {
+		result, err := r.Resolve(components)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", filepath.Join(components...), err)
+		}
+		results[i] = result
+		wanted[result.Path] = true
+	}
+
+	taken := make(map[string]bool, len(paths))
+	for i, result := range results {
+		if !taken[result.Path] {
+			taken[result.Path] = true
+			continue
+		}
+		if r.Strict {
+			return nil, fmt.Errorf("%w: %s", ErrDuplicatePath, filepath.Join(paths[i]...))
+		}
+		// the new name mustn't take the one of a later file either
+		dir, name := filepath.Split(result.Path)
+		path := result.Path
+		for n := 2; taken[path] || wanted[path]; n++ {
+			path = filepath.Join(dir, r.numbered(name, n))
+		}
+		rel, err := filepath.Rel(r.root, path)
+		if err != nil {
+			return nil, err
+		}
+		if err := r.checkSymlinks(strings.Split(rel, string(filepath.Separator))); err != nil {
+			return nil, err
+		}
+		result.Path = path
+		result.Remaps = append(result.Remaps, Remap{len(paths[i]) - 1, name, filepath.Base(path), "duplicate path"})
+		taken[path] = true
+	}
+	return results, nil
+}
+
+// numbered adds ~n to name before its extension, shortening it if needed.
+func (r *Resolver) numbered(name string, n int) string {
+	maxLength := r.MaxComponentLength
+	if maxLength <= 0 {
+		maxLength = MaxComponentLength
+	}
+	suffix := fmt.Sprintf("~%d", n)
+	ext := filepath.Ext(name)
+	if len(ext)+len(suffix) > maxLength/2 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	keep := min(len(stem), maxLength-len(ext)-len(suffix))
+	// Don't cut a multi-byte UTF-8 sequence in half.
+	for keep > 0 && keep < len(stem) && stem[keep]&0xC0 == 0x80 {
+		keep--
+	}
+	return stem[:keep] + suffix + ext
+}
+
+// sanitise returns a safe version of a single path component, and why it had
+// to change. An empty result means the component is dropped.
+func (r *Resolver) sanitise(component string) (string, string) {
+	switch component {
+	case "":
+		return "", "empty component"
+	case ".":
+		return "", "current directory reference"
+	case "..":
+		return "", "parent directory reference"
+	}
+
+	var reasons []string
+	name := component
+
+	if strings.ContainsAny(name, `/\`) {
+		name = strings.NewReplacer("/", "_", `\`, "_").Replace(name)
+		if strings.HasPrefix(component, "/") || strings.HasPrefix(component, `\`) {
+			reasons = append(reasons, "absolute path")
+		} else {
+			reasons = append(reasons, "path separator")
+		}
+	}
+
+	if strings.ContainsAny(name, ":") || strings.IndexFunc(name, isControl) >= 0 {
+		name = strings.Map(func(c rune) rune {
+			if c == ':' || isControl(c) {
+				return '_'
+			}
+			return c
+		}, name)
+		reasons = append(reasons, "invalid character")
+	}
+
+	if trimmed := strings.TrimRight(name, ". "); trimmed != name {
+		name = trimmed + "_"
+		reasons = append(reasons, "trailing dot or space")
+	}
+
+	if isReservedName(name) {
+		name = "_" + name
+		reasons = append(reasons, "reserved name")
+	}
+
+	maxLength := r.MaxComponentLength
+	if maxLength <= 0 {
+		maxLength = MaxComponentLength
+	}
+	if len(name) > maxLength {
+		name = shorten(name, maxLength)
+		reasons = append(reasons, "name too long")
+	}
+
+	return name, strings.Join(reasons, ", ")
+}
+
+// shorten truncates name to at most max bytes, keeping its extension and
+// adding a short hash of the original so distinct long names stay distinct.
+func shorten(name string, max int) string {
+	suffix := fmt.Sprintf("~%x", sha1.Sum([]byte(name)))[:9]
+	ext := filepath.Ext(name)
+	if len(ext)+len(suffix) > max/2 {
+		ext = ""
+	}
+	stem := name[:len(name)-len(ext)]
+	keep := max - len(ext) - len(suffix)
+	// Don't cut a multi-byte UTF-8 sequence in half.
+	for keep > 0 && keep < len(stem) && stem[keep]&0xC0 == 0x80 {
+		keep--
+	}
+	return stem[:keep] + suffix + ext
+}
+
+func isControl(c rune) bool {
+	return c < 0x20 || c == 0x7f
+}
+
+// isReservedName reports whether name is a device name Windows refuses to use
+// as a file name, with or without an extension.
+func isReservedName(name string) bool {
+	base := strings.ToUpper(name)
+	if i := strings.IndexByte(base, '.'); i >= 0 {
+		base = base[:i]
+	}
+	switch base {
+	case "CON", "PRN", "AUX", "NUL":
+		return true
+	}
+	if len(base) == 4 && (strings.HasPrefix(base, "COM") || strings.HasPrefix(base, "LPT")) {
+		return base[3] >= '1' && base[3] <= '9'
+	}
+	return false
+}
+
+func (r *Resolver) contains(path string) bool {
+	rel, err := filepath.Rel(r.root, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// checkSymlinks walks the parts of the path that already exist and makes sure
+// none of them is a symlink pointing outside the root.
+func (r *Resolver) checkSymlinks(components []string) error {
+	current := r.root
+	for _, component := range components {
+		current = filepath.Join(current, component)
+		info, err := os.Lstat(current)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if info.Mode()&os.ModeSymlink == 0 {
+			continue
+		}
+		target, err := filepath.EvalSymlinks(current)
+		if err != nil {
+			return fmt.Errorf("%w: %s: %v", ErrEscapesRoot, current, err)
+		}
+		if !r.contains(target) {
+			return fmt.Errorf("%w: %s links to %s", ErrEscapesRoot, current, target)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,137 @@
+package storage
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestResolve(t *testing.T) {
+	root := t.TempDir()
+	resolver, err := NewResolver(root)
+	require.NoError(t, err)
+	root = resolver.Root()
+
+	testCases := []struct {
+		name     string
+		input    []string
+		expected string
+		remaps   int
+	}{
+		{"plain", []string{"dir", "file.txt"}, "dir/file.txt", 0},
+		{"parent directory", []string{"..", "..", "etc", "passwd"}, "etc/passwd", 2},
+		{"current directory", []string{"a", ".", "b"}, "a/b", 1},
+		{"absolute", []string{"/etc/passwd"}, "_etc_passwd", 1},
+		{"embedded traversal", []string{"a/../../b"}, "a_.._.._b", 1},
+		{"windows drive", []string{`C:\Windows`}, "C__Windows", 1},
+		{"reserved name", []string{"con.txt"}, "_con.txt", 1},
+		{"reserved com port", []string{"COM1"}, "_COM1", 1},
+		{"not reserved", []string{"COM0", "console"}, "COM0/console", 0},
+		{"trailing dot", []string{"name."}, "name_", 1},
+		{"control character", []string{"a\x00b"}, "a_b", 1},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			result, err := resolver.Resolve(tc.input)
+
+			require.NoError(t, err)
+			assert.Equal(t, filepath.Join(root, filepath.FromSlash(tc.expected)), result.Path)
+			assert.Len(t, result.Remaps, tc.remaps)
+		})
+	}
+}
+
+func TestResolveEmpty(t *testing.T) {
+	resolver, err := NewResolver(t.TempDir())
+	require.NoError(t, err)
+
+	_, err = resolver.Resolve([]string{"..", ".", ""})
+	assert.ErrorIs(t, err, ErrEmptyPath)
+}
+
+func TestResolveStrict(t *testing.T) {
+	resolver, err := NewResolver(t.TempDir())
+	require.NoError(t, err)
+	resolver.Strict = true
+
+	_, err = resolver.Resolve([]string{"ok", "..", "passwd"})
+	assert.ErrorIs(t, err, ErrUnsafePath)
+
+	_, err = resolver.Resolve([]string{"ok", "file"})
+	assert.NoError(t, err)
+}
+
+func TestResolveLongName(t *testing.T) {
+	resolver, err := NewResolver(t.TempDir())
+	require.NoError(t, err)
+
+	first, err := resolver.Resolve([]string{strings.Repeat("a", 300) + "1.txt"})
+	require.NoError(t, err)
+	second, err := resolver.Resolve([]string{strings.Repeat("a", 300) + "2.txt"})
+	require.NoError(t, err)
+
+	name := filepath.Base(first.Path)
+	assert.Len(t, name, MaxComponentLength)
+	assert.True(t, strings.HasSuffix(name, ".txt"))
+	assert.NotEqual(t, first.Path, second.Path)
+	require.Len(t, first.Remaps, 1)
+	assert.Equal(t, "name too long", first.Remaps[0].Reason)
+}
+
+func TestResolveSymlinkEscape(t *testing.T) {
+	root := t.TempDir()
+	outside := t.TempDir()
+	require.NoError(t, os.Symlink(outside, filepath.Join(root, "link")))
+	require.NoError(t, os.Mkdir(filepath.Join(root, "inside"), 0o755))
+	require.NoError(t, os.Symlink(filepath.Join(root, "inside"), filepath.Join(root, "internal")))
+
+	resolver, err := NewResolver(root)
+	require.NoError(t, err)
+
+	_, err = resolver.Resolve([]string{"link", "file"})
+	assert.ErrorIs(t, err, ErrEscapesRoot)
+
+	result, err := resolver.Resolve([]string{"internal", "file"})
+	require.NoError(t, err)
+	assert.Equal(t, filepath.Join(resolver.Root(), "internal", "file"), result.Path)
+}
+
+func TestResolveAll(t *testing.T) {
+	resolver, err := NewResolver(t.TempDir())
+	require.NoError(t, err)
+	root := resolver.Root()
+
+	results, err := resolver.ResolveAll([][]string{
+		{"dir", "a:b.txt"},
+		{"dir", "a_b.txt"},
+		{"dir", "a_b.txt"},
+		// taken by a later file, so it is skipped
+		{"dir", "a_b~2.txt"},
+		{"other", "a_b.txt"},
+	})
+	require.NoError(t, err)
+	paths := make([]string, len(results))
+	for i, result := range results {
+		paths[i], err = filepath.Rel(root, result.Path)
+		require.NoError(t, err)
+	}
+	assert.Equal(t, []string{
+		filepath.Join("dir", "a_b.txt"),
+		filepath.Join("dir", "a_b~3.txt"),
+		filepath.Join("dir", "a_b~4.txt"),
+		filepath.Join("dir", "a_b~2.txt"),
+		filepath.Join("other", "a_b.txt"),
+	}, paths)
+	assert.Equal(t, []Remap{{1, "a_b.txt", "a_b~3.txt", "duplicate path"}}, results[1].Remaps)
+
+	resolver.Strict = true
+	_, err = resolver.ResolveAll([][]string{{"a"}, {"a"}})
+	assert.ErrorIs(t, err, ErrDuplicatePath)
+	_, err = resolver.ResolveAll([][]string{{"a"}, {".."}})
+	assert.ErrorIs(t, err, ErrUnsafePath)
+}
@@ -0,0 +1,206 @@
+package tracker
+
+import (
+	"errors"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+)
+
+// ServeHTTP answers announces on paths ending in /announce and scrapes on
+// paths ending in /scrape.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	switch {
+	case strings.HasSuffix(r.URL.Path, "/announce"):
+		s.serveHTTP(w, r, s.httpAnnounce)
+	case strings.HasSuffix(r.URL.Path, "/scrape"):
+		s.serveHTTP(w, r, s.httpScrape)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// serveHTTP applies injected faults and writes the bencoded result of handle.
+func (s *Server) serveHTTP(w http.ResponseWriter, r *http.Request, handle func(*http.Request) (map[string]interface{}, error)) {
+	fault := s.nextFault()
+	if fault != nil && fault.StatusCode != 0 {
+		http.Error(w, http.StatusText(fault.StatusCode), fault.StatusCode)
+		return
+	}
+	err := applyFault(fault, r.Context().Done())
+	if errors.Is(err, ErrDropped) {
+		// keep the client waiting until it gives up
+		<-r.Context().Done()
+		return
+	}
+
+	var response map[string]interface{}
+	if err == nil {
+		response, err = handle(r)
+	}
+	var failure *Failure
+	if errors.As(err, &failure) {
+		response = map[string]interface{}{"failure reason": failure.Reason}
+		if failure.RetryIn > 0 {
+			response["retry in"] = failure.RetryIn
+		}
+	} else if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if fault != nil && fault.WarningMessage != "" && response["failure reason"] == nil {
+		response["warning message"] = fault.WarningMessage
+	}
+
+	encoded, err := bencode.Marshal(response)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte(encoded))
+}
+
+func (s *Server) httpAnnounce(r *http.Request) (map[string]interface{}, error) {
+	query := r.URL.Query()
+	req, err := parseAnnounceQuery(query, r.RemoteAddr)
+	if err != nil {
+		return nil, err
+	}
+	response, err := s.Announce(req)
+	if err != nil {
+		return nil, err
+	}
+
+	result := map[string]interface{}{
+		"interval":   int(response.Interval.Seconds()),
+		"complete":   response.Complete,
+		"incomplete": response.Incomplete,
+	}
+	if response.MinInterval > 0 {
+		result["min interval"] = int(response.MinInterval.Seconds())
+	}
+	if response.TrackerID != "" {
+		result["tracker id"] = response.TrackerID
+	}
+
+	// clients ask for compact peers unless they explicitly refuse them
+	if query.Get("compact") == "0" {
+		peers := make([]interface{}, 0, len(response.Peers))
+		for _, peer := range response.Peers {
+			entry := map[string]interface{}{
+				"ip":   peer.Addr.Addr().Unmap().String(),
+				"port": int(peer.Addr.Port()),
+			}
+			if query.Get("no_peer_id") != "1" {
+				entry["peer id"] = string(peer.ID[:])
+			}
+			peers = append(peers, entry)
+		}
+		result["peers"] = peers
+	} else {
+		peers, peers6 := compactPeers(response.Peers)
+		result["peers"] = string(peers)
+		if len(peers6) > 0 {
+			result["peers6"] = string(peers6)
+		}
+	}
+	return result, nil
+}
+
+func parseAnnounceQuery(query url.Values, remoteAddr string) (*Request, error) {
+	req := &Request{Event: Event(query.Get("event")), Key: query.Get("key"), NumWant: -1}
+
+	infoHash := query.Get("info_hash")
+	if len(infoHash) != 20 {
+		return nil, &Failure{Reason: "invalid info_hash"}
+	}
+	copy(req.InfoHash[:], infoHash)
+
+	peerID := query.Get("peer_id")
+	if len(peerID) != 20 {
+		return nil, &Failure{Reason: "invalid peer_id"}
+	}
+	copy(req.PeerID[:], peerID)
+
+	switch req.Event {
+	case EventNone, EventStarted, EventCompleted, EventStopped:
+	default:
+		return nil, &Failure{Reason: "invalid event"}
+	}
+
+	port, err := strconv.ParseUint(query.Get("port"), 10, 16)
+	if err != nil {
+		return nil, &Failure{Reason: "invalid port"}
+	}
+
+	for name, value := range map[string]*int64{"uploaded": &req.Uploaded, "downloaded": &req.Downloaded, "left": &req.Left} {
+		if raw := query.Get(name); raw != "" {
+			*value, err = strconv.ParseInt(raw, 10, 64)
+			if err != nil || *value < 0 {
+				return nil, &Failure{Reason: "invalid " + name}
+			}
+		}
+	}
+	if raw := query.Get("numwant"); raw != "" {
+		req.NumWant, err = strconv.Atoi(raw)
+		if err != nil {
+			return nil, &Failure{Reason: "invalid numwant"}
+		}
+	}
+
+	// the ip parameter wins over the address the request came from
+	host := query.Get("ip")
+	if host == "" {
+		host, _, _ = net.SplitHostPort(remoteAddr)
+	}
+	addr, err := netip.ParseAddr(host)
+	if err != nil {
+		return nil, &Failure{Reason: "invalid ip"}
+	}
+	req.Addr = netip.AddrPortFrom(addr.Unmap(), uint16(port))
+	return req, nil
+}
+
+// compactPeers encodes peers in the 6 byte IPv4 and 18 byte IPv6 compact
+// forms (BEP 23, BEP 7).
+func compactPeers(peers []Peer) (peers4, peers6 []byte) {
+	for _, peer := range peers {
+		addr := peer.Addr.Addr().Unmap()
+		if addr.Is4() {
+			peers4 = append(peers4, addr.AsSlice()...)
+			peers4 = append(peers4, byte(peer.Addr.Port()>>8), byte(peer.Addr.Port()))
+		} else {
+			peers6 = append(peers6, addr.AsSlice()...)
+			peers6 = append(peers6, byte(peer.Addr.Port()>>8), byte(peer.Addr.Port()))
+		}
+	}
+	return peers4, peers6
+}
+
+func (s *Server) httpScrape(r *http.Request) (map[string]interface{}, error) {
+	var infoHashes [][20]byte
+	for _, raw := range r.URL.Query()["info_hash"] {
+		if len(raw) != 20 {
+			return nil, &Failure{Reason: "invalid info_hash"}
+		}
+		var infoHash [20]byte
+		copy(infoHash[:], raw)
+		infoHashes = append(infoHashes, infoHash)
+	}
+
+	files := map[string]interface{}{}
+	for _, stats := range s.Scrape(infoHashes...) {
+		files[string(stats.InfoHash[:])] = map[string]interface{}{
+			"complete":   stats.Complete,
+			"downloaded": stats.Downloaded,
+			"incomplete": stats.Incomplete,
+		}
+	}
+	return map[string]interface{}{"files": files}, nil
+}
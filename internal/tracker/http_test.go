@@ -0,0 +1,158 @@
+package tracker
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/codecrafters-io/bittorrent-starter-go/internal/bencode"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func get(t *testing.T, rawURL string, query url.Values) (int, map[string]interface{}) {
+	t.Helper()
+	resp, err := http.Get(rawURL + "?" + query.Encode())
+	require.NoError(t, err)
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	require.NoError(t, err)
+	if resp.StatusCode != http.StatusOK {
+		return resp.StatusCode, nil
+	}
+	decoded, err := bencode.Unmarshal(string(body))
+	require.NoError(t, err)
+	return resp.StatusCode, decoded.(map[string]interface{})
+}
+
+func announceQuery(name string, port string, left string) url.Values {
+	id := peerID(name)
+	return url.Values{
+		"info_hash": {string([]byte{1, 19: 0})},
+		"peer_id":   {string(id[:])},
+		"port":      {port},
+		"left":      {left},
+		"compact":   {"1"},
+	}
+}
+
+func TestHTTPAnnounce(t *testing.T) {
+	server := httptest.NewServer(NewServer())
+	defer server.Close()
+
+	_, response := get(t, server.URL+"/announce", announceQuery("seeder", "6881", "0"))
+	assert.Equal(t, "", response["peers"])
+
+	query := announceQuery("leecher", "6882", "10")
+	_, response = get(t, server.URL+"/announce", query)
+	assert.Equal(t, map[string]interface{}{
+		"interval":     1800,
+		"min interval": 60,
+		"complete":     1,
+		"incomplete":   1,
+		"peers":        "\x7f\x00\x00\x01\x1a\xe1",
+	}, response)
+
+	query.Set("compact", "0")
+	_, response = get(t, server.URL+"/announce", query)
+	id := peerID("seeder")
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"ip": "127.0.0.1", "port": 6881, "peer id": string(id[:])},
+	}, response["peers"])
+
+	query.Set("no_peer_id", "1")
+	query.Set("ip", "::1")
+	_, response = get(t, server.URL+"/announce", query)
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"ip": "127.0.0.1", "port": 6881},
+	}, response["peers"])
+
+	// the leecher now announces an IPv6 address
+	_, response = get(t, server.URL+"/announce", announceQuery("seeder", "6881", "0"))
+	assert.Equal(t, "", response["peers"])
+	assert.Equal(t, "\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x00\x01\x1a\xe2", response["peers6"])
+}
+
+func TestHTTPAnnounceInvalid(t *testing.T) {
+	server := httptest.NewServer(NewServer())
+	defer server.Close()
+
+	testCases := []struct {
+		name   string
+		modify func(url.Values)
+		reason string
+	}{
+		{"short info hash", func(q url.Values) { q.Set("info_hash", "abc") }, "invalid info_hash"},
+		{"missing peer id", func(q url.Values) { q.Del("peer_id") }, "invalid peer_id"},
+		{"bad port", func(q url.Values) { q.Set("port", "70000") }, "invalid port"},
+		{"zero port", func(q url.Values) { q.Set("port", "0") }, "invalid port"},
+		{"negative left", func(q url.Values) { q.Set("left", "-1") }, "invalid left"},
+		{"unknown event", func(q url.Values) { q.Set("event", "paused") }, "invalid event"},
+		{"bad ip", func(q url.Values) { q.Set("ip", "example.com") }, "invalid ip"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.name, func(t *testing.T) {
+			query := announceQuery("peer", "6881", "0")
+			tc.modify(query)
+			_, response := get(t, server.URL+"/announce", query)
+			assert.Equal(t, tc.reason, response["failure reason"])
+		})
+	}
+
+	status, _ := get(t, server.URL+"/other", nil)
+	assert.Equal(t, http.StatusNotFound, status)
+}
+
+func TestHTTPScrape(t *testing.T) {
+	server := httptest.NewServer(NewServer())
+	defer server.Close()
+
+	get(t, server.URL+"/announce", announceQuery("seeder", "6881", "0"))
+	get(t, server.URL+"/announce", announceQuery("leecher", "6882", "5"))
+
+	unknown := string(make([]byte, 20))
+	_, response := get(t, server.URL+"/scrape", url.Values{"info_hash": {string([]byte{1, 19: 0}), unknown}})
+	assert.Equal(t, map[string]interface{}{
+		"files": map[string]interface{}{
+			string([]byte{1, 19: 0}): map[string]interface{}{"complete": 1, "downloaded": 0, "incomplete": 1},
+			unknown:                  map[string]interface{}{"complete": 0, "downloaded": 0, "incomplete": 0},
+		},
+	}, response)
+
+	// without info hashes every swarm is returned
+	_, response = get(t, server.URL+"/scrape", nil)
+	assert.Len(t, response["files"], 1)
+}
+
+func TestHTTPFaults(t *testing.T) {
+	s := NewServer()
+	server := httptest.NewServer(s)
+	defer server.Close()
+
+	s.InjectFault(Fault{StatusCode: http.StatusServiceUnavailable, Times: 1})
+	s.InjectFault(Fault{FailureReason: "maintenance", RetryIn: 10, Times: 1})
+	s.InjectFault(Fault{WarningMessage: "slow down", Times: 1})
+
+	status, _ := get(t, server.URL+"/announce", announceQuery("peer", "6881", "0"))
+	assert.Equal(t, http.StatusServiceUnavailable, status)
+
+	_, response := get(t, server.URL+"/announce", announceQuery("peer", "6881", "0"))
+	assert.Equal(t, map[string]interface{}{"failure reason": "maintenance", "retry in": 10}, response)
+
+	_, response = get(t, server.URL+"/announce", announceQuery("peer", "6881", "0"))
+	assert.Equal(t, "slow down", response["warning message"])
+	assert.Equal(t, 1, response["complete"])
+
+	s.InjectFault(Fault{Drop: true, Times: 1})
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	request, err := http.NewRequestWithContext(ctx, http.MethodGet, server.URL+"/announce", nil)
+	require.NoError(t, err)
+	_, err = http.DefaultClient.Do(request)
+	assert.ErrorIs(t, err, context.DeadlineExceeded)
+}
@@ -0,0 +1,338 @@
+package tracker
+
+import (
+	"errors"
+	"math/rand"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+// Event is the event of an announce.
+type Event string
+
+const (
+	EventNone      Event = ""
+	EventStarted   Event = "started"
+	EventCompleted Event = "completed"
+	EventStopped   Event = "stopped"
+)
+
+// Request is an announce from a peer, independent of the protocol.
+type Request struct {
+	InfoHash [20]byte
+	PeerID   [20]byte
+	// Addr is where the peer accepts connections.
+	Addr       netip.AddrPort
+	Uploaded   int64
+	Downloaded int64
+	Left       int64
+	Event      Event
+	// NumWant is how many peers the client asked for; negative means the
+	// server's default.
+	NumWant int
+	Key     string
+}
+
+// Peer is a peer in a swarm.
+type Peer struct {
+	ID   [20]byte
+	Addr netip.AddrPort
+	// Left is the number of bytes the peer still has to download.
+	Left     int64
+	lastSeen time.Time
+}
+
+// Seeder reports whether the peer has the whole torrent.
+func (p Peer) Seeder() bool {
+	return p.Left == 0
+}
+
+// Response is the answer to an announce.
+type Response struct {
+	Interval    time.Duration
+	MinInterval time.Duration
+	TrackerID   string
+	Complete    int
+	Incomplete  int
+	Peers       []Peer
+	// WarningMessage is set by an injected fault.
+	WarningMessage string
+}
+
+// Stats describes a swarm, as returned by scrape.
+type Stats struct {
+	InfoHash   [20]byte
+	Complete   int
+	Downloaded int
+	Incomplete int
+}
+
+// Failure is an error that is reported to the client as a tracker failure
+// instead of a transport error.
+type Failure struct {
+	Reason string
+	// RetryIn is the number of minutes the client should wait before trying
+	// again (BEP 31). Zero leaves it out.
+	RetryIn int
+}
+
+func (f *Failure) Error() string {
+	return f.Reason
+}
+
+// Fault is a failure injected into the responses of a server, for testing
+// how clients cope with broken trackers.
+type Fault struct {
+	// FailureReason makes the tracker answer with this failure.
+	FailureReason string
+	RetryIn       int
+	// StatusCode makes HTTP requests fail with this status code.
+	StatusCode int
+	// Drop makes the tracker not answer at all.
+	Drop bool
+	// Delay is waited before answering.
+	Delay time.Duration
+	// WarningMessage is added to an otherwise successful announce.
+	WarningMessage string
+	// Times is the number of requests the fault applies to. Zero means every
+	// request until the faults are cleared.
+	Times int
+}
+
+// ErrDropped is returned for requests dropped by an injected fault.
+var ErrDropped = errors.New("request dropped")
+
+// Server keeps swarms in memory and answers announces and scrapes. It serves
+// HTTP through ServeHTTP, so it can be used with httptest, and UDP (BEP 15)
+// through ServeUDP.
+type Server struct {
+	// Interval and MinInterval are sent to clients.
+	Interval    time.Duration
+	MinInterval time.Duration
+	// PeerTimeout removes peers that haven't announced for that long.
+	PeerTimeout time.Duration
+	// DefaultNumWant and MaxNumWant bound the number of peers returned.
+	DefaultNumWant int
+	MaxNumWant     int
+	// TrackerID is sent to clients when set.
+	TrackerID string
+	// FailureRate is the probability of answering any request with a
+	// failure, for soak testing clients.
+	FailureRate float64
+
+	mu     sync.Mutex
+	swarms map[[20]byte]*swarm
+	faults []Fault
+	rand   *rand.Rand
+	now    func() time.Time
+
+	udpMu       sync.Mutex
+	connections map[uint64]time.Time
+}
+
+type swarm struct {
+	peers      map[[20]byte]*Peer
+	downloaded int
+}
+
+func NewServer() *Server {
+	return &Server{
+		Interval:       30 * time.Minute,
+		MinInterval:    time.Minute,
+		PeerTimeout:    time.Hour,
+		DefaultNumWant: 50,
+		MaxNumWant:     200,
+		swarms:         map[[20]byte]*swarm{},
+		rand:           rand.New(rand.NewSource(time.Now().UnixNano())),
+		now:            time.Now,
+		connections:    map[uint64]time.Time{},
+	}
+}
+
+// InjectFault queues a fault. Faults apply in the order they were injected.
+func (s *Server) InjectFault(fault Fault) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = append(s.faults, fault)
+}
+
+// ClearFaults removes every queued fault.
+func (s *Server) ClearFaults() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.faults = nil
+}
+
+// nextFault returns the fault for the current request, if any.
+func (s *Server) nextFault() *Fault {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.faults) > 0 {
+		fault := s.faults[0]
+		if fault.Times > 0 {
+			s.faults[0].Times--
+			if s.faults[0].Times == 0 {
+				s.faults = s.faults[1:]
+			}
+		}
+		return &fault
+	}
+	if s.FailureRate > 0 && s.rand.Float64() < s.FailureRate {
+		return &Fault{FailureReason: "injected failure"}
+	}
+	return nil
+}
+
+// applyFault waits for the fault's delay and returns the error it causes.
+// A request whose done is closed meanwhile is dropped, so nothing keeps
+// waiting for a client that gave up or a server that closed.
+func applyFault(fault *Fault, done <-chan struct{}) error {
+	if fault == nil {
+		return nil
+	}
+	if fault.Delay > 0 {
+		timer := time.NewTimer(fault.Delay)
+		defer timer.Stop()
+		select {
+		case <-timer.C:
+		case <-done:
+			return ErrDropped
+		}
+	}
+	switch {
+	case fault.Drop:
+		return ErrDropped
+	case fault.FailureReason != "":
+		return &Failure{Reason: fault.FailureReason, RetryIn: fault.RetryIn}
+	}
+	return nil
+}
+
+// Announce updates the swarm with the announcing peer and returns other
+// peers from it.
+func (s *Server) Announce(req *Request) (*Response, error) {
+	if !req.Addr.IsValid() || req.Addr.Port() == 0 {
+		return nil, &Failure{Reason: "invalid port"}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := s.now()
+	sw := s.swarms[req.InfoHash]
+	if sw == nil {
+		sw = &swarm{peers: map[[20]byte]*Peer{}}
+		s.swarms[req.InfoHash] = sw
+	}
+	s.expire(sw, now)
+
+	if req.Event == EventStopped {
+		delete(sw.peers, req.PeerID)
+	} else {
+		peer, known := sw.peers[req.PeerID]
+		if !known {
+			peer = &Peer{ID: req.PeerID}
+			sw.peers[req.PeerID] = peer
+		}
+		if req.Event == EventCompleted && (!known || peer.Left != 0) {
+			sw.downloaded++
+		}
+		peer.Addr = req.Addr
+		peer.Left = req.Left
+		peer.lastSeen = now
+	}
+
+	numWant := req.NumWant
+	if numWant < 0 {
+		numWant = s.DefaultNumWant
+	}
+	if numWant > s.MaxNumWant {
+		numWant = s.MaxNumWant
+	}
+
+	response := &Response{Interval: s.Interval, MinInterval: s.MinInterval, TrackerID: s.TrackerID}
+	var candidates []Peer
+	for id, peer := range sw.peers {
+		if peer.Seeder() {
+			response.Complete++
+		} else {
+			response.Incomplete++
+		}
+		// a peer doesn't need to hear about itself, and seeders don't need
+		// other seeders
+		if id == req.PeerID || req.Event == EventStopped || (req.Left == 0 && peer.Seeder()) {
+			continue
+		}
+		candidates = append(candidates, *peer)
+	}
+	s.rand.Shuffle(len(candidates), func(i, j int) {
+		candidates[i], candidates[j] = candidates[j], candidates[i]
+	})
+	if len(candidates) > numWant {
+		candidates = candidates[:numWant]
+	}
+	response.Peers = candidates
+	return response, nil
+}
+
+// expire removes peers that stopped announcing.
+func (s *Server) expire(sw *swarm, now time.Time) {
+	if s.PeerTimeout <= 0 {
+		return
+	}
+	for id, peer := range sw.peers {
+		if now.Sub(peer.lastSeen) > s.PeerTimeout {
+			delete(sw.peers, id)
+		}
+	}
+}
+
+// Scrape returns the stats of the given swarms. Unknown info hashes are
+// reported as empty swarms. Without info hashes every swarm is returned.
+func (s *Server) Scrape(infoHashes ...[20]byte) []Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(infoHashes) == 0 {
+		for infoHash := range s.swarms {
+			infoHashes = append(infoHashes, infoHash)
+		}
+	}
+
+	now := s.now()
+	stats := make([]Stats, 0, len(infoHashes))
+	for _, infoHash := range infoHashes {
+		stat := Stats{InfoHash: infoHash}
+		if sw := s.swarms[infoHash]; sw != nil {
+			s.expire(sw, now)
+			stat.Downloaded = sw.downloaded
+			for _, peer := range sw.peers {
+				if peer.Seeder() {
+					stat.Complete++
+				} else {
+					stat.Incomplete++
+				}
+			}
+		}
+		stats = append(stats, stat)
+	}
+	return stats
+}
+
+// Peers returns the peers currently in a swarm.
+func (s *Server) Peers(infoHash [20]byte) []Peer {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	sw := s.swarms[infoHash]
+	if sw == nil {
+		return nil
+	}
+	peers := make([]Peer, 0, len(sw.peers))
+	for _, peer := range sw.peers {
+		peers = append(peers, *peer)
+	}
+	return peers
+}
@@ -0,0 +1,128 @@
+package tracker
+
+import (
+	"net/netip"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func peerID(name string) [20]byte {
+	var id [20]byte
+	copy(id[:], name)
+	return id
+}
+
+func announce(t *testing.T, s *Server, name string, addr string, left int64, event Event) *Response {
+	t.Helper()
+	response, err := s.Announce(&Request{
+		InfoHash: [20]byte{1},
+		PeerID:   peerID(name),
+		Addr:     netip.MustParseAddrPort(addr),
+		Left:     left,
+		Event:    event,
+		NumWant:  -1,
+	})
+	require.NoError(t, err)
+	return response
+}
+
+func TestAnnounceSwarm(t *testing.T) {
+	s := NewServer()
+
+	response := announce(t, s, "seeder", "10.0.0.1:6881", 0, EventStarted)
+	assert.Empty(t, response.Peers)
+	assert.Equal(t, 1, response.Complete)
+	assert.Equal(t, 30*time.Minute, response.Interval)
+
+	response = announce(t, s, "leecher", "10.0.0.2:6881", 100, EventStarted)
+	require.Len(t, response.Peers, 1)
+	assert.Equal(t, netip.MustParseAddrPort("10.0.0.1:6881"), response.Peers[0].Addr)
+	assert.Equal(t, peerID("seeder"), response.Peers[0].ID)
+	assert.Equal(t, 1, response.Complete)
+	assert.Equal(t, 1, response.Incomplete)
+
+	// seeders only hear about leechers
+	announce(t, s, "seeder2", "10.0.0.3:6881", 0, EventStarted)
+	response = announce(t, s, "seeder", "10.0.0.1:6881", 0, EventNone)
+	require.Len(t, response.Peers, 1)
+	assert.Equal(t, peerID("leecher"), response.Peers[0].ID)
+
+	response = announce(t, s, "leecher", "10.0.0.2:6881", 0, EventCompleted)
+	assert.Equal(t, 3, response.Complete)
+	assert.Equal(t, 0, response.Incomplete)
+
+	response = announce(t, s, "leecher", "10.0.0.2:6881", 0, EventStopped)
+	assert.Empty(t, response.Peers)
+	assert.Len(t, s.Peers([20]byte{1}), 2)
+
+	assert.Equal(t, []Stats{
+		{InfoHash: [20]byte{1}, Complete: 2, Downloaded: 1},
+		{InfoHash: [20]byte{2}},
+	}, s.Scrape([20]byte{1}, [20]byte{2}))
+}
+
+func TestAnnounceNumWant(t *testing.T) {
+	s := NewServer()
+	s.MaxNumWant = 3
+	for i := 0; i < 5; i++ {
+		announce(t, s, string(rune('a'+i)), "10.0.0.1:1000", 1, EventStarted)
+	}
+
+	response, err := s.Announce(&Request{InfoHash: [20]byte{1}, PeerID: peerID("z"), Addr: netip.MustParseAddrPort("10.0.0.9:1"), Left: 1, NumWant: 2})
+	require.NoError(t, err)
+	assert.Len(t, response.Peers, 2)
+
+	response = announce(t, s, "z", "10.0.0.9:1", 1, EventNone)
+	assert.Len(t, response.Peers, 3)
+
+	_, err = s.Announce(&Request{InfoHash: [20]byte{1}, PeerID: peerID("y"), Addr: netip.MustParseAddrPort("10.0.0.9:0")})
+	var failure *Failure
+	assert.ErrorAs(t, err, &failure)
+}
+
+func TestAnnounceExpiresPeers(t *testing.T) {
+	s := NewServer()
+	now := time.Now()
+	s.now = func() time.Time { return now }
+
+	announce(t, s, "old", "10.0.0.1:6881", 1, EventStarted)
+	now = now.Add(s.PeerTimeout + time.Second)
+
+	response := announce(t, s, "new", "10.0.0.2:6881", 1, EventStarted)
+	assert.Empty(t, response.Peers)
+	assert.Equal(t, 1, response.Incomplete)
+}
+
+func TestFaults(t *testing.T) {
+	s := NewServer()
+	s.InjectFault(Fault{FailureReason: "go away", RetryIn: 5, Times: 2})
+	s.InjectFault(Fault{Drop: true, Times: 1})
+
+	var failure *Failure
+	for i := 0; i < 2; i++ {
+		err := applyFault(s.nextFault(), nil)
+		require.ErrorAs(t, err, &failure)
+		assert.Equal(t, &Failure{Reason: "go away", RetryIn: 5}, failure)
+	}
+	assert.ErrorIs(t, applyFault(s.nextFault(), nil), ErrDropped)
+	assert.Nil(t, s.nextFault())
+
+	// a delayed request is dropped once done is closed
+	s.InjectFault(Fault{Delay: time.Hour, Times: 1})
+	done := make(chan struct{})
+	close(done)
+	assert.ErrorIs(t, applyFault(s.nextFault(), done), ErrDropped)
+
+	s.InjectFault(Fault{WarningMessage: "careful"})
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, "careful", s.nextFault().WarningMessage)
+	}
+	s.ClearFaults()
+	assert.Nil(t, s.nextFault())
+
+	s.FailureRate = 1
+	assert.ErrorAs(t, applyFault(s.nextFault(), nil), &failure)
+}
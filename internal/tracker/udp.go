@@ -0,0 +1,201 @@
+package tracker
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"net"
+	"net/netip"
+	"time"
+)
+
+// UDP tracker protocol (BEP 15) constants.
+const (
+	udpProtocolID = 0x41727101980
+
+	udpActionConnect  = 0
+	udpActionAnnounce = 1
+	udpActionScrape   = 2
+	udpActionError    = 3
+
+	// udpConnectionIDLifetime is how long the server accepts a connection
+	// id. Clients use one for a minute.
+	udpConnectionIDLifetime = 2 * time.Minute
+	udpMaxScrapeHashes      = 74
+)
+
+var udpEvents = map[uint32]Event{
+	0: EventNone,
+	1: EventCompleted,
+	2: EventStarted,
+	3: EventStopped,
+}
+
+// ServeUDP answers BEP 15 requests on conn until it is closed.
+func (s *Server) ServeUDP(conn net.PacketConn) error {
+	// closed drops the requests held back by a delay fault
+	closed := make(chan struct{})
+	defer close(closed)
+	buffer := make([]byte, 2048)
+	for {
+		n, addr, err := conn.ReadFrom(buffer)
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return nil
+			}
+			return err
+		}
+		packet := append([]byte{}, buffer[:n]...)
+		go func() {
+			if response := s.handleUDP(packet, addr, closed); response != nil {
+				conn.WriteTo(response, addr)
+			}
+		}()
+	}
+}
+
+// handleUDP returns the response to a packet, or nil if it is ignored.
+// closed is closed once the server stops.
+func (s *Server) handleUDP(packet []byte, addr net.Addr, closed <-chan struct{}) []byte {
+	if len(packet) < 16 {
+		return nil
+	}
+	connectionID := binary.BigEndian.Uint64(packet[0:8])
+	action := binary.BigEndian.Uint32(packet[8:12])
+	transactionID := packet[12:16]
+	body := packet[16:]
+
+	var from netip.AddrPort
+	if udpAddr, ok := addr.(*net.UDPAddr); ok {
+		from = udpAddr.AddrPort()
+	}
+
+	if action == udpActionConnect {
+		if connectionID != udpProtocolID {
+			return nil
+		}
+		return udpResponse(udpActionConnect, transactionID, binary.BigEndian.AppendUint64(nil, s.newConnectionID()))
+	}
+	if !s.validConnectionID(connectionID) {
+		return udpError(transactionID, "invalid connection id")
+	}
+
+	fault := s.nextFault()
+	err := applyFault(fault, closed)
+	if errors.Is(err, ErrDropped) {
+		return nil
+	}
+
+	var response []byte
+	if err == nil {
+		switch action {
+		case udpActionAnnounce:
+			response, err = s.udpAnnounce(body, from)
+		case udpActionScrape:
+			response, err = s.udpScrape(body)
+		default:
+			err = &Failure{Reason: "unknown action"}
+		}
+	}
+	var failure *Failure
+	if errors.As(err, &failure) {
+		return udpError(transactionID, failure.Reason)
+	} else if err != nil {
+		return nil
+	}
+	return udpResponse(action, transactionID, response)
+}
+
+func udpResponse(action uint32, transactionID, body []byte) []byte {
+	response := binary.BigEndian.AppendUint32(nil, action)
+	response = append(response, transactionID...)
+	return append(response, body...)
+}
+
+func udpError(transactionID []byte, message string) []byte {
+	return udpResponse(udpActionError, transactionID, []byte(message))
+}
+
+func (s *Server) newConnectionID() uint64 {
+	var raw [8]byte
+	rand.Read(raw[:])
+	connectionID := binary.BigEndian.Uint64(raw[:])
+
+	s.udpMu.Lock()
+	defer s.udpMu.Unlock()
+	now := s.now()
+	for id, issued := range s.connections {
+		if now.Sub(issued) > udpConnectionIDLifetime {
+			delete(s.connections, id)
+		}
+	}
+	s.connections[connectionID] = now
+	return connectionID
+}
+
+func (s *Server) validConnectionID(connectionID uint64) bool {
+	s.udpMu.Lock()
+	defer s.udpMu.Unlock()
+	issued, ok := s.connections[connectionID]
+	return ok && s.now().Sub(issued) <= udpConnectionIDLifetime
+}
+
+func (s *Server) udpAnnounce(body []byte, from netip.AddrPort) ([]byte, error) {
+	if len(body) < 82 {
+		return nil, &Failure{Reason: "invalid announce request"}
+	}
+	req := &Request{
+		Downloaded: int64(binary.BigEndian.Uint64(body[40:48])),
+		Left:       int64(binary.BigEndian.Uint64(body[48:56])),
+		Uploaded:   int64(binary.BigEndian.Uint64(body[56:64])),
+		NumWant:    int(int32(binary.BigEndian.Uint32(body[76:80]))),
+	}
+	copy(req.InfoHash[:], body[0:20])
+	copy(req.PeerID[:], body[20:40])
+
+	event, ok := udpEvents[binary.BigEndian.Uint32(body[64:68])]
+	if !ok {
+		return nil, &Failure{Reason: "invalid event"}
+	}
+	req.Event = event
+
+	// a non-zero IP field is only honoured for IPv4 clients
+	addr := from.Addr().Unmap()
+	if ip := netip.AddrFrom4([4]byte(body[68:72])); addr.Is4() && !ip.IsUnspecified() {
+		addr = ip
+	}
+	req.Addr = netip.AddrPortFrom(addr, binary.BigEndian.Uint16(body[80:82]))
+
+	response, err := s.Announce(req)
+	if err != nil {
+		return nil, err
+	}
+
+	result := binary.BigEndian.AppendUint32(nil, uint32(response.Interval.Seconds()))
+	result = binary.BigEndian.AppendUint32(result, uint32(response.Incomplete))
+	result = binary.BigEndian.AppendUint32(result, uint32(response.Complete))
+	// the peer list has the address family of the request
+	peers4, peers6 := compactPeers(response.Peers)
+	if addr.Is4() {
+		return append(result, peers4...), nil
+	}
+	return append(result, peers6...), nil
+}
+
+func (s *Server) udpScrape(body []byte) ([]byte, error) {
+	if len(body) == 0 || len(body)%20 != 0 || len(body)/20 > udpMaxScrapeHashes {
+		return nil, &Failure{Reason: "invalid scrape request"}
+	}
+	infoHashes := make([][20]byte, len(body)/20)
+	for i := range infoHashes {
+		copy(infoHashes[i][:], body[i*20:])
+	}
+
+	var result []byte
+	for _, stats := range s.Scrape(infoHashes...) {
+		result = binary.BigEndian.AppendUint32(result, uint32(stats.Complete))
+		result = binary.BigEndian.AppendUint32(result, uint32(stats.Downloaded))
+		result = binary.BigEndian.AppendUint32(result, uint32(stats.Incomplete))
+	}
+	return result, nil
+}
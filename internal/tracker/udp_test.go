@@ -0,0 +1,116 @@
+package tracker
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func startUDP(t *testing.T, s *Server) net.Conn {
+	t.Helper()
+	listener, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(t, err)
+	t.Cleanup(func() { listener.Close() })
+	go s.ServeUDP(listener)
+
+	conn, err := net.Dial("udp", listener.LocalAddr().String())
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+	return conn
+}
+
+// udpRoundTrip sends a request and returns the action and body of the
+// response, or -1 when nothing came back.
+func udpRoundTrip(t *testing.T, conn net.Conn, connectionID uint64, action uint32, body []byte) (int, []byte) {
+	t.Helper()
+	request := binary.BigEndian.AppendUint64(nil, connectionID)
+	request = binary.BigEndian.AppendUint32(request, action)
+	request = append(request, 9, 8, 7, 6)
+	request = append(request, body...)
+	_, err := conn.Write(request)
+	require.NoError(t, err)
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	buffer := make([]byte, 2048)
+	n, err := conn.Read(buffer)
+	if err != nil {
+		return -1, nil
+	}
+	require.GreaterOrEqual(t, n, 8)
+	assert.Equal(t, []byte{9, 8, 7, 6}, buffer[4:8])
+	return int(binary.BigEndian.Uint32(buffer)), buffer[8:n]
+}
+
+func udpConnect(t *testing.T, conn net.Conn) uint64 {
+	t.Helper()
+	action, body := udpRoundTrip(t, conn, udpProtocolID, udpActionConnect, nil)
+	require.Equal(t, udpActionConnect, action)
+	return binary.BigEndian.Uint64(body)
+}
+
+func udpAnnounceBody(name string, left uint64, event uint32, port uint16) []byte {
+	id := peerID(name)
+	body := append([]byte{1, 19: 0}, id[:]...)
+	body = binary.BigEndian.AppendUint64(body, 0)
+	body = binary.BigEndian.AppendUint64(body, left)
+	body = binary.BigEndian.AppendUint64(body, 0)
+	body = binary.BigEndian.AppendUint32(body, event)
+	body = append(body, 0, 0, 0, 0)
+	body = binary.BigEndian.AppendUint32(body, 1)
+	body = binary.BigEndian.AppendUint32(body, 0xffffffff)
+	return binary.BigEndian.AppendUint16(body, port)
+}
+
+func TestUDPAnnounceAndScrape(t *testing.T) {
+	conn := startUDP(t, NewServer())
+	connectionID := udpConnect(t, conn)
+
+	action, body := udpRoundTrip(t, conn, connectionID, udpActionAnnounce, udpAnnounceBody("seeder", 0, 2, 6881))
+	require.Equal(t, udpActionAnnounce, action)
+	assert.Equal(t, []byte{0, 0, 0x07, 0x08, 0, 0, 0, 0, 0, 0, 0, 1}, body)
+
+	action, body = udpRoundTrip(t, conn, connectionID, udpActionAnnounce, udpAnnounceBody("leecher", 10, 2, 6882))
+	require.Equal(t, udpActionAnnounce, action)
+	assert.Equal(t, []byte{0, 0, 0x07, 0x08, 0, 0, 0, 1, 0, 0, 0, 1, 127, 0, 0, 1, 0x1a, 0xe1}, body)
+
+	action, body = udpRoundTrip(t, conn, connectionID, udpActionScrape, append([]byte{1, 19: 0}, make([]byte, 20)...))
+	require.Equal(t, udpActionScrape, action)
+	assert.Equal(t, []byte{0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 1, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0}, body)
+}
+
+func TestUDPErrors(t *testing.T) {
+	s := NewServer()
+	conn := startUDP(t, s)
+
+	// requests need a connection id from connect
+	action, body := udpRoundTrip(t, conn, 42, udpActionAnnounce, udpAnnounceBody("peer", 0, 0, 6881))
+	assert.Equal(t, udpActionError, action)
+	assert.Equal(t, "invalid connection id", string(body))
+
+	connectionID := udpConnect(t, conn)
+	action, body = udpRoundTrip(t, conn, connectionID, udpActionAnnounce, udpAnnounceBody("peer", 0, 9, 6881))
+	assert.Equal(t, udpActionError, action)
+	assert.Equal(t, "invalid event", string(body))
+
+	action, _ = udpRoundTrip(t, conn, connectionID, udpActionScrape, make([]byte, 19))
+	assert.Equal(t, udpActionError, action)
+
+	s.InjectFault(Fault{FailureReason: "closed", Times: 1})
+	s.InjectFault(Fault{Drop: true, Times: 1})
+	action, body = udpRoundTrip(t, conn, connectionID, udpActionAnnounce, udpAnnounceBody("peer", 0, 0, 6881))
+	assert.Equal(t, udpActionError, action)
+	assert.Equal(t, "closed", string(body))
+	action, _ = udpRoundTrip(t, conn, connectionID, udpActionAnnounce, udpAnnounceBody("peer", 0, 0, 6881))
+	assert.Equal(t, -1, action)
+
+	// connection ids expire
+	s.udpMu.Lock()
+	s.connections[connectionID] = time.Now().Add(-udpConnectionIDLifetime - time.Second)
+	s.udpMu.Unlock()
+	action, _ = udpRoundTrip(t, conn, connectionID, udpActionAnnounce, udpAnnounceBody("peer", 0, 0, 6881))
+	assert.Equal(t, udpActionError, action)
+}